@@ -1,13 +1,16 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"os"
 
 	"h3ws2h1ws-proxy/internal"
 )
 
 func main() {
-	if err := app.Run(); err != nil {
-		log.Fatal(err)
+	if err := app.Main(context.Background(), os.Args[1:]); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
 	}
 }
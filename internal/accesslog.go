@@ -0,0 +1,38 @@
+package app
+
+import (
+	"io"
+	"os"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/proxy"
+)
+
+// openAccessLog returns the -access-log writer (nil when disabled) and the
+// file to close on exit, if any.
+func openAccessLog(cfg config.Config) (*proxy.AccessLog, io.Closer, error) {
+	var w io.Writer
+	var closer io.Closer
+	switch cfg.AccessLog {
+	case "":
+		return nil, nil, nil
+	case "-", "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		f, err := os.OpenFile(cfg.AccessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, nil, err
+		}
+		w, closer = f, f
+	}
+	l, err := proxy.NewAccessLog(w, cfg.AccessLogFormat, splitList(cfg.AccessLogFields))
+	if err != nil {
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, nil, err
+	}
+	return l, closer, nil
+}
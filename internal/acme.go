@@ -0,0 +1,74 @@
+package app
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager returns a certificate manager for -acme-domains and the
+// domains, or nil when ACME is off. Certificates are issued on the first
+// handshake for a domain, renewed ahead of expiry and kept in -acme-cache
+// across restarts.
+func newACMEManager(cfg config.Config) (*autocert.Manager, []string, error) {
+	var domains []string
+	for _, d := range strings.Split(cfg.ACMEDomains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) == 0 {
+		return nil, nil, nil
+	}
+	if cfg.ACMECacheDir == "" {
+		return nil, nil, errors.New("-acme-cache must be set")
+	}
+	if cfg.ACMEListen == "" {
+		return nil, nil, errors.New("-acme-listen must be set: the HTTP-01 challenge is answered there")
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cfg.ACMECacheDir),
+		Email:      cfg.ACMEEmail,
+		Client:     &acme.Client{DirectoryURL: cfg.ACMEDirectory},
+	}, domains, nil
+}
+
+// acmeCertificate serves certificates from m, falling back to the default
+// domain for clients that send no SNI (connections by IP address).
+func acmeCertificate(m *autocert.Manager, fallback string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			h := *hello
+			h.ServerName = fallback
+			hello = &h
+		}
+		return m.GetCertificate(hello)
+	}
+}
+
+// listenACMEChallenges serves HTTP-01 challenge responses on the companion
+// TCP listener at addr; other requests are redirected to https.
+func listenACMEChallenges(addr string, m *autocert.Manager) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: m.HTTPHandler(nil), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("ACME challenge listener stopped", "addr", addr, "err", err)
+		}
+	}()
+	return srv, nil
+}
@@ -0,0 +1,37 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"h3ws2h1ws-proxy/internal/config"
+)
+
+func TestNewACMEManager(t *testing.T) {
+	cfg, err := config.Load([]string{"-acme-cache", t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, _, err := newACMEManager(cfg); m != nil || err != nil {
+		t.Fatalf("without -acme-domains: %v, %v", m, err)
+	}
+
+	cfg.ACMEDomains = " ws.example.com, ,edge.example.com"
+	m, domains, err := newACMEManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 2 || domains[0] != "ws.example.com" || domains[1] != "edge.example.com" {
+		t.Errorf("domains = %q", domains)
+	}
+	for host, ok := range map[string]bool{"ws.example.com": true, "edge.example.com": true, "other.example.com": false} {
+		if err := m.HostPolicy(context.Background(), host); (err == nil) != ok {
+			t.Errorf("host policy for %s: %v", host, err)
+		}
+	}
+
+	cfg.ACMECacheDir = ""
+	if _, _, err := newACMEManager(cfg); err == nil {
+		t.Error("empty -acme-cache accepted")
+	}
+}
@@ -0,0 +1,762 @@
+package app
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/metrics"
+	"h3ws2h1ws-proxy/internal/proxy"
+)
+
+// configStore owns the structured config currently in effect. Remote polling
+// and the admin API both go through it, so they always edit the same
+// document and a rejected change never reaches the proxy. Admin changes are
+// kept as an overlay on the document from -config or -config-url and
+// re-applied whenever that source is replaced.
+type configStore struct {
+	p     *proxy.Proxy
+	build func(config.File) (*proxy.RuntimeConfig, error)
+
+	mu   sync.Mutex
+	file config.File
+	// source is the document last set by replace or reset, before edits.
+	source config.File
+	// edits are the admin changes applied on top of source, oldest first.
+	edits []configEdit
+	// dropped, when set, is told about edits that no longer apply to a
+	// new source document.
+	dropped func(e configEdit, err error)
+	// discovered holds the members found by DNS discovery, by pool name.
+	// They are merged in at build time and never become part of file.
+	discovered map[string][]config.PoolBackend
+}
+
+// configEdit is one admin change, kept so it can be replayed on a new
+// source document.
+type configEdit struct {
+	action, target string
+	mutate         func(*config.File) error
+}
+
+func newConfigStore(p *proxy.Proxy, build func(config.File) (*proxy.RuntimeConfig, error)) *configStore {
+	return &configStore{p: p, build: build}
+}
+
+func (s *configStore) current() config.File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Clone()
+}
+
+// sourceFile returns the document from the config source, without the
+// admin edits.
+func (s *configStore) sourceFile() config.File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.source.Clone()
+}
+
+// replace installs f as the new source document and re-applies the admin
+// edits on top of it.
+func (s *configStore) replace(f config.File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rebuild(s.build, f, s.edits)
+}
+
+// update applies mutate to a copy of the current document, validates and
+// builds the result and only then swaps it in. Running sessions keep the
+// snapshot they were accepted with.
+func (s *configStore) update(mutate func(*config.File) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.file.Clone()
+	if err := mutate(&next); err != nil {
+		return err
+	}
+	if err := next.Validate(); err != nil {
+		return err
+	}
+	rt, err := s.build(s.expand(next))
+	if err != nil {
+		return err
+	}
+	s.p.SetRuntimeConfig(rt)
+	s.file = next
+	return nil
+}
+
+// edit applies an admin change like update and keeps it in the overlay
+// once it took effect.
+func (s *configStore) edit(e configEdit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.file.Clone()
+	if err := e.mutate(&next); err != nil {
+		return err
+	}
+	if err := next.Validate(); err != nil {
+		return err
+	}
+	rt, err := s.build(s.expand(next))
+	if err != nil {
+		return err
+	}
+	s.p.SetRuntimeConfig(rt)
+	s.file = next
+	s.edits = append(s.edits, e)
+	return nil
+}
+
+// clearEdits drops the admin overlay and goes back to the source document.
+func (s *configStore) clearEdits() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rebuild(s.build, s.source, nil)
+}
+
+// reset applies f with a new build function, for when the flag settings
+// that build closes over have changed. Nothing changes if f fails to build.
+func (s *configStore) reset(build func(config.File) (*proxy.RuntimeConfig, error), f config.File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rebuild(build, f, s.edits)
+}
+
+// rebuild replays edits on source and applies the result. An edit that
+// fails or leaves the document invalid, e.g. a patch of a pool the new
+// source no longer has, is dropped rather than blocking the update.
+// s.mu must be held.
+func (s *configStore) rebuild(build func(config.File) (*proxy.RuntimeConfig, error), source config.File, edits []configEdit) error {
+	source = source.Clone()
+	if err := source.Validate(); err != nil {
+		return err
+	}
+	next := source.Clone()
+	var kept []configEdit
+	type drop struct {
+		e   configEdit
+		err error
+	}
+	var drops []drop
+	for _, e := range edits {
+		cand := next.Clone()
+		err := e.mutate(&cand)
+		if err == nil {
+			err = cand.Validate()
+		}
+		if err != nil {
+			drops = append(drops, drop{e, err})
+			continue
+		}
+		next = cand
+		kept = append(kept, e)
+	}
+	rt, err := build(s.expand(next))
+	if err != nil {
+		return err
+	}
+	s.p.SetRuntimeConfig(rt)
+	s.build = build
+	s.source, s.file, s.edits = source, next, kept
+	for _, d := range drops {
+		slog.Warn("admin change no longer applies, dropped", "action", d.e.action, "target", d.e.target, "err", d.err)
+		if s.dropped != nil {
+			s.dropped(d.e, d.err)
+		}
+	}
+	return nil
+}
+
+func (s *configStore) setDropped(fn func(configEdit, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped = fn
+}
+
+// setDiscovered replaces the discovered members of pool and rebuilds the
+// runtime config with them.
+func (s *configStore) setDiscovered(pool string, backends []config.PoolBackend) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.discovered == nil {
+		s.discovered = make(map[string][]config.PoolBackend)
+	}
+	prev, had := s.discovered[pool]
+	if had && slices.Equal(prev, backends) {
+		return nil
+	}
+	s.discovered[pool] = backends
+	rt, err := s.build(s.expand(s.file))
+	if err != nil {
+		if had {
+			s.discovered[pool] = prev
+		} else {
+			delete(s.discovered, pool)
+		}
+		return err
+	}
+	s.p.SetRuntimeConfig(rt)
+	return nil
+}
+
+// expand returns a copy of f with the discovered members filled in.
+func (s *configStore) expand(f config.File) config.File {
+	f = f.Clone()
+	for i, pool := range f.Pools {
+		if pool.Discovery != nil {
+			f.Pools[i].Backends = slices.Clone(s.discovered[pool.Name])
+		}
+	}
+	return f
+}
+
+const (
+	maxAdminBody    = 1 << 20
+	maxAuditEntries = 256
+	// adminCloseCode (policy violation) is sent to both sides of a session
+	// closed through the admin API.
+	adminCloseCode = 1008
+)
+
+var errNotFound = errors.New("not found")
+
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Remote string    `json:"remote"`
+	Actor  string    `json:"actor"`
+	// ClaimedActor is the unverified X-Admin-Actor request header.
+	ClaimedActor string          `json:"claimed_actor,omitempty"`
+	Action       string          `json:"action"`
+	Target       string          `json:"target,omitempty"`
+	Result       string          `json:"result"`
+	Error        string          `json:"error,omitempty"`
+	Change       json.RawMessage `json:"change,omitempty"`
+}
+
+// auditLog keeps the most recent admin changes in memory and optionally
+// appends every change to a JSON lines file.
+type auditLog struct {
+	mu      sync.Mutex
+	entries []auditEntry
+	file    *os.File
+}
+
+func newAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+	return a, nil
+}
+
+func (a *auditLog) record(e auditEntry) {
+	slog.Info("admin audit", "actor", e.Actor, "claimed_actor", e.ClaimedActor, "remote", e.Remote, "action", e.Action, "target", e.Target, "result", e.Result, "err", e.Error)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries = append(a.entries, e)
+	if len(a.entries) > maxAuditEntries {
+		a.entries = a.entries[len(a.entries)-maxAuditEntries:]
+	}
+	if a.file != nil {
+		line, _ := json.Marshal(e)
+		if _, err := a.file.Write(append(line, '\n')); err != nil {
+			slog.Error("admin audit log write failed", "err", err)
+		}
+	}
+}
+
+// close stops appending to the file; later changes are only kept in memory.
+func (a *auditLog) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		_ = a.file.Close()
+		a.file = nil
+	}
+}
+
+func (a *auditLog) list() []auditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Clone(a.entries)
+}
+
+type adminServer struct {
+	store *configStore
+	// token is the shared -admin-token, attributed to "admin"; tokens maps
+	// the names from -admin-tokens-file to their tokens.
+	token  string
+	tokens map[string]string
+	audit  *auditLog
+}
+
+type adminActorKey struct{}
+
+// loadAdminTokens reads name:token lines; blank lines and # comments are
+// skipped.
+func loadAdminTokens(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, token, ok := strings.Cut(line, ":")
+		if name, token = strings.TrimSpace(name), strings.TrimSpace(token); !ok || name == "" || token == "" {
+			return nil, fmt.Errorf("%s:%d: want name:token", path, i+1)
+		}
+		if _, dup := tokens[name]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate name %q", path, i+1, name)
+		}
+		tokens[name] = token
+	}
+	return tokens, nil
+}
+
+func startAdminServer(cfg config.Config, store *configStore) (*http.Server, error) {
+	var tokens map[string]string
+	if cfg.AdminTokensFile != "" {
+		var err error
+		if tokens, err = loadAdminTokens(cfg.AdminTokensFile); err != nil {
+			return nil, fmt.Errorf("-admin-tokens-file: %w", err)
+		}
+	}
+	if cfg.AdminToken == "" && len(tokens) == 0 {
+		return nil, errors.New("-admin requires -admin-token, $H3WS_ADMIN_TOKEN or -admin-tokens-file")
+	}
+	ln, err := net.Listen("tcp", cfg.AdminAddr)
+	if err != nil {
+		return nil, err
+	}
+	audit, err := newAuditLog(cfg.AdminAuditLog)
+	if err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	a := &adminServer{store: store, token: cfg.AdminToken, tokens: tokens, audit: audit}
+	store.setDropped(a.recordDropped)
+	srv := &http.Server{
+		Handler:           a.handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	srv.RegisterOnShutdown(audit.close)
+	go func() {
+		slog.Info("admin API listening", "url", "http://"+cfg.AdminAddr+"/admin/")
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("admin server failed", "err", err)
+		}
+	}()
+	return srv, nil
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/config", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, a.store.current())
+	})
+	mux.HandleFunc("GET /admin/audit", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, a.audit.list())
+	})
+	mux.HandleFunc("GET /admin/sessions", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, a.store.p.Sessions())
+	})
+	mux.HandleFunc("DELETE /admin/sessions/{id}", a.closeSession)
+	mux.HandleFunc("GET /admin/logging", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, a.store.p.LogSettings())
+	})
+	mux.HandleFunc("PUT /admin/logging", a.setLogging)
+	mux.HandleFunc("DELETE /admin/overrides", func(w http.ResponseWriter, r *http.Request) {
+		err := a.store.clearEdits()
+		a.recordChange(r, "clear_overrides", "", nil, err)
+		if err != nil {
+			metrics.ConfigReloads.WithLabelValues("admin", "invalid").Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		metrics.ConfigReloads.WithLabelValues("admin", "applied").Inc()
+		writeJSON(w, http.StatusOK, a.store.current())
+	})
+	mux.HandleFunc("PUT /admin/config", func(w http.ResponseWriter, r *http.Request) {
+		a.change(w, r, "replace_config", "", func(f *config.File, body []byte) error {
+			var next config.File
+			if err := decodeStrict(body, &next); err != nil {
+				return err
+			}
+			*f = next
+			return nil
+		})
+	})
+	mux.HandleFunc("PUT /admin/tenants/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		a.change(w, r, "put_tenant", name, func(f *config.File, body []byte) error {
+			var t config.Tenant
+			if err := decodeStrict(body, &t); err != nil {
+				return err
+			}
+			if t.Name != "" && t.Name != name {
+				return fmt.Errorf("tenant name %q does not match path %q", t.Name, name)
+			}
+			t.Name = name
+			if i := slices.IndexFunc(f.Tenants, func(c config.Tenant) bool { return c.Name == name }); i >= 0 {
+				f.Tenants[i] = t
+			} else {
+				f.Tenants = append(f.Tenants, t)
+			}
+			return nil
+		})
+	})
+	mux.HandleFunc("DELETE /admin/tenants/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		a.change(w, r, "delete_tenant", name, func(f *config.File, _ []byte) error {
+			i := slices.IndexFunc(f.Tenants, func(c config.Tenant) bool { return c.Name == name })
+			if i < 0 {
+				return fmt.Errorf("tenant %q: %w", name, errNotFound)
+			}
+			f.Tenants = slices.Delete(f.Tenants, i, i+1)
+			return nil
+		})
+	})
+	mux.HandleFunc("PUT /admin/routes/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		a.change(w, r, "put_route", name, func(f *config.File, body []byte) error {
+			var rt config.Route
+			if err := decodeStrict(body, &rt); err != nil {
+				return err
+			}
+			if rt.Name != "" && rt.Name != name {
+				return fmt.Errorf("route name %q does not match path %q", rt.Name, name)
+			}
+			rt.Name = name
+			if i := slices.IndexFunc(f.Routes, func(c config.Route) bool { return c.Name == name }); i >= 0 {
+				f.Routes[i] = rt
+			} else {
+				f.Routes = append(f.Routes, rt)
+			}
+			return nil
+		})
+	})
+	mux.HandleFunc("DELETE /admin/routes/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		a.change(w, r, "delete_route", name, func(f *config.File, _ []byte) error {
+			i := slices.IndexFunc(f.Routes, func(c config.Route) bool { return c.Name == name })
+			if i < 0 {
+				return fmt.Errorf("route %q: %w", name, errNotFound)
+			}
+			f.Routes = slices.Delete(f.Routes, i, i+1)
+			return nil
+		})
+	})
+	mux.HandleFunc("GET /admin/pools", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, a.store.p.Pools())
+	})
+	mux.HandleFunc("PUT /admin/pools/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		a.change(w, r, "put_pool", name, func(f *config.File, body []byte) error {
+			var pool config.Pool
+			if err := decodeStrict(body, &pool); err != nil {
+				return err
+			}
+			if pool.Name != "" && pool.Name != name {
+				return fmt.Errorf("pool name %q does not match path %q", pool.Name, name)
+			}
+			pool.Name = name
+			if i := slices.IndexFunc(f.Pools, func(c config.Pool) bool { return c.Name == name }); i >= 0 {
+				f.Pools[i] = pool
+			} else {
+				f.Pools = append(f.Pools, pool)
+			}
+			return nil
+		})
+	})
+	mux.HandleFunc("DELETE /admin/pools/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		a.change(w, r, "delete_pool", name, func(f *config.File, _ []byte) error {
+			i := slices.IndexFunc(f.Pools, func(c config.Pool) bool { return c.Name == name })
+			if i < 0 {
+				return fmt.Errorf("pool %q: %w", name, errNotFound)
+			}
+			f.Pools = slices.Delete(f.Pools, i, i+1)
+			return nil
+		})
+	})
+	mux.HandleFunc("PUT /admin/pools/{pool}/backends/{name}", func(w http.ResponseWriter, r *http.Request) {
+		poolName, name := r.PathValue("pool"), r.PathValue("name")
+		a.change(w, r, "put_pool_backend", poolName+"/"+name, func(f *config.File, body []byte) error {
+			pool, err := findPool(f, poolName)
+			if err != nil {
+				return err
+			}
+			var b config.PoolBackend
+			if err := decodeStrict(body, &b); err != nil {
+				return err
+			}
+			if b.Name != "" && b.Name != name {
+				return fmt.Errorf("backend name %q does not match path %q", b.Name, name)
+			}
+			b.Name = name
+			if i := slices.IndexFunc(pool.Backends, func(c config.PoolBackend) bool { return c.Name == name }); i >= 0 {
+				pool.Backends[i] = b
+			} else {
+				pool.Backends = append(pool.Backends, b)
+			}
+			return nil
+		})
+	})
+	mux.HandleFunc("PATCH /admin/pools/{pool}/backends/{name}", func(w http.ResponseWriter, r *http.Request) {
+		poolName, name := r.PathValue("pool"), r.PathValue("name")
+		a.change(w, r, "patch_pool_backend", poolName+"/"+name, func(f *config.File, body []byte) error {
+			pool, err := findPool(f, poolName)
+			if err != nil {
+				return err
+			}
+			i := slices.IndexFunc(pool.Backends, func(c config.PoolBackend) bool { return c.Name == name })
+			if i < 0 {
+				return fmt.Errorf("pool %q: backend %q: %w", poolName, name, errNotFound)
+			}
+			if err := decodeStrict(body, &pool.Backends[i]); err != nil {
+				return err
+			}
+			if pool.Backends[i].Name != name {
+				return fmt.Errorf("backend %q cannot be renamed", name)
+			}
+			return nil
+		})
+	})
+	mux.HandleFunc("DELETE /admin/pools/{pool}/backends/{name}", func(w http.ResponseWriter, r *http.Request) {
+		poolName, name := r.PathValue("pool"), r.PathValue("name")
+		a.change(w, r, "delete_pool_backend", poolName+"/"+name, func(f *config.File, _ []byte) error {
+			pool, err := findPool(f, poolName)
+			if err != nil {
+				return err
+			}
+			i := slices.IndexFunc(pool.Backends, func(c config.PoolBackend) bool { return c.Name == name })
+			if i < 0 {
+				return fmt.Errorf("pool %q: backend %q: %w", poolName, name, errNotFound)
+			}
+			pool.Backends = slices.Delete(pool.Backends, i, i+1)
+			return nil
+		})
+	})
+	mux.HandleFunc("PATCH /admin/limits", func(w http.ResponseWriter, r *http.Request) {
+		a.change(w, r, "patch_limits", "", func(f *config.File, body []byte) error {
+			if f.Limits == nil {
+				f.Limits = &config.LimitSet{}
+			}
+			return decodeStrict(body, f.Limits)
+		})
+	})
+	mux.HandleFunc("PATCH /admin/features", func(w http.ResponseWriter, r *http.Request) {
+		a.change(w, r, "patch_features", "", func(f *config.File, body []byte) error {
+			if f.Features == nil {
+				f.Features = &config.Features{}
+			}
+			return decodeStrict(body, f.Features)
+		})
+	})
+	mux.HandleFunc("PUT /admin/chaos", func(w http.ResponseWriter, r *http.Request) {
+		a.change(w, r, "put_chaos", "", func(f *config.File, body []byte) error {
+			var c config.Chaos
+			if err := decodeStrict(body, &c); err != nil {
+				return err
+			}
+			f.Chaos = &c
+			return nil
+		})
+	})
+	mux.HandleFunc("DELETE /admin/chaos", func(w http.ResponseWriter, r *http.Request) {
+		a.change(w, r, "delete_chaos", "", func(f *config.File, _ []byte) error {
+			f.Chaos = nil
+			return nil
+		})
+	})
+	return a.authenticate(mux)
+}
+
+func (a *adminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		actor := ""
+		if ok {
+			actor = a.actor(token)
+		}
+		if actor == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="h3ws-admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminActorKey{}, actor)))
+	})
+}
+
+// actor returns the name token belongs to, or "" when it is not valid.
+// Every token is compared so the time taken does not tell which matched.
+func (a *adminServer) actor(token string) string {
+	actor := ""
+	if a.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1 {
+		actor = "admin"
+	}
+	for name, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			actor = name
+		}
+	}
+	return actor
+}
+
+// change runs one admin mutation through the config store and records it in
+// the audit trail whether or not it was applied.
+func (a *adminServer) change(w http.ResponseWriter, r *http.Request, action, target string, mutate func(*config.File, []byte) error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	err = a.store.edit(configEdit{action: action, target: target, mutate: func(f *config.File) error { return mutate(f, body) }})
+	a.recordChange(r, action, target, body, err)
+
+	if err != nil {
+		metrics.ConfigReloads.WithLabelValues("admin", "invalid").Inc()
+		status := http.StatusBadRequest
+		if errors.Is(err, errNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	metrics.ConfigReloads.WithLabelValues("admin", "applied").Inc()
+	writeJSON(w, http.StatusOK, a.store.current())
+}
+
+func findPool(f *config.File, name string) (*config.Pool, error) {
+	i := slices.IndexFunc(f.Pools, func(c config.Pool) bool { return c.Name == name })
+	if i < 0 {
+		return nil, fmt.Errorf("pool %q: %w", name, errNotFound)
+	}
+	return &f.Pools[i], nil
+}
+
+func (a *adminServer) recordChange(r *http.Request, action, target string, body []byte, err error) {
+	entry := auditEntry{
+		Time:   time.Now().UTC(),
+		Remote: r.RemoteAddr,
+		Actor:  cmp.Or(adminActor(r), "admin"),
+		// The header is whatever the caller sent; only Actor is verified.
+		ClaimedActor: r.Header.Get("X-Admin-Actor"),
+		Action:       action,
+		Target:       target,
+		Result:       "applied",
+	}
+	if json.Valid(body) {
+		entry.Change = json.RawMessage(body)
+	}
+	if err != nil {
+		entry.Result = "rejected"
+		entry.Error = err.Error()
+	}
+	a.audit.record(entry)
+}
+
+// recordDropped notes in the audit trail that an applied change was lost
+// because it no longer fits a new source document.
+func (a *adminServer) recordDropped(e configEdit, err error) {
+	a.audit.record(auditEntry{
+		Time:   time.Now().UTC(),
+		Actor:  "config",
+		Action: e.action,
+		Target: e.target,
+		Result: "dropped",
+		Error:  err.Error(),
+	})
+}
+
+// setLogging replaces the log level and debug targets. A ttl puts an end
+// to the targets so a forgotten investigation does not keep logging.
+func (a *adminServer) setLogging(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var req struct {
+		proxy.LogSettings
+		TTL string `json:"ttl,omitempty"`
+	}
+	err = decodeStrict(body, &req)
+	if err == nil && req.TTL != "" {
+		var ttl time.Duration
+		if ttl, err = time.ParseDuration(req.TTL); err == nil && req.Targets != nil {
+			req.Targets.Until = time.Now().Add(ttl).UTC()
+		}
+	}
+	if err == nil {
+		err = a.store.p.SetLogSettings(req.LogSettings)
+	}
+	a.recordChange(r, "set_logging", "", body, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.store.p.LogSettings())
+}
+
+// closeSession tears down one running session: both sides get a 1008 close
+// frame and the backend connection is closed.
+func (a *adminServer) closeSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var err error
+	if !a.store.p.CloseSession(id, adminCloseCode, "closed by administrator") {
+		err = fmt.Errorf("session %q: %w", id, errNotFound)
+	}
+	a.recordChange(r, "close_session", id, nil, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeStrict(body []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("bad request body: %w", err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func adminActor(r *http.Request) string {
+	actor, _ := r.Context().Value(adminActorKey{}).(string)
+	return actor
+}
@@ -0,0 +1,297 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/proxy"
+	"h3ws2h1ws-proxy/internal/ratelimit"
+)
+
+func TestAdminAPIChangesConfig(t *testing.T) {
+	backend, _ := url.Parse("ws://127.0.0.1:8080")
+	base := proxy.RuntimeConfig{Limits: config.Limits{MaxConns: 10, MaxMessageSize: 1 << 20}}
+	newLimiter := func(_ string, rate float64, burst int) ratelimit.Limiter { return ratelimit.NewLocal(rate, burst) }
+
+	var applied *proxy.RuntimeConfig
+	store := newConfigStore(&proxy.Proxy{}, func(f config.File) (*proxy.RuntimeConfig, error) {
+		rt, err := buildRuntimeConfig(f, backend, base, newLimiter)
+		if err == nil {
+			applied = rt
+		}
+		return rt, err
+	})
+	if err := store.replace(config.File{}); err != nil {
+		t.Fatal(err)
+	}
+	a := &adminServer{store: store, token: "secret", audit: &auditLog{}}
+	h := a.handler()
+
+	do := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do(http.MethodGet, "/admin/config", "", "wrong"); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("bad token: status=%d", rr.Code)
+	}
+	if rr := do(http.MethodGet, "/admin/sessions", "", "secret"); rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Fatalf("list sessions: status=%d body=%s", rr.Code, rr.Body)
+	}
+
+	if rr := do(http.MethodPut, "/admin/tenants/a", `{"path_prefix":"/a","backend":"ws://10.0.0.1:9000"}`, "secret"); rr.Code != http.StatusOK {
+		t.Fatalf("put tenant: status=%d body=%s", rr.Code, rr.Body)
+	}
+	if len(applied.Tenants) != 1 || applied.Tenants[0].Backend.Host != "10.0.0.1:9000" {
+		t.Fatalf("tenant not applied: %+v", applied.Tenants)
+	}
+
+	// Invalid changes are rejected and leave the running config alone.
+	if rr := do(http.MethodPut, "/admin/tenants/b", `{"backend":"http://x"}`, "secret"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("invalid tenant: status=%d", rr.Code)
+	}
+	if rr := do(http.MethodPatch, "/admin/limits", `{"max_cons":5}`, "secret"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("unknown field: status=%d", rr.Code)
+	}
+	if len(store.current().Tenants) != 1 {
+		t.Fatalf("rejected change leaked into config: %+v", store.current())
+	}
+
+	if rr := do(http.MethodPatch, "/admin/limits", `{"max_conns":5}`, "secret"); rr.Code != http.StatusOK {
+		t.Fatalf("patch limits: status=%d body=%s", rr.Code, rr.Body)
+	}
+	if applied.Limits.MaxConns != 5 || applied.Limits.MaxMessageSize != 1<<20 {
+		t.Fatalf("limits = %+v", applied.Limits)
+	}
+	if rr := do(http.MethodPatch, "/admin/features", `{"resume_window":"30s"}`, "secret"); rr.Code != http.StatusOK {
+		t.Fatalf("patch features: status=%d body=%s", rr.Code, rr.Body)
+	}
+	if applied.Resume.Window.String() != "30s" {
+		t.Fatalf("resume window = %s", applied.Resume.Window)
+	}
+
+	if rr := do(http.MethodDelete, "/admin/tenants/missing", "", "secret"); rr.Code != http.StatusNotFound {
+		t.Fatalf("delete missing: status=%d", rr.Code)
+	}
+	if rr := do(http.MethodDelete, "/admin/tenants/a", "", "secret"); rr.Code != http.StatusOK {
+		t.Fatalf("delete tenant: status=%d", rr.Code)
+	}
+	if len(applied.Tenants) != 0 {
+		t.Fatalf("tenant not removed: %+v", applied.Tenants)
+	}
+
+	entries := a.audit.list()
+	if len(entries) != 7 {
+		t.Fatalf("audit entries = %d, want 7", len(entries))
+	}
+	if e := entries[1]; e.Action != "put_tenant" || e.Target != "b" || e.Result != "rejected" || e.Error == "" {
+		t.Fatalf("unexpected audit entry: %+v", e)
+	}
+
+	if rr := do(http.MethodDelete, "/admin/sessions/0123456789abcdef", "", "secret"); rr.Code != http.StatusNotFound {
+		t.Fatalf("close unknown session: status=%d body=%s", rr.Code, rr.Body)
+	}
+	if e := a.audit.list()[7]; e.Action != "close_session" || e.Result != "rejected" {
+		t.Fatalf("unexpected audit entry: %+v", e)
+	}
+}
+
+func TestAdminAPISetsLogging(t *testing.T) {
+	p := &proxy.Proxy{}
+	a := &adminServer{store: newConfigStore(p, nil), token: "secret", audit: &auditLog{}}
+	h := a.handler()
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/admin/logging", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := put(`{"level":"info","targets":{"sessions":["abcd"]},"ttl":"10m"}`); rr.Code != http.StatusOK {
+		t.Fatalf("set logging: status=%d body=%s", rr.Code, rr.Body)
+	}
+	got := p.LogSettings()
+	if got.Targets == nil || got.Targets.Sessions[0] != "abcd" || time.Until(got.Targets.Until) < 9*time.Minute {
+		t.Fatalf("log settings = %+v", got)
+	}
+	if rr := put(`{"level":"verbose"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("bad level: status=%d", rr.Code)
+	}
+	if n := len(a.audit.list()); n != 2 {
+		t.Fatalf("audit entries = %d, want 2", n)
+	}
+}
+
+func TestAdminAPIManagesPools(t *testing.T) {
+	backend, _ := url.Parse("ws://127.0.0.1:8080")
+	base := proxy.RuntimeConfig{Limits: config.Limits{MaxConns: 10}}
+	p := &proxy.Proxy{}
+	var applied *proxy.RuntimeConfig
+	store := newConfigStore(p, func(f config.File) (*proxy.RuntimeConfig, error) {
+		rt, err := buildRuntimeConfig(f, backend, base, nil)
+		if err == nil {
+			applied = rt
+		}
+		return rt, err
+	})
+	if err := store.replace(config.File{}); err != nil {
+		t.Fatal(err)
+	}
+	h := (&adminServer{store: store, token: "secret", audit: &auditLog{}}).handler()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do(http.MethodPut, "/admin/pools/default", `{"backends":[{"name":"a","url":"ws://10.0.0.1:9000"}]}`); rr.Code != http.StatusOK {
+		t.Fatalf("put pool: status=%d body=%s", rr.Code, rr.Body)
+	}
+	if applied.DefaultPool == nil || len(applied.DefaultPool.Backends) != 1 {
+		t.Fatalf("default pool not applied: %+v", applied.DefaultPool)
+	}
+	if rr := do(http.MethodPut, "/admin/pools/default/backends/b", `{"url":"ws://10.0.0.2:9000"}`); rr.Code != http.StatusOK {
+		t.Fatalf("add backend: status=%d body=%s", rr.Code, rr.Body)
+	}
+	if rr := do(http.MethodPatch, "/admin/pools/default/backends/a", `{"draining":true}`); rr.Code != http.StatusOK {
+		t.Fatalf("drain backend: status=%d body=%s", rr.Code, rr.Body)
+	}
+	if rr := do(http.MethodPatch, "/admin/pools/default/backends/missing", `{"draining":true}`); rr.Code != http.StatusNotFound {
+		t.Fatalf("drain missing backend: status=%d", rr.Code)
+	}
+	if rr := do(http.MethodPut, "/admin/routes/r", `{"path":"^/r$","pool":"nope"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("route with unknown pool: status=%d", rr.Code)
+	}
+
+	rr := do(http.MethodGet, "/admin/pools", "")
+	var pools []proxy.PoolInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &pools); err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 1 || len(pools[0].Backends) != 2 || !pools[0].Backends[0].Draining || pools[0].Backends[1].Draining {
+		t.Fatalf("list pools: %s", rr.Body)
+	}
+
+	if rr := do(http.MethodDelete, "/admin/pools/default/backends/a", ""); rr.Code != http.StatusOK {
+		t.Fatalf("remove backend: status=%d body=%s", rr.Code, rr.Body)
+	}
+	if rr := do(http.MethodDelete, "/admin/pools/default", ""); rr.Code != http.StatusOK {
+		t.Fatalf("delete pool: status=%d body=%s", rr.Code, rr.Body)
+	}
+	if applied.DefaultPool != nil {
+		t.Fatalf("default pool not removed: %+v", applied.DefaultPool)
+	}
+}
+
+func TestAdminChangesSurviveSourceReplace(t *testing.T) {
+	backend, _ := url.Parse("ws://127.0.0.1:8080")
+	base := proxy.RuntimeConfig{Limits: config.Limits{MaxConns: 10}}
+	var applied *proxy.RuntimeConfig
+	store := newConfigStore(&proxy.Proxy{}, func(f config.File) (*proxy.RuntimeConfig, error) {
+		rt, err := buildRuntimeConfig(f, backend, base, nil)
+		if err == nil {
+			applied = rt
+		}
+		return rt, err
+	})
+	pool := config.Pool{Name: "chat", Backends: []config.PoolBackend{{Name: "a", URL: "ws://10.0.0.1:9000"}}}
+	if err := store.replace(config.File{Pools: []config.Pool{pool}}); err != nil {
+		t.Fatal(err)
+	}
+	a := &adminServer{store: store, token: "secret", audit: &auditLog{}}
+	store.setDropped(a.recordDropped)
+	h := a.handler()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do(http.MethodPut, "/admin/tenants/a", `{"path_prefix":"/a"}`); rr.Code != http.StatusOK {
+		t.Fatalf("put tenant: status=%d body=%s", rr.Code, rr.Body)
+	}
+	if rr := do(http.MethodPatch, "/admin/pools/chat/backends/a", `{"draining":true}`); rr.Code != http.StatusOK {
+		t.Fatalf("drain backend: status=%d body=%s", rr.Code, rr.Body)
+	}
+
+	// A new source document, as from a -config-url poll or a SIGHUP, keeps
+	// the admin tenant; the drain of a pool it no longer has is dropped.
+	if err := store.replace(config.File{Limits: &config.LimitSet{MaxConns: 7}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(applied.Tenants) != 1 || applied.Tenants[0].Name != "a" || applied.Limits.MaxConns != 7 {
+		t.Fatalf("tenants=%+v limits=%+v after replace", applied.Tenants, applied.Limits)
+	}
+	entries := a.audit.list()
+	if e := entries[len(entries)-1]; e.Action != "patch_pool_backend" || e.Result != "dropped" || e.Error == "" {
+		t.Fatalf("unexpected audit entry: %+v", e)
+	}
+	if got := store.sourceFile(); len(got.Tenants) != 0 {
+		t.Fatalf("admin change leaked into the source: %+v", got.Tenants)
+	}
+
+	if rr := do(http.MethodDelete, "/admin/overrides", ""); rr.Code != http.StatusOK {
+		t.Fatalf("clear overrides: status=%d body=%s", rr.Code, rr.Body)
+	}
+	if len(applied.Tenants) != 0 || applied.Limits.MaxConns != 7 {
+		t.Fatalf("tenants=%+v limits=%+v after clearing", applied.Tenants, applied.Limits)
+	}
+}
+
+func TestAdminAuditActorComesFromToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte("# admins\nalice: a-token\nbob:b-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := loadAdminTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newConfigStore(&proxy.Proxy{}, func(config.File) (*proxy.RuntimeConfig, error) { return &proxy.RuntimeConfig{}, nil })
+	if err := store.replace(config.File{}); err != nil {
+		t.Fatal(err)
+	}
+	a := &adminServer{store: store, token: "shared", tokens: tokens, audit: &auditLog{}}
+	h := a.handler()
+	for _, token := range []string{"a-token", "shared", "wrong"} {
+		req := httptest.NewRequest(http.MethodDelete, "/admin/chaos", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Admin-Actor", "bob")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	entries := a.audit.list()
+	if len(entries) != 2 {
+		t.Fatalf("audit entries = %+v, want 2", entries)
+	}
+	for i, want := range []string{"alice", "admin"} {
+		if e := entries[i]; e.Actor != want || e.ClaimedActor != "bob" {
+			t.Errorf("entry %d: actor=%q claimed=%q, want %q claiming bob", i, e.Actor, e.ClaimedActor, want)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("alice\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAdminTokens(path); err == nil {
+		t.Fatal("line without a token accepted")
+	}
+}
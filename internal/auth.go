@@ -0,0 +1,90 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/jwks"
+	"h3ws2h1ws-proxy/internal/jwt"
+	"h3ws2h1ws-proxy/internal/proxy"
+)
+
+// startAuth returns the JWT check configured by -jwt-jwks-url or -jwt-key
+// (nil when neither is set). A JWKS is refreshed until ctx is done.
+func startAuth(ctx context.Context, cfg config.Config) (*proxy.Auth, error) {
+	v := &jwt.Verifier{Issuer: cfg.JWTIssuer, Audience: cfg.JWTAudience, Leeway: cfg.JWTLeeway}
+	switch {
+	case cfg.JWTJWKSURL != "" && cfg.JWTKeyFile != "":
+		return nil, errors.New("-jwt-jwks-url and -jwt-key are mutually exclusive")
+	case cfg.JWTJWKSURL != "":
+		set := jwks.New(cfg.JWTJWKSURL)
+		if err := set.Refresh(ctx); err != nil {
+			// The IdP may come up after the proxy; tokens are refused with
+			// 503 until the first fetch succeeds.
+			slog.Warn("jwks initial fetch failed", "url", cfg.JWTJWKSURL, "err", err)
+		}
+		go set.Run(ctx)
+		v.Keys = set
+	case cfg.JWTKeyFile != "":
+		key, err := jwt.LoadPublicKey(cfg.JWTKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.Keys = key
+	default:
+		if cfg.JWTIssuer != "" || cfg.JWTAudience != "" || cfg.JWTQuery != "" || cfg.JWTPriorityClaim != "" {
+			return nil, errors.New("-jwt-issuer, -jwt-audience, -jwt-query and -jwt-priority-claim need -jwt-jwks-url or -jwt-key")
+		}
+		return nil, nil
+	}
+	return &proxy.Auth{Verifier: v, Query: cfg.JWTQuery, PriorityClaim: cfg.JWTPriorityClaim}, nil
+}
+
+// tenantAuth returns a tenant's own JWT check. Its JWKS is not refreshed in
+// the background, since tenants come and go with config reloads; the set
+// fetches keys when a token names one it does not know.
+func tenantAuth(spec config.TenantAuth) (*proxy.Auth, error) {
+	v := &jwt.Verifier{Issuer: spec.Issuer, Audience: spec.Audience, Leeway: time.Duration(spec.Leeway)}
+	if v.Leeway == 0 {
+		v.Leeway = 30 * time.Second
+	}
+	if spec.JWKSURL != "" {
+		v.Keys = jwks.New(spec.JWKSURL)
+	} else {
+		key, err := jwt.LoadPublicKey(spec.Key)
+		if err != nil {
+			return nil, err
+		}
+		v.Keys = key
+	}
+	return &proxy.Auth{Verifier: v, Query: spec.Query}, nil
+}
+
+// externalAuth returns the -auth-url check (nil when it is not set).
+func externalAuth(cfg config.Config) (*proxy.ExternalAuth, error) {
+	if cfg.AuthURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.AuthURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("-auth-url %q: want an http:// or https:// URL", cfg.AuthURL)
+	}
+	headers, err := proxy.ForwardHeaders(cfg.AuthResponseHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("-auth-response-headers: %w", err)
+	}
+	return &proxy.ExternalAuth{
+		URL:             cfg.AuthURL,
+		Client:          &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }},
+		Timeout:         cfg.AuthTimeout,
+		CacheTTL:        cfg.AuthCacheTTL,
+		ResponseHeaders: headers,
+		PriorityHeader:  http.CanonicalHeaderKey(cfg.AuthPriorityHeader),
+	}, nil
+}
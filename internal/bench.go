@@ -0,0 +1,355 @@
+package app
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// benchStampSize is the send time every bench message starts with.
+const benchStampSize = 8
+
+// benchConfig is the load a bench run generates.
+type benchConfig struct {
+	URL      *url.URL
+	Sessions int
+	Conns    int
+	Size     int
+	Rate     float64 // messages per second per session; 0 sends on each echo
+	Duration time.Duration
+	TLS      *tls.Config
+}
+
+// Bench runs the bench subcommand: it opens RFC 9220 WebSocket sessions to
+// a proxy, sends messages that the backend echoes and reports round-trip
+// latency and throughput.
+func Bench(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("ws-quic-proxy bench", flag.ContinueOnError)
+	target := fs.String("url", "https://127.0.0.1:443/ws", "WebSocket URL to load (https:// host and path)")
+	sessions := fs.Int("sessions", 10, "concurrent WebSocket sessions")
+	conns := fs.Int("conns", 1, "QUIC connections the sessions are spread over")
+	size := fs.Int("size", 1024, "message size in bytes (at least 8)")
+	rate := fs.Float64("rate", 0, "messages per second per session; 0 sends the next message once the previous one is echoed")
+	duration := fs.Duration("duration", 10*time.Second, "how long to send")
+	caFile := fs.String("ca", "", "PEM CA bundle to verify the proxy with instead of the system roots")
+	insecure := fs.Bool("insecure", false, "skip verification of the proxy certificate")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	u, err := url.Parse(*target)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("bad -url %q: want https://host[:port]/path", *target)
+	}
+	if *sessions < 1 || *conns < 1 {
+		return errors.New("-sessions and -conns must be at least 1")
+	}
+	if *size < benchStampSize {
+		return fmt.Errorf("bad -size %d: must be at least %d", *size, benchStampSize)
+	}
+	if *rate < 0 || *duration <= 0 {
+		return errors.New("-rate must not be negative and -duration must be positive")
+	}
+	tlsConf, err := config.BackendTLSConfig(*caFile, "", "", "", *insecure)
+	if err != nil {
+		return err
+	}
+	cfg := benchConfig{
+		URL:      u,
+		Sessions: *sessions,
+		Conns:    min(*conns, *sessions),
+		Size:     *size,
+		Rate:     *rate,
+		Duration: *duration,
+		TLS:      tlsConf,
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	res, err := runBench(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	res.report(os.Stdout, cfg)
+	return nil
+}
+
+// benchResult is what a bench run measured.
+type benchResult struct {
+	Elapsed   time.Duration
+	Sessions  int // sessions that completed the handshake
+	Failed    int // sessions that failed or broke off
+	Sent      uint64
+	Received  uint64
+	Bytes     uint64 // payload bytes echoed back
+	Latencies []time.Duration
+	Err       error // the first session failure
+}
+
+// runBench opens cfg.Sessions sessions over cfg.Conns QUIC connections and
+// drives them for cfg.Duration or until ctx ends.
+func runBench(ctx context.Context, cfg benchConfig) (*benchResult, error) {
+	rts := make([]*http3.SingleDestinationRoundTripper, cfg.Conns)
+	for i := range rts {
+		rt, err := benchDial(ctx, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("dial %s: %w", cfg.URL.Host, err)
+		}
+		defer func() { _ = rt.Connection.CloseWithError(0, "") }()
+		rts[i] = rt
+	}
+
+	var (
+		mu  sync.Mutex
+		res benchResult
+		wg  sync.WaitGroup
+	)
+	start := time.Now()
+	ctx, cancel := context.WithDeadline(ctx, start.Add(cfg.Duration))
+	defer cancel()
+	for i := range cfg.Sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := benchSession(ctx, cfg, rts[i%len(rts)])
+			mu.Lock()
+			defer mu.Unlock()
+			if st.opened {
+				res.Sessions++
+			}
+			if err != nil {
+				res.Failed++
+				if res.Err == nil {
+					res.Err = err
+				}
+			}
+			res.Sent += st.sent
+			res.Received += uint64(len(st.latencies))
+			res.Bytes += st.bytes
+			res.Latencies = append(res.Latencies, st.latencies...)
+		}()
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	if res.Sessions == 0 {
+		return nil, fmt.Errorf("no session could be opened: %w", res.Err)
+	}
+	return &res, nil
+}
+
+// benchDial opens a QUIC connection to the proxy and waits for its HTTP/3
+// settings, which must allow extended CONNECT.
+func benchDial(ctx context.Context, cfg benchConfig) (*http3.SingleDestinationRoundTripper, error) {
+	tlsConf := &tls.Config{}
+	if cfg.TLS != nil {
+		tlsConf = cfg.TLS.Clone()
+	}
+	tlsConf.NextProtos = []string{http3.NextProtoH3}
+	if tlsConf.ServerName == "" {
+		tlsConf.ServerName = cfg.URL.Hostname()
+	}
+	addr := cfg.URL.Host
+	if cfg.URL.Port() == "" {
+		addr = net.JoinHostPort(cfg.URL.Hostname(), "443")
+	}
+	conn, err := quic.DialAddr(ctx, addr, tlsConf, &quic.Config{KeepAlivePeriod: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	rt := &http3.SingleDestinationRoundTripper{Connection: conn}
+	hc := rt.Start()
+	select {
+	case <-hc.ReceivedSettings():
+	case <-ctx.Done():
+		_ = conn.CloseWithError(0, "")
+		return nil, ctx.Err()
+	}
+	if !hc.Settings().EnableExtendedConnect {
+		_ = conn.CloseWithError(0, "")
+		return nil, errors.New("server does not support extended CONNECT")
+	}
+	return rt, nil
+}
+
+// benchSessionStats is what one session measured.
+type benchSessionStats struct {
+	opened    bool
+	sent      uint64
+	bytes     uint64
+	latencies []time.Duration
+}
+
+// benchSession opens one session and sends messages until ctx ends, then
+// closes it and collects the echoes still in flight.
+func benchSession(ctx context.Context, cfg benchConfig, rt *http3.SingleDestinationRoundTripper) (*benchSessionStats, error) {
+	st := &benchSessionStats{}
+	str, err := rt.OpenRequestStream(ctx)
+	if err != nil {
+		return st, err
+	}
+	defer str.Close()
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		Proto:      "websocket",
+		ProtoMajor: 3,
+		URL:        cfg.URL,
+		Host:       cfg.URL.Host,
+		Header:     http.Header{"Sec-Websocket-Version": {"13"}},
+	}
+	if err := str.SendRequestHeader(req); err != nil {
+		return st, err
+	}
+	resp, err := str.ReadResponse()
+	if err != nil {
+		return st, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return st, fmt.Errorf("CONNECT %s: %s", cfg.URL.Path, resp.Status)
+	}
+	st.opened = true
+
+	// In closed-loop mode the sender waits for each echo before the next
+	// message.
+	echoed := make(chan struct{}, 1)
+	received := make(chan struct{})
+	var recvErr error
+	go func() {
+		defer close(received)
+		recvErr = benchReceive(str, st, echoed)
+	}()
+
+	payload := make([]byte, cfg.Size)
+	for i := range payload[benchStampSize:] {
+		payload[benchStampSize+i] = 'a' + byte(i%26)
+	}
+	var tick <-chan time.Time
+	var next <-chan struct{}
+	if cfg.Rate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / cfg.Rate))
+		defer t.Stop()
+		tick = t.C
+	} else {
+		next = echoed
+	}
+	err = func() error {
+		for {
+			binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+			if err := ws.WriteDataFrame(str, ws.OpBinary, payload, true, 0); err != nil {
+				return err
+			}
+			st.sent++
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-received:
+				return cmp.Or(recvErr, errors.New("closed by the server"))
+			case <-tick:
+			case <-next:
+			}
+		}
+	}()
+	if err == nil {
+		// Echoes still in flight are counted if they arrive before the
+		// server answers the close.
+		err = ws.WriteFrame(str, ws.Frame{Fin: true, Opcode: ws.OpClose, Masked: true, Payload: []byte{0x03, 0xe8}})
+	}
+	if err == nil {
+		_ = str.SetReadDeadline(time.Now().Add(5 * time.Second))
+	} else {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+	}
+	<-received
+	return st, cmp.Or(err, recvErr)
+}
+
+// benchReceive reads echoes until the server's close frame, recording the
+// latency of each message from the send time it carries.
+func benchReceive(r io.Reader, st *benchSessionStats, echoed chan<- struct{}) error {
+	br := bufio.NewReaderSize(r, 64<<10)
+	var msg []byte
+	for {
+		f, err := ws.ReadFrame(br, math.MaxInt32)
+		if err != nil {
+			return err
+		}
+		switch f.Opcode {
+		case ws.OpClose:
+			return nil
+		case ws.OpPing, ws.OpPong:
+			continue
+		}
+		msg = append(msg, f.Payload...)
+		if !f.Fin {
+			continue
+		}
+		if len(msg) >= benchStampSize {
+			sent := int64(binary.BigEndian.Uint64(msg))
+			st.latencies = append(st.latencies, time.Duration(time.Now().UnixNano()-sent))
+		}
+		st.bytes += uint64(len(msg))
+		msg = msg[:0]
+		select {
+		case echoed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// latencySummary holds latency percentiles.
+type latencySummary struct {
+	Min, P50, P90, P99, Max time.Duration
+}
+
+// summarizeLatencies sorts d and returns its nearest-rank percentiles.
+func summarizeLatencies(d []time.Duration) latencySummary {
+	if len(d) == 0 {
+		return latencySummary{}
+	}
+	slices.Sort(d)
+	pct := func(p float64) time.Duration {
+		i := int(math.Ceil(p/100*float64(len(d)))) - 1
+		return d[max(i, 0)]
+	}
+	return latencySummary{Min: d[0], P50: pct(50), P90: pct(90), P99: pct(99), Max: d[len(d)-1]}
+}
+
+func (r *benchResult) report(w io.Writer, cfg benchConfig) {
+	secs := r.Elapsed.Seconds()
+	l := summarizeLatencies(r.Latencies)
+	fmt.Fprintf(w, "target:     %s\n", cfg.URL)
+	fmt.Fprintf(w, "sessions:   %d opened, %d failed, over %d connections\n", r.Sessions, r.Failed, cfg.Conns)
+	fmt.Fprintf(w, "duration:   %s\n", r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "messages:   %d sent, %d echoed, %d lost\n", r.Sent, r.Received, r.Sent-min(r.Received, r.Sent))
+	fmt.Fprintf(w, "throughput: %.1f msg/s, %.1f KiB/s\n", float64(r.Received)/secs, float64(r.Bytes)/1024/secs)
+	if r.Err != nil {
+		fmt.Fprintf(w, "error:      %v\n", r.Err)
+	}
+	fmt.Fprintf(w, "latency:    min %s  p50 %s  p90 %s  p99 %s  max %s\n",
+		l.Min.Round(time.Microsecond), l.P50.Round(time.Microsecond), l.P90.Round(time.Microsecond),
+		l.P99.Round(time.Microsecond), l.Max.Round(time.Microsecond))
+}
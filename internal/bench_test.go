@@ -0,0 +1,119 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/proxy"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestSummarizeLatencies(t *testing.T) {
+	var d []time.Duration
+	for i := 100; i >= 1; i-- {
+		d = append(d, time.Duration(i)*time.Millisecond)
+	}
+	got := summarizeLatencies(d)
+	want := latencySummary{
+		Min: time.Millisecond,
+		P50: 50 * time.Millisecond,
+		P90: 90 * time.Millisecond,
+		P99: 99 * time.Millisecond,
+		Max: 100 * time.Millisecond,
+	}
+	if got != want {
+		t.Fatalf("summary = %+v, want %+v", got, want)
+	}
+	if got := summarizeLatencies(nil); got != (latencySummary{}) {
+		t.Fatalf("empty summary = %+v", got)
+	}
+}
+
+func TestBenchAgainstProxy(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(mt, msg); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	p := &proxy.Proxy{
+		Backend:    backendURL,
+		PathRegexp: regexp.MustCompile(`^/ws$`),
+		Limits: config.Limits{
+			MaxFrameSize:   1 << 20,
+			MaxMessageSize: 1 << 20,
+			MaxConns:       100,
+			WriteTimeout:   5 * time.Second,
+		},
+	}
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "localhost")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http3.Server{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{http3.NextProtoH3}},
+		Handler:   http.HandlerFunc(p.HandleH3WebSocket),
+	}
+	defer srv.Close()
+	go func() { _ = srv.Serve(pc) }()
+
+	target, _ := url.Parse("https://" + pc.LocalAddr().String() + "/ws")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := runBench(ctx, benchConfig{
+		URL:      target,
+		Sessions: 4,
+		Conns:    2,
+		Size:     256,
+		Rate:     50,
+		Duration: 300 * time.Millisecond,
+		TLS:      &tls.Config{InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatalf("bench: %v", err)
+	}
+	if res.Sessions != 4 || res.Failed != 0 {
+		t.Fatalf("sessions = %d opened, %d failed (%v)", res.Sessions, res.Failed, res.Err)
+	}
+	if res.Sent == 0 || res.Received != res.Sent {
+		t.Fatalf("sent %d, echoed %d", res.Sent, res.Received)
+	}
+	if res.Bytes != res.Received*256 {
+		t.Fatalf("bytes = %d, want %d", res.Bytes, res.Received*256)
+	}
+	var sb strings.Builder
+	res.report(&sb, benchConfig{URL: target, Conns: 2})
+	if !strings.Contains(sb.String(), "p99") {
+		t.Fatalf("report lacks percentiles:\n%s", sb.String())
+	}
+}
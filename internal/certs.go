@@ -0,0 +1,275 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+const certExpiryCheckInterval = time.Hour
+
+// Warning levels escalate as the certificate gets closer to NotAfter.
+var certExpiryThresholds = []time.Duration{
+	30 * 24 * time.Hour,
+	14 * 24 * time.Hour,
+	7 * 24 * time.Hour,
+	3 * 24 * time.Hour,
+	24 * time.Hour,
+}
+
+func certLeaf(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("empty certificate chain")
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+// loadCertificate reads a key pair and exports its expiry.
+func loadCertificate(certFile, keyFile string) (*tls.Certificate, *x509.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaf, err := certLeaf(&cert)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert.Leaf = leaf
+	return &cert, leaf, nil
+}
+
+// certHolder serves the certificate in use and lets a reload replace it;
+// handshakes that already started keep the previous one.
+type certHolder struct {
+	mu      sync.RWMutex
+	file    string
+	keyFile string
+	cert    *tls.Certificate
+	leaf    *x509.Certificate
+}
+
+func (h *certHolder) set(file, keyFile string, cert *tls.Certificate, leaf *x509.Certificate) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.leaf != nil {
+		metrics.CertNotAfter.DeleteLabelValues(h.file, h.leaf.Subject.CommonName)
+	}
+	h.file, h.keyFile, h.cert, h.leaf = file, keyFile, cert, leaf
+	metrics.CertNotAfter.WithLabelValues(file, leaf.Subject.CommonName).Set(float64(leaf.NotAfter.Unix()))
+}
+
+func (h *certHolder) files() (string, string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.file, h.keyFile
+}
+
+func (h *certHolder) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.cert, nil
+}
+
+func (h *certHolder) current() (string, *x509.Certificate) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.file, h.leaf
+}
+
+// certPair is a loaded -cert/-key pair.
+type certPair struct {
+	file, keyFile string
+	cert          *tls.Certificate
+	leaf          *x509.Certificate
+}
+
+// loadCertPairs loads the comma separated -cert and -key lists, which pair
+// up by position.
+func loadCertPairs(certFiles, keyFiles string) ([]certPair, error) {
+	certs, keys := splitList(certFiles), splitList(keyFiles)
+	if len(certs) == 0 || len(certs) != len(keys) {
+		return nil, fmt.Errorf("%d certificate files for %d key files", len(certs), len(keys))
+	}
+	pairs := make([]certPair, len(certs))
+	for i := range certs {
+		cert, leaf, err := loadCertificate(certs[i], keys[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", certs[i], err)
+		}
+		pairs[i] = certPair{certs[i], keys[i], cert, leaf}
+	}
+	return pairs, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// certSet holds one certHolder per -cert/-key pair, so one listener can
+// serve several hostnames. Each holder reloads on its own; the number of
+// pairs is fixed at startup.
+type certSet []*certHolder
+
+func newCertSet(pairs []certPair) certSet {
+	s := make(certSet, len(pairs))
+	for i, p := range pairs {
+		s[i] = &certHolder{}
+		s[i].set(p.file, p.keyFile, p.cert, p.leaf)
+	}
+	return s
+}
+
+// set replaces the certificates; pairs must have one entry per holder.
+func (s certSet) set(pairs []certPair) {
+	for i, p := range pairs {
+		s[i].set(p.file, p.keyFile, p.cert, p.leaf)
+	}
+}
+
+// getCertificate picks the first certificate valid for the client's SNI
+// (and signature algorithms), falling back to the first one, as crypto/tls
+// does for tls.Config.Certificates.
+func (s certSet) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(s) > 1 {
+		for _, h := range s {
+			if cert, _ := h.getCertificate(hello); hello.SupportsCertificate(cert) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return s[0].getCertificate(hello)
+}
+
+// certExpiryLevel returns 0 while the certificate is far from expiry, then
+// 1..len(certExpiryThresholds) as each threshold is crossed, and one more
+// level once the certificate has expired.
+func certExpiryLevel(remaining time.Duration) int {
+	if remaining <= 0 {
+		return len(certExpiryThresholds) + 1
+	}
+	level := 0
+	for i, th := range certExpiryThresholds {
+		if remaining <= th {
+			level = i + 1
+		}
+	}
+	return level
+}
+
+// startCertExpiryMonitor warns as the certificate in h nears expiry until
+// ctx is done. A reloaded certificate starts over from its own level.
+func startCertExpiryMonitor(ctx context.Context, h *certHolder) {
+	go func() {
+		var watched *x509.Certificate
+		lastLevel := 0
+		check := func() {
+			file, leaf := h.current()
+			if leaf != watched {
+				watched, lastLevel = leaf, 0
+			}
+			remaining := time.Until(leaf.NotAfter)
+			level := certExpiryLevel(remaining)
+			switch {
+			case level > len(certExpiryThresholds):
+				slog.Error("certificate expired", "file", file, "subject", leaf.Subject.CommonName, "not_after", leaf.NotAfter)
+			case level == len(certExpiryThresholds):
+				// Last threshold before expiry: keep reminding on every check.
+				slog.Error("certificate expires very soon", "file", file, "subject", leaf.Subject.CommonName, "not_after", leaf.NotAfter, "remaining", remaining.Round(time.Minute))
+			case level > lastLevel:
+				slog.Warn("certificate expires soon", "file", file, "subject", leaf.Subject.CommonName, "not_after", leaf.NotAfter, "remaining", remaining.Round(time.Minute))
+			}
+			lastLevel = level
+		}
+		check()
+		ticker := time.NewTicker(certExpiryCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				check()
+			}
+		}
+	}()
+}
+
+// fileStamp identifies the version of a file on disk. Stat follows
+// symlinks, so a swapped link (certbot's live/, Kubernetes secret volumes)
+// counts as a change too.
+type fileStamp struct {
+	info os.FileInfo
+}
+
+func statFile(name string) (fileStamp, error) {
+	info, err := os.Stat(name)
+	return fileStamp{info}, err
+}
+
+func (s fileStamp) same(o fileStamp) bool {
+	return s.info != nil && o.info != nil && os.SameFile(s.info, o.info) &&
+		s.info.ModTime().Equal(o.info.ModTime()) && s.info.Size() == o.info.Size()
+}
+
+// watchCertFiles polls the certificate and key files in h every interval
+// and swaps in the new pair when either changes, so renewals apply to new
+// handshakes without a restart while established QUIC connections keep
+// going. A pair that does not load yet (say, the key is still being
+// written) is retried on the next poll. The files are stat'ed before it
+// returns; polling runs in the background until ctx is done.
+func watchCertFiles(ctx context.Context, h *certHolder, interval time.Duration) {
+	certFile, keyFile := h.files()
+	certStamp, _ := statFile(certFile)
+	keyStamp, _ := statFile(keyFile)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if c, k := h.files(); c != certFile || k != keyFile {
+				// A SIGHUP reload switched files and loaded them itself.
+				certFile, keyFile = c, k
+				certStamp, _ = statFile(certFile)
+				keyStamp, _ = statFile(keyFile)
+				continue
+			}
+			nextCert, err1 := statFile(certFile)
+			nextKey, err2 := statFile(keyFile)
+			if err1 != nil || err2 != nil || (nextCert.same(certStamp) && nextKey.same(keyStamp)) {
+				continue
+			}
+			cert, leaf, err := loadCertificate(certFile, keyFile)
+			if err != nil {
+				metrics.ConfigReloads.WithLabelValues("cert_files", "invalid").Inc()
+				slog.Warn("certificate files changed but do not load, keeping the current certificate", "err", err)
+				continue
+			}
+			h.set(certFile, keyFile, cert, leaf)
+			certStamp, keyStamp = nextCert, nextKey
+			metrics.ConfigReloads.WithLabelValues("cert_files", "applied").Inc()
+			slog.Info("certificate reloaded", "file", certFile, "subject", leaf.Subject.CommonName, "not_after", leaf.NotAfter)
+		}
+	}()
+}
@@ -0,0 +1,95 @@
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/proxy"
+	"h3ws2h1ws-proxy/internal/ratelimit"
+)
+
+// Check runs the check subcommand: it takes the same flags as serving,
+// usually just -config, and validates them the way startup does without
+// binding sockets or contacting anything. Every problem found is printed
+// to stderr.
+func Check(args []string) error {
+	cfg, err := config.Load(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	problems := checkConfig(cfg, time.Now())
+	if len(problems) == 0 {
+		fmt.Println("configuration OK")
+		return nil
+	}
+	for _, err := range problems {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	}
+	return fmt.Errorf("configuration has %d problem(s)", len(problems))
+}
+
+// checkConfig returns the problems serving with cfg would run into before
+// accepting traffic.
+func checkConfig(cfg config.Config, now time.Time) []error {
+	var problems []error
+	backendURL, err := proxy.ParseBackendURL(cfg.BackendWS)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("bad -backend: %w", err))
+	}
+	newLimiter, err := rateLimiterFactory(cfg)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("bad -rate-limit-redis: %w", err))
+		newLimiter = func(_ string, rate float64, burst int) ratelimit.Limiter {
+			return ratelimit.NewLocal(rate, burst)
+		}
+	}
+	if backendURL != nil {
+		if _, err := newProxy(cfg, backendURL, newLimiter); err != nil {
+			problems = append(problems, err)
+		}
+		if _, err := runtimeBuilder(cfg, backendURL, newLimiter)(cfg.Structured); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if cfg.MetricsAddr == "" && (cfg.ExpVar || cfg.Pprof) {
+		problems = append(problems, errors.New("-expvar and -pprof require -metrics"))
+	}
+	if _, err := parseListenSpecs(cfg.ListenAddr, cfg.ListenDevice, cfg.ListenDSCP); err != nil {
+		problems = append(problems, fmt.Errorf("bad -listen: %w", err))
+	}
+	if _, err := config.ClientAuthTLSConfig(cfg.ClientCAFile, cfg.ClientCertReq); err != nil {
+		problems = append(problems, fmt.Errorf("bad -client-ca: %w", err))
+	}
+	if m, _, err := newACMEManager(cfg); err != nil {
+		problems = append(problems, fmt.Errorf("bad -acme-domains: %w", err))
+	} else if m == nil {
+		problems = append(problems, checkCertificates(cfg, now)...)
+	}
+	return problems
+}
+
+// checkCertificates loads the -cert/-key pairs and reports those that do
+// not load or are not valid at now.
+func checkCertificates(cfg config.Config, now time.Time) []error {
+	pairs, err := loadCertPairs(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return []error{fmt.Errorf("load TLS certificate: %w", err)}
+	}
+	var problems []error
+	for _, p := range pairs {
+		switch {
+		case now.After(p.leaf.NotAfter):
+			problems = append(problems, fmt.Errorf("%s: certificate expired at %s", p.file, p.leaf.NotAfter.Format(time.RFC3339)))
+		case now.Before(p.leaf.NotBefore):
+			problems = append(problems, fmt.Errorf("%s: certificate not valid until %s", p.file, p.leaf.NotBefore.Format(time.RFC3339)))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "proxy")
+	configFile := filepath.Join(dir, "proxy.yaml")
+	load := func(content string) config.Config {
+		t.Helper()
+		if err := os.WriteFile(configFile, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := config.Load([]string{"-config", configFile})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	good := load("backend: ws://127.0.0.1:8080\ncert: " + certFile + "\nkey: " + keyFile + "\n" +
+		"routes:\n  - name: chat\n    path: ^/chat$\n")
+	if problems := checkConfig(good, time.Now()); len(problems) != 0 {
+		t.Fatalf("valid config: %v", problems)
+	}
+	if problems := checkConfig(good, time.Now().Add(48*time.Hour)); len(problems) != 1 || !strings.Contains(problems[0].Error(), "expired") {
+		t.Fatalf("expired certificate: %v", problems)
+	}
+
+	bad := load("backend: ws://127.0.0.1:8080\ncert: " + filepath.Join(dir, "missing.pem") + "\nkey: " + keyFile + "\n" +
+		"max-frame: 2048\nmax-message: 1024\nlisten: ':443?colour=red'\n")
+	problems := checkConfig(bad, time.Now())
+	var msgs []string
+	for _, err := range problems {
+		msgs = append(msgs, err.Error())
+	}
+	got := strings.Join(msgs, "\n")
+	for _, want := range []string{"-max-frame", "bad -listen", "missing.pem"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("problems lack %q:\n%s", want, got)
+		}
+	}
+
+	tenant := load("backend: ws://127.0.0.1:8080\ncert: " + certFile + "\nkey: " + keyFile + "\n" +
+		"tenants:\n  - name: big\n    path_prefix: /big\n    max_frame: 16777216\n")
+	if problems := checkConfig(tenant, time.Now()); len(problems) != 1 || !strings.Contains(problems[0].Error(), `tenant "big"`) {
+		t.Fatalf("tenant frame above the message limit: %v", problems)
+	}
+}
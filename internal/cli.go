@@ -0,0 +1,70 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// command is a subcommand of the binary; each parses its own flags.
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{"serve", "run the proxy (the default when the first argument is a flag)", Run},
+	{"check", "validate the serve flags and -config file without serving", withoutContext(Check)},
+	{"version", "print the version, commit and Go version", withoutContext(printVersion)},
+	{"gen-cert", "write a self-signed certificate and key for local testing", withoutContext(GenCert)},
+	{"echo", "serve an HTTP/1.1 WebSocket echo backend", Echo},
+	{"bench", "load a proxy over RFC 9220 and report latency and throughput", Bench},
+}
+
+// withoutContext adapts a command that runs to completion on its own.
+func withoutContext(run func(args []string) error) func(context.Context, []string) error {
+	return func(_ context.Context, args []string) error { return run(args) }
+}
+
+// Main runs the subcommand named by args[0] with the rest of args; the
+// long-running ones stop once ctx is done. Without a command, when args
+// start with a flag, it serves, as the binary did before it had
+// subcommands.
+func Main(ctx context.Context, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && !isHelp(args[0]) {
+		return Run(ctx, args)
+	}
+	if isHelp(args[0]) {
+		if len(args) > 1 {
+			return Main(ctx, []string{args[1], "-h"})
+		}
+		printUsage(os.Stdout)
+		return nil
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(ctx, args[1:])
+		}
+	}
+	printUsage(os.Stderr)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func isHelp(arg string) bool {
+	switch arg {
+	case "help", "-h", "-help", "--help":
+		return true
+	}
+	return false
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: ws-quic-proxy <command> [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-9s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nRun \"ws-quic-proxy <command> -h\" for the flags of a command.\n")
+}
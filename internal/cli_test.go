@@ -0,0 +1,32 @@
+package app
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMainDispatch(t *testing.T) {
+	if err := Main(context.Background(), []string{"frobnicate"}); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Fatalf("unknown command: %v", err)
+	}
+	for _, args := range [][]string{{"help"}, {"-h"}, {"version"}, {"help", "gen-cert"}, {"bench", "-h"}} {
+		if err := Main(context.Background(), args); err != nil {
+			t.Errorf("Main(%q): %v", args, err)
+		}
+	}
+	// Flags belong to their command.
+	if err := Main(context.Background(), []string{"gen-cert", "-backend", "ws://127.0.0.1:8080"}); err == nil {
+		t.Error("gen-cert accepted a serve flag")
+	}
+}
+
+func TestUsageListsCommands(t *testing.T) {
+	var sb strings.Builder
+	printUsage(&sb)
+	for _, c := range commands {
+		if !strings.Contains(sb.String(), "  "+c.name+" ") {
+			t.Errorf("usage lacks %q:\n%s", c.name, sb.String())
+		}
+	}
+}
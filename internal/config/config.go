@@ -2,6 +2,10 @@ package config
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
 	"regexp"
 	"time"
 
@@ -9,19 +13,144 @@ import (
 )
 
 type Config struct {
-	ListenAddr   string
-	CertFile     string
-	KeyFile      string
-	BackendWS    string
-	PathPattern  string
-	PathRegexp   *regexp.Regexp
-	MetricsAddr  string
-	MaxFrame     int64
-	MaxMessage   int64
-	MaxConns     int64
-	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
-	Debug        bool
+	ListenAddr        string
+	ListenDevice      string
+	ListenDSCP        int
+	ListenH2          string
+	ListenH1          string
+	CertFile          string
+	KeyFile           string
+	ClientCAFile      string
+	ACMEDomains       string
+	ACMECacheDir      string
+	ACMEEmail         string
+	ACMEDirectory     string
+	ACMEListen        string
+	CertWatchInterval time.Duration
+	ClientCertReq     bool
+	BackendWS         string
+	PathPattern       string
+	PathRegexp        *regexp.Regexp
+	MetricsAddr       string
+	ExpVar            bool
+	Pprof             bool
+	GopsAddr          string
+	AllowChaos        bool
+	MaxFrame          int64
+	MaxMessage        int64
+	StreamMessages    bool
+	StrictRFC9220     bool
+	ClientMasking     string
+	CloseTimeout      time.Duration
+	CloseCodeMap      string
+	H3FlushDelay      time.Duration
+	H3FlushBytes      int
+	MaxConns          int64
+	MaxConnsPerIP     int64
+	MaxBPSPerSession  int64
+	MaxBPSIngress     int64
+	MaxBPSEgress      int64
+	MaxMsgsPerSession float64
+	MaxMsgsBurst      int
+	MsgRateAction     string
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	Debug             bool
+	ResumeWindow      time.Duration
+	ResumeBuffer      int64
+
+	ClientDeflate        bool
+	ClientDeflateLevel   int
+	ClientDeflateMinSize int
+	BackendDeflate       bool
+	BackendDeflateLevel  int
+	DeflatePassthrough   bool
+
+	BackendSource   string
+	BackendDevice   string
+	ForwardHeaders  string
+	BackendCAFile   string
+	BackendCertFile string
+	BackendKeyFile  string
+	BackendSNI      string
+	BackendInsecure bool
+	BackendDSCP     int
+	BackendProxy    string
+	BackendProtocol string
+
+	JWTJWKSURL       string
+	JWTKeyFile       string
+	JWTIssuer        string
+	JWTAudience      string
+	JWTQuery         string
+	JWTLeeway        time.Duration
+	JWTPriorityClaim string
+
+	AuthURL             string
+	AuthTimeout         time.Duration
+	AuthCacheTTL        time.Duration
+	AuthResponseHeaders string
+	AuthPriorityHeader  string
+	OPAURL              string
+	OPATimeout          time.Duration
+
+	LogLevel  string
+	LogFormat string
+
+	AccessLog       string
+	AccessLogFormat string
+	AccessLogFields string
+
+	BackendReconnectTimeout time.Duration
+	BackendReconnectBuffer  int64
+	BackendDialTimeout      time.Duration
+	BackendDialRetries      int
+	BackendDialBackoff      time.Duration
+	BackendResolveInterval  time.Duration
+
+	ConfigFile         string
+	ConfigURL          string
+	ConfigPollInterval time.Duration
+	ConfigS3Endpoint   string
+	ConfigS3Region     string
+	Structured         File
+
+	RateLimitIP         float64
+	RateLimitIPBurst    int
+	RateLimitRedis      string
+	RateLimitRedisBatch int
+	OverloadRetryAfter  time.Duration
+	AdmissionQueueWait  time.Duration
+	AdmissionQueueSize  int
+	LowPriorityShare    float64
+	ShedIdleAfter       time.Duration
+	MemoryBudget        uint64
+	StaleSessionTimeout time.Duration
+	IdleTimeout         time.Duration
+	IdleCloseCode       int
+	RTTProbeInterval    time.Duration
+	ClientPingInterval  time.Duration
+	ClientPingMisses    int
+	BackendPingInterval time.Duration
+	BackendPingMisses   int
+	QUICStatsInterval   time.Duration
+	ReadyWindow         time.Duration
+	GoAwayTimeout       time.Duration
+	DrainTimeout        time.Duration
+	DrainCloseCode      int
+	TagHeader           string
+	TagQuery            string
+	TagValues           string
+	UsageFile           string
+	UsageWebhook        string
+	UsageInterval       time.Duration
+	UsageIdentityHeader string
+	UsageIdentityHash   bool
+
+	AdminAddr       string
+	AdminToken      string
+	AdminTokensFile string
+	AdminAuditLog   string
 }
 
 type Limits struct {
@@ -32,9 +161,102 @@ type Limits struct {
 	WriteTimeout   time.Duration
 }
 
+// Validate rejects limits that cannot hold together: a frame larger than
+// the largest message could never be accepted.
+func (l Limits) Validate() error {
+	if l.MaxFrameSize > 0 && l.MaxMessageSize > 0 && l.MaxFrameSize > l.MaxMessageSize {
+		return fmt.Errorf("max frame size %d is larger than max message size %d (-max-frame/max_frame must not exceed -max-message/max_message)", l.MaxFrameSize, l.MaxMessageSize)
+	}
+	return nil
+}
+
+// Admission controls queueing of CONNECTs that hit a session cap. A zero
+// Wait rejects them immediately.
+type Admission struct {
+	Wait     time.Duration
+	MaxQueue int
+	// LowPriorityShare caps low priority sessions at this fraction of
+	// max-conns (0 or 1 = no separate cap).
+	LowPriorityShare float64
+	// ShedIdle lets a CONNECT at the global cap shed the longest-idle
+	// session of its class or below once it has been idle this long (0 =
+	// off).
+	ShedIdle time.Duration
+}
+
+type Resume struct {
+	Window    time.Duration
+	MaxBuffer int64
+}
+
+type Reconnect struct {
+	Timeout   time.Duration
+	MaxBuffer int64
+}
+
 func DefaultTLSConfig() *tls.Config {
 	return &tls.Config{
 		MinVersion: tls.VersionTLS13,
 		NextProtos: []string{http3.NextProtoH3},
 	}
 }
+
+// BackendTLSConfig returns the client TLS settings for wss:// backends: the
+// root CAs in caFile instead of the system ones, a client certificate from
+// certFile/keyFile for backends that require mTLS, and serverName to verify
+// instead of the backend host. It returns nil when nothing is set, which
+// keeps the defaults.
+func BackendTLSConfig(caFile, certFile, keyFile, serverName string, insecure bool) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" && serverName == "" && !insecure {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: serverName, InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates", caFile)
+		}
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("-backend-cert and -backend-key go together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// ClientAuthTLSConfig is DefaultTLSConfig with client certificates verified
+// against the PEM bundle in caFile. required demands one
+// (tls.RequireAndVerifyClientCert); otherwise a certificate is verified
+// only when the client sends it. An empty caFile leaves mTLS off.
+func ClientAuthTLSConfig(caFile string, required bool) (*tls.Config, error) {
+	cfg := DefaultTLSConfig()
+	if caFile == "" {
+		if required {
+			return nil, errors.New("-client-cert-required needs -client-ca")
+		}
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificates", caFile)
+	}
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if required {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
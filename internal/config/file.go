@@ -0,0 +1,993 @@
+package config
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"h3ws2h1ws-proxy/internal/schema"
+)
+
+// File is the structured configuration loaded with -config. It carries the
+// settings that do not fit into flat command line flags.
+type File struct {
+	Tenants    []Tenant             `json:"tenants"`
+	Routes     []Route              `json:"routes,omitempty"`
+	Rejections map[string]Rejection `json:"rejections,omitempty"`
+	// BackendHeaders are added to backend handshakes. Values are Go
+	// templates rendered per session, e.g. "{{.RemoteIP}}".
+	BackendHeaders map[string]string `json:"backend_headers,omitempty"`
+	Limits         *LimitSet         `json:"limits,omitempty"`
+	Features       *Features         `json:"features,omitempty"`
+	Redaction      *Redaction        `json:"redaction,omitempty"`
+	Chaos          *Chaos            `json:"chaos,omitempty"`
+	// Pools are named sets of interchangeable backends that routes and
+	// tenants use instead of a single backend URL.
+	Pools []Pool `json:"pools,omitempty"`
+}
+
+// DefaultPool is the pool that serves sessions whose route and tenant name
+// no backend, in place of -backend.
+const DefaultPool = "default"
+
+// Pool is a named set of interchangeable backends.
+type Pool struct {
+	Name     string        `json:"name"`
+	Backends []PoolBackend `json:"backends"`
+	// Discovery fills the members from DNS or Consul instead of Backends.
+	Discovery *Discovery `json:"discovery,omitempty"`
+	// Balance is one of BalancePolicies ("" = round_robin).
+	Balance string `json:"balance,omitempty"`
+	// HashOn is the session key of the hash policy: "ip", "header:<name>"
+	// or "query:<name>".
+	HashOn string `json:"hash_on,omitempty"`
+	// HealthCheck probes the members and keeps new sessions off those that
+	// fail (nil = members are always healthy).
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+	// DialRetries is how many other members a session tries when its
+	// backend dial fails, all within DialDeadline (0 = only the handshake
+	// timeout of each dial).
+	DialRetries  int      `json:"dial_retries,omitempty"`
+	DialDeadline Duration `json:"dial_deadline,omitempty"`
+	// Outliers temporarily ejects members that fail dials or sessions (nil
+	// = off).
+	Outliers *OutlierDetection `json:"outlier_detection,omitempty"`
+}
+
+// OutlierDetection ejects a pool member after ConsecutiveFailures dial
+// failures in a row, or when at least MinSessions sessions ended within
+// Interval and the share that failed on the backend side reached ErrorRate
+// (0 = off). Ejections last BaseEjection, doubling for each repeated
+// ejection up to MaxEjection. Zero fields use the defaults.
+type OutlierDetection struct {
+	ConsecutiveFailures int      `json:"consecutive_failures,omitempty"`
+	ErrorRate           float64  `json:"error_rate,omitempty"`
+	MinSessions         int      `json:"min_sessions,omitempty"`
+	Interval            Duration `json:"interval,omitempty"`
+	BaseEjection        Duration `json:"base_ejection,omitempty"`
+	MaxEjection         Duration `json:"max_ejection,omitempty"`
+}
+
+// Discovery takes a pool's members from the SRV records of SRV
+// ("_ws._tcp.chat.example.com", optionally written srv://...), re-resolved
+// every Interval (0 = 30s), or from the healthy instances of a Consul
+// service. Each target becomes a member named host:port with the record's
+// priority and weight.
+type Discovery struct {
+	SRV    string           `json:"srv,omitempty"`
+	Consul *ConsulDiscovery `json:"consul,omitempty"`
+	// TLS dials the targets with wss:// instead of ws://.
+	TLS      bool     `json:"tls,omitempty"`
+	Interval Duration `json:"interval,omitempty"`
+}
+
+// ConsulDiscovery watches the instances of Service that pass their health
+// checks through blocking queries against the Consul HTTP API at Address
+// (default $CONSUL_HTTP_ADDR, then http://127.0.0.1:8500). The ACL token is
+// read from $CONSUL_HTTP_TOKEN.
+type ConsulDiscovery struct {
+	Service    string `json:"service"`
+	Address    string `json:"address,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	Datacenter string `json:"datacenter,omitempty"`
+}
+
+// HealthCheck configures active probes of a pool's members. By default a
+// probe is a WebSocket handshake to the member URL that is closed right
+// away; with Path it is an HTTP GET of that path instead.
+type HealthCheck struct {
+	Interval Duration `json:"interval,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`
+	Path     string   `json:"path,omitempty"`
+	// UnhealthyAfter and HealthyAfter are the consecutive failures and
+	// successes that flip a member's state.
+	UnhealthyAfter int `json:"unhealthy_after,omitempty"`
+	HealthyAfter   int `json:"healthy_after,omitempty"`
+}
+
+// PoolBackend is one member of a Pool, addressed by Name in the admin API.
+type PoolBackend struct {
+	Name string `json:"name"`
+	// URL is a ws:// or wss:// URL, or ws+unix:// or wss+unix:// with a
+	// socket path; as with -backend the request path and query are
+	// forwarded.
+	URL string `json:"url"`
+	// Weight is the member's share of new sessions relative to the other
+	// members (0 = 1).
+	Weight int `json:"weight,omitempty"`
+	// Priority ranks members: only those with the lowest value that are
+	// available get new sessions, the others are backups.
+	Priority int `json:"priority,omitempty"`
+	// Draining members keep their running sessions but get no new ones.
+	Draining bool `json:"draining,omitempty"`
+}
+
+// Tenant groups sessions of one product. A tenant is selected by SNI, path
+// prefix and/or auth identity; zero limits inherit the global values.
+type Tenant struct {
+	Name       string   `json:"name"`
+	SNI        []string `json:"sni"`
+	PathPrefix string   `json:"path_prefix"`
+	// Claims select the tenant by auth identity: only sessions whose JWT
+	// (see -jwt-jwks-url) carries them match, as for a route's claims.
+	Claims map[string]string `json:"claims,omitempty"`
+	// Auth requires the tenant's sessions to carry a JWT from the
+	// tenant's own identity provider.
+	Auth    *TenantAuth `json:"auth,omitempty"`
+	Backend string      `json:"backend"`
+	// Pool names a Pool to use instead of Backend.
+	Pool       string  `json:"pool,omitempty"`
+	MaxConns   int64   `json:"max_conns"`
+	MaxFrame   int64   `json:"max_frame"`
+	MaxMessage int64   `json:"max_message"`
+	RateLimit  float64 `json:"rate_limit"`
+	RateBurst  int     `json:"rate_burst"`
+	Priority   string  `json:"priority,omitempty"`
+}
+
+// TenantAuth is a tenant's own JWT check, set like the -jwt-* flags. The
+// JWKS is fetched when the first token needs it and again on unknown kids.
+type TenantAuth struct {
+	JWKSURL  string   `json:"jwks_url,omitempty"`
+	Key      string   `json:"key,omitempty"`
+	Issuer   string   `json:"issuer,omitempty"`
+	Audience string   `json:"audience,omitempty"`
+	Query    string   `json:"query,omitempty"`
+	Leeway   Duration `json:"leeway,omitempty"`
+}
+
+func (a *TenantAuth) validate() error {
+	if a == nil {
+		return nil
+	}
+	if (a.JWKSURL == "") == (a.Key == "") {
+		return errors.New("exactly one of jwks_url and key is required")
+	}
+	if a.Leeway < 0 {
+		return errors.New("leeway must not be negative")
+	}
+	return nil
+}
+
+// Route applies policy to requests whose path matches the Path regexp
+// and, when Hosts is set, whose :authority (Host) matches one of Hosts.
+// Routes are matched in order and the first match wins.
+type Route struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Tenant limits the route to that tenant's sessions. A route that
+	// sends sessions to a tenant's backend or pool must name the tenant.
+	Tenant   string   `json:"tenant,omitempty"`
+	Hosts    []string `json:"hosts,omitempty"`
+	MaxConns int64    `json:"max_conns,omitempty"`
+	Priority string   `json:"priority,omitempty"`
+	DSCP     int      `json:"dscp,omitempty"`
+	// BackendProtocol replaces -backend-protocol for the route's backend
+	// handshakes: one of BackendProtocols.
+	BackendProtocol string `json:"backend_protocol,omitempty"`
+	// BackendProxy replaces -backend-proxy for the route's backend
+	// connections: a proxy URL or "direct".
+	BackendProxy string               `json:"backend_proxy,omitempty"`
+	Rejections   map[string]Rejection `json:"rejections,omitempty"`
+	Messages     *MessageRules        `json:"messages,omitempty"`
+	Compression  *Compression         `json:"compression,omitempty"`
+	// Opaque relays the route's messages without parsing more than frame
+	// headers, for trusted internal clients (see proxy.Route.Opaque).
+	Opaque bool `json:"opaque,omitempty"`
+	// Backend is a ws:// or wss:// URL for the route's sessions, or a
+	// ws+unix:///socket:/path one for a Unix domain socket. Its path may
+	// use the capture groups of Path ($1, ${name}); without a path the
+	// request path is forwarded.
+	Backend string `json:"backend,omitempty"`
+	// Pool names a Pool to use instead of Backend.
+	Pool string `json:"pool,omitempty"`
+	// Balance and HashOn override the pool's balancing policy for the
+	// route's sessions.
+	Balance string `json:"balance,omitempty"`
+	HashOn  string `json:"hash_on,omitempty"`
+	// ClientCert admits the route's sessions by their TLS client
+	// certificate (see -client-ca).
+	ClientCert *ClientCertPolicy `json:"client_cert,omitempty"`
+	// BackendHeaders replace or add to the top-level backend_headers for
+	// the route's sessions.
+	BackendHeaders map[string]string `json:"backend_headers,omitempty"`
+	// Claims the session's JWT must carry (see -jwt-jwks-url): a string
+	// claim equal to the value or listing it among space separated words
+	// (scopes), or an array containing it.
+	Claims map[string]string `json:"claims,omitempty"`
+}
+
+// ClientCertPolicy allows or denies sessions by the verified client
+// certificate. Allow and Deny are regexps matched against the subject DN
+// (e.g. "CN=svc,O=Acme") and each SAN, written "dns:", "email:", "uri:" or
+// "ip:" followed by the value. A Deny match rejects; with Allow set, one of
+// them must match.
+type ClientCertPolicy struct {
+	Required bool     `json:"required,omitempty"`
+	Allow    []string `json:"allow,omitempty"`
+	Deny     []string `json:"deny,omitempty"`
+}
+
+func (p *ClientCertPolicy) validate() error {
+	if p == nil {
+		return nil
+	}
+	for _, expr := range slices.Concat(p.Allow, p.Deny) {
+		if _, err := regexp.Compile(expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compression tunes permessage-deflate on a route. Each side present
+// replaces the command line settings for that side.
+type Compression struct {
+	Client  *ClientCompression  `json:"client,omitempty"`
+	Backend *BackendCompression `json:"backend,omitempty"`
+	// Passthrough relays the client's extension offer to the backend
+	// instead of terminating it (nil = -deflate-passthrough).
+	Passthrough *bool `json:"passthrough,omitempty"`
+}
+
+// ClientCompression configures deflate toward H3 clients. A nil Level uses
+// DefaultDeflateLevel.
+type ClientCompression struct {
+	Disabled                bool `json:"disabled,omitempty"`
+	Level                   *int `json:"level,omitempty"`
+	MinSize                 int  `json:"min_size,omitempty"`
+	ServerContextTakeover   bool `json:"server_context_takeover,omitempty"`
+	ClientNoContextTakeover bool `json:"client_no_context_takeover,omitempty"`
+	ClientMaxWindowBits     int  `json:"client_max_window_bits,omitempty"`
+}
+
+// BackendCompression configures deflate on the backend leg.
+type BackendCompression struct {
+	Disabled bool `json:"disabled,omitempty"`
+	Level    *int `json:"level,omitempty"`
+}
+
+// DefaultDeflateLevel is flate.BestSpeed: most of the ratio for little CPU.
+const DefaultDeflateLevel = 1
+
+// MessageRules validates client messages on a route before they are
+// forwarded to the backend.
+type MessageRules struct {
+	// TextSchema is a JSON Schema every text message must satisfy.
+	TextSchema json.RawMessage `json:"text_schema,omitempty"`
+	Binary     *BinaryRules    `json:"binary,omitempty"`
+	// Policy is applied to invalid messages: "close" (default) ends the
+	// session with 1008, "reject" drops the message, "log" forwards it.
+	Policy string `json:"policy,omitempty"`
+}
+
+// BinaryRules checks binary messages; zero fields are not checked.
+type BinaryRules struct {
+	MinLength int `json:"min_length,omitempty"`
+	MaxLength int `json:"max_length,omitempty"`
+	// Magic is a hex encoded prefix every message must start with.
+	Magic string `json:"magic,omitempty"`
+	// Proto requires the rest of the message, after Magic, to be a
+	// protobuf message.
+	Proto *ProtoRules `json:"proto,omitempty"`
+}
+
+// ProtoRules names the protobuf type binary messages must decode as.
+type ProtoRules struct {
+	// Descriptor is a FileDescriptorSet file written by
+	// protoc --descriptor_set_out --include_imports.
+	Descriptor string `json:"descriptor"`
+	// Message is the fully qualified message name, e.g. "chat.v1.Event".
+	Message string `json:"message"`
+	// AllowUnknown accepts fields the message type does not declare.
+	AllowUnknown bool `json:"allow_unknown,omitempty"`
+}
+
+// MessagePolicies lists the accepted MessageRules.Policy values.
+var MessagePolicies = []string{"close", "reject", "log"}
+
+// Rejection customizes the response for one rejection reason. Zero fields
+// keep the built-in status and body.
+type Rejection struct {
+	Status  int               `json:"status,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// RejectionReasons lists the keys accepted in rejections maps.
+var RejectionReasons = []string{"method", "path", "bad_headers", "rate_limit", "overload", "auth", "acl", "mtls", "shutdown", "no_backend"}
+
+// BackendProtocols lists the accepted backend handshake protocols.
+var BackendProtocols = []string{"http1", "h2", "h3"}
+
+// BalancePolicies lists the accepted pool balancing policies.
+var BalancePolicies = []string{"round_robin", "least_conn", "hash"}
+
+// ParseHashOn splits a hash_on value into its source ("ip", "header" or
+// "query") and the header or parameter name.
+func ParseHashOn(s string) (source, name string, err error) {
+	source, name, _ = strings.Cut(s, ":")
+	switch {
+	case source == "ip" && name == "":
+		return source, "", nil
+	case (source == "header" || source == "query") && name != "":
+		return source, name, nil
+	}
+	return "", "", fmt.Errorf("bad hash_on %q: want ip, header:<name> or query:<name>", s)
+}
+
+// PriorityClasses lists the accepted priority values, lowest first.
+var PriorityClasses = []string{"low", "normal", "high"}
+
+// LimitSet overrides the global limits from the command line; zero fields
+// keep the flag value.
+type LimitSet struct {
+	MaxConns      int64    `json:"max_conns,omitempty"`
+	MaxFrame      int64    `json:"max_frame,omitempty"`
+	MaxMessage    int64    `json:"max_message,omitempty"`
+	ReadTimeout   Duration `json:"read_timeout,omitempty"`
+	WriteTimeout  Duration `json:"write_timeout,omitempty"`
+	QueueWait     Duration `json:"queue_wait,omitempty"`
+	QueueSize     int      `json:"queue_size,omitempty"`
+	ShedIdleAfter Duration `json:"shed_idle_after,omitempty"`
+}
+
+// Features toggles optional behaviour. Unset fields keep the flag value; an
+// explicit zero duration turns the feature off.
+type Features struct {
+	ResumeWindow            *Duration `json:"resume_window,omitempty"`
+	BackendReconnectTimeout *Duration `json:"backend_reconnect_timeout,omitempty"`
+}
+
+// Redaction masks sensitive data before payloads are logged. Fields are
+// JSON keys (any depth) or dotted paths from the root with "*" wildcards;
+// patterns are regexps applied to the raw payload.
+type Redaction struct {
+	Fields   []string `json:"fields,omitempty"`
+	Patterns []string `json:"patterns,omitempty"`
+}
+
+// Chaos injects faults for resilience testing. Rates are probabilities
+// from 0 to 1. It is refused unless the proxy runs with -allow-chaos.
+type Chaos struct {
+	DelayRate       float64  `json:"delay_rate,omitempty"`
+	MaxDelay        Duration `json:"max_delay,omitempty"`
+	DropRate        float64  `json:"drop_rate,omitempty"`
+	TruncateRate    float64  `json:"truncate_rate,omitempty"`
+	CloseRate       float64  `json:"close_rate,omitempty"`
+	DialFailureRate float64  `json:"dial_failure_rate,omitempty"`
+	// Routes limits chaos to these route names; empty means all sessions.
+	Routes []string `json:"routes,omitempty"`
+}
+
+// Duration is a time.Duration that reads and writes JSON as "30s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("duration must be a string such as \"30s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func LoadFile(path string) (File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return File{}, err
+	}
+	return ParseFile(path, data)
+}
+
+// ParseFile decodes and validates a config document. The extension of
+// name selects YAML or TOML over JSON; otherwise name is only used in error
+// messages.
+func ParseFile(name string, data []byte) (File, error) {
+	if documentFormat(name) != "json" {
+		doc, err := decodeDocument(name, data)
+		if err != nil {
+			return File{}, err
+		}
+		return decodeFile(name, doc)
+	}
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, fmt.Errorf("parse %s: %w", name, err)
+	}
+	return f, f.Validate()
+}
+
+func (f File) Validate() error {
+	pools := make(map[string]bool, len(f.Pools))
+	poolHashOn := make(map[string]string, len(f.Pools))
+	for i, p := range f.Pools {
+		if p.Name == "" {
+			return fmt.Errorf("pool #%d: name is required", i)
+		}
+		if pools[p.Name] {
+			return fmt.Errorf("pool %q: duplicate name", p.Name)
+		}
+		pools[p.Name] = true
+		poolHashOn[p.Name] = p.HashOn
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("pool %q: %w", p.Name, err)
+		}
+	}
+	seen := make(map[string]bool, len(f.Tenants))
+	// owners maps the backends and pools tenants use to the tenants using
+	// them, so routes cannot send one tenant's sessions to another's.
+	owners := make(map[string][]string)
+	for i, t := range f.Tenants {
+		if t.Name == "" {
+			return fmt.Errorf("tenant #%d: name is required", i)
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("tenant %q: duplicate name", t.Name)
+		}
+		seen[t.Name] = true
+		if len(t.SNI) == 0 && t.PathPrefix == "" && len(t.Claims) == 0 {
+			return fmt.Errorf("tenant %q: at least one of sni, path_prefix or claims is required", t.Name)
+		}
+		for name := range t.Claims {
+			if name == "" {
+				return fmt.Errorf("tenant %q: claims: empty claim name", t.Name)
+			}
+		}
+		if err := t.Auth.validate(); err != nil {
+			return fmt.Errorf("tenant %q: auth: %w", t.Name, err)
+		}
+		if t.MaxConns < 0 || t.MaxFrame < 0 || t.MaxMessage < 0 || t.RateLimit < 0 || t.RateBurst < 0 {
+			return fmt.Errorf("tenant %q: limits must not be negative", t.Name)
+		}
+		if t.Priority != "" && !slices.Contains(PriorityClasses, t.Priority) {
+			return fmt.Errorf("tenant %q: unknown priority %q", t.Name, t.Priority)
+		}
+		if t.Pool != "" && t.Backend != "" {
+			return fmt.Errorf("tenant %q: backend and pool are exclusive", t.Name)
+		}
+		if t.Pool != "" && !pools[t.Pool] {
+			return fmt.Errorf("tenant %q: unknown pool %q", t.Name, t.Pool)
+		}
+		if t.Pool != "" {
+			owners["pool "+t.Pool] = append(owners["pool "+t.Pool], t.Name)
+		}
+		if t.Backend != "" {
+			owners["backend "+t.Backend] = append(owners["backend "+t.Backend], t.Name)
+		}
+	}
+	tenants := seen
+	seen = make(map[string]bool, len(f.Routes))
+	for i, rt := range f.Routes {
+		if rt.Name == "" {
+			return fmt.Errorf("route #%d: name is required", i)
+		}
+		if seen[rt.Name] {
+			return fmt.Errorf("route %q: duplicate name", rt.Name)
+		}
+		seen[rt.Name] = true
+		re, err := regexp.Compile(rt.Path)
+		if err != nil {
+			return fmt.Errorf("route %q: bad path: %w", rt.Name, err)
+		}
+		for _, h := range rt.Hosts {
+			if h == "" || strings.Contains(strings.TrimPrefix(h, "*."), "*") {
+				return fmt.Errorf("route %q: bad host %q: want a name or *.domain", rt.Name, h)
+			}
+		}
+		if rt.Backend != "" {
+			if err := validateRouteBackend(re, rt.Backend); err != nil {
+				return fmt.Errorf("route %q: backend: %w", rt.Name, err)
+			}
+		}
+		if rt.Pool != "" && rt.Backend != "" {
+			return fmt.Errorf("route %q: backend and pool are exclusive", rt.Name)
+		}
+		if rt.Pool != "" && !pools[rt.Pool] {
+			return fmt.Errorf("route %q: unknown pool %q", rt.Name, rt.Pool)
+		}
+		if rt.Tenant != "" && rt.Tenant != "default" && !tenants[rt.Tenant] {
+			return fmt.Errorf("route %q: unknown tenant %q", rt.Name, rt.Tenant)
+		}
+		for _, target := range []string{"pool " + rt.Pool, "backend " + rt.Backend} {
+			if names := owners[target]; len(names) > 0 && !slices.Contains(names, rt.Tenant) {
+				return fmt.Errorf("route %q: %s belongs to tenant %s, set tenant", rt.Name, target, strings.Join(names, ", "))
+			}
+		}
+		if rt.Balance != "" && !slices.Contains(BalancePolicies, rt.Balance) {
+			return fmt.Errorf("route %q: unknown balance policy %q", rt.Name, rt.Balance)
+		}
+		if rt.HashOn != "" {
+			if _, _, err := ParseHashOn(rt.HashOn); err != nil {
+				return fmt.Errorf("route %q: %w", rt.Name, err)
+			}
+		}
+		if rt.Balance == "hash" && rt.HashOn == "" && poolHashOn[rt.Pool] == "" {
+			return fmt.Errorf("route %q: balance hash needs hash_on on the route or its pool", rt.Name)
+		}
+		if rt.MaxConns < 0 {
+			return fmt.Errorf("route %q: max_conns must not be negative", rt.Name)
+		}
+		if rt.Priority != "" && !slices.Contains(PriorityClasses, rt.Priority) {
+			return fmt.Errorf("route %q: unknown priority %q", rt.Name, rt.Priority)
+		}
+		if rt.DSCP < 0 || rt.DSCP > 63 {
+			return fmt.Errorf("route %q: dscp must be 0-63", rt.Name)
+		}
+		if rt.BackendProtocol != "" && !slices.Contains(BackendProtocols, rt.BackendProtocol) {
+			return fmt.Errorf("route %q: unknown backend_protocol %q", rt.Name, rt.BackendProtocol)
+		}
+		if rt.BackendProxy != "" && rt.BackendProxy != "direct" {
+			u, err := url.Parse(rt.BackendProxy)
+			if err != nil || !slices.Contains([]string{"http", "https", "socks5", "socks5h"}, u.Scheme) || u.Hostname() == "" {
+				return fmt.Errorf("route %q: backend_proxy must be an http://, https:// or socks5:// URL or \"direct\"", rt.Name)
+			}
+		}
+		if err := validateRejections(rt.Rejections); err != nil {
+			return fmt.Errorf("route %q: %w", rt.Name, err)
+		}
+		if err := rt.Messages.validate(); err != nil {
+			return fmt.Errorf("route %q: messages: %w", rt.Name, err)
+		}
+		if err := rt.Compression.validate(); err != nil {
+			return fmt.Errorf("route %q: compression: %w", rt.Name, err)
+		}
+		if err := rt.ClientCert.validate(); err != nil {
+			return fmt.Errorf("route %q: client_cert: %w", rt.Name, err)
+		}
+		if err := validateBackendHeaders(rt.BackendHeaders); err != nil {
+			return fmt.Errorf("route %q: %w", rt.Name, err)
+		}
+		for name := range rt.Claims {
+			if name == "" {
+				return fmt.Errorf("route %q: claims: empty claim name", rt.Name)
+			}
+		}
+	}
+	if err := validateRejections(f.Rejections); err != nil {
+		return err
+	}
+	if err := validateBackendHeaders(f.BackendHeaders); err != nil {
+		return err
+	}
+	if l := f.Limits; l != nil {
+		if l.MaxConns < 0 || l.MaxFrame < 0 || l.MaxMessage < 0 || l.ReadTimeout < 0 || l.WriteTimeout < 0 || l.QueueWait < 0 || l.QueueSize < 0 || l.ShedIdleAfter < 0 {
+			return errors.New("limits must not be negative")
+		}
+	}
+	if ft := f.Features; ft != nil {
+		if (ft.ResumeWindow != nil && *ft.ResumeWindow < 0) || (ft.BackendReconnectTimeout != nil && *ft.BackendReconnectTimeout < 0) {
+			return errors.New("feature durations must not be negative")
+		}
+	}
+	if rd := f.Redaction; rd != nil {
+		for _, field := range rd.Fields {
+			if slices.Contains(strings.Split(field, "."), "") {
+				return fmt.Errorf("redaction: bad field %q", field)
+			}
+		}
+		for _, p := range rd.Patterns {
+			if _, err := regexp.Compile(p); err != nil {
+				return fmt.Errorf("redaction: bad pattern: %w", err)
+			}
+		}
+	}
+	if c := f.Chaos; c != nil {
+		for _, r := range []float64{c.DelayRate, c.DropRate, c.TruncateRate, c.CloseRate, c.DialFailureRate} {
+			if r < 0 || r > 1 {
+				return errors.New("chaos: rates must be between 0 and 1")
+			}
+		}
+		if c.MaxDelay < 0 {
+			return errors.New("chaos: max_delay must not be negative")
+		}
+	}
+	return nil
+}
+
+func (p Pool) validate() error {
+	if p.Balance != "" && !slices.Contains(BalancePolicies, p.Balance) {
+		return fmt.Errorf("unknown balance policy %q", p.Balance)
+	}
+	if p.HashOn != "" {
+		if _, _, err := ParseHashOn(p.HashOn); err != nil {
+			return err
+		}
+	} else if p.Balance == "hash" {
+		return errors.New("balance hash needs hash_on")
+	}
+	if hc := p.HealthCheck; hc != nil {
+		if hc.Interval < 0 || hc.Timeout < 0 || hc.UnhealthyAfter < 0 || hc.HealthyAfter < 0 {
+			return errors.New("health_check: values must not be negative")
+		}
+		if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+			return fmt.Errorf("health_check: path %q must start with /", hc.Path)
+		}
+	}
+	if d := p.Discovery; d != nil {
+		if (strings.TrimPrefix(d.SRV, "srv://") == "") == (d.Consul == nil) {
+			return errors.New("discovery: exactly one of srv and consul is required")
+		}
+		if d.Consul != nil && d.Consul.Service == "" {
+			return errors.New("discovery: consul: service is required")
+		}
+		if d.Interval < 0 {
+			return errors.New("discovery: interval must not be negative")
+		}
+		if len(p.Backends) > 0 {
+			return errors.New("discovery: backends are discovered and cannot be listed too")
+		}
+	}
+	if p.DialRetries < 0 || p.DialDeadline < 0 {
+		return errors.New("dial_retries and dial_deadline must not be negative")
+	}
+	if od := p.Outliers; od != nil {
+		if od.ConsecutiveFailures < 0 || od.MinSessions < 0 || od.Interval < 0 || od.BaseEjection < 0 || od.MaxEjection < 0 {
+			return errors.New("outlier_detection: values must not be negative")
+		}
+		if od.ErrorRate < 0 || od.ErrorRate > 1 {
+			return errors.New("outlier_detection: error_rate must be between 0 and 1")
+		}
+	}
+	seen := make(map[string]bool, len(p.Backends))
+	for i, b := range p.Backends {
+		if b.Name == "" {
+			return fmt.Errorf("backend #%d: name is required", i)
+		}
+		if seen[b.Name] {
+			return fmt.Errorf("backend %q: duplicate name", b.Name)
+		}
+		seen[b.Name] = true
+		if b.Weight < 0 || b.Priority < 0 {
+			return fmt.Errorf("backend %q: weight and priority must not be negative", b.Name)
+		}
+		u, err := url.Parse(b.URL)
+		if err != nil {
+			return fmt.Errorf("backend %q: %w", b.Name, err)
+		}
+		if !validBackendURL(u) {
+			return fmt.Errorf("backend %q: want a ws://, wss://, ws+unix:// or wss+unix:// URL, got %q", b.Name, b.URL)
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("backend %q: must not have a query or fragment; the request query is forwarded", b.Name)
+		}
+	}
+	return nil
+}
+
+// validBackendURL reports whether u is a ws:// or wss:// URL with a host,
+// or a ws+unix:// or wss+unix:// URL with a socket path
+// (ws+unix:///var/run/app.sock:/path).
+func validBackendURL(u *url.URL) bool {
+	switch u.Scheme {
+	case "ws", "wss":
+		return u.Host != ""
+	case "ws+unix", "wss+unix":
+		sock, _, _ := strings.Cut(u.Path, ":")
+		return u.Host == "" && sock != ""
+	}
+	return false
+}
+
+// validateRouteBackend checks a route backend URL and that every capture
+// group its path refers to exists in path.
+func validateRouteBackend(path *regexp.Regexp, backend string) error {
+	u, err := url.Parse(backend)
+	if err != nil {
+		return err
+	}
+	if !validBackendURL(u) {
+		return fmt.Errorf("want a ws://, wss://, ws+unix:// or wss+unix:// URL, got %q", backend)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return errors.New("must not have a query or fragment; the request query is forwarded")
+	}
+	for _, ref := range templateRefs(u.Path) {
+		if n, err := strconv.Atoi(ref); err == nil {
+			if n > path.NumSubexp() {
+				return fmt.Errorf("path has no capture group $%d", n)
+			}
+		} else if path.SubexpIndex(ref) < 0 {
+			return fmt.Errorf("path has no capture group named %q", ref)
+		}
+	}
+	return nil
+}
+
+// templateRefs returns the group names and numbers a regexp.Expand
+// template refers to.
+func templateRefs(tmpl string) []string {
+	var refs []string
+	for {
+		i := strings.IndexByte(tmpl, '$')
+		if i < 0 || i+1 >= len(tmpl) {
+			return refs
+		}
+		tmpl = tmpl[i+1:]
+		switch {
+		case tmpl[0] == '$':
+			tmpl = tmpl[1:]
+		case tmpl[0] == '{':
+			end := strings.IndexByte(tmpl, '}')
+			if end < 0 {
+				return refs
+			}
+			refs = append(refs, tmpl[1:end])
+			tmpl = tmpl[end+1:]
+		default:
+			end := 0
+			for end < len(tmpl) && (tmpl[end] == '_' || unicode.IsLetter(rune(tmpl[end])) || unicode.IsDigit(rune(tmpl[end]))) {
+				end++
+			}
+			if end > 0 {
+				refs = append(refs, tmpl[:end])
+			}
+			tmpl = tmpl[end:]
+		}
+	}
+}
+
+func (m *MessageRules) validate() error {
+	if m == nil {
+		return nil
+	}
+	if m.Policy != "" && !slices.Contains(MessagePolicies, m.Policy) {
+		return fmt.Errorf("unknown policy %q", m.Policy)
+	}
+	if len(bytes.TrimSpace(m.TextSchema)) > 0 {
+		if _, err := schema.Compile(m.TextSchema); err != nil {
+			return fmt.Errorf("text_schema: %w", err)
+		}
+	}
+	if b := m.Binary; b != nil {
+		if b.MinLength < 0 || b.MaxLength < 0 {
+			return errors.New("binary lengths must not be negative")
+		}
+		if b.MaxLength > 0 && b.MinLength > b.MaxLength {
+			return errors.New("binary min_length exceeds max_length")
+		}
+		if _, err := hex.DecodeString(b.Magic); err != nil {
+			return fmt.Errorf("binary magic: %w", err)
+		}
+		if pr := b.Proto; pr != nil && (pr.Descriptor == "" || pr.Message == "") {
+			return errors.New("binary proto needs descriptor and message")
+		}
+	}
+	return nil
+}
+
+func (c *Compression) validate() error {
+	if c == nil {
+		return nil
+	}
+	if cl := c.Client; cl != nil {
+		if err := validateDeflateLevel(cl.Level); err != nil {
+			return err
+		}
+		if cl.MinSize < 0 {
+			return errors.New("min_size must not be negative")
+		}
+		if cl.ClientMaxWindowBits != 0 && (cl.ClientMaxWindowBits < 8 || cl.ClientMaxWindowBits > 15) {
+			return errors.New("client_max_window_bits must be 8-15")
+		}
+	}
+	if c.Backend != nil {
+		return validateDeflateLevel(c.Backend.Level)
+	}
+	return nil
+}
+
+// ValidDeflateLevel reports whether l is a compress/flate level.
+func ValidDeflateLevel(l int) bool {
+	return l >= -2 && l <= 9
+}
+
+func validateDeflateLevel(l *int) error {
+	if l != nil && !ValidDeflateLevel(*l) {
+		return fmt.Errorf("level %d out of range -2..9", *l)
+	}
+	return nil
+}
+
+func validateBackendHeaders(m map[string]string) error {
+	for name, value := range m {
+		if !headerNameRe.MatchString(name) {
+			return fmt.Errorf("backend_headers: bad header name %q", name)
+		}
+		if _, err := template.New(name).Parse(value); err != nil {
+			return fmt.Errorf("backend_headers: %w", err)
+		}
+	}
+	return nil
+}
+
+var headerNameRe = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+func validateRejections(m map[string]Rejection) error {
+	for reason, rej := range m {
+		if !slices.Contains(RejectionReasons, reason) {
+			return fmt.Errorf("rejections: unknown reason %q", reason)
+		}
+		if rej.Status != 0 && (rej.Status < 400 || rej.Status > 599) {
+			return fmt.Errorf("rejections %q: status must be 4xx or 5xx", reason)
+		}
+		for k := range rej.Headers {
+			if !headerNameRe.MatchString(k) {
+				return fmt.Errorf("rejections %q: bad header name %q", reason, k)
+			}
+		}
+	}
+	return nil
+}
+
+// Clone returns a copy that can be modified without affecting f.
+func (f File) Clone() File {
+	c := File{Tenants: make([]Tenant, len(f.Tenants))}
+	for i, t := range f.Tenants {
+		t.SNI = append([]string(nil), t.SNI...)
+		t.Claims = maps.Clone(t.Claims)
+		if t.Auth != nil {
+			a := *t.Auth
+			t.Auth = &a
+		}
+		c.Tenants[i] = t
+	}
+	if f.Routes != nil {
+		c.Routes = make([]Route, len(f.Routes))
+		for i, rt := range f.Routes {
+			rt.Hosts = slices.Clone(rt.Hosts)
+			rt.BackendHeaders = maps.Clone(rt.BackendHeaders)
+			rt.Claims = maps.Clone(rt.Claims)
+			rt.Rejections = cloneRejections(rt.Rejections)
+			if rt.Messages != nil {
+				m := *rt.Messages
+				m.TextSchema = slices.Clone(m.TextSchema)
+				if m.Binary != nil {
+					b := *m.Binary
+					if b.Proto != nil {
+						pr := *b.Proto
+						b.Proto = &pr
+					}
+					m.Binary = &b
+				}
+				rt.Messages = &m
+			}
+			if rt.Compression != nil {
+				rt.Compression = rt.Compression.clone()
+			}
+			if rt.ClientCert != nil {
+				cc := *rt.ClientCert
+				cc.Allow, cc.Deny = slices.Clone(cc.Allow), slices.Clone(cc.Deny)
+				rt.ClientCert = &cc
+			}
+			c.Routes[i] = rt
+		}
+	}
+	c.Rejections = cloneRejections(f.Rejections)
+	c.BackendHeaders = maps.Clone(f.BackendHeaders)
+	if f.Limits != nil {
+		l := *f.Limits
+		c.Limits = &l
+	}
+	if f.Features != nil {
+		ft := Features{}
+		if f.Features.ResumeWindow != nil {
+			d := *f.Features.ResumeWindow
+			ft.ResumeWindow = &d
+		}
+		if f.Features.BackendReconnectTimeout != nil {
+			d := *f.Features.BackendReconnectTimeout
+			ft.BackendReconnectTimeout = &d
+		}
+		c.Features = &ft
+	}
+	if f.Redaction != nil {
+		c.Redaction = &Redaction{Fields: slices.Clone(f.Redaction.Fields), Patterns: slices.Clone(f.Redaction.Patterns)}
+	}
+	if f.Chaos != nil {
+		ch := *f.Chaos
+		ch.Routes = slices.Clone(ch.Routes)
+		c.Chaos = &ch
+	}
+	if f.Pools != nil {
+		c.Pools = make([]Pool, len(f.Pools))
+		for i, p := range f.Pools {
+			p.Backends = slices.Clone(p.Backends)
+			if p.HealthCheck != nil {
+				hc := *p.HealthCheck
+				p.HealthCheck = &hc
+			}
+			if p.Outliers != nil {
+				od := *p.Outliers
+				p.Outliers = &od
+			}
+			if p.Discovery != nil {
+				d := *p.Discovery
+				if d.Consul != nil {
+					consul := *d.Consul
+					d.Consul = &consul
+				}
+				p.Discovery = &d
+			}
+			c.Pools[i] = p
+		}
+	}
+	return c
+}
+
+func (c *Compression) clone() *Compression {
+	out := &Compression{}
+	if c.Passthrough != nil {
+		pt := *c.Passthrough
+		out.Passthrough = &pt
+	}
+	if c.Client != nil {
+		cl := *c.Client
+		if cl.Level != nil {
+			l := *cl.Level
+			cl.Level = &l
+		}
+		out.Client = &cl
+	}
+	if c.Backend != nil {
+		b := *c.Backend
+		if b.Level != nil {
+			l := *b.Level
+			b.Level = &l
+		}
+		out.Backend = &b
+	}
+	return out
+}
+
+func cloneRejections(m map[string]Rejection) map[string]Rejection {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]Rejection, len(m))
+	for k, v := range m {
+		v.Headers = maps.Clone(v.Headers)
+		c[k] = v
+	}
+	return c
+}
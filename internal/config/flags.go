@@ -0,0 +1,141 @@
+package config
+
+import (
+	"flag"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// registerFlags binds every command line flag to a field of c, with its
+// default value.
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ListenAddr, "listen", ":443", "comma separated UDP listen addrs for HTTP/3 (e.g. :443, udp4://0.0.0.0:443,udp6://[::]:443)")
+	fs.StringVar(&c.CertFile, "cert", "cert.pem", "TLS cert PEM; a comma separated list serves several hostnames, picked by SNI")
+	fs.StringVar(&c.KeyFile, "key", "key.pem", "TLS key PEM; a comma separated list pairs up with -cert")
+	fs.DurationVar(&c.CertWatchInterval, "cert-watch-interval", 10*time.Second, "check -cert/-key this often and load them when they change, e.g. after a renewal (0 disables)")
+	fs.StringVar(&c.ACMEDomains, "acme-domains", "", "comma separated domains to obtain and renew certificates for via ACME (Let's Encrypt) instead of -cert/-key; the first one serves clients without SNI")
+	fs.StringVar(&c.ACMECacheDir, "acme-cache", "acme-cache", "directory ACME account keys and certificates are kept in across restarts")
+	fs.StringVar(&c.ACMEEmail, "acme-email", "", "contact email for the ACME account (optional)")
+	fs.StringVar(&c.ACMEDirectory, "acme-directory", autocert.DefaultACMEDirectory, "ACME directory URL, e.g. the Let's Encrypt staging endpoint for testing")
+	fs.StringVar(&c.ACMEListen, "acme-listen", ":80", "TCP addr of the plain HTTP listener that answers ACME HTTP-01 challenges (must be reachable as port 80 of every -acme-domains name)")
+	fs.StringVar(&c.ClientCAFile, "client-ca", "", "PEM bundle of CAs that client certificates are verified against (enables mTLS; routes can then allow or deny by subject/SAN)")
+	fs.BoolVar(&c.ClientCertReq, "client-cert-required", false, "reject TLS handshakes without a client certificate valid for -client-ca")
+
+	fs.StringVar(&c.ListenDevice, "listen-device", "", "network interface the HTTP/3 sockets are bound to (SO_BINDTODEVICE, linux); per-entry ?device= overrides it")
+	fs.IntVar(&c.ListenDSCP, "listen-dscp", 0, "DSCP code point (0-63) for outgoing QUIC packets; per-entry ?dscp= overrides it")
+	fs.StringVar(&c.ListenH1, "listen-h1", "", "TCP addr of a plain HTTP/1.1 listener for classic WebSocket upgrades, routed like HTTP/3 sessions (disabled by default)")
+	fs.StringVar(&c.ListenH2, "listen-h2", "", "TCP addr of a companion HTTP/2 TLS listener for RFC 8441 WebSocket CONNECTs, for clients whose UDP is blocked (needs GODEBUG=http2xconnect=1; disabled by default)")
+	fs.StringVar(&c.BackendWS, "backend", "ws://127.0.0.1:8080", "backend ws:// or wss:// URL (HTTP/1.1 WebSocket), without path, or ws+unix:///path/to.sock for a Unix domain socket")
+	fs.StringVar(&c.BackendSource, "backend-source", "", "local source IP for backend connections")
+	fs.StringVar(&c.BackendDevice, "backend-device", "", "network interface backend connections are bound to (SO_BINDTODEVICE, linux)")
+	fs.StringVar(&c.ForwardHeaders, "forward-headers", "", "comma separated client request headers copied into the backend handshake, e.g. Authorization,Cookie,Origin,User-Agent (default none)")
+	fs.StringVar(&c.BackendCAFile, "backend-ca", "", "PEM bundle of root CAs that wss:// backend certificates are verified against instead of the system roots")
+	fs.StringVar(&c.BackendCertFile, "backend-cert", "", "client certificate PEM presented to wss:// backends that require mTLS (with -backend-key)")
+	fs.StringVar(&c.BackendKeyFile, "backend-key", "", "key PEM for -backend-cert")
+	fs.StringVar(&c.BackendSNI, "backend-server-name", "", "server name sent to and verified against wss:// backends instead of the backend URL host")
+	fs.BoolVar(&c.BackendInsecure, "backend-insecure-skip-verify", false, "do not verify wss:// backend certificates (testing only)")
+	fs.IntVar(&c.BackendDSCP, "backend-dscp", 0, "DSCP code point (0-63) for backend TCP connections; routes may override it")
+	fs.StringVar(&c.BackendProtocol, "backend-protocol", "http1", "backend handshake: http1 (HTTP/1.1 upgrade), h2 (RFC 8441 extended CONNECT) or h3 (RFC 9220, wss:// only); routes may override it")
+	fs.StringVar(&c.BackendProxy, "backend-proxy", "", "http://, https:// or socks5:// egress proxy (user:password@ for authentication) for backend connections, or \"direct\" to ignore HTTPS_PROXY; routes may override it (default: proxy from the environment)")
+	fs.StringVar(&c.JWTJWKSURL, "jwt-jwks-url", "", "JWKS URL of the identity provider; CONNECTs without a valid JWT signed by one of its keys are rejected with 401")
+	fs.StringVar(&c.JWTKeyFile, "jwt-key", "", "PEM public key (RSA, ECDSA or Ed25519) JWTs are verified against, instead of -jwt-jwks-url")
+	fs.StringVar(&c.JWTIssuer, "jwt-issuer", "", "required iss claim of JWTs (default any)")
+	fs.StringVar(&c.JWTAudience, "jwt-audience", "", "required aud claim of JWTs (default any)")
+	fs.StringVar(&c.JWTQuery, "jwt-query", "", "query parameter that may carry the JWT for clients that cannot set Authorization (default the header only)")
+	fs.StringVar(&c.JWTPriorityClaim, "jwt-priority-claim", "", "JWT claim whose value (low, normal or high) sets the session's priority class over the route's and tenant's (disabled by default)")
+	fs.DurationVar(&c.JWTLeeway, "jwt-leeway", 30*time.Second, "clock skew tolerated on the exp and nbf claims of JWTs")
+	fs.StringVar(&c.AuthURL, "auth-url", "", "URL of an authorization service asked with a GET carrying the client's headers and X-Original-URI before each session; non-2xx answers reject the CONNECT (disabled by default)")
+	fs.DurationVar(&c.AuthTimeout, "auth-timeout", 2*time.Second, "timeout of -auth-url requests; a CONNECT whose check times out gets 503")
+	fs.DurationVar(&c.AuthCacheTTL, "auth-cache-ttl", 0, "how long -auth-url approvals are reused for requests with the same URI, headers and client IP (0 disables caching)")
+	fs.StringVar(&c.AuthResponseHeaders, "auth-response-headers", "", "comma separated -auth-url response headers copied into the backend handshake, e.g. X-User")
+	fs.StringVar(&c.AuthPriorityHeader, "auth-priority-header", "", "-auth-url response header whose value (low, normal or high) sets the session's priority class over the route's and tenant's (disabled by default)")
+	fs.StringVar(&c.OPAURL, "opa-url", "", "Open Policy Agent decision URL, e.g. http://127.0.0.1:8181/v1/data/h3ws/session, queried with the request path, headers, client IP and SNI before each session (disabled by default)")
+	fs.DurationVar(&c.OPATimeout, "opa-timeout", time.Second, "timeout of -opa-url queries; a CONNECT whose query fails gets 503")
+	fs.StringVar(&c.AccessLog, "access-log", "", "write one line per completed session to this file, or stdout/stderr (disabled by default)")
+	fs.StringVar(&c.AccessLogFormat, "access-log-format", "json", "access log format: json or text (key=value)")
+	fs.StringVar(&c.AccessLogFields, "access-log-fields", "", "comma separated access log fields, in output order (default all)")
+	fs.StringVar(&c.PathPattern, "path", "^/ws$", "regexp pattern for RFC9220 websocket CONNECT path")
+
+	fs.StringVar(&c.MetricsAddr, "metrics", "", "TCP addr for Prometheus /metrics (empty disables metrics server)")
+	fs.BoolVar(&c.ExpVar, "expvar", false, "serve expvar (config snapshot, session counts, rate limiter state) at /debug/vars on the -metrics server")
+	fs.DurationVar(&c.ReadyWindow, "ready-window", 30*time.Second, "/readyz on the -metrics server passes while a backend answered a dial within this long; after it, /readyz connects to -backend itself")
+	fs.BoolVar(&c.Pprof, "pprof", false, "serve net/http/pprof profiles (heap, CPU, goroutines, trace) at /debug/pprof/ on the -metrics server")
+	fs.BoolVar(&c.AllowChaos, "allow-chaos", false, "accept a \"chaos\" block in the structured config, which injects faults into traffic (staging only)")
+	fs.StringVar(&c.GopsAddr, "gops", "", "run the gops agent on this addr, e.g. 127.0.0.1:0 (requires a -tags gops build)")
+	fs.Int64Var(&c.MaxFrame, "max-frame", 1<<20, "max ws frame payload bytes (H3 side)")
+	fs.Int64Var(&c.MaxMessage, "max-message", 8<<20, "max reassembled message bytes (H3 side)")
+	fs.BoolVar(&c.StrictRFC9220, "strict-rfc9220", false, "require the RFC 9220 handshake (:protocol websocket, Sec-WebSocket-Version 13, no Sec-WebSocket-Key/Accept); off also accepts clients that omit those headers or use the key handshake")
+	fs.StringVar(&c.ClientMasking, "client-masking", "allow", "unmasked client frames: allow (RFC 9220 streams are protected by QUIC) or require a mask and close with 1002 otherwise (RFC 6455 5.1)")
+	fs.DurationVar(&c.CloseTimeout, "close-timeout", 5*time.Second, "how long a session waits for the reply to a close frame from the other side before the proxy answers it and tears the session down")
+	fs.StringVar(&c.CloseCodeMap, "close-code-map", "", "close codes to replace when forwarding them between client and backend, as from=to pairs, e.g. 1004=1008,4999=1011; other codes RFC 6455 does not allow on the wire become 1002")
+	fs.DurationVar(&c.H3FlushDelay, "h3-flush-delay", 0, "let data frames to H3 clients wait this long to be coalesced into one stream write with the frames that follow (0 writes every frame at once)")
+	fs.IntVar(&c.H3FlushBytes, "h3-flush-bytes", 16<<10, "with -h3-flush-delay, write as soon as this many bytes are buffered")
+	fs.BoolVar(&c.StreamMessages, "stream-messages", false, "forward fragmented client messages to the backend frame by frame instead of reassembling them first (-max-message still applies)")
+	fs.Int64Var(&c.MaxConns, "max-conns", 2000, "max concurrent sessions")
+	fs.Int64Var(&c.MaxConnsPerIP, "max-conns-per-ip", 0, "max concurrent sessions per client IP, answered with 429 beyond it (0 disables)")
+	fs.Int64Var(&c.MaxBPSPerSession, "max-bps-per-session", 0, "max data message bytes per second each session may send in each direction; pumps stop reading beyond it so flow control slows the sender (0 disables)")
+	fs.Int64Var(&c.MaxBPSIngress, "max-bps-ingress", 0, "max data message bytes per second from all clients to backends together, shared fairly between sessions (0 disables)")
+	fs.Int64Var(&c.MaxBPSEgress, "max-bps-egress", 0, "max data message bytes per second from all backends to clients together, shared fairly between sessions (0 disables)")
+	fs.Float64Var(&c.MaxMsgsPerSession, "max-msgs-per-session", 0, "max messages per second each client may send (0 disables)")
+	fs.IntVar(&c.MaxMsgsBurst, "max-msgs-burst", 0, "messages a client may send at once under -max-msgs-per-session (0 = one second's worth)")
+	fs.StringVar(&c.MsgRateAction, "msg-rate-action", "close", "what to do with a client over -max-msgs-per-session: close (1008) or throttle (stop reading until the rate allows)")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", 120*time.Second, "read timeout")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", 15*time.Second, "write timeout")
+	fs.DurationVar(&c.ResumeWindow, "resume-window", 0, "how long a session whose client stream dropped is kept for resumption (0 disables resume tokens)")
+	fs.Int64Var(&c.ResumeBuffer, "resume-buffer", 1<<20, "max backend->client bytes buffered while a session waits for resumption")
+	fs.DurationVar(&c.BackendReconnectTimeout, "backend-reconnect-timeout", 0, "how long to keep re-dialing a dropped backend before closing the client session (0 disables transparent reconnection)")
+	fs.Int64Var(&c.BackendReconnectBuffer, "backend-reconnect-buffer", 1<<20, "max client->backend bytes buffered while the backend is being re-dialed; beyond it reads from the client pause until the reconnect")
+	fs.DurationVar(&c.BackendDialTimeout, "backend-dial-timeout", 10*time.Second, "timeout of one backend WebSocket handshake, including the TCP and TLS connect")
+	fs.IntVar(&c.BackendDialRetries, "backend-dial-retries", 0, "re-dial the same backend this many times after a connection error or timeout before failing the CONNECT")
+	fs.DurationVar(&c.BackendResolveInterval, "backend-resolve-interval", 0, "resolve backend host names in the proxy and spread sessions over all their addresses, re-resolving when the DNS TTL runs out but at least this often (0 = the dialer resolves on every dial)")
+	fs.DurationVar(&c.BackendDialBackoff, "backend-dial-backoff", 100*time.Millisecond, "wait before the first -backend-dial-retries attempt; doubles per attempt up to 2s, with jitter")
+	fs.BoolVar(&c.ClientDeflate, "client-deflate", false, "negotiate permessage-deflate with H3 clients and compress backend->client text messages in the proxy (the backend leg stays uncompressed)")
+	fs.IntVar(&c.ClientDeflateLevel, "client-deflate-level", DefaultDeflateLevel, "compress/flate level for -client-deflate (-2 Huffman only .. 9 best compression)")
+	fs.IntVar(&c.ClientDeflateMinSize, "client-deflate-min-size", 0, "backend->client messages smaller than this many bytes are sent uncompressed")
+	fs.BoolVar(&c.BackendDeflate, "backend-deflate", false, "offer permessage-deflate to backends and compress client->backend messages when they accept")
+	fs.IntVar(&c.BackendDeflateLevel, "backend-deflate-level", DefaultDeflateLevel, "compress/flate level for -backend-deflate")
+	fs.BoolVar(&c.DeflatePassthrough, "deflate-passthrough", false, "offer the client's Sec-WebSocket-Extensions to the backend and relay frames untouched, so permessage-deflate runs end to end (replaces -client-deflate and -backend-deflate for clients that offer extensions)")
+	fs.BoolVar(&c.Debug, "debug", false, "enable verbose debug logs for QUIC/HTTP3 and proxy flow (implies -log-level debug)")
+	fs.StringVar(&c.LogLevel, "log-level", "info", "log level: debug, info, warn or error; the admin API can change it at runtime")
+	fs.StringVar(&c.LogFormat, "log-format", "text", "log format: text (key=value) or json")
+	fs.Float64Var(&c.RateLimitIP, "rate-limit-ip", 0, "max CONNECT attempts per second per client IP (0 disables)")
+	fs.IntVar(&c.RateLimitIPBurst, "rate-limit-ip-burst", 10, "burst size for -rate-limit-ip")
+	fs.StringVar(&c.RateLimitRedis, "rate-limit-redis", "", "redis://[:password@]host:port[/db] to share rate limit state across instances (empty keeps it local)")
+	fs.IntVar(&c.RateLimitRedisBatch, "rate-limit-redis-batch", 1, "tokens leased from Redis per round trip and spent locally (higher = fewer round trips, looser limits)")
+	fs.DurationVar(&c.OverloadRetryAfter, "overload-retry-after", time.Second, "Retry-After sent with 503 responses when a session cap is reached (0 omits the header)")
+	fs.DurationVar(&c.AdmissionQueueWait, "admission-queue-wait", 0, "how long a CONNECT that hits the global or a route session cap may wait for a free slot before being rejected (0 rejects immediately)")
+	fs.IntVar(&c.AdmissionQueueSize, "admission-queue-size", 1000, "max CONNECTs waiting per cap when -admission-queue-wait is set")
+	fs.Float64Var(&c.LowPriorityShare, "low-priority-share", 1, "fraction of -max-conns that low priority sessions may occupy")
+	fs.DurationVar(&c.ShedIdleAfter, "shed-idle-after", 0, "at -max-conns, close the longest-idle session idle for at least this long (1013) to admit a new CONNECT instead of refusing it (0 disables)")
+	fs.DurationVar(&c.StaleSessionTimeout, "stale-session-timeout", 0, "close sessions that carried no frames in either direction for this long (0 disables)")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", 0, "close sessions that carried no data messages in either direction for this long; pings and other control frames do not count (0 disables)")
+	fs.IntVar(&c.IdleCloseCode, "idle-close-code", 4000, "WebSocket close code sent to both sides of sessions closed by -idle-timeout")
+	fs.DurationVar(&c.RTTProbeInterval, "rtt-probe-interval", 0, "ping the client and the backend of every session this often and export round trip times (0 disables)")
+	fs.DurationVar(&c.ClientPingInterval, "client-ping-interval", 0, "ping the H3 client of every session this often and close sessions whose client stops answering, whatever QUIC keepalives say (0 disables)")
+	fs.IntVar(&c.ClientPingMisses, "client-ping-misses", 3, "consecutive unanswered -client-ping-interval pings after which a session is closed with 1001")
+	fs.DurationVar(&c.BackendPingInterval, "backend-ping-interval", 0, "ping the backend of sessions idle for this long and close them when the backend stops answering, instead of waiting for -read-timeout (0 disables)")
+	fs.IntVar(&c.BackendPingMisses, "backend-ping-misses", 3, "consecutive unanswered -backend-ping-interval pings after which a session is closed with 1001")
+	fs.DurationVar(&c.QUICStatsInterval, "quic-stats-interval", 15*time.Second, "sample RTT, congestion window and path MTU of every QUIC connection this often into h3ws_proxy_quic_* metrics; packet counters are kept while it is set (0 disables)")
+	fs.DurationVar(&c.GoAwayTimeout, "goaway-timeout", 10*time.Second, "on SIGINT/SIGTERM, how long to wait after draining sessions for other in-flight requests to finish")
+	fs.DurationVar(&c.DrainTimeout, "drain-timeout", 30*time.Second, "on SIGINT/SIGTERM, how long sessions get to finish their close handshake before they are cut off")
+	fs.IntVar(&c.DrainCloseCode, "drain-close-code", 1001, "WebSocket close code sent to clients when draining on SIGINT/SIGTERM (e.g. 1001 going away, 1012 service restart)")
+	fs.StringVar(&c.TagHeader, "tag-header", "", "request header whose value tags the session in h3ws_proxy_tag_* metrics (e.g. X-App-Version)")
+	fs.StringVar(&c.TagQuery, "tag-query", "", "query parameter used as the session tag when -tag-header is unset or missing")
+	fs.StringVar(&c.TagValues, "tag-values", "", "comma separated allowlist of tag values; others are counted as \"other\", missing tags as \"none\"")
+	fs.StringVar(&c.UsageFile, "usage-file", "", "append per-identity usage records as JSON lines to this file")
+	fs.StringVar(&c.UsageWebhook, "usage-webhook", "", "POST per-identity usage records as JSON lines to this URL")
+	fs.DurationVar(&c.UsageInterval, "usage-interval", time.Minute, "usage record window for -usage-file/-usage-webhook")
+	fs.StringVar(&c.UsageIdentityHeader, "usage-identity-header", "", "request header identifying the client for usage records (e.g. X-Api-Key; missing = \"anonymous\")")
+	fs.BoolVar(&c.UsageIdentityHash, "usage-identity-hash", false, "record a SHA-256 prefix of the -usage-identity-header value instead of the value")
+	fs.Uint64Var(&c.MemoryBudget, "memory-budget", 0, "heap bytes above which the longest-idle sessions are closed with 1013 (0 disables)")
+	fs.StringVar(&c.ConfigFile, "config", "", "YAML, TOML or JSON config file with flag values and structured settings (tenants, routes); flags on the command line override it")
+	fs.StringVar(&c.ConfigURL, "config-url", "", "https:// or s3://bucket/key URL of a JSON config document polled for changes (replaces -config structured settings)")
+	fs.DurationVar(&c.ConfigPollInterval, "config-poll-interval", 30*time.Second, "poll interval for -config-url")
+	fs.StringVar(&c.ConfigS3Endpoint, "config-s3-endpoint", "", "S3-compatible endpoint for s3:// config URLs (default AWS for the region)")
+	fs.StringVar(&c.ConfigS3Region, "config-s3-region", "", "region for s3:// config URLs (default $AWS_REGION or us-east-1)")
+	fs.StringVar(&c.AdminAddr, "admin", "", "TCP addr for the admin API (empty disables it; requires -admin-token)")
+	fs.StringVar(&c.AdminToken, "admin-token", "", "bearer token required by the admin API (default $H3WS_ADMIN_TOKEN)")
+	fs.StringVar(&c.AdminTokensFile, "admin-tokens-file", "", "file of name:token lines, one bearer token per admin; changes are audited under the name")
+	fs.StringVar(&c.AdminAuditLog, "admin-audit-log", "", "append admin API changes as JSON lines to this file")
+}
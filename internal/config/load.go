@@ -0,0 +1,175 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// fileKeys are the top-level keys that belong to File; every other key of
+// a -config document names a flag.
+var fileKeys = func() map[string]bool {
+	keys := map[string]bool{}
+	t := reflect.TypeFor[File]()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		keys[name] = true
+	}
+	return keys
+}()
+
+// Load parses command line arguments. With -config, flag values and
+// structured settings are read from that YAML, TOML or JSON file first
+// (chosen by extension); flags given on the command line override it.
+func Load(args []string) (Config, error) {
+	var cfg Config
+	fs := flag.NewFlagSet("ws-quic-proxy serve", flag.ContinueOnError)
+	cfg.registerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if cfg.ConfigFile != "" {
+		set := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		file, err := loadConfigFile(cfg.ConfigFile, fs, set)
+		if err != nil {
+			return cfg, fmt.Errorf("bad -config: %w", err)
+		}
+		cfg.Structured = file
+	}
+
+	if cfg.AdminToken == "" {
+		cfg.AdminToken = os.Getenv("H3WS_ADMIN_TOKEN")
+	}
+
+	pathRegexp, err := regexp.Compile(cfg.PathPattern)
+	if err != nil {
+		return cfg, fmt.Errorf("bad -path regexp: %w", err)
+	}
+	cfg.PathRegexp = pathRegexp
+	return cfg, nil
+}
+
+// loadConfigFile applies the flag values in the file at path to fs, except
+// those in set, and returns its structured settings.
+func loadConfigFile(path string, fs *flag.FlagSet, set map[string]bool) (File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return File{}, err
+	}
+	doc, err := decodeDocument(path, data)
+	if err != nil {
+		return File{}, err
+	}
+	structured := map[string]any{}
+	for key, v := range doc {
+		if fileKeys[key] {
+			structured[key] = v
+			continue
+		}
+		name := strings.ReplaceAll(key, "_", "-")
+		if name == "config" || fs.Lookup(name) == nil {
+			return File{}, fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+		if set[name] {
+			continue
+		}
+		s, err := flagValue(v)
+		if err != nil {
+			return File{}, fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+		if err := fs.Set(name, s); err != nil {
+			return File{}, fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+	}
+	return decodeFile(path, structured)
+}
+
+// flagValue renders a document value the way it would be written on the
+// command line. Lists become comma separated values.
+func flagValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case json.Number:
+		return v.String(), nil
+	case nil:
+		return "", nil
+	case []any:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			s, err := flagValue(item)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, ","), nil
+	}
+	return "", errors.New("must be a scalar or a list")
+}
+
+// decodeDocument parses a YAML (.yaml, .yml), TOML (.toml) or JSON
+// document; name supplies the extension. Numbers in JSON are kept as
+// json.Number.
+func decodeDocument(name string, data []byte) (map[string]any, error) {
+	var doc map[string]any
+	var err error
+	switch documentFormat(name) {
+	case "yaml":
+		err = yaml.Unmarshal(data, &doc)
+	case "toml":
+		err = toml.Unmarshal(data, &doc)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", name, err)
+	}
+	return doc, nil
+}
+
+func documentFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	return "json"
+}
+
+// decodeFile converts a decoded document into a validated File.
+func decodeFile(name string, doc map[string]any) (File, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return File{}, fmt.Errorf("parse %s: %w", name, err)
+	}
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, fmt.Errorf("parse %s: %w", name, err)
+	}
+	return f, f.Validate()
+}
@@ -0,0 +1,193 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const yamlConfig = `
+# flags use their command line names
+listen: [":443", "udp6://[::]:443"]
+backend: ws://10.0.0.5:8080
+max-conns: 500
+read_timeout: 90s
+debug: true
+low-priority-share: 0.25
+
+tenants:
+  - name: acme
+    sni: [acme.example.com]
+    backend: "ws://acme:8080"   # quoted
+    max_conns: 10
+backend_headers: {X-Proxy-Region: eu-1, X-Client-IP: "{{.RemoteIP}}"}
+routes:
+  - name: chat
+    path: ^/chat$
+    priority: high
+limits:
+  read_timeout: 1m
+`
+
+func TestLoadYAML(t *testing.T) {
+	path := writeConfig(t, "proxy.yaml", yamlConfig)
+	cfg, err := Load([]string{"-config", path, "-max-conns", "700"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ListenAddr != ":443,udp6://[::]:443" || cfg.BackendWS != "ws://10.0.0.5:8080" {
+		t.Errorf("listen/backend = %q / %q", cfg.ListenAddr, cfg.BackendWS)
+	}
+	if cfg.MaxConns != 700 {
+		t.Errorf("max-conns = %d, want the command line value 700", cfg.MaxConns)
+	}
+	if cfg.ReadTimeout != 90*time.Second || !cfg.Debug || cfg.LowPriorityShare != 0.25 {
+		t.Errorf("read-timeout=%v debug=%v low-priority-share=%v", cfg.ReadTimeout, cfg.Debug, cfg.LowPriorityShare)
+	}
+	if cfg.WriteTimeout != 15*time.Second {
+		t.Errorf("write-timeout = %v, want the default", cfg.WriteTimeout)
+	}
+	want := []Tenant{{Name: "acme", SNI: []string{"acme.example.com"}, Backend: "ws://acme:8080", MaxConns: 10}}
+	if !reflect.DeepEqual(cfg.Structured.Tenants, want) {
+		t.Errorf("tenants = %+v", cfg.Structured.Tenants)
+	}
+	if len(cfg.Structured.Routes) != 1 || cfg.Structured.Routes[0].Path != "^/chat$" || cfg.Structured.Routes[0].Priority != "high" {
+		t.Errorf("routes = %+v", cfg.Structured.Routes)
+	}
+	if want := map[string]string{"X-Proxy-Region": "eu-1", "X-Client-IP": "{{.RemoteIP}}"}; !reflect.DeepEqual(cfg.Structured.BackendHeaders, want) {
+		t.Errorf("backend_headers = %v", cfg.Structured.BackendHeaders)
+	}
+	if cfg.Structured.Limits == nil || time.Duration(cfg.Structured.Limits.ReadTimeout) != time.Minute {
+		t.Errorf("limits = %+v", cfg.Structured.Limits)
+	}
+}
+
+const tomlConfig = `
+backend = "ws://10.0.0.5:8080"
+max-conns = 1_000
+tag_values = ["ios", "android"]
+
+[[tenants]]
+name = "acme"
+path_prefix = '/acme'
+rate_limit = 2.5
+
+[features]
+resume_window = "30s"
+`
+
+func TestLoadTOML(t *testing.T) {
+	path := writeConfig(t, "proxy.toml", tomlConfig)
+	cfg, err := Load([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BackendWS != "ws://10.0.0.5:8080" || cfg.MaxConns != 1000 || cfg.TagValues != "ios,android" {
+		t.Errorf("backend=%q max-conns=%d tag-values=%q", cfg.BackendWS, cfg.MaxConns, cfg.TagValues)
+	}
+	if len(cfg.Structured.Tenants) != 1 || cfg.Structured.Tenants[0].PathPrefix != "/acme" || cfg.Structured.Tenants[0].RateLimit != 2.5 {
+		t.Errorf("tenants = %+v", cfg.Structured.Tenants)
+	}
+	if f := cfg.Structured.Features; f == nil || f.ResumeWindow == nil || time.Duration(*f.ResumeWindow) != 30*time.Second {
+		t.Errorf("features = %+v", f)
+	}
+}
+
+func TestLoadJSONAndErrors(t *testing.T) {
+	path := writeConfig(t, "proxy.json", `{"max-conns": 42, "tenants": [{"name": "a", "path_prefix": "/a"}]}`)
+	cfg, err := Load([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxConns != 42 || len(cfg.Structured.Tenants) != 1 {
+		t.Errorf("max-conns=%d tenants=%+v", cfg.MaxConns, cfg.Structured.Tenants)
+	}
+
+	for name, content := range map[string]string{
+		"typo.yaml":    "max-conn: 5\n",
+		"nested.yaml":  "config: other.yaml\n",
+		"badval.toml":  "max-conns = \"many\"\n",
+		"invalid.yaml": "tenants:\n  - name: a\n",
+		"indent.yaml":  "a: 1\n   b: 2\n",
+		"group.yaml":   "routes:\n  - name: r\n    path: ^/r/(\\d+)$\n    backend: ws://b/$2\n",
+		"host.yaml":    "routes:\n  - name: r\n    path: ^/\n    hosts: [\"a.*.com\"]\n",
+		"tauth.json":   `{"tenants": [{"name": "a", "path_prefix": "/a", "auth": {"audience": "ws"}}]}`,
+		"claim.json":   `{"tenants": [{"name": "a", "claims": {"": "x"}}]}`,
+		"xtenant.json": `{"tenants": [{"name": "a", "path_prefix": "/a", "backend": "ws://a"}], "routes": [{"name": "r", "path": "^/b", "backend": "ws://a"}]}`,
+		"rtenant.json": `{"routes": [{"name": "r", "path": "^/b", "tenant": "missing"}]}`,
+		"proto.json":   `{"routes": [{"name": "r", "path": "^/", "messages": {"binary": {"proto": {"descriptor": "x.pb"}}}}]}`,
+	} {
+		if _, err := Load([]string{"-config", writeConfig(t, name, content)}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestDecodeDocumentShapes(t *testing.T) {
+	yamlDoc, err := decodeDocument("proxy.yaml", []byte(strings.Join([]string{
+		"a:",
+		"- x",
+		"- {k: 'it''s', n: [1, 2.5, null]}",
+		"b:",
+		"  c: \"tab\\there # not a comment\"",
+		"  d: http://host:8080/p#frag",
+		"  e: &b ws://x",
+		"  f: *b",
+		"g: |",
+		"  line",
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"a": []any{"x", map[string]any{"k": "it's", "n": []any{1, 2.5, nil}}},
+		"b": map[string]any{"c": "tab\there # not a comment", "d": "http://host:8080/p#frag", "e": "ws://x", "f": "ws://x"},
+		"g": "line",
+	}
+	if !reflect.DeepEqual(yamlDoc, want) {
+		t.Errorf("yaml: got %#v\nwant %#v", yamlDoc, want)
+	}
+
+	tomlDoc, err := decodeDocument("proxy.toml", []byte(`
+title = "a \"quoted\" é"
+a.b = 0x10
+list = [
+  1, # comment
+  2,
+]
+inline = { x = 'raw\n', y = [true, false] }
+
+[server.tls]
+enabled = true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]any{
+		"title":  "a \"quoted\" é",
+		"a":      map[string]any{"b": int64(16)},
+		"list":   []any{int64(1), int64(2)},
+		"inline": map[string]any{"x": `raw\n`, "y": []any{true, false}},
+		"server": map[string]any{"tls": map[string]any{"enabled": true}},
+	}
+	if !reflect.DeepEqual(tomlDoc, want) {
+		t.Errorf("toml: got %#v\nwant %#v", tomlDoc, want)
+	}
+	for _, bad := range []string{"a = 1\na = 2", "[t]\n[t]", "x = [1, 2"} {
+		if _, err := decodeDocument("bad.toml", []byte(bad)); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
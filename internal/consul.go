@@ -0,0 +1,171 @@
+package app
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+const (
+	// consulWait is how long Consul may hold a blocking query open.
+	consulWait         = 5 * time.Minute
+	consulMaxRetryWait = 30 * time.Second
+)
+
+// watchConsulPools starts a watch for every pool with Consul discovery and
+// stops the watches of pools that were removed or changed.
+func watchConsulPools(ctx context.Context, store *configStore, client *http.Client, watches map[string]context.CancelFunc) {
+	want := make(map[string]bool)
+	for _, pool := range store.current().Pools {
+		d := pool.Discovery
+		if d == nil || d.Consul == nil {
+			continue
+		}
+		spec, _ := json.Marshal(d)
+		key := pool.Name + "\x00" + string(spec)
+		want[key] = true
+		if watches[key] != nil {
+			continue
+		}
+		watchCtx, cancel := context.WithCancel(ctx)
+		watches[key] = cancel
+		go watchConsulService(watchCtx, store, client, pool.Name, d)
+	}
+	for key, cancel := range watches {
+		if !want[key] {
+			cancel()
+			delete(watches, key)
+		}
+	}
+}
+
+// watchConsulService follows the healthy instances of a Consul service
+// with blocking queries until ctx is done. Errors keep the members found
+// before and are retried with backoff.
+func watchConsulService(ctx context.Context, store *configStore, client *http.Client, pool string, d *config.Discovery) {
+	index := uint64(0)
+	retryWait := time.Second
+	for ctx.Err() == nil {
+		backends, next, err := queryConsul(ctx, client, d, index)
+		if err == nil {
+			err = store.setDiscovered(pool, backends)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			metrics.DiscoveryRefreshes.WithLabelValues(pool, "error").Inc()
+			slog.Warn("backend discovery failed", "pool", pool, "consul_service", d.Consul.Service, "err", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(retryWait):
+			}
+			retryWait = min(retryWait*2, consulMaxRetryWait)
+			continue
+		}
+		metrics.DiscoveryRefreshes.WithLabelValues(pool, "ok").Inc()
+		retryWait = time.Second
+		// Consul may reset its index; start over rather than block on a
+		// value that will not come back, and pace the non-blocking query.
+		if next < index || next == 0 {
+			index = 0
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		index = next
+	}
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+// queryConsul returns the passing instances of the service as pool members
+// and the index to block on next. With a non-zero index the call returns
+// when the set changes or after consulWait.
+func queryConsul(ctx context.Context, client *http.Client, d *config.Discovery, index uint64) ([]config.PoolBackend, uint64, error) {
+	c := d.Consul
+	addr := cmp.Or(c.Address, os.Getenv("CONSUL_HTTP_ADDR"), "http://127.0.0.1:8500")
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	q := url.Values{"passing": {"1"}}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", consulWait.String())
+	}
+	if c.Tag != "" {
+		q.Set("tag", c.Tag)
+	}
+	if c.Datacenter != "" {
+		q.Set("dc", c.Datacenter)
+	}
+	u := strings.TrimSuffix(addr, "/") + "/v1/health/service/" + url.PathEscape(c.Service) + "?" + q.Encode()
+	// Consul adds up to wait/16 of jitter to blocking queries.
+	ctx, cancel := context.WithTimeout(ctx, consulWait+consulWait/16+10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul answered %s", resp.Status)
+	}
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("decode consul answer: %w", err)
+	}
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	scheme := "ws"
+	if d.TLS {
+		scheme = "wss"
+	}
+	backends := []config.PoolBackend{}
+	for _, e := range entries {
+		host := cmp.Or(e.Service.Address, e.Node.Address)
+		if host == "" || e.Service.Port == 0 {
+			continue
+		}
+		hostPort := net.JoinHostPort(host, strconv.Itoa(e.Service.Port))
+		if slices.ContainsFunc(backends, func(b config.PoolBackend) bool { return b.Name == hostPort }) {
+			continue
+		}
+		backends = append(backends, config.PoolBackend{Name: hostPort, URL: scheme + "://" + hostPort, Weight: e.Service.Weights.Passing})
+	}
+	slices.SortFunc(backends, func(a, b config.PoolBackend) int { return strings.Compare(a.Name, b.Name) })
+	return backends, next, nil
+}
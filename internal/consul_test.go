@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/proxy"
+)
+
+func TestWatchConsulService(t *testing.T) {
+	changed := make(chan struct{})
+	var queries atomic.Int32
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		q := r.URL.Query()
+		if r.URL.Path != "/v1/health/service/chat" || q.Get("passing") != "1" || q.Get("tag") != "v2" {
+			http.Error(w, "unexpected query "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		instance := func(addr string, port, weight int) string {
+			return fmt.Sprintf(`{"Node":{"Address":"10.0.0.1"},"Service":{"Address":%q,"Port":%d,"Weights":{"Passing":%d}}}`, addr, port, weight)
+		}
+		switch q.Get("index") {
+		case "":
+			w.Header().Set("X-Consul-Index", "5")
+			fmt.Fprintf(w, "[%s,%s]", instance("10.0.0.2", 8080, 3), instance("", 8081, 1))
+		case "5":
+			// Block like Consul until the service changes.
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+			w.Header().Set("X-Consul-Index", "6")
+			fmt.Fprintf(w, "[%s]", instance("10.0.0.2", 8080, 3))
+		default:
+			<-r.Context().Done()
+		}
+	}))
+	defer consul.Close()
+
+	backend, _ := url.Parse("ws://127.0.0.1:8080")
+	p := &proxy.Proxy{}
+	store := newConfigStore(p, func(f config.File) (*proxy.RuntimeConfig, error) {
+		return buildRuntimeConfig(f, backend, proxy.RuntimeConfig{Limits: config.Limits{MaxConns: 10}}, nil)
+	})
+	file := config.File{Pools: []config.Pool{{Name: "chat", Discovery: &config.Discovery{Consul: &config.ConsulDiscovery{Service: "chat", Address: consul.URL, Tag: "v2"}}}}}
+	if err := store.replace(file); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watches := map[string]context.CancelFunc{}
+	watchConsulPools(ctx, store, consul.Client(), watches)
+	watchConsulPools(ctx, store, consul.Client(), watches)
+	if len(watches) != 1 {
+		t.Fatalf("watches: %d", len(watches))
+	}
+
+	waitMembers := func(want ...string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			var got []string
+			for _, b := range p.Pools()[0].Backends {
+				got = append(got, b.URL)
+			}
+			if fmt.Sprint(got) == fmt.Sprint(want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("members: got %v want %v", got, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitMembers("ws://10.0.0.1:8081", "ws://10.0.0.2:8080")
+	close(changed)
+	waitMembers("ws://10.0.0.2:8080")
+
+	// Removing the pool's discovery stops the watch.
+	if err := store.update(func(f *config.File) error { f.Pools = nil; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	watchConsulPools(ctx, store, consul.Client(), watches)
+	if len(watches) != 0 {
+		t.Fatalf("watches after removal: %d", len(watches))
+	}
+}
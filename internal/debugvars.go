@@ -0,0 +1,99 @@
+package app
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"h3ws2h1ws-proxy/internal/config"
+)
+
+const redacted = "REDACTED"
+
+// debugVarsSource is what the expvars of the latest Run report.
+type debugVarsSource struct {
+	cfg   config.Config
+	store *configStore
+}
+
+var (
+	debugVarsOnce sync.Once
+	debugVars     atomic.Pointer[debugVarsSource]
+)
+
+// publishDebugVars registers the proxy's expvars: the flag configuration
+// with secrets removed, the structured config in effect, and session and
+// rate limiter state. expvar names can only be registered once per process,
+// so a later Run repoints them instead.
+func publishDebugVars(cfg config.Config, store *configStore) {
+	debugVars.Store(&debugVarsSource{cfg: redactConfig(cfg), store: store})
+	debugVarsOnce.Do(func() {
+		expvar.Publish("config", expvar.Func(func() any { return debugVars.Load().cfg }))
+		expvar.Publish("runtime_config", expvar.Func(func() any { return debugVars.Load().store.current() }))
+		expvar.Publish("proxy", expvar.Func(func() any { return debugVars.Load().store.p.Stats() }))
+	})
+}
+
+// redactConfig drops the admin token and credentials or query strings in
+// URLs, which may carry tokens.
+func redactConfig(cfg config.Config) config.Config {
+	if cfg.AdminToken != "" {
+		cfg.AdminToken = redacted
+	}
+	cfg.RateLimitRedis = redactURL(cfg.RateLimitRedis)
+	cfg.ConfigURL = redactURL(cfg.ConfigURL)
+	cfg.UsageWebhook = redactURL(cfg.UsageWebhook)
+	return cfg
+}
+
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		if raw == "" {
+			return ""
+		}
+		return redacted
+	}
+	if u.User != nil {
+		u.User = url.User(redacted)
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = redacted
+	}
+	return u.String()
+}
+
+// debugVarsHandler serves expvar like expvar.Handler but leaves out
+// "cmdline", since flags such as -admin-token would be shown verbatim.
+func debugVarsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		vars := map[string]json.RawMessage{}
+		expvar.Do(func(kv expvar.KeyValue) {
+			if kv.Key != "cmdline" {
+				vars[kv.Key] = json.RawMessage(kv.Value.String())
+			}
+		})
+		data, err := json.MarshalIndent(vars, "", "  ")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("encode vars: %v", err), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(data)
+	})
+}
+
+// handlePprof mounts the net/http/pprof handlers on mux. Like
+// debugVarsHandler it leaves out /debug/pprof/cmdline.
+func handlePprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/pprof/cmdline", http.NotFoundHandler())
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"h3ws2h1ws-proxy/internal/config"
+)
+
+func TestRedactConfig(t *testing.T) {
+	cfg := redactConfig(config.Config{
+		AdminToken:     "secret",
+		RateLimitRedis: "redis://:hunter2@redis:6379/0",
+		ConfigURL:      "https://config.example.com/proxy.json?sig=abc",
+		UsageWebhook:   "https://usage.example.com/ingest",
+	})
+	if cfg.AdminToken != redacted {
+		t.Errorf("admin token = %q", cfg.AdminToken)
+	}
+	if cfg.RateLimitRedis != "redis://REDACTED@redis:6379/0" {
+		t.Errorf("redis url = %q", cfg.RateLimitRedis)
+	}
+	if cfg.ConfigURL != "https://config.example.com/proxy.json?REDACTED" {
+		t.Errorf("config url = %q", cfg.ConfigURL)
+	}
+	if cfg.UsageWebhook != "https://usage.example.com/ingest" {
+		t.Errorf("usage webhook = %q", cfg.UsageWebhook)
+	}
+}
+
+func TestDebugVarsHandlerOmitsCmdline(t *testing.T) {
+	rec := httptest.NewRecorder()
+	debugVarsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if _, ok := vars["cmdline"]; ok {
+		t.Error("cmdline exposed")
+	}
+	if _, ok := vars["memstats"]; !ok {
+		t.Error("memstats missing")
+	}
+}
+
+func TestPprofOmitsCmdline(t *testing.T) {
+	mux := http.NewServeMux()
+	handlePprof(mux)
+	for path, want := range map[string]int{
+		"/debug/pprof/":                  http.StatusOK,
+		"/debug/pprof/goroutine?debug=1": http.StatusOK,
+		"/debug/pprof/heap":              http.StatusOK,
+		"/debug/pprof/cmdline":           http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("%s: status %d, want %d", path, rec.Code, want)
+		}
+	}
+}
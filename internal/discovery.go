@@ -0,0 +1,118 @@
+package app
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+// defaultDiscoveryInterval is how often SRV records are re-resolved when
+// a pool's discovery sets no interval.
+const defaultDiscoveryInterval = 30 * time.Second
+
+type srvLookup func(ctx context.Context, name string) ([]*net.SRV, error)
+
+func lookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	return records, err
+}
+
+// runDiscovery keeps the members of pools with discovery in sync with DNS
+// and Consul until ctx is done. Pools are checked every tick, so ones added
+// at runtime are picked up; SRV pools are re-resolved at their own
+// interval and Consul pools are watched.
+func runDiscovery(ctx context.Context, store *configStore, lookup srvLookup, tick time.Duration) {
+	last := make(map[string]time.Time)
+	watches := make(map[string]context.CancelFunc)
+	defer func() {
+		for _, cancel := range watches {
+			cancel()
+		}
+	}()
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		discoverPools(ctx, store, lookup, last, time.Now())
+		watchConsulPools(ctx, store, http.DefaultClient, watches)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// discoverPools re-resolves the pools whose interval has passed since
+// last[pool] and applies changed member sets. A failed lookup keeps the
+// members found before.
+func discoverPools(ctx context.Context, store *configStore, lookup srvLookup, last map[string]time.Time, now time.Time) {
+	for _, pool := range store.current().Pools {
+		d := pool.Discovery
+		if d == nil || d.SRV == "" {
+			continue
+		}
+		key := pool.Name + "\x00" + d.SRV
+		if now.Sub(last[key]) < cmp.Or(time.Duration(d.Interval), defaultDiscoveryInterval) {
+			continue
+		}
+		last[key] = now
+		lookupCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		backends, err := discoverSRV(lookupCtx, lookup, d)
+		cancel()
+		if err == nil {
+			err = store.setDiscovered(pool.Name, backends)
+		}
+		if err != nil {
+			metrics.DiscoveryRefreshes.WithLabelValues(pool.Name, "error").Inc()
+			slog.Warn("backend discovery failed", "pool", pool.Name, "srv", d.SRV, "err", err)
+			continue
+		}
+		metrics.DiscoveryRefreshes.WithLabelValues(pool.Name, "ok").Inc()
+	}
+}
+
+// discoverSRV turns the SRV records of d into pool members, sorted by name
+// so an unchanged answer in a different order changes nothing.
+func discoverSRV(ctx context.Context, lookup srvLookup, d *config.Discovery) ([]config.PoolBackend, error) {
+	records, err := lookup(ctx, strings.TrimPrefix(d.SRV, "srv://"))
+	if err != nil {
+		return nil, err
+	}
+	scheme := "ws"
+	if d.TLS {
+		scheme = "wss"
+	}
+	var backends []config.PoolBackend
+	for _, r := range records {
+		host := strings.TrimSuffix(r.Target, ".")
+		if host == "" {
+			// A "." target means the service is not offered here.
+			continue
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(int(r.Port)))
+		if slices.ContainsFunc(backends, func(b config.PoolBackend) bool { return b.Name == addr }) {
+			continue
+		}
+		backends = append(backends, config.PoolBackend{
+			Name:     addr,
+			URL:      scheme + "://" + addr,
+			Weight:   int(r.Weight),
+			Priority: int(r.Priority),
+		})
+	}
+	if len(backends) == 0 {
+		return nil, errors.New("no SRV targets")
+	}
+	slices.SortFunc(backends, func(a, b config.PoolBackend) int { return strings.Compare(a.Name, b.Name) })
+	return backends, nil
+}
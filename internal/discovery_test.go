@@ -0,0 +1,77 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/proxy"
+)
+
+func TestDiscoverPools(t *testing.T) {
+	backend, _ := url.Parse("ws://127.0.0.1:8080")
+	base := proxy.RuntimeConfig{Limits: config.Limits{MaxConns: 10}}
+	p := &proxy.Proxy{}
+	store := newConfigStore(p, func(f config.File) (*proxy.RuntimeConfig, error) {
+		return buildRuntimeConfig(f, backend, base, nil)
+	})
+	file := config.File{Pools: []config.Pool{{Name: "chat", Discovery: &config.Discovery{SRV: "srv://_ws._tcp.chat.example.com", TLS: true, Interval: config.Duration(time.Minute)}}}}
+	if err := store.replace(file); err != nil {
+		t.Fatal(err)
+	}
+
+	var asked string
+	records := []*net.SRV{
+		{Target: "b.example.com.", Port: 9000, Priority: 10, Weight: 5},
+		{Target: "a.example.com.", Port: 9000, Priority: 10, Weight: 1},
+		{Target: "backup.example.com.", Port: 9000, Priority: 20},
+	}
+	var lookupErr error
+	lookup := func(_ context.Context, name string) ([]*net.SRV, error) {
+		asked = name
+		return records, lookupErr
+	}
+	last := map[string]time.Time{}
+	now := time.Now()
+	discoverPools(context.Background(), store, lookup, last, now)
+	if asked != "_ws._tcp.chat.example.com" {
+		t.Fatalf("looked up %q", asked)
+	}
+	members := p.Pools()[0].Backends
+	if len(members) != 3 || members[0].Name != "a.example.com:9000" || members[0].URL != "wss://a.example.com:9000" || members[1].Weight != 5 || members[2].Priority != 20 {
+		t.Fatalf("members: %+v", members)
+	}
+	if len(store.current().Pools[0].Backends) != 0 {
+		t.Fatal("discovered members leaked into the config document")
+	}
+
+	// Nothing is looked up before the interval, and a failed lookup keeps
+	// the members.
+	records = records[:1]
+	discoverPools(context.Background(), store, lookup, last, now.Add(time.Second))
+	if len(p.Pools()[0].Backends) != 3 {
+		t.Fatal("re-resolved before the interval")
+	}
+	lookupErr = errors.New("SERVFAIL")
+	discoverPools(context.Background(), store, lookup, last, now.Add(time.Minute))
+	if len(p.Pools()[0].Backends) != 3 {
+		t.Fatal("failed lookup dropped the members")
+	}
+	lookupErr = nil
+	discoverPools(context.Background(), store, lookup, last, now.Add(2*time.Minute))
+	if got := p.Pools()[0].Backends; len(got) != 1 || got[0].Name != "b.example.com:9000" {
+		t.Fatalf("members after refresh: %+v", got)
+	}
+
+	// Config changes keep the discovered members.
+	if err := store.update(func(f *config.File) error { f.Pools[0].DialRetries = 1; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Pools()[0].Backends) != 1 {
+		t.Fatal("config update dropped the discovered members")
+	}
+}
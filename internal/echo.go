@@ -0,0 +1,162 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// echoMutation is how the echo server changes text messages before
+// sending them back.
+type echoMutation int8
+
+const (
+	echoVerbatim echoMutation = iota
+	echoUpper
+	echoLower
+	echoReverse
+)
+
+func parseEchoMutation(s string) (echoMutation, error) {
+	switch s {
+	case "", "none":
+		return echoVerbatim, nil
+	case "upper":
+		return echoUpper, nil
+	case "lower":
+		return echoLower, nil
+	case "reverse":
+		return echoReverse, nil
+	}
+	return echoVerbatim, fmt.Errorf("unknown mutation %q (want none, upper, lower or reverse)", s)
+}
+
+func (m echoMutation) String() string {
+	switch m {
+	case echoUpper:
+		return "upper"
+	case echoLower:
+		return "lower"
+	case echoReverse:
+		return "reverse"
+	default:
+		return "none"
+	}
+}
+
+// echoServer is a WebSocket echo backend for tests and demos.
+type echoServer struct {
+	Delay  time.Duration // before each reply
+	Jitter time.Duration // random extra delay, up to this much
+	Mutate echoMutation  // applied to text messages
+	Prefix string        // prepended to text messages
+}
+
+// Echo runs the echo subcommand: an HTTP/1.1 WebSocket server that sends
+// every message back, optionally delayed and changed.
+func Echo(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("ws-quic-proxy echo", flag.ContinueOnError)
+	listen := fs.String("listen", ":8080", "TCP listen address")
+	delay := fs.Duration("delay", 0, "delay before each reply")
+	jitter := fs.Duration("jitter", 0, "random extra delay before each reply, up to this much")
+	mutate := fs.String("mutate", "none", "change text messages before echoing: none, upper, lower or reverse")
+	prefix := fs.String("prefix", "", "prepend this to echoed text messages")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	m, err := parseEchoMutation(*mutate)
+	if err != nil {
+		return fmt.Errorf("bad -mutate: %w", err)
+	}
+	if *delay < 0 || *jitter < 0 {
+		return errors.New("-delay and -jitter must not be negative")
+	}
+
+	e := &echoServer{Delay: *delay, Jitter: *jitter, Mutate: m, Prefix: *prefix}
+	srv := &http.Server{Addr: *listen, Handler: e, ReadHeaderTimeout: 10 * time.Second}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	slog.Info("echo backend listening", "addr", *listen, "delay", *delay, "jitter", *jitter, "mutate", m.String())
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (e *echoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	// Any origin and the first subprotocol offered are accepted.
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	var header http.Header
+	if protos := websocket.Subprotocols(r); len(protos) > 0 {
+		header = http.Header{"Sec-Websocket-Protocol": {protos[0]}}
+	}
+	c, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	slog.Debug("echo session", "remote", r.RemoteAddr, "path", r.URL.Path)
+	for {
+		mt, msg, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		if d := e.Delay + e.jitter(); d > 0 {
+			time.Sleep(d)
+		}
+		if mt == websocket.TextMessage {
+			msg = e.mutate(msg)
+		}
+		if err := c.WriteMessage(mt, msg); err != nil {
+			return
+		}
+	}
+}
+
+func (e *echoServer) jitter() time.Duration {
+	if e.Jitter <= 0 {
+		return 0
+	}
+	return rand.N(e.Jitter + 1)
+}
+
+// mutate returns the text message msg as the server echoes it.
+func (e *echoServer) mutate(msg []byte) []byte {
+	switch e.Mutate {
+	case echoUpper:
+		msg = []byte(strings.ToUpper(string(msg)))
+	case echoLower:
+		msg = []byte(strings.ToLower(string(msg)))
+	case echoReverse:
+		runes := []rune(string(msg))
+		slices.Reverse(runes)
+		msg = []byte(string(runes))
+	}
+	if e.Prefix != "" {
+		msg = append([]byte(e.Prefix), msg...)
+	}
+	return msg
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEchoServer(t *testing.T) {
+	for _, tc := range []struct {
+		mutate string
+		prefix string
+		in     string
+		want   string
+	}{
+		{"none", "", "Hello", "Hello"},
+		{"upper", "", "Hello", "HELLO"},
+		{"lower", "", "Hello", "hello"},
+		{"reverse", "echo: ", "héllo", "echo: olléh"},
+	} {
+		t.Run(tc.mutate, func(t *testing.T) {
+			m, err := parseEchoMutation(tc.mutate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.String() != tc.mutate {
+				t.Fatalf("String() = %q, want %q", m, tc.mutate)
+			}
+			srv := httptest.NewServer(&echoServer{Delay: 50 * time.Millisecond, Mutate: m, Prefix: tc.prefix})
+			defer srv.Close()
+			c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			start := time.Now()
+			if err := c.WriteMessage(websocket.TextMessage, []byte(tc.in)); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.WriteMessage(websocket.BinaryMessage, []byte(tc.in)); err != nil {
+				t.Fatal(err)
+			}
+			mt, got, err := c.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+				t.Fatalf("reply after %s, want the 50ms delay", elapsed)
+			}
+			if mt != websocket.TextMessage || string(got) != tc.want {
+				t.Fatalf("text echo = %d %q, want %q", mt, got, tc.want)
+			}
+			// Binary messages come back unchanged.
+			if mt, got, err = c.ReadMessage(); err != nil || mt != websocket.BinaryMessage || string(got) != tc.in {
+				t.Fatalf("binary echo = %d %q, %v", mt, got, err)
+			}
+		})
+	}
+}
+
+func TestEchoServerRequiresUpgrade(t *testing.T) {
+	rr := httptest.NewRecorder()
+	(&echoServer{}).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusUpgradeRequired {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusUpgradeRequired)
+	}
+	if _, err := parseEchoMutation("rot13"); err == nil {
+		t.Fatal("unknown mutation accepted")
+	}
+}
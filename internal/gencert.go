@@ -0,0 +1,105 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// GenCert runs the gen-cert subcommand: it writes a self-signed
+// certificate and key for local HTTP/3 testing.
+func GenCert(args []string) error {
+	fs := flag.NewFlagSet("ws-quic-proxy gen-cert", flag.ContinueOnError)
+	hosts := fs.String("hosts", "localhost,127.0.0.1,::1", "comma-separated DNS names and IP addresses the certificate is for")
+	certFile := fs.String("cert", "cert.pem", "certificate output file")
+	keyFile := fs.String("key", "key.pem", "private key output file")
+	validFor := fs.Duration("valid-for", 365*24*time.Hour, "certificate lifetime")
+	force := fs.Bool("force", false, "overwrite existing files")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if *validFor <= 0 {
+		return fmt.Errorf("bad -valid-for %s: must be positive", *validFor)
+	}
+	certPEM, keyPEM, err := selfSignedCert(strings.Split(*hosts, ","), time.Now(), *validFor)
+	if err != nil {
+		return err
+	}
+	if !*force {
+		for _, f := range []string{*certFile, *keyFile} {
+			if _, err := os.Stat(f); err == nil {
+				return fmt.Errorf("%s exists (use -force to overwrite)", f)
+			}
+		}
+	}
+	if err := os.WriteFile(*certFile, certPEM, 0o644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(*keyFile, keyPEM, 0o600); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s and %s for %s, valid until %s\n", *certFile, *keyFile, *hosts, time.Now().Add(*validFor).Format(time.DateOnly))
+	fmt.Printf("clients must trust %s, e.g. bench -ca %s\n", *certFile, *certFile)
+	return nil
+}
+
+// selfSignedCert returns a PEM certificate and ECDSA P-256 key for hosts,
+// which may be DNS names or IP addresses. The certificate is its own CA, so
+// clients can trust it directly.
+func selfSignedCert(hosts []string, now time.Time, validFor time.Duration) (certPEM, keyPEM []byte, err error) {
+	tmpl := &x509.Certificate{
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		h = strings.TrimSpace(h)
+		switch {
+		case h == "":
+		case net.ParseIP(h) != nil:
+			tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(h))
+		default:
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	if len(tmpl.DNSNames)+len(tmpl.IPAddresses) == 0 {
+		return nil, nil, errors.New("no hosts to issue the certificate for")
+	}
+	tmpl.Subject = pkix.Name{Organization: []string{"h3ws2h1ws-proxy"}, CommonName: strings.TrimSpace(hosts[0])}
+	if tmpl.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128)); err != nil {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
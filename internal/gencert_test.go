@@ -0,0 +1,49 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	args := []string{"-hosts", "localhost, 127.0.0.1,proxy.test", "-cert", certFile, "-key", keyFile}
+	if err := GenCert(args); err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	for _, host := range []string{"localhost", "127.0.0.1", "proxy.test"} {
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("verify for %s: %v", host, err)
+		}
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: "other.test", Roots: roots}); err == nil {
+		t.Error("certificate verified for a host it was not issued for")
+	}
+	if fi, err := os.Stat(keyFile); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("key file mode = %v, %v; want 0600", fi.Mode().Perm(), err)
+	}
+
+	if err := GenCert(args); err == nil {
+		t.Fatal("existing files were overwritten without -force")
+	}
+	if err := GenCert(append(args, "-force")); err != nil {
+		t.Fatalf("-force: %v", err)
+	}
+	if err := GenCert([]string{"-hosts", " ,", "-cert", certFile, "-key", keyFile, "-force"}); err == nil {
+		t.Fatal("certificate issued without hosts")
+	}
+}
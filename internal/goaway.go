@@ -0,0 +1,186 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+const (
+	frameTypeGoAway = 0x7
+	// errCodeNoError is H3_NO_ERROR, used to refuse connections that
+	// arrive after GOAWAY.
+	errCodeNoError = 0x100
+)
+
+// goAwayFrame encodes an HTTP/3 GOAWAY (RFC 9114 7.2.6) with the largest
+// client bidirectional stream ID: requests the client already sent are
+// still served, but it must open new ones on another connection.
+func goAwayFrame() []byte {
+	id := uint64(quicvarint.Max) &^ 3
+	b := quicvarint.Append(nil, frameTypeGoAway)
+	b = quicvarint.Append(b, uint64(quicvarint.Len(id)))
+	return quicvarint.Append(b, id)
+}
+
+// drainer tracks client connections and in-flight requests so shutdown can
+// send GOAWAY and wait for requests to finish. quic-go's
+// Server.CloseGracefully is not implemented, so the frame is written to the
+// control stream the server opens on each connection.
+type drainer struct {
+	mu       sync.Mutex
+	conns    map[*goAwayConn]struct{}
+	draining bool
+	inflight atomic.Int64
+}
+
+// handler counts requests, including CONNECT tunnels, while they run.
+func (d *drainer) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.inflight.Add(1)
+		defer d.inflight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (d *drainer) listener(ln http3.QUICEarlyListener) http3.QUICEarlyListener {
+	return &goAwayListener{QUICEarlyListener: ln, d: d}
+}
+
+// goAway sends GOAWAY on every tracked connection and refuses connections
+// accepted afterwards. It returns the number of frames sent.
+func (d *drainer) goAway() int {
+	d.mu.Lock()
+	d.draining = true
+	conns := make([]*goAwayConn, 0, len(d.conns))
+	for c := range d.conns {
+		conns = append(conns, c)
+	}
+	d.mu.Unlock()
+	sent := 0
+	for _, c := range conns {
+		if c.goAway() {
+			sent++
+		}
+	}
+	metrics.GoAwaySent.Add(float64(sent))
+	return sent
+}
+
+// wait blocks until no request is in flight or ctx is done and reports
+// whether everything finished.
+func (d *drainer) wait(ctx context.Context) bool {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for d.inflight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+func (d *drainer) track(c *goAwayConn) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+	if d.conns == nil {
+		d.conns = make(map[*goAwayConn]struct{})
+	}
+	d.conns[c] = struct{}{}
+	return true
+}
+
+func (d *drainer) untrack(c *goAwayConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.conns, c)
+}
+
+type goAwayListener struct {
+	http3.QUICEarlyListener
+	d *drainer
+}
+
+func (l *goAwayListener) Accept(ctx context.Context) (quic.EarlyConnection, error) {
+	for {
+		conn, err := l.QUICEarlyListener.Accept(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c := &goAwayConn{EarlyConnection: conn}
+		if !l.d.track(c) {
+			_ = conn.CloseWithError(errCodeNoError, "shutting down")
+			continue
+		}
+		go func() {
+			<-conn.Context().Done()
+			l.d.untrack(c)
+		}()
+		return c, nil
+	}
+}
+
+// goAwayConn remembers the first unidirectional stream the server opens,
+// which is its HTTP/3 control stream.
+type goAwayConn struct {
+	quic.EarlyConnection
+	mu      sync.Mutex
+	control *controlStream
+	sent    bool
+}
+
+func (c *goAwayConn) OpenUniStream() (quic.SendStream, error) {
+	str, err := c.EarlyConnection.OpenUniStream()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.control != nil {
+		return str, nil
+	}
+	c.control = &controlStream{SendStream: str, conn: c}
+	return c.control, nil
+}
+
+// goAway writes GOAWAY once. A connection whose SETTINGS frame is not out
+// yet is skipped; it is closed with the server.
+func (c *goAwayConn) goAway() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.control == nil || !c.control.settingsSent || c.sent {
+		return false
+	}
+	c.sent = true
+	_, err := c.control.SendStream.Write(goAwayFrame())
+	return err == nil
+}
+
+// controlStream serializes the server's writes with goAway, since GOAWAY
+// must not precede SETTINGS.
+type controlStream struct {
+	quic.SendStream
+	conn         *goAwayConn
+	settingsSent bool
+}
+
+func (s *controlStream) Write(b []byte) (int, error) {
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	n, err := s.SendStream.Write(b)
+	s.settingsSent = true
+	return n, err
+}
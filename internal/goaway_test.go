@@ -0,0 +1,59 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+func TestGoAwayFrame(t *testing.T) {
+	r := bytes.NewReader(goAwayFrame())
+	typ, err := quicvarint.Read(r)
+	if err != nil || typ != frameTypeGoAway {
+		t.Fatalf("frame type = %d, %v", typ, err)
+	}
+	length, err := quicvarint.Read(r)
+	if err != nil || int(length) != r.Len() {
+		t.Fatalf("frame length = %d, %v; %d bytes follow", length, err, r.Len())
+	}
+	id, err := quicvarint.Read(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id%4 != 0 || id < quicvarint.Max-3 {
+		t.Fatalf("stream id = %d, want the largest client bidirectional stream id", id)
+	}
+}
+
+func TestDrainerWaitsForInflightRequests(t *testing.T) {
+	d := &drainer{}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := d.handler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		close(started)
+		<-release
+	}))
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if d.wait(ctx) {
+		t.Fatal("wait returned with a request in flight")
+	}
+
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if !d.wait(ctx) {
+		t.Fatal("wait timed out after the request finished")
+	}
+	if d.goAway() != 0 {
+		t.Fatal("goAway sent frames without connections")
+	}
+}
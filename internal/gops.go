@@ -0,0 +1,12 @@
+//go:build gops
+
+package app
+
+import "github.com/google/gops/agent"
+
+// startGops runs the gops agent so `gops stack|memstats|trace <pid>` work
+// against the proxy. It is only built with -tags gops, keeping the
+// dependency out of default builds.
+func startGops(addr string) error {
+	return agent.Listen(agent.Options{Addr: addr, ShutdownCleanup: true})
+}
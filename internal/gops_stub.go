@@ -0,0 +1,10 @@
+//go:build !gops
+
+package app
+
+import "errors"
+
+// startGops fails in default builds; see gops.go.
+func startGops(string) error {
+	return errors.New("built without gops support (rebuild with -tags gops)")
+}
@@ -0,0 +1,32 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// readyProbeTimeout bounds the backend probe /readyz makes when no session
+// dialed a backend recently.
+const readyProbeTimeout = 2 * time.Second
+
+// healthzHandler answers while the process can serve HTTP at all.
+func healthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+}
+
+// readyzHandler answers 200 while ready reports no error and 503 with the
+// reason otherwise.
+func readyzHandler(ready func(context.Context) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyProbeTimeout)
+		defer cancel()
+		if err := ready(ctx); err != nil {
+			http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+}
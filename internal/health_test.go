@@ -0,0 +1,27 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadyzHandler(t *testing.T) {
+	var readyErr error
+	h := readyzHandler(func(context.Context) error { return readyErr })
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("ready: status %d", rec.Code)
+	}
+
+	readyErr = errors.New("draining")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "draining") {
+		t.Errorf("not ready: status %d body %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,308 @@
+// Package jwks fetches a JSON Web Key Set (RFC 7517) and keeps it fresh, so
+// signing key rotation at the identity provider needs no proxy restart.
+package jwks
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	maxSetSize = 1 << 20
+
+	DefaultRefreshInterval    = time.Hour
+	DefaultMinRefreshInterval = 30 * time.Second
+)
+
+// ErrUnknownKey is returned when no key matches a kid, even after a refresh.
+var ErrUnknownKey = errors.New("jwks: unknown key id")
+
+// Key is a signature verification key from the set.
+type Key struct {
+	ID        string
+	Algorithm string // "alg" of the JWK, empty when the set does not pin it
+	Public    crypto.PublicKey
+}
+
+// Set is a cached JWKS. Keys are refreshed every RefreshInterval by Run
+// and on demand when a token names an unknown kid, at most once per
+// MinRefreshInterval so garbage kids cannot hammer the identity provider.
+// A failed refresh keeps the previous keys.
+type Set struct {
+	URL                string
+	Client             *http.Client
+	RefreshInterval    time.Duration
+	MinRefreshInterval time.Duration
+
+	// refreshMu serializes fetches; mu guards the fields below.
+	refreshMu   sync.Mutex
+	mu          sync.RWMutex
+	keys        map[string]Key
+	etag        string
+	lastAttempt time.Time
+	now         func() time.Time
+}
+
+func New(url string) *Set {
+	return &Set{URL: url}
+}
+
+// Key returns the key for kid. A token without kid matches a set holding a
+// single key.
+func (s *Set) Key(ctx context.Context, kid string) (Key, error) {
+	if k, ok := s.lookup(kid); ok {
+		return k, nil
+	}
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	// Another caller may have refreshed while we waited.
+	if k, ok := s.lookup(kid); ok {
+		return k, nil
+	}
+	s.mu.RLock()
+	recent := !s.lastAttempt.IsZero() && s.clock().Sub(s.lastAttempt) < s.minRefreshInterval()
+	s.mu.RUnlock()
+	if recent {
+		return Key{}, ErrUnknownKey
+	}
+	if err := s.refreshLocked(ctx); err != nil {
+		return Key{}, err
+	}
+	if k, ok := s.lookup(kid); ok {
+		return k, nil
+	}
+	return Key{}, ErrUnknownKey
+}
+
+func (s *Set) lookup(kid string) (Key, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if kid == "" {
+		if len(s.keys) == 1 {
+			for _, k := range s.keys {
+				return k, true
+			}
+		}
+		return Key{}, false
+	}
+	k, ok := s.keys[kid]
+	return k, ok
+}
+
+// Refresh fetches the set now.
+func (s *Set) Refresh(ctx context.Context) error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	return s.refreshLocked(ctx)
+}
+
+func (s *Set) refreshLocked(ctx context.Context) error {
+	s.mu.Lock()
+	s.lastAttempt = s.clock()
+	etag := s.etag
+	s.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("jwks fetch %s: %w", s.URL, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("jwks fetch %s: unexpected status %s", s.URL, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSetSize+1))
+	if err != nil {
+		return fmt.Errorf("jwks fetch %s: %w", s.URL, err)
+	}
+	if len(data) > maxSetSize {
+		return fmt.Errorf("jwks fetch %s: set larger than %d bytes", s.URL, maxSetSize)
+	}
+	keys, err := Parse(data)
+	if err != nil {
+		return fmt.Errorf("jwks fetch %s: %w", s.URL, err)
+	}
+	s.mu.Lock()
+	s.keys = keys
+	s.etag = resp.Header.Get("ETag")
+	s.mu.Unlock()
+	return nil
+}
+
+// Run refreshes the set every RefreshInterval until ctx is done. Errors are
+// logged and the previous keys stay in use.
+func (s *Set) Run(ctx context.Context) {
+	interval := s.RefreshInterval
+	if interval <= 0 {
+		interval = DefaultRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.Refresh(ctx); err != nil {
+			slog.Error("jwks refresh failed, keeping previous keys", "url", s.URL, "err", err)
+		}
+	}
+}
+
+func (s *Set) minRefreshInterval() time.Duration {
+	if s.MinRefreshInterval > 0 {
+		return s.MinRefreshInterval
+	}
+	return DefaultMinRefreshInterval
+}
+
+func (s *Set) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Parse decodes a JWKS document into its signature keys by kid. Encryption
+// keys and key types other than RSA, EC (P-256/384/521) and Ed25519 are
+// skipped so an IdP adding new kinds of keys does not break verification.
+func Parse(data []byte) (map[string]Key, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]Key, len(doc.Keys))
+	for i, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d (kid %q): %w", i, k.Kid, err)
+		}
+		if pub == nil {
+			continue
+		}
+		if _, dup := keys[k.Kid]; dup {
+			return nil, fmt.Errorf("duplicate kid %q", k.Kid)
+		}
+		keys[k.Kid] = Key{ID: k.Kid, Algorithm: k.Alg, Public: pub}
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e: %w", err)
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("e out of range")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		x, err := decodeFixed(k.X, size)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := decodeFixed(k.Y, size)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		return ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, x...), y...))
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := decodeFixed(k.X, ed25519.PublicKeySize)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func decodeFixed(s string, size int) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != size {
+		return nil, fmt.Errorf("want %d bytes, got %d", size, len(b))
+	}
+	return b, nil
+}
@@ -0,0 +1,146 @@
+package jwks
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func rsaJWK(t *testing.T, kid string) (map[string]string, *rsa.PublicKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := &key.PublicKey
+	return map[string]string{"kty": "RSA", "kid": kid, "alg": "RS256", "use": "sig", "n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())}, pub
+}
+
+func TestParse(t *testing.T) {
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPub, err := ec.PublicKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, rsaPub := rsaJWK(t, "r1")
+	doc, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		rsaKey,
+		{"kty": "EC", "kid": "e1", "crv": "P-256", "x": b64(ecPub[1:33]), "y": b64(ecPub[33:])},
+		{"kty": "OKP", "kid": "d1", "crv": "Ed25519", "x": b64(edPub)},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+	}})
+	keys, err := Parse(doc)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("got %d keys, want 3: %v", len(keys), keys)
+	}
+	if k := keys["r1"]; k.Algorithm != "RS256" || !rsaPub.Equal(k.Public) {
+		t.Fatalf("rsa key = %+v", k)
+	}
+	if !ec.PublicKey.Equal(keys["e1"].Public) {
+		t.Fatal("ec key mismatch")
+	}
+	if !edPub.Equal(keys["d1"].Public) {
+		t.Fatal("ed25519 key mismatch")
+	}
+
+	for _, bad := range []string{
+		`{"keys":[{"kty":"EC","kid":"x","crv":"P-256","x":"AQ","y":"AQ"}]}`,
+		`{"keys":[{"kty":"RSA","kid":"a","n":"AQAB","e":"AQAB"},{"kty":"RSA","kid":"a","n":"AQAB","e":"AQAB"}]}`,
+		`{"keys":[{"kty":"RSA","kid":"a","n":"!!","e":"AQAB"}]}`,
+	} {
+		if _, err := Parse([]byte(bad)); err == nil {
+			t.Errorf("Parse(%s) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestSetRefreshesOnUnknownKid(t *testing.T) {
+	k1, _ := rsaJWK(t, "k1")
+	k2, _ := rsaJWK(t, "k2")
+	var current atomic.Value
+	current.Store([]map[string]string{k1})
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": current.Load()})
+	}))
+	defer srv.Close()
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := New(srv.URL)
+	s.now = func() time.Time { return now }
+	ctx := context.Background()
+	if _, err := s.Key(ctx, "k1"); err != nil {
+		t.Fatalf("k1: %v", err)
+	}
+	if _, err := s.Key(ctx, ""); err != nil {
+		t.Fatalf("single key without kid: %v", err)
+	}
+
+	// The IdP rotates; the first token signed with k2 triggers a refresh
+	// once the minimum interval has passed.
+	current.Store([]map[string]string{k1, k2})
+	if _, err := s.Key(ctx, "k2"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("k2 before min interval: %v", err)
+	}
+	now = now.Add(DefaultMinRefreshInterval)
+	if _, err := s.Key(ctx, "k2"); err != nil {
+		t.Fatalf("k2 after rotation: %v", err)
+	}
+	if _, err := s.Key(ctx, "nope"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("unknown kid: %v", err)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("fetched %d times, want 2", n)
+	}
+}
+
+func TestSetKeepsKeysWhenRefreshFails(t *testing.T) {
+	k1, _ := rsaJWK(t, "k1")
+	var fail atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{k1}})
+	}))
+	defer srv.Close()
+
+	s := New(srv.URL)
+	if err := s.Refresh(context.Background()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	fail.Store(true)
+	if err := s.Refresh(context.Background()); err == nil {
+		t.Fatal("refresh against a failing server succeeded")
+	}
+	if _, err := s.Key(context.Background(), "k1"); err != nil {
+		t.Fatalf("k1 after failed refresh: %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+// Package jwt verifies signed JSON Web Tokens (RFC 7519) presented by
+// clients. Only asymmetric algorithms are accepted, so a leaked verification
+// key cannot be used to mint tokens.
+package jwt
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256" // hashes of the accepted algorithms
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/jwks"
+)
+
+// ErrInvalid wraps every reason a token is refused.
+var ErrInvalid = errors.New("jwt: invalid token")
+
+// KeySource finds the verification key for a token's kid; *jwks.Set is one.
+type KeySource interface {
+	Key(ctx context.Context, kid string) (jwks.Key, error)
+}
+
+// StaticKey is a KeySource holding a single key, used whatever kid a token
+// names.
+type StaticKey jwks.Key
+
+func (k StaticKey) Key(context.Context, string) (jwks.Key, error) {
+	return jwks.Key(k), nil
+}
+
+// LoadPublicKey reads a PEM encoded RSA, ECDSA or Ed25519 public key (or a
+// certificate carrying one).
+func LoadPublicKey(file string) (StaticKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return StaticKey{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return StaticKey{}, fmt.Errorf("%s: no PEM block", file)
+	}
+	var pub crypto.PublicKey
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return StaticKey{}, fmt.Errorf("%s: %w", file, err)
+		}
+		pub = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		if pub, err = x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+			return StaticKey{}, fmt.Errorf("%s: %w", file, err)
+		}
+	default:
+		if pub, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return StaticKey{}, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	switch pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return StaticKey{Public: pub}, nil
+	}
+	return StaticKey{}, fmt.Errorf("%s: unsupported key type %T", file, pub)
+}
+
+// Claims are the decoded claims of a verified token. Numbers are
+// json.Number.
+type Claims map[string]any
+
+// Subject returns the "sub" claim.
+func (c Claims) Subject() string {
+	s, _ := c["sub"].(string)
+	return s
+}
+
+// Has reports whether claim name carries value: a string equal to it or,
+// like OAuth scopes, listing it among space separated words, or an array
+// with an element equal to it.
+func (c Claims) Has(name, value string) bool {
+	switch v := c[name].(type) {
+	case string:
+		return v == value || slices.Contains(strings.Fields(v), value)
+	case []any:
+		for _, item := range v {
+			if fmt.Sprint(item) == value {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	default:
+		return fmt.Sprint(v) == value
+	}
+}
+
+// Verifier checks signature, expiry and, when set, issuer and audience.
+type Verifier struct {
+	Keys     KeySource
+	Issuer   string
+	Audience string
+	// Leeway tolerates clock skew on exp and nbf.
+	Leeway time.Duration
+	now    func() time.Time
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify returns the claims of token, or an error wrapping ErrInvalid (or
+// the key source's error when the key could not be fetched).
+func (v *Verifier) Verify(ctx context.Context, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a signed JWT", ErrInvalid)
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalid, err)
+	}
+	key, err := v.Keys.Key(ctx, h.Kid)
+	if err != nil {
+		if errors.Is(err, jwks.ErrUnknownKey) {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		return nil, err
+	}
+	if key.Algorithm != "" && key.Algorithm != h.Alg {
+		return nil, fmt.Errorf("%w: alg %q, key is for %q", ErrInvalid, h.Alg, key.Algorithm)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrInvalid, err)
+	}
+	if err := verifySignature(h.Alg, key.Public, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrInvalid, err)
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return claims, nil
+}
+
+func (v *Verifier) checkClaims(c Claims) error {
+	now := time.Now()
+	if v.now != nil {
+		now = v.now()
+	}
+	if exp, ok, err := numericDate(c, "exp"); err != nil {
+		return err
+	} else if ok && !now.Before(exp.Add(v.Leeway)) {
+		return errors.New("expired")
+	}
+	if nbf, ok, err := numericDate(c, "nbf"); err != nil {
+		return err
+	} else if ok && now.Add(v.Leeway).Before(nbf) {
+		return errors.New("not valid yet")
+	}
+	if v.Issuer != "" && c["iss"] != v.Issuer {
+		return fmt.Errorf("issuer %v", c["iss"])
+	}
+	if v.Audience != "" {
+		switch aud := c["aud"].(type) {
+		case string:
+			if aud != v.Audience {
+				return fmt.Errorf("audience %q", aud)
+			}
+		case []any:
+			if !slices.Contains(aud, any(v.Audience)) {
+				return fmt.Errorf("audience %v", aud)
+			}
+		default:
+			return errors.New("no audience")
+		}
+	}
+	return nil
+}
+
+func numericDate(c Claims, name string) (time.Time, bool, error) {
+	raw, ok := c[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	n, ok := raw.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("%s is not a number", name)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%s: %v", name, err)
+	}
+	return time.Unix(0, int64(f*float64(time.Second))), true, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// algorithms maps the accepted "alg" values to their digest.
+var algorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// ecdsaCurveBits is the curve size each ES algorithm is defined for.
+var ecdsaCurveBits = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+func verifySignature(alg string, pub crypto.PublicKey, signed string, sig []byte) error {
+	hash, ok := algorithms[alg]
+	if !ok {
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	if alg == "EdDSA" {
+		k, ok := pub.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(k, []byte(signed), sig) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	switch alg[:2] {
+	case "RS", "PS":
+		k, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("alg %s needs an RSA key", alg)
+		}
+		var err error
+		if alg[0] == 'R' {
+			err = rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		} else {
+			err = rsa.VerifyPSS(k, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		if err != nil {
+			return errors.New("bad signature")
+		}
+		return nil
+	default:
+		k, ok := pub.(*ecdsa.PublicKey)
+		if !ok || k.Curve.Params().BitSize != ecdsaCurveBits[alg] {
+			return fmt.Errorf("alg %s does not match the key", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("bad signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+}
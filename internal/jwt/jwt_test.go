@@ -0,0 +1,141 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/jwks"
+)
+
+func sign(t *testing.T, alg string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	h, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	default:
+		digest := sha256.Sum256([]byte(signed))
+		sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Unix(1_700_000_000, 0)
+	valid := map[string]any{"sub": "alice", "iss": "https://idp", "aud": []string{"other", "proxy"}, "exp": now.Unix() + 60, "scope": "chat read"}
+
+	for alg, key := range map[string]crypto.Signer{"RS256": rsaKey, "ES256": ecKey, "EdDSA": edKey} {
+		v := &Verifier{Keys: StaticKey{Public: key.Public()}, Issuer: "https://idp", Audience: "proxy", now: func() time.Time { return now }}
+		claims, err := v.Verify(context.Background(), sign(t, alg, key, valid))
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if claims.Subject() != "alice" || !claims.Has("scope", "chat") || claims.Has("scope", "write") || !claims.Has("aud", "proxy") {
+			t.Errorf("%s: claims %v", alg, claims)
+		}
+	}
+
+	v := &Verifier{Keys: StaticKey{Public: rsaKey.Public()}, Issuer: "https://idp", Audience: "proxy", Leeway: 10 * time.Second, now: func() time.Time { return now }}
+	bad := map[string]string{
+		"expired":     sign(t, "RS256", rsaKey, map[string]any{"iss": "https://idp", "aud": "proxy", "exp": now.Unix() - 11}),
+		"not yet":     sign(t, "RS256", rsaKey, map[string]any{"iss": "https://idp", "aud": "proxy", "nbf": now.Unix() + 11}),
+		"issuer":      sign(t, "RS256", rsaKey, map[string]any{"iss": "https://evil", "aud": "proxy"}),
+		"audience":    sign(t, "RS256", rsaKey, map[string]any{"iss": "https://idp", "aud": "other"}),
+		"wrong key":   sign(t, "EdDSA", edKey, valid),
+		"wrong alg":   sign(t, "ES256", ecKey, valid),
+		"alg none":    "eyJhbGciOiJub25lIn0.eyJzdWIiOiJhbGljZSJ9.",
+		"garbage":     "not.a.jwt",
+		"two parts":   "a.b",
+		"tampered":    sign(t, "RS256", rsaKey, valid)[:40] + "x" + sign(t, "RS256", rsaKey, valid)[41:],
+		"exp string":  sign(t, "RS256", rsaKey, map[string]any{"iss": "https://idp", "aud": "proxy", "exp": "tomorrow"}),
+		"no audience": sign(t, "RS256", rsaKey, map[string]any{"iss": "https://idp"}),
+	}
+	for name, token := range bad {
+		if _, err := v.Verify(context.Background(), token); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+	// Within the leeway.
+	if _, err := v.Verify(context.Background(), sign(t, "RS256", rsaKey, map[string]any{"iss": "https://idp", "aud": "proxy", "exp": now.Unix() - 5})); err != nil {
+		t.Errorf("token expired within the leeway: %v", err)
+	}
+
+	// A key pinned to another alg is refused.
+	pinned := &Verifier{Keys: StaticKey{Public: rsaKey.Public(), Algorithm: "PS256"}}
+	if _, err := pinned.Verify(context.Background(), sign(t, "RS256", rsaKey, nil)); !errors.Is(err, ErrInvalid) {
+		t.Errorf("alg mismatch with the JWK: %v", err)
+	}
+}
+
+type failingKeys struct{ err error }
+
+func (f failingKeys) Key(context.Context, string) (jwks.Key, error) { return jwks.Key{}, f.err }
+
+func TestVerifyKeySourceErrors(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	token := sign(t, "RS256", rsaKey, nil)
+	if _, err := (&Verifier{Keys: failingKeys{jwks.ErrUnknownKey}}).Verify(context.Background(), token); !errors.Is(err, ErrInvalid) {
+		t.Errorf("unknown kid: %v", err)
+	}
+	outage := errors.New("idp down")
+	if _, err := (&Verifier{Keys: failingKeys{outage}}).Verify(context.Background(), token); !errors.Is(err, outage) || errors.Is(err, ErrInvalid) {
+		t.Errorf("key fetch failure: %v", err)
+	}
+}
+
+func TestLoadPublicKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "jwt.pub")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	static, err := LoadPublicKey(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.PublicKey.Equal(static.Public) {
+		t.Error("loaded a different key")
+	}
+	if err := os.WriteFile(file, []byte("nope"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPublicKey(file); err == nil {
+		t.Error("garbage accepted")
+	}
+}
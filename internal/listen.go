@@ -0,0 +1,228 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/sockopt"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// listenSpec is one UDP socket of the HTTP/3 server.
+type listenSpec struct {
+	network string // udp (dual-stack), udp4 or udp6 (v6-only)
+	addr    string
+	device  string // SO_BINDTODEVICE interface, empty for any
+	dscp    int    // DSCP code point for outgoing QUIC packets, 0 leaves it unset
+}
+
+func (s listenSpec) String() string {
+	q := url.Values{}
+	if s.device != "" {
+		q.Set("device", s.device)
+	}
+	if s.dscp != 0 {
+		q.Set("dscp", strconv.Itoa(s.dscp))
+	}
+	if len(q) > 0 {
+		return s.network + "://" + s.addr + "?" + q.Encode()
+	}
+	return s.network + "://" + s.addr
+}
+
+// parseListenSpecs parses a comma separated -listen value. Each entry is
+// host:port, optionally prefixed with udp://, udp4:// or udp6:// to pick the
+// address family: udp on a wildcard IPv6 address is dual-stack (IPv4 arrives
+// v4-mapped), udp6 sets IPV6_V6ONLY and udp4 only accepts IPv4. A
+// ?device=eth1 suffix binds the socket to an interface and ?dscp=46 marks
+// its packets, overriding the defaults.
+func parseListenSpecs(value, defaultDevice string, defaultDSCP int) ([]listenSpec, error) {
+	var specs []listenSpec
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		device, dscp := defaultDevice, defaultDSCP
+		hostPort, rawQuery, hasQuery := strings.Cut(entry, "?")
+		if hasQuery {
+			q, err := url.ParseQuery(rawQuery)
+			if err != nil {
+				return nil, fmt.Errorf("listen %q: %w", entry, err)
+			}
+			for k := range q {
+				if k != "device" && k != "dscp" {
+					return nil, fmt.Errorf("listen %q: unknown option %q", entry, k)
+				}
+			}
+			if q.Has("device") {
+				device = q.Get("device")
+			}
+			if q.Has("dscp") {
+				if dscp, err = parseDSCP(q.Get("dscp")); err != nil {
+					return nil, fmt.Errorf("listen %q: %w", entry, err)
+				}
+			}
+		}
+		spec := listenSpec{network: "udp", addr: hostPort, device: device, dscp: dscp}
+		if network, addr, ok := strings.Cut(hostPort, "://"); ok {
+			switch network {
+			case "udp", "udp4", "udp6":
+			default:
+				return nil, fmt.Errorf("listen %q: network must be udp, udp4 or udp6", entry)
+			}
+			spec.network, spec.addr = network, addr
+		}
+		if _, _, err := net.SplitHostPort(spec.addr); err != nil {
+			return nil, fmt.Errorf("listen %q: %w", entry, err)
+		}
+		specs = append(specs, spec)
+	}
+	if len(specs) == 0 {
+		return nil, errors.New("no listen address")
+	}
+	return specs, nil
+}
+
+func parseDSCP(s string) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 || v > 63 {
+		return 0, fmt.Errorf("dscp must be 0-63, got %q", s)
+	}
+	return v, nil
+}
+
+// serveHTTP3 opens every listen socket before serving any of them, so a bad
+// address fails startup instead of leaving a half-bound server. It returns
+// when the first socket stops serving or, once ctx is done, after shutting
+// down: GOAWAY goes out on every client connection, drainSessions closes
+// the WebSocket sessions, and other in-flight requests get up to grace to
+// finish before the sockets close.
+func serveHTTP3(ctx context.Context, server *http3.Server, specs []listenSpec, grace time.Duration, drainSessions func()) error {
+	conns := make([]net.PacketConn, 0, len(specs))
+	for _, spec := range specs {
+		if spec.dscp != 0 && os.Getenv("QUIC_GO_DISABLE_ECN") == "" {
+			// quic-go writes the whole TOS byte per packet for ECN, which
+			// would clear the DSCP bits set on the socket.
+			slog.Info("dscp marking enabled, disabling QUIC ECN", "listen", spec)
+			_ = os.Setenv("QUIC_GO_DISABLE_ECN", "true")
+		}
+		lc := net.ListenConfig{Control: sockopt.Control(sockopt.BindToDevice(spec.device), sockopt.DSCP(spec.dscp))}
+		conn, err := lc.ListenPacket(context.Background(), spec.network, spec.addr)
+		if err != nil {
+			for _, c := range conns {
+				_ = c.Close()
+			}
+			return fmt.Errorf("listen %s: %w", spec, err)
+		}
+		conns = append(conns, conn)
+	}
+
+	d := &drainer{}
+	server.Handler = d.handler(server.Handler)
+	tlsCfg := http3.ConfigureTLSConfig(server.TLSConfig)
+	listeners := make([]http3.QUICEarlyListener, 0, len(conns))
+	for i, conn := range conns {
+		ln, err := quic.ListenEarly(conn, tlsCfg, server.QUICConfig)
+		if err != nil {
+			for _, c := range conns {
+				_ = c.Close()
+			}
+			return fmt.Errorf("listen %s: %w", specs[i], err)
+		}
+		listeners = append(listeners, d.listener(ln))
+	}
+
+	errCh := make(chan error, len(listeners))
+	var wg sync.WaitGroup
+	for i, ln := range listeners {
+		slog.Info("HTTP/3 listener bound", "listen", specs[i], "local", conns[i].LocalAddr().String())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errCh <- server.ServeListener(ln)
+		}()
+	}
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		slog.Info("shutting down: GOAWAY sent", "connections", d.goAway())
+		drainSessions()
+		waitCtx, cancel := context.WithTimeout(context.Background(), grace)
+		if !d.wait(waitCtx) {
+			slog.Warn("shutdown: requests still running", "requests", d.inflight.Load(), "after", grace)
+		}
+		cancel()
+	}
+	_ = server.Close()
+	wg.Wait()
+	for _, c := range conns {
+		_ = c.Close()
+	}
+	return err
+}
+
+// listenHTTP2 starts the RFC 8441 companion listener: HTTP/2 over TLS on
+// TCP, sharing the handler (and so routing, limits and metrics) with the
+// HTTP/3 server. Go's HTTP/2 server only advertises extended CONNECT when
+// GODEBUG=http2xconnect=1 is in the environment at process start.
+func listenHTTP2(addr string, tlsCfg *tls.Config, handler http.Handler) (*http.Server, error) {
+	if !slices.Contains(strings.Split(os.Getenv("GODEBUG"), ","), "http2xconnect=1") {
+		return nil, errors.New("HTTP/2 extended CONNECT needs GODEBUG=http2xconnect=1 in the environment")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := tlsCfg.Clone()
+	cfg.NextProtos = []string{"h2"}
+	srv := &http.Server{Handler: handler, TLSConfig: cfg, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.ServeTLS(ln, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP/2 listener stopped", "addr", addr, "err", err)
+		}
+	}()
+	return srv, nil
+}
+
+// listenHTTP1 starts a plain HTTP/1.1 listener for classic WebSocket
+// upgrades, sharing the handler with the HTTP/3 server.
+func listenHTTP1(addr string, handler http.Handler) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP/1.1 listener stopped", "addr", addr, "err", err)
+		}
+	}()
+	return srv, nil
+}
+
+// stopTCPServer shuts a companion listener down once serveHTTP3 has
+// drained the sessions, which include the ones it carried, so this only
+// waits for other requests and closes idle connections.
+func stopTCPServer(srv *http.Server, grace time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		_ = srv.Close()
+	}
+}
@@ -0,0 +1,27 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseListenSpecs(t *testing.T) {
+	got, err := parseListenSpecs(":443, udp4://0.0.0.0:443?device=eth1,udp6://[::]:8443?dscp=0", "eth0", 46)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []listenSpec{
+		{network: "udp", addr: ":443", device: "eth0", dscp: 46},
+		{network: "udp4", addr: "0.0.0.0:443", device: "eth1", dscp: 46},
+		{network: "udp6", addr: "[::]:8443", device: "eth0"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	for _, bad := range []string{"", "tcp://:443", "udp4://0.0.0.0", "localhost", ":443?iface=eth0", ":443?dscp=64"} {
+		if _, err := parseListenSpecs(bad, "", 0); err == nil {
+			t.Errorf("parseListenSpecs(%q) succeeded", bad)
+		}
+	}
+}
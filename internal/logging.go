@@ -0,0 +1,46 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/proxy"
+)
+
+// setupLogging installs the process logger for -log-level and -log-format
+// and returns its level, which the admin API can change. -debug lowers the
+// level to debug.
+func setupLogging(cfg config.Config, w io.Writer) (*slog.LevelVar, error) {
+	level, err := proxy.ParseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, fmt.Errorf("bad -log-level: %w", err)
+	}
+	if cfg.Debug {
+		level = min(level, slog.LevelDebug)
+	}
+	lv := new(slog.LevelVar)
+	lv.Set(level)
+	opts := &slog.HandlerOptions{Level: lv}
+	var h slog.Handler
+	switch cfg.LogFormat {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("bad -log-format %q: want text or json", cfg.LogFormat)
+	}
+	slog.SetDefault(slog.New(h))
+	return lv, nil
+}
+
+// debugf logs a formatted debug message, for the QUIC and HTTP tracing
+// that has no natural attributes.
+func debugf(format string, args ...any) {
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		slog.Debug(fmt.Sprintf(format, args...))
+	}
+}
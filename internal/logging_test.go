@@ -0,0 +1,46 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"h3ws2h1ws-proxy/internal/config"
+)
+
+func TestSetupLogging(t *testing.T) {
+	prev := slog.Default()
+	defer slog.SetDefault(prev)
+
+	var buf bytes.Buffer
+	level, err := setupLogging(config.Config{LogLevel: "warn", LogFormat: "json"}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.Info("hidden")
+	slog.Warn("shown", "n", 1)
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("%v: %q", err, buf.String())
+	}
+	if rec["msg"] != "shown" || rec["level"] != "WARN" || rec["n"] != 1.0 {
+		t.Errorf("record %v", rec)
+	}
+
+	buf.Reset()
+	level.Set(slog.LevelDebug)
+	debugf("quic conn_id=%s", "x")
+	if !bytes.Contains(buf.Bytes(), []byte(`"msg":"quic conn_id=x"`)) {
+		t.Errorf("debug line after level change: %q", buf.String())
+	}
+
+	if level, _ := setupLogging(config.Config{LogLevel: "error", LogFormat: "text", Debug: true}, &buf); level.Level() != slog.LevelDebug {
+		t.Errorf("-debug level = %s", level.Level())
+	}
+	for _, cfg := range []config.Config{{LogLevel: "trace", LogFormat: "text"}, {LogLevel: "info", LogFormat: "xml"}} {
+		if _, err := setupLogging(cfg, &buf); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
@@ -36,24 +36,57 @@ var (
 		Help: "WebSocket frames forwarded by direction and opcode",
 	}, []string{"dir", "opcode"})
 	MessageSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name:    "h3ws_proxy_message_size_bytes",
-		Help:    "Observed message size by direction and type",
-		Buckets: []float64{64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536, 131072, 262144, 524288, 1048576, 2097152, 4194304},
+		Name: "h3ws_proxy_message_size_bytes",
+		Help: "Forwarded message size by direction and type",
+		// Up to well past the default -max-message (8 MiB), so quantiles
+		// near the limit stay meaningful.
+		Buckets: []float64{64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536, 131072, 262144, 524288, 1048576, 2097152, 4194304, 8388608, 16777216, 33554432},
 	}, []string{"dir", "type"})
 	SessionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Name:    "h3ws_proxy_session_duration_seconds",
 		Help:    "Proxy session lifetime in seconds",
 		Buckets: []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60, 120, 300, 600, 1800, 3600},
 	})
+	HandshakeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "h3ws_proxy_handshake_duration_seconds",
+		Help:    "Time from receiving a CONNECT to accepting the tunnel, by route",
+		Buckets: []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"route"})
+	BackendDialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "h3ws_proxy_backend_dial_duration_seconds",
+		Help:    "Latency of backend WebSocket dials including the handshake, by result (ok, error)",
+		Buckets: []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"result"})
 	SessionTrafficBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "h3ws_proxy_session_traffic_bytes",
 		Help:    "Total bytes transferred per session by direction",
 		Buckets: []float64{512, 1024, 2048, 4096, 8192, 16384, 32768, 65536, 131072, 262144, 524288, 1048576, 2097152, 4194304, 8388608, 16777216, 33554432, 67108864, 134217728},
 	}, []string{"dir"})
+	DeflateBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_client_deflate_bytes_total",
+		Help: "Message bytes before and after client-side permessage-deflate by direction",
+	}, []string{"dir", "form"})
+	CompressionRatio = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "h3ws_proxy_compression_ratio",
+		Help:    "Compressed/raw size of permessage-deflate messages by side and direction",
+		Buckets: []float64{0.05, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1, 1.1},
+	}, []string{"side", "dir"})
+	MessageViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_message_violations_total",
+		Help: "Client messages that failed route validation by route and applied policy",
+	}, []string{"route", "policy"})
 	Ctrl = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "h3ws_proxy_control_frames_total",
 		Help: "Control frames observed",
 	}, []string{"type"})
+	CloseCodes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_close_codes_total",
+		Help: "Close codes sent by each side of finished sessions",
+	}, []string{"side", "code"})
+	CloseTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_close_timeouts_total",
+		Help: "Close handshakes cut short after -close-timeout, by the side that did not reply",
+	}, []string{"side"})
 	OversizeDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "h3ws_proxy_oversize_drops_total",
 		Help: "Dropped frames/messages due to size limits",
@@ -62,6 +95,209 @@ var (
 		Name: "h3ws_proxy_prerequest_close_total",
 		Help: "QUIC connections closed before any HTTP request reached handler",
 	}, []string{"reason"})
+	CertNotAfter = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "h3ws_proxy_cert_not_after_timestamp_seconds",
+		Help: "Expiry (NotAfter) of loaded TLS certificates as unix timestamp",
+	}, []string{"file", "subject"})
+	Resumes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_resumes_total",
+		Help: "Client session resume attempts by result",
+	}, []string{"result"})
+	BackendReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_backend_reconnects_total",
+		Help: "Transparent backend reconnection attempts by result",
+	}, []string{"result"})
+	TenantActiveSessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "h3ws_proxy_tenant_active_sessions",
+		Help: "Number of active proxy sessions by tenant",
+	}, []string{"tenant"})
+	TenantAccepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_tenant_accepted_total",
+		Help: "Accepted RFC9220 sessions by tenant",
+	}, []string{"tenant"})
+	TenantRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_tenant_rejected_total",
+		Help: "Rejected requests by tenant and reason",
+	}, []string{"tenant", "reason"})
+	TenantBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_tenant_bytes_total",
+		Help: "Bytes forwarded by tenant and direction, added when sessions end",
+	}, []string{"tenant", "dir"})
+	TagBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_tag_bytes_total",
+		Help: "Bytes forwarded by connection tag and direction, added when sessions end",
+	}, []string{"tag", "dir"})
+	TagMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_tag_messages_total",
+		Help: "Messages forwarded by connection tag and direction, added when sessions end",
+	}, []string{"tag", "dir"})
+	RouteActiveSessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "h3ws_proxy_route_active_sessions",
+		Help: "Number of active proxy sessions by route",
+	}, []string{"route"})
+	BackendActiveSessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "h3ws_proxy_backend_active_sessions",
+		Help: "Number of active proxy sessions by backend pool and member",
+	}, []string{"pool", "backend"})
+	BackendHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "h3ws_proxy_backend_healthy",
+		Help: "Health check state of backend pool members (1 = healthy)",
+	}, []string{"pool", "backend"})
+	BackendEjections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_backend_ejections_total",
+		Help: "Backend pool members ejected by outlier detection, by reason",
+	}, []string{"pool", "backend", "reason"})
+	BackendDialTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "h3ws_proxy_backend_dial_timeouts_total",
+		Help: "Backend dials that timed out",
+	})
+	BackendProxyFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_backend_proxy_failures_total",
+		Help: "Backend connections the egress proxy could not open, by reason (unreachable, auth, refused)",
+	}, []string{"reason"})
+	BackendResolutions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_backend_resolutions_total",
+		Help: "Backend host name resolutions by result",
+	}, []string{"result"})
+	DiscoveryRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_discovery_refreshes_total",
+		Help: "SRV re-resolutions of backend pools by pool and result",
+	}, []string{"pool", "result"})
+	BackendDialRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "h3ws_proxy_backend_dial_retries_total",
+		Help: "Backend dials retried against another pool member",
+	})
+	RouteRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_route_rejected_total",
+		Help: "Requests rejected by a route policy, by route and reason",
+	}, []string{"route", "reason"})
+	AdmissionQueue = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_admission_queue_total",
+		Help: "CONNECTs that hit a session cap with queueing enabled, by outcome (admitted, timeout, full)",
+	}, []string{"result"})
+	AdmissionQueueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "h3ws_proxy_admission_queue_length",
+		Help: "CONNECTs currently waiting for a session slot",
+	})
+	AdmissionWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "h3ws_proxy_admission_wait_seconds",
+		Help:    "Time queued CONNECTs waited before being admitted",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	})
+	ShedSessions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_shed_sessions_total",
+		Help: "Sessions closed with 1013 to admit higher priority traffic, by shed session priority",
+	}, []string{"priority"})
+	IdleShed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_idle_shed_sessions_total",
+		Help: "Longest-idle sessions closed with 1013 by budget that was exceeded (connections, memory)",
+	}, []string{"reason"})
+	PingRTT = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "h3ws_proxy_ping_rtt_seconds",
+		Help:    "Round trip time of proxy-originated pings by side (client, backend)",
+		Buckets: []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"side"})
+	ReapedSessions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "h3ws_proxy_reaped_sessions_total",
+		Help: "Sessions closed by the stale session reaper after carrying no traffic",
+	})
+	MessageRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_message_rate_limited_total",
+		Help: "Client messages over the per-session message rate, by action taken (close, throttle)",
+	}, []string{"action"})
+	Backpressure = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_backpressure_seconds_total",
+		Help: "Time pumps stopped reading because the other side could not take more data, by direction",
+	}, []string{"dir"})
+	ThrottleWait = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_throttle_wait_seconds_total",
+		Help: "Time pumps spent waiting for bandwidth limits, by direction",
+	}, []string{"dir"})
+	IdleTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "h3ws_proxy_idle_timeouts_total",
+		Help: "Sessions closed after carrying no data messages for -idle-timeout",
+	})
+	KeepaliveTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_keepalive_timeouts_total",
+		Help: "Sessions closed because one side stopped answering keepalive pings",
+	}, []string{"side"})
+	GoAwaySent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "h3ws_proxy_goaway_sent_total",
+		Help: "HTTP/3 GOAWAY frames sent to client connections during shutdown",
+	})
+	RateLimitBackendErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "h3ws_proxy_ratelimit_backend_errors_total",
+		Help: "Shared rate limit store errors (requests fell back to local limiting)",
+	})
+	UsageExports = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_usage_exports_total",
+		Help: "Usage record exports by result (ok, empty, error)",
+	}, []string{"result"})
+	ChaosFaults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_chaos_faults_total",
+		Help: "Faults injected by chaos mode by kind (delay, drop, truncate, close, dial_failure)",
+	}, []string{"fault"})
+	ConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_config_reloads_total",
+		Help: "Runtime config updates by source and result",
+	}, []string{"source", "result"})
+	ExtAuthRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_ext_auth_requests_total",
+		Help: "External authorization checks by result (allowed, denied, error, cached)",
+	}, []string{"result"})
+	ExtAuthDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "h3ws_proxy_ext_auth_duration_seconds",
+		Help:    "Latency of external authorization subrequests",
+		Buckets: []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	})
+	PolicyDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_policy_decisions_total",
+		Help: "Open Policy Agent session decisions by result (allow, deny, error)",
+	}, []string{"result"})
+	PolicyDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "h3ws_proxy_policy_duration_seconds",
+		Help:    "Latency of Open Policy Agent queries",
+		Buckets: []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	})
+	QUICConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "h3ws_proxy_quic_connections",
+		Help: "Open QUIC connections",
+	})
+	QUICPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "h3ws_proxy_quic_packets_total",
+		Help: "QUIC packets by event (sent, received, lost, dropped)",
+	}, []string{"event"})
+	QUICSmoothedRTT = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "h3ws_proxy_quic_smoothed_rtt_seconds",
+		Help:    "Smoothed RTT of open QUIC connections, one observation per connection per sample",
+		Buckets: []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	})
+	QUICCongestionWindow = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "h3ws_proxy_quic_congestion_window_bytes",
+		Help:    "Congestion window of open QUIC connections, one observation per connection per sample",
+		Buckets: prometheus.ExponentialBuckets(2048, 2, 14),
+	})
+	QUICPathMTU = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "h3ws_proxy_quic_path_mtu_bytes",
+		Help:    "Discovered path MTU of open QUIC connections, one observation per connection per sample",
+		Buckets: []float64{1200, 1250, 1300, 1350, 1400, 1450, 1500},
+	})
+	BuildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "h3ws_proxy_build_info",
+		Help: "Always 1; labels carry the proxy version, VCS commit and Go version",
+	}, []string{"version", "commit", "go_version"})
+	LimitMaxConns = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "h3ws_proxy_limit_max_conns",
+		Help: "Effective global session cap (0 = unlimited)",
+	})
+	LimitMaxMessageBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "h3ws_proxy_limit_max_message_bytes",
+		Help: "Effective maximum reassembled message size",
+	})
+	LimitMaxFrameBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "h3ws_proxy_limit_max_frame_bytes",
+		Help: "Effective maximum frame payload size",
+	})
 	GoMemAllocBytes = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "h3ws_proxy_go_mem_alloc_bytes",
 		Help: "Bytes of allocated heap objects",
@@ -96,8 +332,16 @@ func init() {
 	prometheus.MustRegister(
 		ActiveSessions, Accepted, Rejected, Errors,
 		Bytes, Messages, Frames, MessageSize,
-		SessionDuration, SessionTrafficBytes,
-		Ctrl, OversizeDrops, PreRequestClose,
+		SessionDuration, HandshakeDuration, BackendDialDuration, SessionTrafficBytes,
+		DeflateBytes, CompressionRatio, MessageViolations, Ctrl, CloseCodes, CloseTimeouts, OversizeDrops, PreRequestClose, CertNotAfter,
+		Resumes, BackendReconnects,
+		TenantActiveSessions, TenantAccepted, TenantRejected, TenantBytes, TagBytes, TagMessages,
+		RouteActiveSessions, RouteRejected, BackendActiveSessions, BackendHealthy, BackendEjections, BackendDialRetries, BackendDialTimeouts, BackendProxyFailures, BackendResolutions, DiscoveryRefreshes,
+		AdmissionQueue, AdmissionQueueLength, AdmissionWait, ShedSessions, IdleShed, ReapedSessions, MessageRateLimited, Backpressure, ThrottleWait, IdleTimeouts, KeepaliveTimeouts, PingRTT, GoAwaySent,
+		RateLimitBackendErrors, ConfigReloads, UsageExports, ChaosFaults,
+		ExtAuthRequests, ExtAuthDuration, PolicyDecisions, PolicyDuration,
+		BuildInfo, LimitMaxConns, LimitMaxMessageBytes, LimitMaxFrameBytes,
+		QUICConnections, QUICPackets, QUICSmoothedRTT, QUICCongestionWindow, QUICPathMTU,
 		GoMemAllocBytes, GoHeapInuseBytes, GoHeapIdleBytes,
 		GoHeapReleasedBytes, GoMemSysBytes,
 		GoGCLastPauseSeconds, GoGCCyclesTotal,
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogFields are the fields of an access log record, in output order.
+// "in" is client to backend, "out" backend to client; a close code of 0
+// means that side sent no close frame.
+var AccessLogFields = []string{
+	"time", "session", "client_ip", "host", "path", "route", "tenant", "identity",
+	"subprotocol", "backend", "duration_ms", "bytes_in", "bytes_out",
+	"messages_in", "messages_out", "client_close_code", "backend_close_code",
+	"labels", "error",
+}
+
+// AccessLog writes one line per completed session, as JSON or as
+// logfmt-style key=value text.
+type AccessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	text   bool
+	fields []string
+}
+
+// NewAccessLog returns an access log writing format ("json" or "text")
+// records with fields (nil = all of AccessLogFields) to w.
+func NewAccessLog(w io.Writer, format string, fields []string) (*AccessLog, error) {
+	if format != "json" && format != "text" {
+		return nil, fmt.Errorf("unknown format %q: want json or text", format)
+	}
+	if len(fields) == 0 {
+		fields = AccessLogFields
+	}
+	for _, f := range fields {
+		if !slices.Contains(AccessLogFields, f) {
+			return nil, fmt.Errorf("unknown field %q", f)
+		}
+	}
+	return &AccessLog{w: w, text: format == "text", fields: fields}, nil
+}
+
+func (l *AccessLog) write(rec map[string]any) {
+	var b bytes.Buffer
+	if !l.text {
+		b.WriteByte('{')
+	}
+	first := true
+	for _, f := range l.fields {
+		v, ok := rec[f]
+		if !ok {
+			continue
+		}
+		if !first {
+			if l.text {
+				b.WriteByte(' ')
+			} else {
+				b.WriteByte(',')
+			}
+		}
+		first = false
+		if l.text {
+			b.WriteString(f)
+			b.WriteByte('=')
+			b.WriteString(textValue(v))
+			continue
+		}
+		name, _ := json.Marshal(f)
+		value, err := json.Marshal(v)
+		if err != nil {
+			value = []byte(strconv.Quote(fmt.Sprint(v)))
+		}
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	if !l.text {
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(b.Bytes())
+}
+
+func textValue(v any) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case map[string]string:
+		s = formatLabels(v)
+	default:
+		return fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \"=\\\n\t") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"h3ws2h1ws-proxy/internal/config"
+)
+
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	if _, err := NewAccessLog(&bytes.Buffer{}, "xml", nil); err == nil {
+		t.Error("unknown format accepted")
+	}
+	if _, err := NewAccessLog(&bytes.Buffer{}, "json", []string{"path", "nope"}); err == nil {
+		t.Error("unknown field accepted")
+	}
+	rec := map[string]any{"path": "/chat room", "bytes_in": uint64(12), "session": "ab", "labels": map[string]string{"team": "blue"}}
+	var b bytes.Buffer
+	l, _ := NewAccessLog(&b, "text", []string{"session", "path", "bytes_in", "labels", "error"})
+	l.write(rec)
+	if got, want := b.String(), `session=ab path="/chat room" bytes_in=12 labels="team=\"blue\""`+"\n"; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+	b.Reset()
+	l, _ = NewAccessLog(&b, "json", []string{"session", "path", "bytes_in", "labels"})
+	l.write(rec)
+	if got, want := b.String(), `{"session":"ab","path":"/chat room","bytes_in":12,"labels":{"team":"blue"}}`+"\n"; got != want {
+		t.Errorf("json = %q, want %q", got, want)
+	}
+}
+
+func TestAccessLogSession(t *testing.T) {
+	backendURL, closeBackend := startEchoBackend(t)
+	defer closeBackend()
+	backend, _ := url.Parse(backendURL)
+	var out lockedBuffer
+	accessLog, err := NewAccessLog(&out, "json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{
+		Backend:   backend,
+		Limits:    config.Limits{MaxFrameSize: 1 << 20, MaxMessageSize: 1 << 20, MaxConns: 10, WriteTimeout: 5 * time.Second},
+		AccessLog: accessLog,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(p.HandleH3WebSocket))
+	defer srv.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?token=secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"), time.Now().Add(time.Second))
+	c.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for out.String() == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("no access log record")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var rec map[string]any
+	if err := json.Unmarshal([]byte(out.String()), &rec); err != nil {
+		t.Fatalf("%v: %s", err, out.String())
+	}
+	for field, want := range map[string]any{
+		"path": "/ws", "client_ip": "127.0.0.1", "route": "default", "backend": backendURL + "/ws",
+		"bytes_in": 5.0, "bytes_out": 5.0, "messages_in": 1.0, "messages_out": 1.0, "client_close_code": 1000.0, "backend_close_code": 1000.0,
+	} {
+		if rec[field] != want {
+			t.Errorf("%s = %v, want %v", field, rec[field], want)
+		}
+	}
+	if _, ok := rec["error"]; ok {
+		t.Errorf("clean session logged an error: %v", rec["error"])
+	}
+}
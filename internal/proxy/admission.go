@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+// sessionGate counts sessions against a cap. When admission queueing is
+// enabled, CONNECTs that hit the cap wait in a bounded FIFO and a released
+// slot is handed directly to the oldest waiter, so new arrivals cannot
+// overtake queued ones.
+type sessionGate struct {
+	mu      sync.Mutex
+	active  int64
+	waiters list.List // of chan struct{}
+}
+
+// acquire takes a slot under limit, waiting up to q.Wait for one when the
+// gate is full and the queue has room.
+func (g *sessionGate) acquire(ctx context.Context, limit int64, q config.Admission) bool {
+	g.mu.Lock()
+	// Slots freed by a raised limit go to the queue before this arrival.
+	g.grant(limit)
+	if g.active < limit && g.waiters.Len() == 0 {
+		g.active++
+		g.mu.Unlock()
+		return true
+	}
+	if q.Wait <= 0 || g.waiters.Len() >= q.MaxQueue {
+		g.mu.Unlock()
+		if q.Wait > 0 {
+			metrics.AdmissionQueue.WithLabelValues("full").Inc()
+		}
+		return false
+	}
+	ready := make(chan struct{})
+	el := g.waiters.PushBack(ready)
+	metrics.AdmissionQueueLength.Inc()
+	g.mu.Unlock()
+	defer metrics.AdmissionQueueLength.Dec()
+
+	started := time.Now()
+	timer := time.NewTimer(q.Wait)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		metrics.AdmissionQueue.WithLabelValues("admitted").Inc()
+		metrics.AdmissionWait.Observe(time.Since(started).Seconds())
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	select {
+	case <-ready:
+		// A slot was handed over while the wait expired; keep it.
+		metrics.AdmissionQueue.WithLabelValues("admitted").Inc()
+		metrics.AdmissionWait.Observe(time.Since(started).Seconds())
+		return true
+	default:
+	}
+	g.waiters.Remove(el)
+	metrics.AdmissionQueue.WithLabelValues("timeout").Inc()
+	return false
+}
+
+// release frees a slot, or passes it on to the oldest waiter when the gate
+// is still within limit (the limit may have been lowered meanwhile).
+func (g *sessionGate) release(limit int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if front := g.waiters.Front(); front != nil && g.active <= limit {
+		g.waiters.Remove(front)
+		close(front.Value.(chan struct{}))
+		return
+	}
+	g.active--
+	g.grant(limit)
+}
+
+// setLimit hands the slots a raised limit frees to queued waiters, which
+// would otherwise only be woken by a release.
+func (g *sessionGate) setLimit(limit int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.grant(limit)
+}
+
+// grant admits waiters in order while the gate is under limit. g.mu must
+// be held.
+func (g *sessionGate) grant(limit int64) {
+	for g.active < limit {
+		front := g.waiters.Front()
+		if front == nil {
+			return
+		}
+		g.waiters.Remove(front)
+		g.active++
+		close(front.Value.(chan struct{}))
+	}
+}
+
+var noQueue config.Admission
+
+func (g *sessionGate) count() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.active
+}
+
+// unlimited maps a zero cap to "no cap" for gates where zero means unset.
+func unlimited(limit int64) int64 {
+	if limit <= 0 {
+		return math.MaxInt64
+	}
+	return limit
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+)
+
+func TestSessionGateQueue(t *testing.T) {
+	var g sessionGate
+	ctx := context.Background()
+	q := config.Admission{Wait: 2 * time.Second, MaxQueue: 1}
+
+	if !g.acquire(ctx, 1, q) {
+		t.Fatal("first acquire failed")
+	}
+
+	admitted := make(chan bool, 1)
+	go func() { admitted <- g.acquire(ctx, 1, q) }()
+	waitForWaiters(t, &g, 1)
+
+	// The queue holds one waiter; the next CONNECT is rejected right away.
+	if g.acquire(ctx, 1, q) {
+		t.Fatal("acquire succeeded with a full queue")
+	}
+
+	g.release(1)
+	if !<-admitted {
+		t.Fatal("queued CONNECT was not admitted after release")
+	}
+	g.mu.Lock()
+	active := g.active
+	g.mu.Unlock()
+	if active != 1 {
+		t.Fatalf("active = %d after hand-over, want 1", active)
+	}
+}
+
+func TestSessionGateQueueTimeout(t *testing.T) {
+	var g sessionGate
+	ctx := context.Background()
+	q := config.Admission{Wait: 20 * time.Millisecond, MaxQueue: 10}
+
+	if !g.acquire(ctx, 1, q) {
+		t.Fatal("first acquire failed")
+	}
+	start := time.Now()
+	if g.acquire(ctx, 1, q) {
+		t.Fatal("acquire succeeded over the cap")
+	}
+	if time.Since(start) < q.Wait {
+		t.Fatal("rejected before the queue wait elapsed")
+	}
+	waitForWaiters(t, &g, 0)
+
+	g.release(1)
+	if !g.acquire(ctx, 1, config.Admission{}) {
+		t.Fatal("slot not freed")
+	}
+}
+
+func TestSessionGateRaisedLimitAdmitsWaiters(t *testing.T) {
+	var g sessionGate
+	ctx := context.Background()
+	q := config.Admission{Wait: 2 * time.Second, MaxQueue: 10}
+
+	if !g.acquire(ctx, 1, q) {
+		t.Fatal("first acquire failed")
+	}
+	admitted := make(chan bool, 2)
+	for range 2 {
+		go func() { admitted <- g.acquire(ctx, 1, q) }()
+	}
+	waitForWaiters(t, &g, 2)
+
+	// Raising the cap wakes the queue without any session ending.
+	g.setLimit(3)
+	for range 2 {
+		if !<-admitted {
+			t.Fatal("queued CONNECT was not admitted after the limit was raised")
+		}
+	}
+
+	// A later arrival also drains the queue before taking a slot itself.
+	go func() { admitted <- g.acquire(ctx, 3, q) }()
+	waitForWaiters(t, &g, 1)
+	if !g.acquire(ctx, 5, q) {
+		t.Fatal("acquire under the raised limit failed")
+	}
+	if !<-admitted {
+		t.Fatal("queued CONNECT was overtaken")
+	}
+	if got := g.count(); got != 5 {
+		t.Fatalf("active = %d, want 5", got)
+	}
+}
+
+func waitForWaiters(t *testing.T, g *sessionGate, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		g.mu.Lock()
+		got := g.waiters.Len()
+		g.mu.Unlock()
+		if got == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("waiters did not reach %d", n)
+}
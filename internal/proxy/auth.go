@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"h3ws2h1ws-proxy/internal/jwt"
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+// Auth requires a valid JWT on every CONNECT.
+type Auth struct {
+	Verifier *jwt.Verifier
+	// Query names a query parameter that may carry the token for clients
+	// that cannot set Authorization (empty = the header only). It is
+	// removed from the URL forwarded to the backend.
+	Query string
+	// PriorityClaim names a claim whose value (low, normal or high) sets
+	// the session's priority class over the route's and tenant's.
+	PriorityClaim string
+}
+
+// token returns the bearer token of r and whether it came from the query.
+func (a *Auth) token(r *http.Request) (string, bool) {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token), false
+	}
+	if a.Query != "" {
+		return r.URL.Query().Get(a.Query), true
+	}
+	return "", false
+}
+
+// authenticate verifies the token of r against Auth and picks the tenant,
+// which may match on the token's claims. A tenant with its own Auth then
+// has the token verified by that one too, and a route scoped to another
+// tenant is refused. The claims are stored in sess. It answers the CONNECT
+// and returns false when the session may not proceed.
+func (p *Proxy) authenticate(w http.ResponseWriter, rt *RuntimeConfig, route *Route, r *http.Request, sess *session) (*Tenant, bool) {
+	var queries []string
+	if p.Auth != nil {
+		fromQuery, ok := p.verifyToken(w, rt, route, r, sess, p.Auth)
+		if !ok {
+			return nil, false
+		}
+		if fromQuery {
+			queries = append(queries, p.Auth.Query)
+		}
+	}
+	tenant := rt.matchTenant(r, sess.claims)
+	if tenant != nil && tenant.Auth != nil {
+		fromQuery, ok := p.verifyToken(w, rt, route, r, sess, tenant.Auth)
+		if !ok {
+			rejectTenant(tenant, "auth")
+			return nil, false
+		}
+		if fromQuery {
+			queries = append(queries, tenant.Auth.Query)
+		}
+	}
+	if len(queries) > 0 {
+		u := *r.URL
+		q := u.Query()
+		for _, name := range queries {
+			q.Del(name)
+		}
+		u.RawQuery = q.Encode()
+		r.URL = &u
+	}
+	if route != nil && route.Tenant != "" && route.Tenant != tenantName(tenant) {
+		metrics.Rejected.WithLabelValues("acl").Inc()
+		rejectRoute(route, "acl")
+		rejectTenant(tenant, "acl")
+		rt.reject(w, route, "acl", http.StatusForbidden, "route belongs to another tenant")
+		return nil, false
+	}
+	if route != nil {
+		for name, value := range route.Claims {
+			if !sess.claims.Has(name, value) {
+				metrics.Rejected.WithLabelValues("acl").Inc()
+				rejectRoute(route, "acl")
+				rejectTenant(tenant, "acl")
+				rt.reject(w, route, "acl", http.StatusForbidden, "token does not grant this route")
+				return nil, false
+			}
+		}
+	}
+	return tenant, true
+}
+
+// verifyToken checks the token of r against a and stores its claims in sess.
+// It reports whether the token came from the query.
+func (p *Proxy) verifyToken(w http.ResponseWriter, rt *RuntimeConfig, route *Route, r *http.Request, sess *session, a *Auth) (bool, bool) {
+	token, fromQuery := a.token(r)
+	if token == "" {
+		rejectAuth(w, rt, route, "missing bearer token")
+		return false, false
+	}
+	claims, err := a.Verifier.Verify(r.Context(), token)
+	if err != nil {
+		if !errors.Is(err, jwt.ErrInvalid) {
+			slog.Error("cannot verify JWTs", "session", sess.id, "err", err)
+			metrics.Rejected.WithLabelValues("auth").Inc()
+			rejectRoute(route, "auth")
+			rt.reject(w, route, "auth", http.StatusServiceUnavailable, "authentication unavailable")
+			return false, false
+		}
+		sess.debugf("auth: token refused: remote=%s err=%v", r.RemoteAddr, err)
+		rejectAuth(w, rt, route, "invalid bearer token")
+		return false, false
+	}
+	sess.claims = claims
+	if a.PriorityClaim != "" {
+		class, _ := claims[a.PriorityClaim].(string)
+		sess.setIdentityPriority("auth: "+a.PriorityClaim+" claim", class)
+	}
+	if p.Usage != nil && p.UsageIdentity.Header == "" && claims.Subject() != "" {
+		sess.identity = p.UsageIdentity.label(claims.Subject())
+	}
+	return fromQuery, true
+}
+
+func rejectAuth(w http.ResponseWriter, rt *RuntimeConfig, route *Route, body string) {
+	metrics.Rejected.WithLabelValues("auth").Inc()
+	rejectRoute(route, "auth")
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	rt.reject(w, route, "auth", http.StatusUnauthorized, body)
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/jwt"
+)
+
+func signEdDSA(key ed25519.PrivateKey, claims map[string]any) string {
+	h, _ := json.Marshal(map[string]string{"alg": "EdDSA"})
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(signed)))
+}
+
+func TestAuth(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	queries := make(chan string, 10)
+	upgrader := websocket.Upgrader{}
+	backendSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.RawQuery + " user=" + r.Header.Get("X-User")
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer backendSrv.Close()
+	backend, _ := url.Parse("ws" + strings.TrimPrefix(backendSrv.URL, "http"))
+
+	headers, err := NewHeaderTemplates(map[string]string{"X-User": "{{.Claims.sub}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := config.Limits{MaxFrameSize: 1 << 20, MaxMessageSize: 1 << 20, MaxConns: 10, WriteTimeout: 5 * time.Second}
+	p := &Proxy{
+		Backend:    backend,
+		PathRegexp: regexp.MustCompile(`^/(ws|admin)$`),
+		Limits:     limits,
+		Auth: &Auth{
+			Verifier: &jwt.Verifier{Keys: jwt.StaticKey{Public: pub}, Audience: "proxy"},
+			Query:    "access_token",
+		},
+	}
+	admin := &Route{Name: "admin", Path: regexp.MustCompile(`^/admin$`), Claims: map[string]string{"scope": "admin"}}
+	p.SetRuntimeConfig(&RuntimeConfig{Limits: limits, Routes: []*Route{admin}, BackendHeaders: headers})
+	srv := httptest.NewServer(http.HandlerFunc(p.HandleH3WebSocket))
+	defer srv.Close()
+	base := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	exp := time.Now().Add(time.Hour).Unix()
+	user := signEdDSA(priv, map[string]any{"sub": "alice", "aud": "proxy", "exp": exp, "scope": "chat"})
+	dial := func(path string, header http.Header) (*websocket.Conn, *http.Response, error) {
+		c, resp, err := websocket.DefaultDialer.Dial(base+path, header)
+		if err == nil {
+			_ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			c.Close()
+		}
+		return c, resp, err
+	}
+
+	for name, header := range map[string]http.Header{
+		"missing":  nil,
+		"expired":  {"Authorization": {"Bearer " + signEdDSA(priv, map[string]any{"aud": "proxy", "exp": time.Now().Add(-time.Hour).Unix()})}},
+		"audience": {"Authorization": {"Bearer " + signEdDSA(priv, map[string]any{"aud": "other"})}},
+		"scheme":   {"Authorization": {"Basic " + user}},
+	} {
+		_, resp, err := dial("/ws", header)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("%s: resp=%v err=%v", name, resp, err)
+		}
+	}
+
+	if _, _, err := dial("/ws", http.Header{"Authorization": {"Bearer " + user}}); err != nil {
+		t.Fatalf("valid header token: %v", err)
+	}
+	if got := <-queries; got != " user=alice" {
+		t.Errorf("backend saw %q", got)
+	}
+	// A query token is not passed on to the backend.
+	if _, _, err := dial("/ws?room=1&access_token="+user, nil); err != nil {
+		t.Fatalf("valid query token: %v", err)
+	}
+	if got := <-queries; got != "room=1 user=alice" {
+		t.Errorf("backend saw %q", got)
+	}
+
+	if _, resp, err := dial("/admin", http.Header{"Authorization": {"Bearer " + user}}); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("route claims not enforced: resp=%v err=%v", resp, err)
+	}
+	adminToken := signEdDSA(priv, map[string]any{"sub": "root", "aud": "proxy", "scope": "chat admin"})
+	if _, _, err := dial("/admin", http.Header{"Authorization": {"Bearer " + adminToken}}); err != nil {
+		t.Errorf("admin token refused: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"h3ws2h1ws-proxy/internal/jwt"
+)
+
+// HeaderTemplates adds headers to backend handshakes. Values are
+// text/template templates over HeaderData, rendered once per session.
+type HeaderTemplates map[string]*template.Template
+
+// HeaderData is what a backend header template can refer to, e.g.
+// {{.RemoteIP}} or {{.Header "User-Agent"}}.
+type HeaderData struct {
+	RemoteAddr string // client address, ip:port
+	RemoteIP   string
+	Host       string // request :authority
+	Path       string
+	SessionID  string
+	Route      string // "default" outside any route
+	Tenant     string // "default" outside any tenant
+	// Claims of the client's JWT, e.g. {{.Claims.sub}} (nil without
+	// Auth).
+	Claims  jwt.Claims
+	request *http.Request
+}
+
+// Header returns the first value of the client request header name.
+func (d HeaderData) Header(name string) string {
+	return d.request.Header.Get(name)
+}
+
+// NewHeaderTemplates parses values into templates keyed by canonical header
+// name. Headers the backend handshake owns are refused.
+func NewHeaderTemplates(values map[string]string) (HeaderTemplates, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	h := make(HeaderTemplates, len(values))
+	for name, value := range values {
+		name = http.CanonicalHeaderKey(name)
+		if handshakeHeaders[name] {
+			return nil, fmt.Errorf("%s is part of the backend handshake and cannot be set", name)
+		}
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		h[name] = tmpl
+	}
+	return h, nil
+}
+
+// backendHeaders returns the header templates for sessions on route: the
+// global ones, overridden by the route's.
+func (rc *RuntimeConfig) backendHeaders(route *Route) HeaderTemplates {
+	if route == nil {
+		return rc.BackendHeaders
+	}
+	return rc.BackendHeaders.merge(route.BackendHeaders)
+}
+
+// merge returns h with the entries of override replacing those of the same
+// name.
+func (h HeaderTemplates) merge(override HeaderTemplates) HeaderTemplates {
+	if len(override) == 0 {
+		return h
+	}
+	if len(h) == 0 {
+		return override
+	}
+	merged := maps.Clone(h)
+	maps.Copy(merged, override)
+	return merged
+}
+
+// render sets the headers in dst. A template that fails to render, or
+// renders a value that cannot go on the wire, leaves its header out.
+func (h HeaderTemplates) render(dst http.Header, data HeaderData) error {
+	var firstErr error
+	var b strings.Builder
+	for name, tmpl := range h {
+		b.Reset()
+		if err := tmpl.Execute(&b, data); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("backend header %s: %w", name, err)
+			}
+			continue
+		}
+		v := b.String()
+		if strings.ContainsAny(v, "\r\n\x00") {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("backend header %s: value contains control characters", name)
+			}
+			continue
+		}
+		dst[name] = []string{v}
+	}
+	return firstErr
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderTemplates(t *testing.T) {
+	global, err := NewHeaderTemplates(map[string]string{
+		"X-Proxy-Region": "eu-1",
+		"x-client-ip":    "{{.RemoteIP}}",
+		"X-Session":      "{{.SessionID}}/{{.Route}}/{{.Tenant}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat, err := NewHeaderTemplates(map[string]string{"X-Proxy-Region": "chat-eu", "X-Agent": `{{.Header "User-Agent"}} via {{.Host}}{{.Path}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := &RuntimeConfig{BackendHeaders: global}
+	route := &Route{Name: "chat", BackendHeaders: chat}
+
+	r := httptest.NewRequest(http.MethodConnect, "/chat", nil)
+	r.Host = "ws.example.com:443"
+	r.RemoteAddr = "203.0.113.7:51000"
+	r.Header.Set("User-Agent", "app/2.1")
+	data := HeaderData{RemoteAddr: r.RemoteAddr, RemoteIP: clientIP(r), Host: requestHost(r), Path: r.URL.Path, SessionID: "abc", Route: routeName(route), Tenant: tenantName(nil), request: r}
+	got := http.Header{}
+	if err := rc.backendHeaders(route).render(got, data); err != nil {
+		t.Fatal(err)
+	}
+	want := http.Header{
+		"X-Proxy-Region": {"chat-eu"},
+		"X-Client-Ip":    {"203.0.113.7"},
+		"X-Session":      {"abc/chat/default"},
+		"X-Agent":        {"app/2.1 via ws.example.com/chat"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rendered %v, want %v", got, want)
+	}
+	if len(rc.backendHeaders(nil)) != 3 || len(global) != 3 {
+		t.Error("route override leaked into the global headers")
+	}
+
+	for _, bad := range []map[string]string{{"Host": "x"}, {"Sec-WebSocket-Key": "x"}, {"X-A": "{{.Nope"}} {
+		if _, err := NewHeaderTemplates(bad); err == nil {
+			t.Errorf("%v accepted", bad)
+		}
+	}
+
+	// Values that would split the header are left out.
+	inject, _ := NewHeaderTemplates(map[string]string{"X-Agent": `{{.Header "User-Agent"}}`})
+	r.Header.Set("User-Agent", "a\r\nX-Admin: 1")
+	got = http.Header{}
+	if err := inject.render(got, data); err == nil || len(got) != 0 {
+		t.Errorf("control characters rendered: %v, %v", got, err)
+	}
+}
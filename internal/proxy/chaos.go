@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+	"h3ws2h1ws-proxy/internal/ws"
+)
+
+var (
+	errChaosDial  = errors.New("chaos: injected dial failure")
+	errChaosClose = errors.New("chaos: forced close")
+)
+
+// Chaos injects faults for resilience testing. Rates are probabilities in
+// [0, 1], drawn for every forwarded message, except DialFailureRate which
+// is drawn per backend dial.
+type Chaos struct {
+	DelayRate       float64
+	MaxDelay        time.Duration
+	DropRate        float64
+	TruncateRate    float64
+	CloseRate       float64
+	DialFailureRate float64
+	// Routes limits chaos to sessions on these routes; empty means all.
+	Routes []string
+}
+
+// forRoute returns c if it applies to sessions on route, else nil.
+func (c *Chaos) forRoute(route *Route) *Chaos {
+	if c == nil || (len(c.Routes) > 0 && !slices.Contains(c.Routes, routeName(route))) {
+		return nil
+	}
+	return c
+}
+
+func (c *Chaos) dialFails() bool {
+	if c == nil || rand.Float64() >= c.DialFailureRate {
+		return false
+	}
+	metrics.ChaosFaults.WithLabelValues("dial_failure").Inc()
+	return true
+}
+
+// message applies faults to one message on its way to the other side. It
+// returns the message to forward and whether to drop it instead, or
+// errChaosClose after closing the client stream with 1011.
+func (c *Chaos) message(ctx context.Context, client io.Writer, msg []byte) ([]byte, bool, error) {
+	if c == nil {
+		return msg, false, nil
+	}
+	if rand.Float64() < c.CloseRate {
+		metrics.ChaosFaults.WithLabelValues("close").Inc()
+		_ = ws.WriteCloseFrame(client, 1011, "chaos: forced close")
+		return nil, false, errChaosClose
+	}
+	if rand.Float64() < c.DropRate {
+		metrics.ChaosFaults.WithLabelValues("drop").Inc()
+		return nil, true, nil
+	}
+	if len(msg) > 1 && rand.Float64() < c.TruncateRate {
+		metrics.ChaosFaults.WithLabelValues("truncate").Inc()
+		msg = msg[:rand.N(len(msg))]
+	}
+	if c.MaxDelay > 0 && rand.Float64() < c.DelayRate {
+		metrics.ChaosFaults.WithLabelValues("delay").Inc()
+		t := time.NewTimer(rand.N(c.MaxDelay))
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-t.C:
+		}
+	}
+	return msg, false, nil
+}
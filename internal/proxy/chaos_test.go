@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+)
+
+func TestChaosMessage(t *testing.T) {
+	ctx := context.Background()
+	msg := []byte("hello world")
+
+	var off *Chaos
+	if got, drop, err := off.message(ctx, &bytes.Buffer{}, msg); err != nil || drop || !bytes.Equal(got, msg) {
+		t.Fatalf("nil chaos changed the message: %q drop=%v err=%v", got, drop, err)
+	}
+	if off.dialFails() {
+		t.Fatal("nil chaos failed a dial")
+	}
+
+	if _, drop, err := (&Chaos{DropRate: 1}).message(ctx, &bytes.Buffer{}, msg); err != nil || !drop {
+		t.Fatalf("drop: drop=%v err=%v", drop, err)
+	}
+	got, _, err := (&Chaos{TruncateRate: 1}).message(ctx, &bytes.Buffer{}, msg)
+	if err != nil || len(got) >= len(msg) || !bytes.HasPrefix(msg, got) {
+		t.Fatalf("truncate: %q err=%v", got, err)
+	}
+
+	var client bytes.Buffer
+	if _, _, err := (&Chaos{CloseRate: 1}).message(ctx, &client, msg); !errors.Is(err, errChaosClose) {
+		t.Fatalf("close: err=%v", err)
+	}
+	if client.Len() == 0 {
+		t.Fatal("close: no close frame written to the client")
+	}
+	if !(&Chaos{DialFailureRate: 1}).dialFails() {
+		t.Fatal("dial failure rate 1 did not fail the dial")
+	}
+}
+
+func TestChaosForRoute(t *testing.T) {
+	c := &Chaos{DropRate: 1, Routes: []string{"chat"}}
+	chat := &Route{Name: "chat", Path: regexp.MustCompile("^/chat$")}
+	feed := &Route{Name: "feed", Path: regexp.MustCompile("^/feed$")}
+	if c.forRoute(chat) != c {
+		t.Fatal("chaos not applied to a listed route")
+	}
+	if c.forRoute(feed) != nil || c.forRoute(nil) != nil {
+		t.Fatal("chaos applied to an unlisted route")
+	}
+	all := &Chaos{DropRate: 1}
+	if all.forRoute(feed) != all {
+		t.Fatal("chaos without routes should apply everywhere")
+	}
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"h3ws2h1ws-proxy/internal/ws"
+)
+
+// CloseCodeMap replaces close codes on their way from one side to the
+// other. Codes it does not name pass when RFC 6455 lets an endpoint send
+// them and become 1002 otherwise; 1005 (no code) is forwarded as a close
+// frame without a code.
+type CloseCodeMap map[int]int
+
+// ParseCloseCodeMap parses a -close-code-map value such as
+// "1004=1008,4999=1011".
+func ParseCloseCodeMap(s string) (CloseCodeMap, error) {
+	m := CloseCodeMap{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("want from=to, got %q", pair)
+		}
+		f, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			return nil, fmt.Errorf("bad code in %q", pair)
+		}
+		t, err := strconv.Atoi(strings.TrimSpace(to))
+		if err != nil {
+			return nil, fmt.Errorf("bad code in %q", pair)
+		}
+		if !ws.ValidCloseCode(t) {
+			return nil, fmt.Errorf("%d may not be sent in a close frame", t)
+		}
+		m[f] = t
+	}
+	return m, nil
+}
+
+// normalize returns the code to forward in place of code.
+func (m CloseCodeMap) normalize(code int) int {
+	if to, ok := m[code]; ok {
+		return to
+	}
+	if code == noStatusCode || ws.ValidCloseCode(code) {
+		return code
+	}
+	return 1002
+}
+
+// noStatusCode stands for a close frame without a code (RFC 6455 7.1.5).
+const noStatusCode = 1005
+
+// forwardedClose normalizes a close received from one side for the other,
+// logging replaced codes.
+func (s *session) forwardedClose(from string, code int) int {
+	out := s.closeCodes.normalize(code)
+	if out != code {
+		s.debugf("%s close code %d replaced with %d", from, code, out)
+	}
+	return out
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCloseCodeMap(t *testing.T) {
+	m, err := ParseCloseCodeMap("1004=1008, 4999=1011")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for code, want := range map[int]int{
+		1000: 1000, 1005: 1005, 4000: 4000,
+		1004: 1008, 4999: 1011,
+		1006: 1002, 1015: 1002, 999: 1002, 2000: 1002, 5000: 1002, 0: 1002,
+	} {
+		if got := m.normalize(code); got != want {
+			t.Errorf("normalize(%d) = %d, want %d", code, got, want)
+		}
+	}
+	for _, bad := range []string{"1004", "x=1000", "1004=1006", "1004=5000"} {
+		if _, err := ParseCloseCodeMap(bad); err == nil {
+			t.Errorf("ParseCloseCodeMap(%q) accepted", bad)
+		}
+	}
+}
+
+func TestClientCloseCodesNormalized(t *testing.T) {
+	codes := make(chan int, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetCloseHandler(func(code int, _ string) error {
+			codes <- code
+			return nil
+		})
+		_, _, _ = conn.ReadMessage()
+	}))
+	defer srv.Close()
+
+	for _, c := range []struct {
+		payload []byte
+		want    int
+	}{
+		{websocket.FormatCloseMessage(1006, "abnormal"), 1002},
+		{websocket.FormatCloseMessage(1004, ""), 1008},
+		{nil, websocket.CloseNoStatusReceived},
+		{websocket.FormatCloseMessage(4000, "app"), 4000},
+	} {
+		backendConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		quicSide, proxySide := net.Pipe()
+		limits := config.Limits{MaxFrameSize: 1 << 16, MaxMessageSize: 1 << 16, WriteTimeout: 5 * time.Second}
+		sess := &session{closeCodes: CloseCodeMap{1004: 1008}}
+		go func() {
+			_ = pumpH3ToBackend(context.Background(), proxySide, backendConn, limits, &sessionTrafficStats{}, sess, "", "")
+		}()
+		if err := ws.WriteFrame(quicSide, ws.Frame{Fin: true, Opcode: ws.OpClose, Masked: true, Payload: c.payload}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-codes:
+			if got != c.want {
+				t.Errorf("close %x reached the backend as %d, want %d", c.payload, got, c.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("backend got no close")
+		}
+		quicSide.Close()
+		proxySide.Close()
+		backendConn.Close()
+	}
+}
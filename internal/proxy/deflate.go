@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"errors"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/gorilla/websocket"
+)
+
+// DeflateOptions tunes permessage-deflate toward H3 clients.
+type DeflateOptions struct {
+	Enabled bool
+	// Level is a compress/flate level (-2..9).
+	Level int
+	// MinSize leaves smaller backend messages uncompressed.
+	MinSize int
+	// ServerContextTakeover keeps the proxy's compression window across
+	// messages, which pays off for small repetitive messages. Clients must
+	// then keep a window per session too.
+	ServerContextTakeover bool
+	// ClientNoContextTakeover asks clients to reset their window after
+	// every message, so the proxy keeps no 32 KiB dictionary per session.
+	ClientNoContextTakeover bool
+	// ClientMaxWindowBits caps the client's window when it offers
+	// client_max_window_bits (0 = no cap).
+	ClientMaxWindowBits int
+}
+
+// BackendCompression enables permessage-deflate on the backend leg.
+// gorilla/websocket only supports it without context takeover.
+type BackendCompression struct {
+	Enabled bool
+	Level   int
+}
+
+func (p *Proxy) clientDeflateOptions(route *Route) DeflateOptions {
+	if route != nil && route.ClientDeflate != nil {
+		return *route.ClientDeflate
+	}
+	return p.ClientDeflate
+}
+
+func (p *Proxy) backendCompression(route *Route) BackendCompression {
+	if route != nil && route.BackendCompression != nil {
+		return *route.BackendCompression
+	}
+	return p.BackendCompression
+}
+
+// apply sets the write compression of a freshly dialed backend connection.
+// Compression is only used when the backend accepted the extension.
+func (c BackendCompression) apply(conn *websocket.Conn) error {
+	if !c.Enabled {
+		return nil
+	}
+	conn.EnableWriteCompression(true)
+	return conn.SetCompressionLevel(c.Level)
+}
+
+// clientDeflate holds the permessage-deflate state negotiated with the H3
+// client. It is independent of the backend leg: text messages from the
+// backend are compressed here and compressed client messages are inflated
+// before they are forwarded.
+type clientDeflate struct {
+	minSize      int
+	compressor   *ws.Compressor
+	decompressor *ws.Decompressor
+}
+
+// negotiateClientDeflate answers the client's offer according to opts; it
+// returns nil when compression stays off.
+func negotiateClientDeflate(opts DeflateOptions, offer string) (*clientDeflate, string) {
+	if !opts.Enabled || offer == "" {
+		return nil, ""
+	}
+	want := ws.DeflateParams{
+		ServerNoContextTakeover: !opts.ServerContextTakeover,
+		ClientNoContextTakeover: opts.ClientNoContextTakeover,
+		ClientMaxWindowBits:     opts.ClientMaxWindowBits,
+	}
+	params, ext, ok := ws.NegotiateDeflate(offer, want)
+	if !ok {
+		return nil, ""
+	}
+	return &clientDeflate{
+		minSize:      opts.MinSize,
+		compressor:   ws.NewCompressor(opts.Level, !params.ServerNoContextTakeover),
+		decompressor: ws.NewDecompressor(params),
+	}, ext
+}
+
+var errUnexpectedCompression = errors.New("protocol error: compressed message without permessage-deflate")
+
+func (d *clientDeflate) inflate(payload []byte, limit int64) ([]byte, error) {
+	if d == nil {
+		return nil, errUnexpectedCompression
+	}
+	msg, err := d.decompressor.Decompress(payload, limit)
+	if err != nil {
+		return nil, err
+	}
+	observeDeflate("h3_to_h1", len(msg), len(payload))
+	return msg, nil
+}
+
+// compresses reports whether a backend message of size n is compressed.
+func (d *clientDeflate) compresses(n int) bool {
+	return d != nil && n >= d.minSize
+}
+
+func (d *clientDeflate) deflate(msg []byte) ([]byte, error) {
+	out, err := d.compressor.Compress(msg)
+	if err != nil {
+		return nil, err
+	}
+	observeDeflate("h1_to_h3", len(msg), len(out))
+	return out, nil
+}
+
+func observeDeflate(dir string, raw, compressed int) {
+	metrics.DeflateBytes.WithLabelValues(dir, "raw").Add(float64(raw))
+	metrics.DeflateBytes.WithLabelValues(dir, "compressed").Add(float64(compressed))
+	if raw > 0 {
+		metrics.CompressionRatio.WithLabelValues("client", dir).Observe(float64(compressed) / float64(raw))
+	}
+}
@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestNegotiateDeflate(t *testing.T) {
+	on := DeflateOptions{Enabled: true}
+	cases := []struct {
+		opts        DeflateOptions
+		offer, want string
+	}{
+		{on, "permessage-deflate", "permessage-deflate; server_no_context_takeover"},
+		{on, "permessage-deflate; client_max_window_bits; client_no_context_takeover", "permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		{on, "permessage-deflate; server_max_window_bits=10, permessage-deflate", "permessage-deflate; server_no_context_takeover"},
+		{on, "permessage-deflate; server_max_window_bits=10", ""},
+		{on, "x-webkit-deflate-frame", ""},
+		{DeflateOptions{}, "permessage-deflate", ""},
+		{DeflateOptions{Enabled: true, ServerContextTakeover: true}, "permessage-deflate", "permessage-deflate"},
+		{DeflateOptions{Enabled: true, ServerContextTakeover: true}, "permessage-deflate; server_no_context_takeover", "permessage-deflate; server_no_context_takeover"},
+		{DeflateOptions{Enabled: true, ClientNoContextTakeover: true, ClientMaxWindowBits: 10}, "permessage-deflate; client_max_window_bits", "permessage-deflate; server_no_context_takeover; client_no_context_takeover; client_max_window_bits=10"},
+		{DeflateOptions{Enabled: true, ClientMaxWindowBits: 10}, "permessage-deflate", "permessage-deflate; server_no_context_takeover"},
+	}
+	for _, c := range cases {
+		dfl, got := negotiateClientDeflate(c.opts, c.offer)
+		if got != c.want || (dfl != nil) != (c.want != "") {
+			t.Errorf("negotiate(%+v, %q) = %q, %v; want %q", c.opts, c.offer, got, dfl != nil, c.want)
+		}
+	}
+}
+
+func TestClientDeflateAgainstPlainBackend(t *testing.T) {
+	backendURL, closeBackend := startEchoBackend(t)
+	defer closeBackend()
+	backendConn, _, err := websocket.DefaultDialer.Dial(backendURL, nil)
+	if err != nil {
+		t.Fatalf("dial backend websocket: %v", err)
+	}
+	defer backendConn.Close()
+
+	quicSide, proxySide := net.Pipe()
+	defer quicSide.Close()
+	defer proxySide.Close()
+
+	limits := config.Limits{MaxFrameSize: 1 << 16, MaxMessageSize: 1 << 16, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
+	dfl, ext := negotiateClientDeflate(DeflateOptions{Enabled: true, Level: flate.BestSpeed, MinSize: 64, ServerContextTakeover: true}, "permessage-deflate")
+	if dfl == nil {
+		t.Fatal("deflate not negotiated")
+	}
+	params := ws.DeflateParams{}
+	if ext != "permessage-deflate" {
+		t.Fatalf("extension response = %q", ext)
+	}
+	sess := &session{deflate: dfl}
+	stats := &sessionTrafficStats{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = pumpH3ToBackend(ctx, proxySide, backendConn, limits, stats, sess, "", "") }()
+	go func() { _ = pumpBackendToH3(ctx, backendConn, proxySide, limits, stats, sess, "", "") }()
+
+	if err := quicSide.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	client := ws.NewDecompressor(params)
+	br := bufio.NewReader(quicSide)
+	for i, original := range [][]byte{
+		bytes.Repeat([]byte(`{"event":"tick","value":42}`), 40),
+		bytes.Repeat([]byte(`{"event":"tock","value":43}`), 40),
+	} {
+		compressed, err := ws.NewCompressor(flate.DefaultCompression, false).Compress(original)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ws.WriteCompressedDataFrame(quicSide, ws.OpText, compressed, 0); err != nil {
+			t.Fatalf("write compressed frame: %v", err)
+		}
+		f, err := ws.ReadFrame(br, 0)
+		if err != nil {
+			t.Fatalf("read echoed frame: %v", err)
+		}
+		if !f.Rsv1 || !f.Fin || f.Opcode != ws.OpText {
+			t.Fatalf("message %d: rsv1=%v fin=%v opcode=%d, want compressed text", i, f.Rsv1, f.Fin, f.Opcode)
+		}
+		if len(f.Payload) >= len(original) {
+			t.Fatalf("message %d not compressed: %d >= %d bytes", i, len(f.Payload), len(original))
+		}
+		// With server context takeover the second message reuses the first
+		// one's window and shrinks to a few bytes.
+		if i == 1 && len(f.Payload) > 32 {
+			t.Fatalf("message %d did not use the previous window: %d bytes", i, len(f.Payload))
+		}
+		got, err := client.Decompress(f.Payload, limits.MaxMessageSize)
+		if err != nil {
+			t.Fatalf("inflate echoed message: %v", err)
+		}
+		if !bytes.Equal(got, original) {
+			t.Fatalf("message %d mismatch", i)
+		}
+	}
+
+	// Messages below min size go out uncompressed.
+	if err := ws.WriteDataFrame(quicSide, ws.OpText, []byte("short"), true, 0); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ws.ReadFrame(br, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Rsv1 || string(f.Payload) != "short" {
+		t.Fatalf("short message: rsv1=%v payload=%q", f.Rsv1, f.Payload)
+	}
+}
+
+func TestDeflatePassthrough(t *testing.T) {
+	offers := make(chan string, 1)
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offers <- r.Header.Get("Sec-WebSocket-Extensions")
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// The backend speaks first, so its frame may arrive with the
+		// handshake answer.
+		_ = conn.WriteMessage(websocket.TextMessage, bytes.Repeat([]byte("welcome "), 64))
+		for {
+			mt, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(mt, data); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http"))
+
+	const offer = "permessage-deflate; client_no_context_takeover; server_no_context_takeover"
+	sess := &session{extensions: offer}
+	bws, _, err := (&Proxy{}).dialBackend(context.Background(), &websocket.Dialer{}, u, nil, sess)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer bws.Close()
+	if got := <-offers; got != offer {
+		t.Fatalf("backend got offer %q, want %q", got, offer)
+	}
+	frames, ok := newFrameConn(bws)
+	if !ok {
+		t.Fatal("backend connection does not pass extensions through")
+	}
+	if !strings.HasPrefix(frames.conn.accepted, "permessage-deflate") {
+		t.Fatalf("accepted extensions = %q", frames.conn.accepted)
+	}
+
+	quicSide, proxySide := net.Pipe()
+	defer quicSide.Close()
+	defer proxySide.Close()
+	limits := config.Limits{MaxFrameSize: 1 << 16, MaxMessageSize: 1 << 16, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
+	stats := &sessionTrafficStats{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = relayClientFrames(ctx, proxySide, frames, limits, stats, sess) }()
+	go func() { _ = relayBackendFrames(ctx, frames, proxySide, limits, stats, sess) }()
+
+	if err := quicSide.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(quicSide)
+	inflate := ws.NewDecompressor(ws.DeflateParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true})
+	readCompressed := func(want []byte) {
+		t.Helper()
+		f, err := ws.ReadFrame(br, 0)
+		if err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		if !f.Rsv1 || len(f.Payload) >= len(want) {
+			t.Fatalf("frame not compressed end to end: rsv1=%v len=%d", f.Rsv1, len(f.Payload))
+		}
+		got, err := inflate.Decompress(f.Payload, limits.MaxMessageSize)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("inflate: %q %v", got, err)
+		}
+	}
+	readCompressed(bytes.Repeat([]byte("welcome "), 64))
+
+	original := bytes.Repeat([]byte(`{"event":"tick","value":42}`), 40)
+	compressed, err := ws.NewCompressor(flate.BestSpeed, false).Compress(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteFrame(quicSide, ws.Frame{Fin: true, Opcode: ws.OpText, Masked: true, Rsv1: true, Payload: compressed}); err != nil {
+		t.Fatal(err)
+	}
+	readCompressed(original)
+
+	if err := ws.WriteFrame(quicSide, ws.Frame{Fin: true, Opcode: ws.OpClose, Masked: true, Payload: websocket.FormatCloseMessage(1000, "")}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ws.ReadFrame(br, 0)
+	if err != nil || f.Opcode != ws.OpClose {
+		t.Fatalf("close answer: opcode=%d err=%v", f.Opcode, err)
+	}
+}
+
+// With termination the proxy inflates the client's messages, recompresses
+// them toward a backend that accepted permessage-deflate and does the
+// reverse on the way back.
+func TestDeflateTerminatedOnBothLegs(t *testing.T) {
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(mt, data); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	compression := BackendCompression{Enabled: true, Level: flate.BestSpeed}
+	dialer := websocket.Dialer{EnableCompression: compression.Enabled}
+	backendConn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial backend websocket: %v", err)
+	}
+	defer backendConn.Close()
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.HasPrefix(ext, "permessage-deflate") {
+		t.Fatalf("backend extensions = %q", ext)
+	}
+	if err := compression.apply(backendConn); err != nil {
+		t.Fatal(err)
+	}
+
+	dfl, _ := negotiateClientDeflate(DeflateOptions{Enabled: true, Level: flate.BestSpeed}, "permessage-deflate")
+	if dfl == nil {
+		t.Fatal("deflate not negotiated")
+	}
+	quicSide, proxySide := net.Pipe()
+	defer quicSide.Close()
+	defer proxySide.Close()
+	limits := config.Limits{MaxFrameSize: 1 << 16, MaxMessageSize: 1 << 16, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
+	sess := &session{deflate: dfl}
+	stats := &sessionTrafficStats{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = pumpH3ToBackend(ctx, proxySide, backendConn, limits, stats, sess, "", "") }()
+	go func() { _ = pumpBackendToH3(ctx, backendConn, proxySide, limits, stats, sess, "", "") }()
+
+	if err := quicSide.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	original := bytes.Repeat([]byte(`{"event":"tick","value":42}`), 40)
+	compressed, err := ws.NewCompressor(flate.BestSpeed, false).Compress(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteCompressedDataFrame(quicSide, ws.OpText, compressed, 0); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ws.ReadFrame(bufio.NewReader(quicSide), 0)
+	if err != nil {
+		t.Fatalf("read echoed frame: %v", err)
+	}
+	if !f.Rsv1 || len(f.Payload) >= len(original) {
+		t.Fatalf("echo not compressed: rsv1=%v len=%d", f.Rsv1, len(f.Payload))
+	}
+	got, err := ws.NewDecompressor(ws.DeflateParams{ServerNoContextTakeover: true}).Decompress(f.Payload, limits.MaxMessageSize)
+	if err != nil || !bytes.Equal(got, original) {
+		t.Fatalf("inflate echo: %v", err)
+	}
+	if in := atomic.LoadUint64(&stats.h3ToH1Bytes); in != uint64(len(original)) {
+		t.Fatalf("h3_to_h1 bytes = %d, want the inflated %d", in, len(original))
+	}
+}
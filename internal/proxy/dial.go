@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultDialTimeout bounds a backend handshake when Proxy.DialTimeout is
+// unset.
+const DefaultDialTimeout = 10 * time.Second
+
+const maxDialBackoff = 2 * time.Second
+
+// dialBackend makes the WebSocket handshake with the backend at u,
+// re-dialing it up to DialRetries times while it cannot be reached. A
+// backend that answers, even with a refusal, is not re-dialed.
+func (p *Proxy) dialBackend(ctx context.Context, dialer *websocket.Dialer, u *url.URL, header http.Header, sess *session) (*websocket.Conn, *http.Response, error) {
+	backoff := p.DialBackoff
+	for attempt := 0; ; attempt++ {
+		bws, resp, err := p.dialOnce(ctx, dialer, u, header, sess)
+		if err == nil || resp != nil || attempt >= p.DialRetries || ctx.Err() != nil {
+			return bws, resp, err
+		}
+		// Full jitter over the upper half keeps retrying sessions apart.
+		wait := backoff/2 + rand.N(backoff/2+1)
+		sess.debugf("backend dial failed to %s: %v; re-dialing in %s", u.String(), err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, nil, err
+		}
+		backoff = min(backoff*2, maxDialBackoff)
+	}
+}
+
+// dialOnce makes one WebSocket handshake with the backend at u.
+func (p *Proxy) dialOnce(ctx context.Context, dialer *websocket.Dialer, u *url.URL, header http.Header, sess *session) (*websocket.Conn, *http.Response, error) {
+	if sess.chaos.dialFails() {
+		return nil, nil, errChaosDial
+	}
+	dialStarted := time.Now()
+	dialer, target := websocketTarget(dialer, u)
+	if sess.extensions != "" {
+		dialer = withExtensions(dialer, sess.extensions)
+	}
+	bws, resp, err := dialer.DialContext(ctx, target, header)
+	result := "ok"
+	if err != nil {
+		result = "error"
+		if isTimeout(err) {
+			metrics.BackendDialTimeouts.Inc()
+		}
+	}
+	metrics.BackendDialDuration.WithLabelValues(result).Observe(time.Since(dialStarted).Seconds())
+	if resp != nil {
+		// Any HTTP answer, even a refused upgrade, shows the backend is up.
+		p.markBackendReachable()
+	}
+	return bws, resp, err
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
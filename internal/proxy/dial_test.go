@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDialBackendRetries(t *testing.T) {
+	backendURL, stop := startEchoBackend(t)
+	defer stop()
+	u, _ := url.Parse(backendURL)
+
+	dials := 0
+	dialer := &websocket.Dialer{NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		if dials <= 2 {
+			return nil, errors.New("connection refused")
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}}
+	sess := &session{}
+
+	p := &Proxy{DialRetries: 1, DialBackoff: time.Millisecond}
+	if _, _, err := p.dialBackend(context.Background(), dialer, u, nil, sess); err == nil {
+		t.Fatal("dial succeeded before the backend came up")
+	}
+	dials = 0
+	p.DialRetries = 2
+	c, _, err := p.dialBackend(context.Background(), dialer, u, nil, sess)
+	if err != nil {
+		t.Fatalf("dial with retries: %v", err)
+	}
+	c.Close()
+	if dials != 3 {
+		t.Fatalf("dials: got %d want 3", dials)
+	}
+
+	// A backend that answers is not re-dialed.
+	refusing := httptest.NewServer(http.NotFoundHandler())
+	defer refusing.Close()
+	ru, _ := url.Parse("ws" + strings.TrimPrefix(refusing.URL, "http"))
+	dials = 2
+	if _, resp, err := p.dialBackend(context.Background(), dialer, ru, nil, sess); err == nil || resp == nil || dials != 3 {
+		t.Fatalf("refused upgrade: err=%v resp=%v dials=%d", err, resp, dials)
+	}
+}
+
+func TestDialBackendTimeout(t *testing.T) {
+	// Accepts connections and never answers the handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	p := &Proxy{DialTimeout: 50 * time.Millisecond}
+	dialer := &websocket.Dialer{HandshakeTimeout: p.DialTimeout}
+	start := time.Now()
+	_, _, err = p.dialBackend(context.Background(), dialer, &url.URL{Scheme: "ws", Host: ln.Addr().String()}, nil, &session{})
+	if err == nil || !isTimeout(err) {
+		t.Fatalf("black-holed dial: err=%v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("dial took %s", d)
+	}
+}
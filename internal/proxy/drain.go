@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+// Drain stops accepting sessions and closes the running ones gracefully:
+// the client and the backend each get a close frame with code and reason,
+// and the pumps finish the messages already in flight
+// while both sides answer. Sessions still running when ctx is done are
+// terminated. It returns how many sessions were asked to close and how
+// many of them had to be terminated.
+func (p *Proxy) Drain(ctx context.Context, code int, reason string) (drained, terminated int) {
+	p.draining.Store(true)
+	for _, s := range p.registry.snapshot() {
+		drained++
+		go s.drain(code, reason)
+	}
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for p.registry.len() > 0 {
+		select {
+		case <-ctx.Done():
+			for _, s := range p.registry.snapshot() {
+				terminated++
+				go s.terminate(code, reason)
+			}
+			return drained, terminated
+		case <-ticker.C:
+		}
+	}
+	return drained, 0
+}
+
+// rejectDraining refuses a CONNECT that arrives during Drain.
+func (p *Proxy) rejectDraining(w http.ResponseWriter, rt *RuntimeConfig, route *Route) bool {
+	if !p.draining.Load() {
+		return false
+	}
+	metrics.Rejected.WithLabelValues("shutdown").Inc()
+	rt.reject(w, route, "shutdown", http.StatusServiceUnavailable, "shutting down")
+	return true
+}
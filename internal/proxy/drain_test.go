@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDrainClosesSessionsGracefully(t *testing.T) {
+	p := &Proxy{}
+	codes := make(chan int, 2)
+	// The polite session finishes its close handshake; the stuck one never
+	// answers and has to be terminated.
+	polite := &session{}
+	polite.drain = func(code int, _ string) {
+		codes <- code
+		p.registry.remove(polite)
+	}
+	polite.terminate = func(int, string) { t.Error("polite session terminated") }
+	stuck := &session{}
+	stuck.drain = func(code int, _ string) { codes <- code }
+	terminated := make(chan int, 1)
+	stuck.terminate = func(code int, _ string) {
+		terminated <- code
+		p.registry.remove(stuck)
+	}
+	p.registry.add(polite)
+	p.registry.add(stuck)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	drained, cut := p.Drain(ctx, 1012, "service restart")
+	if drained != 2 || cut != 1 {
+		t.Fatalf("Drain = %d drained, %d terminated; want 2, 1", drained, cut)
+	}
+	for range 2 {
+		if code := <-codes; code != 1012 {
+			t.Fatalf("drain code = %d, want 1012", code)
+		}
+	}
+	if code := <-terminated; code != 1012 {
+		t.Fatalf("terminate code = %d, want 1012", code)
+	}
+
+	rr := httptest.NewRecorder()
+	p.HandleH3WebSocket(rr, httptest.NewRequest(http.MethodConnect, "/ws", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("CONNECT while draining: status %d, want 503", rr.Code)
+	}
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// BackendProxy sends backend connections through an egress proxy.
+type BackendProxy struct {
+	// URL is an http://, https:// or socks5:// proxy, optionally with
+	// user:password; nil dials backends directly, ignoring the
+	// HTTPS_PROXY/NO_PROXY environment.
+	URL *url.URL
+}
+
+// ParseBackendProxy parses a -backend-proxy or route backend_proxy value:
+// a proxy URL, or "direct" for no proxy at all.
+func ParseBackendProxy(raw string) (*BackendProxy, error) {
+	if raw == "direct" {
+		return &BackendProxy{}, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("want an http://, https:// or socks5:// proxy URL or \"direct\", got %q", raw)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", raw)
+	}
+	return &BackendProxy{URL: u}, nil
+}
+
+// backendProxy returns the egress proxy for a route's backend connections
+// (nil = the proxy from the environment).
+func (p *Proxy) backendProxy(route *Route) *BackendProxy {
+	if route != nil && route.BackendProxy != nil {
+		return route.BackendProxy
+	}
+	return p.BackendProxy
+}
+
+// egressDial returns the dial function of the proxy-wide egress proxy, or
+// nil without one.
+func (p *Proxy) egressDial() dialFunc {
+	if p.BackendProxy == nil || p.BackendProxy.URL == nil {
+		return nil
+	}
+	return p.BackendProxy.dialer(p.backendNetDialer(nil))
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Dial and DialContext let a dialFunc reach a SOCKS5 proxy.
+func (f dialFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f dialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// dialer returns a dial function that tunnels through the proxy, reaching
+// the proxy itself with nd (nil = a default net.Dialer).
+func (bp *BackendProxy) dialer(nd *net.Dialer) dialFunc {
+	if nd == nil {
+		nd = &net.Dialer{}
+	}
+	if bp.URL.Scheme == "socks5" || bp.URL.Scheme == "socks5h" {
+		var auth *xproxy.Auth
+		if user := bp.URL.User; user != nil {
+			password, _ := user.Password()
+			auth = &xproxy.Auth{User: user.Username(), Password: password}
+		}
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			reachable := true
+			forward := dialFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := nd.DialContext(ctx, network, addr)
+				reachable = err == nil
+				return conn, err
+			})
+			d, err := xproxy.SOCKS5("tcp", proxyAddr(bp.URL), auth, forward)
+			if err != nil {
+				return nil, err
+			}
+			conn, err := d.(xproxy.ContextDialer).DialContext(ctx, network, addr)
+			if err != nil {
+				reason := "refused"
+				if !reachable {
+					reason = "unreachable"
+				}
+				metrics.BackendProxyFailures.WithLabelValues(reason).Inc()
+				return nil, fmt.Errorf("socks5 proxy %s: %w", bp.URL.Host, err)
+			}
+			return conn, nil
+		}
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := bp.connect(ctx, nd, addr)
+		if err != nil {
+			var pe *proxyError
+			reason := "unreachable"
+			if errors.As(err, &pe) {
+				reason = pe.reason
+			}
+			metrics.BackendProxyFailures.WithLabelValues(reason).Inc()
+			return nil, fmt.Errorf("http proxy %s: %w", bp.URL.Host, err)
+		}
+		return conn, nil
+	}
+}
+
+type proxyError struct {
+	reason string
+	err    error
+}
+
+func (e *proxyError) Error() string { return e.err.Error() }
+func (e *proxyError) Unwrap() error { return e.err }
+
+// connect opens a tunnel to addr with an HTTP CONNECT request.
+func (bp *BackendProxy) connect(ctx context.Context, nd *net.Dialer, addr string) (net.Conn, error) {
+	conn, err := nd.DialContext(ctx, "tcp", proxyAddr(bp.URL))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if bp.URL.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{ServerName: bp.URL.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := bp.URL.User; user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	br := bufio.NewReader(conn)
+	err = req.Write(conn)
+	var resp *http.Response
+	if err == nil {
+		resp, err = http.ReadResponse(br, req)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, &proxyError{reason: "refused", err: err}
+	}
+	// The body of a refusal is not needed and closing the connection
+	// discards it.
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		reason := "refused"
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			reason = "auth"
+		}
+		return nil, &proxyError{reason: reason, err: fmt.Errorf("CONNECT %s: %s", addr, resp.Status)}
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn hands out bytes the proxy sent after its CONNECT answer
+// before reading from the tunnel again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func proxyAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "1080"
+	switch u.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// startConnectProxy runs an HTTP CONNECT proxy that wants user:secret and
+// records the targets it tunnels to.
+func startConnectProxy(t *testing.T) (*httptest.Server, <-chan string) {
+	t.Helper()
+	targets := make(chan string, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpzZWNyZXQ=" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		backend, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		targets <- r.Host
+		w.WriteHeader(http.StatusOK)
+		client, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			backend.Close()
+			return
+		}
+		go func() {
+			_, _ = io.Copy(backend, client)
+			backend.Close()
+		}()
+		_, _ = io.Copy(client, backend)
+		client.Close()
+	}))
+	return srv, targets
+}
+
+func TestBackendProxyConnect(t *testing.T) {
+	backendURL, stop := startEchoBackend(t)
+	defer stop()
+	egress, targets := startConnectProxy(t)
+	defer egress.Close()
+
+	bp, err := ParseBackendProxy(strings.Replace(egress.URL, "http://", "http://user:secret@", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _, err := (&websocket.Dialer{NetDialContext: bp.dialer(nil)}).DialContext(context.Background(), backendURL, nil)
+	if err != nil {
+		t.Fatalf("dial through proxy: %v", err)
+	}
+	defer c.Close()
+	if want := strings.TrimPrefix(backendURL, "ws://"); <-targets != want {
+		t.Fatalf("proxy did not tunnel to %s", want)
+	}
+	if err := c.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := c.ReadMessage(); err != nil || string(data) != "hi" {
+		t.Fatalf("echo: %q %v", data, err)
+	}
+
+	before := testutil.ToFloat64(metrics.BackendProxyFailures.WithLabelValues("auth"))
+	noAuth := &BackendProxy{URL: &url.URL{Scheme: "http", Host: strings.TrimPrefix(egress.URL, "http://")}}
+	if _, _, err := (&websocket.Dialer{NetDialContext: noAuth.dialer(nil)}).DialContext(context.Background(), backendURL, nil); err == nil {
+		t.Fatal("dial without proxy credentials succeeded")
+	}
+	if got := testutil.ToFloat64(metrics.BackendProxyFailures.WithLabelValues("auth")); got != before+1 {
+		t.Fatalf("auth failures: got %v want %v", got, before+1)
+	}
+}
+
+func TestParseBackendProxy(t *testing.T) {
+	if bp, err := ParseBackendProxy("direct"); err != nil || bp.URL != nil {
+		t.Fatalf("direct: %+v %v", bp, err)
+	}
+	if bp, err := ParseBackendProxy("socks5://u:p@egress:1080"); err != nil || proxyAddr(bp.URL) != "egress:1080" {
+		t.Fatalf("socks5: %+v %v", bp, err)
+	}
+	for _, bad := range []string{"ftp://egress", "http://", "egress:3128"} {
+		if _, err := ParseBackendProxy(bad); err == nil {
+			t.Errorf("%q: accepted", bad)
+		}
+	}
+	route := &Route{BackendProxy: &BackendProxy{}}
+	p := &Proxy{BackendProxy: &BackendProxy{URL: &url.URL{Scheme: "http", Host: "egress:3128"}}}
+	if p.backendProxy(route).URL != nil || p.backendProxy(nil).URL == nil {
+		t.Fatal("route override not applied")
+	}
+}
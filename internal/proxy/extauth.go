@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+// ExternalAuth asks an HTTP service whether a CONNECT may proceed, like
+// nginx's auth_request: the service gets a GET with the client's headers
+// and X-Original-URI, and a 2xx answer admits the session.
+type ExternalAuth struct {
+	URL     string
+	Client  *http.Client
+	Timeout time.Duration
+	// CacheTTL keeps positive verdicts for requests with the same URI,
+	// headers and client IP (0 = ask for every CONNECT).
+	CacheTTL time.Duration
+	// ResponseHeaders are copied from a 2xx answer into the backend
+	// handshake, e.g. X-User set by the service.
+	ResponseHeaders []string
+	// PriorityHeader names a response header whose value (low, normal or
+	// high) sets the session's priority class.
+	PriorityHeader string
+
+	mu    sync.Mutex
+	cache map[[32]byte]extAuthVerdict
+}
+
+type extAuthVerdict struct {
+	header   http.Header
+	priority string
+	expires  time.Time
+}
+
+// maxExtAuthCache bounds the verdict cache; expired entries are swept
+// when it fills up and, if that is not enough, the cache is reset.
+const maxExtAuthCache = 10000
+
+// extAuthResult is the outcome of a check: allowed carries the headers for
+// the backend and the PriorityHeader value, otherwise status and header are
+// sent to the client.
+type extAuthResult struct {
+	allowed  bool
+	header   http.Header
+	priority string
+	status   int
+}
+
+func (a *ExternalAuth) check(ctx context.Context, r *http.Request) (extAuthResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.URL, nil)
+	if err != nil {
+		return extAuthResult{}, err
+	}
+	for name, values := range r.Header {
+		if !handshakeHeaders[name] {
+			req.Header[name] = values
+		}
+	}
+	req.Header.Set("X-Original-URI", r.URL.RequestURI())
+	req.Header.Set("X-Original-Method", r.Method)
+	req.Header.Set("X-Forwarded-For", clientIP(r))
+	req.Header.Set("X-Forwarded-Host", requestHost(r))
+
+	key := extAuthKey(req)
+	if a.CacheTTL > 0 {
+		if v, ok := a.cached(key); ok {
+			metrics.ExtAuthRequests.WithLabelValues("cached").Inc()
+			return extAuthResult{allowed: true, header: v.header, priority: v.priority}, nil
+		}
+	}
+
+	if a.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	metrics.ExtAuthDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.ExtAuthRequests.WithLabelValues("error").Inc()
+		return extAuthResult{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		metrics.ExtAuthRequests.WithLabelValues("denied").Inc()
+		return extAuthResult{status: resp.StatusCode, header: resp.Header}, nil
+	}
+	metrics.ExtAuthRequests.WithLabelValues("allowed").Inc()
+	h := http.Header{}
+	for _, name := range a.ResponseHeaders {
+		if v := resp.Header.Values(name); len(v) > 0 {
+			h[name] = slices.Clone(v)
+		}
+	}
+	var priority string
+	if a.PriorityHeader != "" {
+		priority = resp.Header.Get(a.PriorityHeader)
+	}
+	if a.CacheTTL > 0 {
+		a.store(key, h, priority)
+	}
+	return extAuthResult{allowed: true, header: h, priority: priority}, nil
+}
+
+// extAuthKey identifies an auth subrequest by everything sent with it.
+func extAuthKey(req *http.Request) [32]byte {
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		for _, v := range req.Header[name] {
+			b.WriteByte(0)
+			b.WriteString(v)
+		}
+		b.WriteByte('\n')
+	}
+	return sha256.Sum256([]byte(b.String()))
+}
+
+func (a *ExternalAuth) cached(key [32]byte) (extAuthVerdict, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	v, ok := a.cache[key]
+	if !ok || time.Now().After(v.expires) {
+		return extAuthVerdict{}, false
+	}
+	return v, true
+}
+
+func (a *ExternalAuth) store(key [32]byte, h http.Header, priority string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if len(a.cache) >= maxExtAuthCache {
+		for k, v := range a.cache {
+			if now.After(v.expires) {
+				delete(a.cache, k)
+			}
+		}
+		if len(a.cache) >= maxExtAuthCache {
+			a.cache = nil
+		}
+	}
+	if a.cache == nil {
+		a.cache = make(map[[32]byte]extAuthVerdict)
+	}
+	a.cache[key] = extAuthVerdict{header: h, priority: priority, expires: now.Add(a.CacheTTL)}
+}
+
+// authorizeExternal runs the ExternalAuth check for r. It answers the
+// CONNECT and returns false when the session may not proceed; on success
+// the headers for the backend are kept in sess and the PriorityHeader sets
+// its class.
+func (p *Proxy) authorizeExternal(w http.ResponseWriter, rt *RuntimeConfig, route *Route, r *http.Request, sess *session) bool {
+	if p.ExternalAuth == nil {
+		return true
+	}
+	res, err := p.ExternalAuth.check(r.Context(), r)
+	switch {
+	case err != nil:
+		slog.Error("external auth failed", "session", sess.id, "url", p.ExternalAuth.URL, "err", err)
+		metrics.Rejected.WithLabelValues("auth").Inc()
+		rejectRoute(route, "auth")
+		rt.reject(w, route, "auth", http.StatusServiceUnavailable, "authorization unavailable")
+		return false
+	case res.allowed:
+		sess.authHeader = res.header
+		sess.setIdentityPriority("auth: "+p.ExternalAuth.PriorityHeader+" header", res.priority)
+		return true
+	case res.status == http.StatusUnauthorized:
+		sess.debugf("auth: denied: remote=%s status=%d", r.RemoteAddr, res.status)
+		for _, v := range res.header.Values("WWW-Authenticate") {
+			w.Header().Add("WWW-Authenticate", v)
+		}
+		metrics.Rejected.WithLabelValues("auth").Inc()
+		rejectRoute(route, "auth")
+		rt.reject(w, route, "auth", http.StatusUnauthorized, "unauthorized")
+		return false
+	case res.status == http.StatusForbidden:
+		sess.debugf("auth: denied: remote=%s status=%d", r.RemoteAddr, res.status)
+		metrics.Rejected.WithLabelValues("acl").Inc()
+		rejectRoute(route, "acl")
+		rt.reject(w, route, "acl", http.StatusForbidden, "forbidden")
+		return false
+	default:
+		// Anything else is the service failing, not a verdict on the client.
+		slog.Error("external auth failed", "session", sess.id, "url", p.ExternalAuth.URL, "status", res.status)
+		metrics.Rejected.WithLabelValues("auth").Inc()
+		rejectRoute(route, "auth")
+		rt.reject(w, route, "auth", http.StatusServiceUnavailable, "authorization unavailable")
+		return false
+	}
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"h3ws2h1ws-proxy/internal/config"
+)
+
+func TestExternalAuth(t *testing.T) {
+	var calls atomic.Int32
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("Sec-Websocket-Key") != "" || r.Header.Get("X-Forwarded-For") != "127.0.0.1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.Header.Get("Authorization") {
+		case "Bearer good":
+			if r.Header.Get("X-Original-Uri") != "/ws?room=1" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("X-User", "alice")
+			w.Header().Set("X-Internal", "not copied")
+		case "Bearer banned":
+			w.WriteHeader(http.StatusForbidden)
+		case "Bearer crash":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="chat"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer authSrv.Close()
+
+	capture := &backendHeaderCapture{}
+	backendURL, closeBackend := startEchoBackendWithCapture(t, capture)
+	defer closeBackend()
+	backend, _ := url.Parse(backendURL)
+	p := &Proxy{
+		Backend: backend,
+		Limits:  config.Limits{MaxFrameSize: 1 << 20, MaxMessageSize: 1 << 20, MaxConns: 10, WriteTimeout: 5 * time.Second},
+		ExternalAuth: &ExternalAuth{
+			URL:             authSrv.URL,
+			Timeout:         time.Second,
+			CacheTTL:        time.Minute,
+			ResponseHeaders: []string{"X-User"},
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(p.HandleH3WebSocket))
+	defer srv.Close()
+	proxyURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?room=1"
+	dial := func(token string) (*http.Response, error) {
+		c, resp, err := websocket.DefaultDialer.Dial(proxyURL, http.Header{"Authorization": {"Bearer " + token}})
+		if err == nil {
+			_ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			c.Close()
+		}
+		return resp, err
+	}
+
+	for token, want := range map[string]int{"": http.StatusUnauthorized, "banned": http.StatusForbidden, "crash": http.StatusServiceUnavailable} {
+		resp, err := dial(token)
+		if err == nil || resp == nil || resp.StatusCode != want {
+			t.Errorf("token %q: resp=%v err=%v, want %d", token, resp, err, want)
+		}
+	}
+	if resp, _ := dial("nope"); resp == nil || resp.Header.Get("WWW-Authenticate") != `Bearer realm="chat"` {
+		t.Errorf("WWW-Authenticate not passed on: %v", resp)
+	}
+	denied := calls.Load()
+
+	if _, err := dial("good"); err != nil {
+		t.Fatalf("approved session: %v", err)
+	}
+	if got := capture.Get("X-User"); got != "alice" {
+		t.Errorf("backend X-User = %q", got)
+	}
+	if got := capture.Get("X-Internal"); got != "" {
+		t.Errorf("unlisted response header forwarded: %q", got)
+	}
+	// Approvals are cached, refusals are not.
+	if _, err := dial("good"); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load() - denied; n != 1 {
+		t.Errorf("auth service asked %d times for the same approved request", n)
+	}
+	if resp, _ := dial("banned"); resp == nil || resp.StatusCode != http.StatusForbidden || calls.Load()-denied != 2 {
+		t.Errorf("refusal served from the cache: %v", resp)
+	}
+}
+
+func TestExternalAuthTimeout(t *testing.T) {
+	release := make(chan struct{})
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer authSrv.Close()
+	defer close(release)
+	p := &Proxy{
+		Limits:       config.Limits{MaxConns: 10},
+		ExternalAuth: &ExternalAuth{URL: authSrv.URL, Timeout: 50 * time.Millisecond},
+	}
+	w := httptest.NewRecorder()
+	p.HandleH3WebSocket(w, httptest.NewRequest(http.MethodConnect, "/ws", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", w.Code)
+	}
+}
@@ -0,0 +1,355 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// BackendProtocol is the HTTP version of the backend handshake.
+type BackendProtocol int8
+
+const (
+	// BackendProtocolUnset defers to the proxy-wide protocol.
+	BackendProtocolUnset BackendProtocol = iota
+	// BackendHTTP1 upgrades an HTTP/1.1 connection (RFC 6455).
+	BackendHTTP1
+	// BackendHTTP2 opens an extended CONNECT stream over HTTP/2 (RFC 8441),
+	// with TLS for wss:// backends and prior knowledge for ws:// ones.
+	BackendHTTP2
+	// BackendHTTP3 opens an extended CONNECT stream over HTTP/3 (RFC 9220);
+	// the backend must be wss://.
+	BackendHTTP3
+)
+
+func ParseBackendProtocol(s string) (BackendProtocol, error) {
+	switch s {
+	case "":
+		return BackendProtocolUnset, nil
+	case "http1":
+		return BackendHTTP1, nil
+	case "h2":
+		return BackendHTTP2, nil
+	case "h3":
+		return BackendHTTP3, nil
+	}
+	return BackendProtocolUnset, fmt.Errorf("unknown backend protocol %q (want http1, h2 or h3)", s)
+}
+
+func (bp BackendProtocol) String() string {
+	switch bp {
+	case BackendHTTP2:
+		return "h2"
+	case BackendHTTP3:
+		return "h3"
+	default:
+		return "http1"
+	}
+}
+
+// backendProtocol returns the handshake protocol for a route's backend.
+func (p *Proxy) backendProtocol(route *Route) BackendProtocol {
+	if route != nil && route.BackendProtocol != BackendProtocolUnset {
+		return route.BackendProtocol
+	}
+	return p.BackendProtocol
+}
+
+// extendedConnectClients holds the HTTP/3 connections that backend
+// streams share.
+type extendedConnectClients struct {
+	mu sync.Mutex
+	h3 map[string]*http3.SingleDestinationRoundTripper
+}
+
+// useExtendedConnect makes dialer reach backends over HTTP/2 or HTTP/3
+// streams. The HTTP/1.1 upgrade the dialer writes is sent as an extended
+// CONNECT and the answer handed back as the matching HTTP/1.1 response, so
+// the session above sees an ordinary WebSocket connection.
+func (p *Proxy) useExtendedConnect(dialer *websocket.Dialer, proto BackendProtocol) {
+	dial := func(scheme string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return func(ctx context.Context, _, addr string) (net.Conn, error) {
+			if proto == BackendHTTP3 && scheme != "https" {
+				return nil, errors.New("HTTP/3 backends must be wss://")
+			}
+			return &extendedConn{p: p, ctx: ctx, proto: proto, scheme: scheme, addr: addr}, nil
+		}
+	}
+	dialer.Proxy = nil
+	dialer.NetDialContext = dial("http")
+	dialer.NetDialTLSContext = dial("https")
+}
+
+// extendedStream is the data side of an extended CONNECT.
+type extendedStream interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// extendedConn is the net.Conn the WebSocket dialer talks to. It collects
+// the upgrade request, answers it from the extended CONNECT response and
+// then carries the frames over the stream.
+type extendedConn struct {
+	p      *Proxy
+	ctx    context.Context // bounds the handshake
+	proto  BackendProtocol
+	scheme string
+	addr   string
+	req    bytes.Buffer
+	resp   bytes.Reader
+	stream extendedStream
+}
+
+func (c *extendedConn) Write(b []byte) (int, error) {
+	if c.stream != nil {
+		return c.stream.Write(b)
+	}
+	if c.resp.Size() > 0 {
+		return 0, errors.New("backend refused the extended CONNECT")
+	}
+	c.req.Write(b)
+	if !bytes.Contains(c.req.Bytes(), []byte("\r\n\r\n")) {
+		return len(b), nil
+	}
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *extendedConn) Read(b []byte) (int, error) {
+	if c.resp.Len() > 0 {
+		return c.resp.Read(b)
+	}
+	if c.stream == nil {
+		return 0, io.EOF
+	}
+	return c.stream.Read(b)
+}
+
+// handshake sends the upgrade request as an extended CONNECT and prepares
+// the HTTP/1.1 answer the dialer expects: 101 with the accept key for a
+// 2xx, the backend's status, headers and the start of its body otherwise.
+func (c *extendedConn) handshake() error {
+	req, err := http.ReadRequest(bufio.NewReader(&c.req))
+	if err != nil {
+		return err
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	header := req.Header.Clone()
+	for _, h := range []string{"Connection", "Upgrade", "Sec-Websocket-Key"} {
+		delete(header, h)
+	}
+	target := &url.URL{Scheme: c.scheme, Host: c.addr, Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: req.URL.RawQuery}
+
+	var resp *http.Response
+	var stream extendedStream
+	if c.proto == BackendHTTP3 {
+		resp, stream, err = c.p.h3Connect(c.ctx, target, req.Host, header)
+	} else {
+		resp, stream, err = c.p.h2Connect(c.ctx, target, req.Host, header)
+	}
+	if err != nil {
+		return err
+	}
+
+	var answer bytes.Buffer
+	var body []byte
+	resp.Header.Del("Transfer-Encoding")
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		answer.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		answer.WriteString("Sec-WebSocket-Accept: " + ws.ComputeAccept(key) + "\r\n")
+		resp.Header.Del("Content-Length")
+		c.stream = stream
+	} else {
+		body, _ = io.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = stream.Close()
+		fmt.Fprintf(&answer, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	_ = resp.Header.Write(&answer)
+	answer.WriteString("\r\n")
+	answer.Write(body)
+	c.resp.Reset(answer.Bytes())
+	return nil
+}
+
+func (c *extendedConn) Close() error {
+	if c.stream != nil {
+		return c.stream.Close()
+	}
+	return nil
+}
+
+func (c *extendedConn) LocalAddr() net.Addr  { return extendedAddr{c.proto, ""} }
+func (c *extendedConn) RemoteAddr() net.Addr { return extendedAddr{c.proto, c.addr} }
+
+// Deadlines before the handshake are left to the dial context.
+func (c *extendedConn) SetDeadline(t time.Time) error {
+	if c.stream == nil {
+		return nil
+	}
+	_ = c.stream.SetReadDeadline(t)
+	return c.stream.SetWriteDeadline(t)
+}
+
+func (c *extendedConn) SetReadDeadline(t time.Time) error {
+	if c.stream == nil {
+		return nil
+	}
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *extendedConn) SetWriteDeadline(t time.Time) error {
+	if c.stream == nil {
+		return nil
+	}
+	return c.stream.SetWriteDeadline(t)
+}
+
+type extendedAddr struct {
+	proto BackendProtocol
+	addr  string
+}
+
+func (a extendedAddr) Network() string { return a.proto.String() }
+func (a extendedAddr) String() string  { return a.addr }
+
+// deadline runs expire once t passes.
+type deadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired bool
+}
+
+func (d *deadline) set(t time.Time, expire func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if t.IsZero() || d.expired {
+		return
+	}
+	d.timer = time.AfterFunc(time.Until(t), func() {
+		d.mu.Lock()
+		d.expired = true
+		d.mu.Unlock()
+		expire()
+	})
+}
+
+// err reports a failure after the deadline passed as a timeout.
+func (d *deadline) err(err error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.expired {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+// h3RoundTripper returns the HTTP/3 connection to addr, dialing a new one
+// when there is none or it has closed.
+func (p *Proxy) h3RoundTripper(ctx context.Context, addr, host string) (*http3.SingleDestinationRoundTripper, error) {
+	c := &p.extConnect
+	c.mu.Lock()
+	rt := c.h3[addr]
+	c.mu.Unlock()
+	if rt != nil && rt.Connection.Context().Err() == nil {
+		return rt, nil
+	}
+	tlsConf := &tls.Config{}
+	if p.BackendTLSConfig != nil {
+		tlsConf = p.BackendTLSConfig.Clone()
+	}
+	tlsConf.NextProtos = []string{http3.NextProtoH3}
+	if tlsConf.ServerName == "" {
+		tlsConf.ServerName = host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			tlsConf.ServerName = h
+		}
+	}
+	// Keep-alives hold the connection open for idle sessions.
+	conn, err := quic.DialAddr(ctx, addr, tlsConf, &quic.Config{KeepAlivePeriod: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	rt = &http3.SingleDestinationRoundTripper{Connection: conn}
+	c.mu.Lock()
+	if c.h3 == nil {
+		c.h3 = map[string]*http3.SingleDestinationRoundTripper{}
+	}
+	c.h3[addr] = rt
+	c.mu.Unlock()
+	return rt, nil
+}
+
+// h3Connect opens an RFC 9220 WebSocket stream to target.
+func (p *Proxy) h3Connect(ctx context.Context, target *url.URL, host string, header http.Header) (*http.Response, extendedStream, error) {
+	rt, err := p.h3RoundTripper(ctx, target.Host, host)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := rt.Start()
+	select {
+	case <-conn.ReceivedSettings():
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	if !conn.Settings().EnableExtendedConnect {
+		return nil, nil, errors.New("HTTP/3 backend does not support extended CONNECT")
+	}
+	str, err := rt.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	abort := func() {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+		str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+	}
+	stop := context.AfterFunc(ctx, abort)
+	req := &http.Request{Method: http.MethodConnect, Proto: "websocket", ProtoMajor: 3, URL: target, Host: host, Header: header}
+	err = str.SendRequestHeader(req)
+	var resp *http.Response
+	if err == nil {
+		resp, err = str.ReadResponse()
+	}
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		abort()
+		return nil, nil, err
+	}
+	return resp, h3Stream{str}, nil
+}
+
+// h3Stream closes both directions of the request stream.
+type h3Stream struct {
+	http3.RequestStream
+}
+
+func (s h3Stream) Close() error {
+	s.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	return s.RequestStream.Close()
+}
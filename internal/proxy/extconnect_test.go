@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// startChainedProxy runs a proxy in front of an echo backend, for another
+// proxy to reach over HTTP/2 or HTTP/3.
+func startChainedProxy(t *testing.T) *Proxy {
+	t.Helper()
+	backendURL, stop := startEchoBackend(t)
+	t.Cleanup(stop)
+	u, _ := url.Parse(backendURL)
+	return &Proxy{
+		Backend:    u,
+		PathRegexp: regexp.MustCompile(`^/ws$`),
+		Limits:     config.Limits{MaxFrameSize: 1 << 20, MaxMessageSize: 1 << 20, MaxConns: 10, WriteTimeout: 5 * time.Second},
+	}
+}
+
+func dialExtendedConnect(t *testing.T, proto BackendProtocol, backend string) {
+	t.Helper()
+	p := &Proxy{BackendTLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	dialer := &websocket.Dialer{Subprotocols: []string{"chat"}}
+	p.useExtendedConnect(dialer, proto)
+	u, _ := url.Parse(backend + "/ws")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, resp, err := p.dialBackend(ctx, dialer, u, nil, &session{})
+	if err != nil {
+		t.Fatalf("dial over %s: %v (resp=%v)", proto, err, resp)
+	}
+	defer c.Close()
+	for _, msg := range []string{"one", strings.Repeat("x", 100<<10)} {
+		if err := c.WriteMessage(websocket.BinaryMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, data, err := c.ReadMessage(); err != nil || string(data) != msg {
+			t.Fatalf("echo over %s: %d bytes, %v", proto, len(data), err)
+		}
+	}
+
+	// A refused CONNECT comes back as the backend's status.
+	u.Path = "/elsewhere"
+	if _, resp, err := p.dialBackend(ctx, dialer, u, nil, &session{}); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("refused CONNECT over %s: err=%v resp=%v", proto, err, resp)
+	}
+}
+
+func TestExtendedConnectHTTP2Backend(t *testing.T) {
+	// As in TestHTTP2ExtendedConnectRoundTrip, the HTTP/2 server needs
+	// extended CONNECT switched on before it starts.
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestExtendedConnectHTTP2Backend$", "-test.count=1")
+		cmd.Env = append(os.Environ(), "GODEBUG=http2xconnect=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		return
+	}
+	chained := startChainedProxy(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(chained.HandleH3WebSocket))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	dialExtendedConnect(t, BackendHTTP2, "wss://"+srv.Listener.Addr().String())
+}
+
+func TestExtendedConnectHTTP3Backend(t *testing.T) {
+	chained := startChainedProxy(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	srv := &http3.Server{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{mustMakeTLSCert(t)}, NextProtos: []string{http3.NextProtoH3}},
+		Handler:   http.HandlerFunc(chained.HandleH3WebSocket),
+	}
+	defer srv.Close()
+	go func() { _ = srv.Serve(pc) }()
+	dialExtendedConnect(t, BackendHTTP3, "wss://"+pc.LocalAddr().String())
+}
+
+func TestParseBackendProtocol(t *testing.T) {
+	for s, want := range map[string]BackendProtocol{"": BackendProtocolUnset, "http1": BackendHTTP1, "h2": BackendHTTP2, "h3": BackendHTTP3} {
+		if got, err := ParseBackendProtocol(s); err != nil || got != want {
+			t.Errorf("%q: got %v, %v", s, got, err)
+		}
+	}
+	if _, err := ParseBackendProtocol("spdy"); err == nil {
+		t.Error("unknown protocol accepted")
+	}
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/ws"
+)
+
+// DefaultFlushBytes is how much a flushWriter collects before it writes
+// without waiting for the flush delay.
+const DefaultFlushBytes = 16 << 10
+
+// flushWriter coalesces the frames of a session into fewer, larger stream
+// writes. Data frames wait up to delay for company or until threshold bytes
+// are buffered; control frames (ping, pong, close) flush at once. Every
+// Write carries whole frames, so frames are still never split. Writes from
+// the pumps and the keepalive goroutines are serialized.
+type flushWriter struct {
+	w         io.Writer
+	delay     time.Duration
+	threshold int
+
+	mu    sync.Mutex
+	buf   []byte
+	timer *time.Timer
+	err   error
+}
+
+func newFlushWriter(w io.Writer, delay time.Duration, threshold int) *flushWriter {
+	return &flushWriter{w: w, delay: delay, threshold: threshold}
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return 0, f.err
+	}
+	if len(f.buf)+len(p) > f.threshold {
+		if err := f.flushLocked(); err != nil {
+			return 0, err
+		}
+	}
+	if len(p) >= f.threshold {
+		return f.w.Write(p)
+	}
+	f.buf = append(f.buf, p...)
+	if len(p) > 0 && p[0]&0x0f >= ws.OpClose {
+		return len(p), f.flushLocked()
+	}
+	if f.timer == nil {
+		f.timer = time.AfterFunc(f.delay, func() { _ = f.Flush() })
+	}
+	return len(p), nil
+}
+
+// Flush writes out whatever is buffered.
+func (f *flushWriter) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flushLocked()
+}
+
+func (f *flushWriter) flushLocked() error {
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	if len(f.buf) == 0 || f.err != nil {
+		return f.err
+	}
+	_, f.err = f.w.Write(f.buf)
+	f.buf = f.buf[:0]
+	return f.err
+}
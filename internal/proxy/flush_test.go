@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/ws"
+)
+
+type recordingWriter struct {
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (r *recordingWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes = append(r.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (r *recordingWriter) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.writes)
+}
+
+func TestFlushWriterCoalescesDataFrames(t *testing.T) {
+	rec := &recordingWriter{}
+	fw := newFlushWriter(rec, 20*time.Millisecond, 1024)
+	for range 3 {
+		if err := ws.WriteDataFrame(fw, ws.OpText, []byte("hi"), false, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := rec.count(); n != 0 {
+		t.Fatalf("%d writes before the flush delay, want 0", n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := rec.count(); n != 1 || len(rec.writes[0]) != 12 {
+		t.Fatalf("got %d writes, want the three frames in one", n)
+	}
+
+	// A control frame takes the buffered data frames with it at once.
+	if err := ws.WriteDataFrame(fw, ws.OpBinary, []byte("x"), false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteControlFrame(fw, ws.OpPing, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := rec.count(); n != 2 || !bytes.Equal(rec.writes[1], []byte{0x82, 1, 'x', 0x89, 0}) {
+		t.Fatalf("ping was not flushed with the pending frame: %x", rec.writes)
+	}
+
+	// Frames at or over the threshold are not held back.
+	if err := ws.WriteDataFrame(fw, ws.OpBinary, make([]byte, 2048), false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := rec.count(); n != 3 {
+		t.Fatalf("large frame was buffered: %d writes", n)
+	}
+}
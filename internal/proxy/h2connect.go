@@ -0,0 +1,370 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// settingEnableConnectProtocol is SETTINGS_ENABLE_CONNECT_PROTOCOL (RFC
+// 8441), which x/net/http2 has no name for.
+const settingEnableConnectProtocol http2.SettingID = 0x8
+
+// h2ReceiveWindow is how much backend data one stream may have in flight.
+const h2ReceiveWindow = 1 << 20
+
+// h2ConnectStream is an HTTP/2 connection carrying one extended CONNECT
+// stream. net/http cannot send :protocol, so the proxy speaks the framing
+// itself; a WebSocket session lives as long as its stream, so connections
+// are not shared between sessions.
+type h2ConnectStream struct {
+	conn net.Conn
+	fr   *http2.Framer
+	wmu  sync.Mutex // serializes frame writes
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	settings   bool // the backend's first SETTINGS arrived
+	xconnect   bool
+	resp       *http.Response
+	data       bytes.Buffer // received and not read yet
+	unacked    int          // read and not returned to the stream window
+	err        error        // set once the stream is over
+	connSend   int64
+	streamSend int64
+	maxFrame   int
+
+	read, written deadline
+}
+
+// h2Connect opens an RFC 8441 WebSocket stream to target.
+func (p *Proxy) h2Connect(ctx context.Context, target *url.URL, host string, header http.Header) (*http.Response, extendedStream, error) {
+	conn, err := p.h2Dial(ctx, target)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &h2ConnectStream{conn: conn, fr: http2.NewFramer(conn, conn), connSend: 65535, streamSend: 65535, maxFrame: 16384}
+	s.cond = sync.NewCond(&s.mu)
+	s.fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	stop := context.AfterFunc(ctx, func() { s.fail(ctx.Err()) })
+	resp, err := s.open(target, host, header)
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = s.Close()
+		return nil, nil, err
+	}
+	resp.Body = io.NopCloser(s)
+	return resp, s, nil
+}
+
+// h2Dial connects to the backend, negotiating h2 over TLS for wss://.
+func (p *Proxy) h2Dial(ctx context.Context, target *url.URL) (net.Conn, error) {
+	dial := (&net.Dialer{}).DialContext
+	nd := p.backendNetDialer(nil)
+	switch egress := p.egressDial(); {
+	case egress != nil:
+		dial = egress
+	case p.Resolver != nil:
+		dial = p.Resolver.dialer(nd)
+	case nd != nil:
+		dial = nd.DialContext
+	}
+	conn, err := dial(ctx, "tcp", target.Host)
+	if err != nil || target.Scheme != "https" {
+		return conn, err
+	}
+	cfg := &tls.Config{}
+	if p.BackendTLSConfig != nil {
+		cfg = p.BackendTLSConfig.Clone()
+	}
+	cfg.NextProtos = []string{http2.NextProtoTLS}
+	if cfg.ServerName == "" {
+		cfg.ServerName = target.Hostname()
+	}
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if proto := tc.ConnectionState().NegotiatedProtocol; proto != http2.NextProtoTLS {
+		_ = conn.Close()
+		return nil, fmt.Errorf("backend does not speak HTTP/2 (ALPN %q)", proto)
+	}
+	return tc, nil
+}
+
+// open starts the connection and sends the CONNECT on stream 1.
+func (s *h2ConnectStream) open(target *url.URL, host string, header http.Header) (*http.Response, error) {
+	if _, err := io.WriteString(s.conn, http2.ClientPreface); err != nil {
+		return nil, err
+	}
+	err := s.fr.WriteSettings(http2.Setting{ID: http2.SettingEnablePush, Val: 0}, http2.Setting{ID: http2.SettingInitialWindowSize, Val: h2ReceiveWindow})
+	if err == nil {
+		err = s.fr.WriteWindowUpdate(0, h2ReceiveWindow-65535)
+	}
+	if err != nil {
+		return nil, err
+	}
+	go s.readFrames()
+
+	s.mu.Lock()
+	for !s.settings && s.err == nil {
+		s.cond.Wait()
+	}
+	xconnect, err := s.xconnect, s.err
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if !xconnect {
+		return nil, errors.New("HTTP/2 backend does not support extended CONNECT")
+	}
+
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	path := target.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if target.RawQuery != "" {
+		path += "?" + target.RawQuery
+	}
+	for _, f := range [][2]string{{":method", http.MethodConnect}, {":protocol", "websocket"}, {":scheme", target.Scheme}, {":authority", host}, {":path", path}} {
+		_ = enc.WriteField(hpack.HeaderField{Name: f[0], Value: f[1]})
+	}
+	for name, values := range header {
+		switch name {
+		case "Host", "Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade":
+			continue
+		}
+		for _, v := range values {
+			_ = enc.WriteField(hpack.HeaderField{Name: strings.ToLower(name), Value: v})
+		}
+	}
+	if block.Len() > 16384 {
+		return nil, errors.New("backend handshake headers too large")
+	}
+	s.wmu.Lock()
+	err = s.fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block.Bytes(), EndHeaders: true})
+	s.wmu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.resp == nil && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.resp == nil {
+		return nil, s.err
+	}
+	return s.resp, nil
+}
+
+// readFrames handles everything the backend sends until the connection
+// fails or the stream ends.
+func (s *h2ConnectStream) readFrames() {
+	for {
+		f, err := s.fr.ReadFrame()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if f.IsAck() {
+				continue
+			}
+			s.mu.Lock()
+			_ = f.ForeachSetting(func(st http2.Setting) error {
+				switch st.ID {
+				case http2.SettingInitialWindowSize:
+					s.streamSend += int64(st.Val) - 65535
+				case http2.SettingMaxFrameSize:
+					s.maxFrame = int(st.Val)
+				case settingEnableConnectProtocol:
+					s.xconnect = st.Val == 1
+				}
+				return nil
+			})
+			s.settings = true
+			s.cond.Broadcast()
+			s.mu.Unlock()
+			s.writeFrame(func() error { return s.fr.WriteSettingsAck() })
+		case *http2.MetaHeadersFrame:
+			if f.StreamID != 1 {
+				continue
+			}
+			s.mu.Lock()
+			if s.resp == nil {
+				s.resp = h2Response(f)
+			}
+			s.cond.Broadcast()
+			s.mu.Unlock()
+			if f.StreamEnded() {
+				s.fail(io.EOF)
+			}
+		case *http2.DataFrame:
+			// The connection window is given back right away; the
+			// stream window bounds what is buffered.
+			if n := f.Header().Length; n > 0 {
+				s.writeFrame(func() error { return s.fr.WriteWindowUpdate(0, n) })
+			}
+			if f.StreamID != 1 {
+				continue
+			}
+			s.mu.Lock()
+			s.data.Write(f.Data())
+			s.unacked += int(f.Header().Length) - len(f.Data())
+			s.cond.Broadcast()
+			s.mu.Unlock()
+			if f.StreamEnded() {
+				s.fail(io.EOF)
+			}
+		case *http2.WindowUpdateFrame:
+			s.mu.Lock()
+			if f.StreamID == 0 {
+				s.connSend += int64(f.Increment)
+			} else if f.StreamID == 1 {
+				s.streamSend += int64(f.Increment)
+			}
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				s.writeFrame(func() error { return s.fr.WritePing(true, f.Data) })
+			}
+		case *http2.RSTStreamFrame:
+			if f.StreamID == 1 {
+				s.fail(fmt.Errorf("backend reset the stream: %v", f.ErrCode))
+			}
+		case *http2.GoAwayFrame:
+			if f.LastStreamID < 1 || f.ErrCode != http2.ErrCodeNo {
+				s.fail(fmt.Errorf("backend closed the connection: %v", f.ErrCode))
+			}
+		}
+	}
+}
+
+func h2Response(f *http2.MetaHeadersFrame) *http.Response {
+	resp := &http.Response{Proto: "HTTP/2.0", ProtoMajor: 2, Header: http.Header{}, Body: http.NoBody}
+	for _, hf := range f.Fields {
+		if hf.Name == ":status" {
+			resp.StatusCode, _ = strconv.Atoi(hf.Value)
+			resp.Status = hf.Value + " " + http.StatusText(resp.StatusCode)
+		} else if !strings.HasPrefix(hf.Name, ":") {
+			resp.Header.Add(hf.Name, hf.Value)
+		}
+	}
+	return resp
+}
+
+func (s *h2ConnectStream) writeFrame(write func() error) {
+	s.wmu.Lock()
+	err := write()
+	s.wmu.Unlock()
+	if err != nil {
+		s.fail(err)
+	}
+}
+
+// fail ends the stream with err unless it is over already.
+func (s *h2ConnectStream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if err != io.EOF {
+		_ = s.conn.Close()
+	}
+}
+
+func (s *h2ConnectStream) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	for s.data.Len() == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.data.Len() == 0 {
+		err := s.err
+		s.mu.Unlock()
+		return 0, s.read.err(err)
+	}
+	n, _ := s.data.Read(b)
+	s.unacked += n
+	update := 0
+	if s.unacked >= h2ReceiveWindow/2 {
+		update, s.unacked = s.unacked, 0
+	}
+	s.mu.Unlock()
+	if update > 0 {
+		s.writeFrame(func() error { return s.fr.WriteWindowUpdate(1, uint32(update)) })
+	}
+	return n, nil
+}
+
+func (s *h2ConnectStream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		s.mu.Lock()
+		for (s.connSend <= 0 || s.streamSend <= 0) && s.err == nil {
+			s.cond.Wait()
+		}
+		if err := s.err; err != nil {
+			s.mu.Unlock()
+			return written, s.written.err(err)
+		}
+		n := int(min(int64(len(b)-written), s.connSend, s.streamSend, int64(s.maxFrame)))
+		s.connSend -= int64(n)
+		s.streamSend -= int64(n)
+		s.mu.Unlock()
+		s.wmu.Lock()
+		err := s.fr.WriteData(1, false, b[written:written+n])
+		s.wmu.Unlock()
+		if err != nil {
+			s.fail(err)
+			return written, s.written.err(err)
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (s *h2ConnectStream) Close() error {
+	s.read.set(time.Time{}, nil)
+	s.written.set(time.Time{}, nil)
+	s.fail(net.ErrClosed)
+	return nil
+}
+
+// HTTP/2 streams have no deadlines of their own, so a passed deadline
+// gives up the whole stream, as a WebSocket connection does after a timed
+// out read or write anyway.
+func (s *h2ConnectStream) SetReadDeadline(t time.Time) error {
+	s.read.set(t, func() { s.fail(errDeadline) })
+	return nil
+}
+
+func (s *h2ConnectStream) SetWriteDeadline(t time.Time) error {
+	s.written.set(t, func() { s.fail(errDeadline) })
+	return nil
+}
+
+var errDeadline = errors.New("deadline exceeded")
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"h3ws2h1ws-proxy/internal/ws"
+)
+
+// ClientMasking decides what happens to unmasked client frames.
+type ClientMasking int8
+
+const (
+	// MaskingAllow accepts unmasked frames: RFC 9220 streams are already
+	// protected by QUIC, and some clients skip the mask there.
+	MaskingAllow ClientMasking = iota
+	// MaskingRequire closes the session with 1002 on an unmasked frame, as
+	// RFC 6455 5.1 prescribes.
+	MaskingRequire
+)
+
+func ParseClientMasking(s string) (ClientMasking, error) {
+	switch s {
+	case "", "allow":
+		return MaskingAllow, nil
+	case "require":
+		return MaskingRequire, nil
+	}
+	return MaskingAllow, fmt.Errorf("unknown masking policy %q (want require or allow)", s)
+}
+
+func (m ClientMasking) String() string {
+	if m == MaskingRequire {
+		return "require"
+	}
+	return "allow"
+}
+
+// errUnmaskedFrame fails a client frame without a mask under
+// MaskingRequire.
+var errUnmaskedFrame = errors.New("protocol error: unmasked client frame")
+
+// IsUpgradeRequest reports whether r is a classic HTTP/1.1 WebSocket
+// upgrade (RFC 6455), which is served next to extended CONNECT.
+func IsUpgradeRequest(r *http.Request) bool {
+	return r.ProtoMajor == 1 && r.Method == http.MethodGet &&
+		headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkHandshake validates the extended CONNECT headers. It returns the
+// Sec-WebSocket-Accept value to answer with, if any, or the problem to
+// reject the request with.
+func (p *Proxy) checkHandshake(r *http.Request) (accept, problem string) {
+	ver := r.Header.Get("Sec-WebSocket-Version")
+	if IsUpgradeRequest(r) {
+		// RFC 6455 makes the key mandatory on HTTP/1.1.
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if key == "" || ver != "13" {
+			return "", "missing/invalid websocket headers"
+		}
+		return ws.ComputeAccept(key), ""
+	}
+	if p.StrictRFC9220 {
+		// quic-go exposes the :protocol pseudo-header as r.Proto, the
+		// HTTP/2 server (RFC 8441) as a header.
+		protocol := r.Proto
+		if r.ProtoMajor == 2 {
+			protocol = r.Header.Get(":protocol")
+		}
+		if protocol != "websocket" {
+			return "", "missing/invalid :protocol websocket"
+		}
+		if ver != "13" {
+			return "", "missing/invalid Sec-WebSocket-Version"
+		}
+		return "", ""
+	}
+
+	// Compatibility note:
+	// Some clients / gateways still omit RFC8441 `:protocol` and
+	// Sec-WebSocket-Version over H3 Extended CONNECT.
+	// We reject only explicitly invalid values, but tolerate absence.
+	if proto := firstNonEmpty(
+		r.Header.Get(":protocol"),
+		r.Header.Get("protocol"),
+		r.Header.Get("Protocol"),
+	); proto != "" && proto != "websocket" {
+		return "", "missing/invalid :protocol websocket"
+	}
+	if ver != "" && ver != "13" {
+		return "", "missing/invalid websocket headers"
+	}
+	if key := r.Header.Get("Sec-WebSocket-Key"); key != "" {
+		return ws.ComputeAccept(key), ""
+	}
+	return "", ""
+}
+
+// backendFailureHeaders are copied from a refused backend handshake so the
+// client can act on them.
+var backendFailureHeaders = []string{"Retry-After", "WWW-Authenticate"}
+
+// backendFailureStatus maps a failed backend dial onto the status the H3
+// client gets: authentication, authorization, missing path and overload
+// answers pass through, timeouts become 504 and everything else 502.
+func backendFailureStatus(resp *http.Response, err error) int {
+	if resp != nil {
+		switch resp.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusServiceUnavailable:
+			return resp.StatusCode
+		}
+		return http.StatusBadGateway
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// writeBackendFailure answers a CONNECT whose backend dial failed.
+func writeBackendFailure(w http.ResponseWriter, resp *http.Response, err error, session string) {
+	status := backendFailureStatus(resp, err)
+	if resp != nil && status == resp.StatusCode {
+		for _, h := range backendFailureHeaders {
+			if v := resp.Header.Get(h); v != "" {
+				w.Header().Set(h, v)
+			}
+		}
+	}
+	http.Error(w, fmt.Sprintf("backend handshake failed: %s (session %s)", http.StatusText(status), session), status)
+}
+
+// handshakeHeaders are written by the proxy or the websocket dialer for
+// the backend handshake, or are hop-by-hop, so they are never forwarded
+// from the client.
+var handshakeHeaders = map[string]bool{
+	"Host": true, "Connection": true, "Upgrade": true, "Keep-Alive": true,
+	"Te": true, "Trailer": true, "Transfer-Encoding": true, "Content-Length": true,
+	"Proxy-Connection": true, "Proxy-Authorization": true,
+	"Sec-Websocket-Key": true, "Sec-Websocket-Version": true,
+	"Sec-Websocket-Extensions": true, "Sec-Websocket-Protocol": true,
+}
+
+// ForwardHeaders returns the canonical names in the comma separated list
+// of client headers to copy into backend handshakes, or an error for a
+// header the proxy must own.
+func ForwardHeaders(list string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		name = http.CanonicalHeaderKey(name)
+		if handshakeHeaders[name] || strings.HasPrefix(name, ":") {
+			return nil, fmt.Errorf("%s is part of the backend handshake and cannot be forwarded", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// copyForwardHeaders copies the headers named in names from the client
+// request to the backend handshake. HTTP/2 and HTTP/3 clients may split
+// Cookie into several fields, which HTTP/1.1 needs joined into one.
+func copyForwardHeaders(dst, src http.Header, names []string) {
+	for _, name := range names {
+		vs := src.Values(name)
+		if len(vs) == 0 {
+			continue
+		}
+		if name == "Cookie" && len(vs) > 1 {
+			vs = []string{strings.Join(vs, "; ")}
+		}
+		dst[name] = slices.Clone(vs)
+	}
+}
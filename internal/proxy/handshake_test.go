@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWriteBackendFailure(t *testing.T) {
+	for _, c := range []struct {
+		backend int
+		want    int
+	}{
+		{http.StatusUnauthorized, http.StatusUnauthorized},
+		{http.StatusForbidden, http.StatusForbidden},
+		{http.StatusNotFound, http.StatusNotFound},
+		{http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{http.StatusInternalServerError, http.StatusBadGateway},
+		{http.StatusOK, http.StatusBadGateway},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(c.backend)
+		}))
+		_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		srv.Close()
+		if err == nil {
+			t.Fatalf("backend %d: dial succeeded", c.backend)
+		}
+		rec := httptest.NewRecorder()
+		writeBackendFailure(rec, resp, err, "0123456789abcdef")
+		if rec.Code != c.want {
+			t.Errorf("backend %d: got %d, want %d", c.backend, rec.Code, c.want)
+		}
+		if got := rec.Header().Get("Retry-After"); (got == "7") != (c.want == c.backend) {
+			t.Errorf("backend %d: Retry-After = %q", c.backend, got)
+		}
+		if body := rec.Body.String(); !strings.Contains(body, "session 0123456789abcdef") {
+			t.Errorf("backend %d: body %q does not name the session", c.backend, body)
+		}
+	}
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	rec := httptest.NewRecorder()
+	writeBackendFailure(rec, resp, err, "0123456789abcdef")
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("refused connection: got %d, want 502", rec.Code)
+	}
+}
+
+func TestCheckHandshake(t *testing.T) {
+	request := func(proto string, headers ...string) *http.Request {
+		r := httptest.NewRequest(http.MethodConnect, "https://example.com/ws", nil)
+		r.Proto = proto
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		return r
+	}
+	for _, c := range []struct {
+		name       string
+		strict     bool
+		r          *http.Request
+		wantAccept bool
+		wantOK     bool
+	}{
+		{"compat bare", false, request("HTTP/3.0"), false, true},
+		{"compat key", false, request("websocket", "Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ=="), true, true},
+		{"compat bad version", false, request("websocket", "Sec-WebSocket-Version", "8"), false, false},
+		{"compat bad protocol", false, request("websocket", "Protocol", "mqtt"), false, false},
+		{"strict", true, request("websocket", "Sec-WebSocket-Version", "13"), false, true},
+		{"strict ignores key", true, request("websocket", "Sec-WebSocket-Version", "13", "Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ=="), false, true},
+		{"strict no protocol", true, request("HTTP/3.0", "Sec-WebSocket-Version", "13", "Protocol", "websocket"), false, false},
+		{"strict no version", true, request("websocket"), false, false},
+	} {
+		p := &Proxy{StrictRFC9220: c.strict}
+		accept, problem := p.checkHandshake(c.r)
+		if (problem == "") != c.wantOK || (accept != "") != c.wantAccept {
+			t.Errorf("%s: accept=%q problem=%q", c.name, accept, problem)
+		}
+	}
+}
+
+func TestForwardHeaders(t *testing.T) {
+	names, err := ForwardHeaders(" authorization, cookie,,X-Client-Version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "Authorization,Cookie,X-Client-Version" {
+		t.Errorf("names = %q", names)
+	}
+	for _, bad := range []string{"Host", "connection", "Sec-WebSocket-Key", "Sec-WebSocket-Protocol", "Transfer-Encoding"} {
+		if _, err := ForwardHeaders("Cookie," + bad); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+
+	src := http.Header{"Authorization": {"Bearer x"}, "Cookie": {"a=1", "b=2"}, "Origin": {"o"}}
+	dst := http.Header{}
+	copyForwardHeaders(dst, src, names)
+	want := http.Header{"Authorization": {"Bearer x"}, "Cookie": {"a=1; b=2"}}
+	if !reflect.DeepEqual(dst, want) {
+		t.Errorf("forwarded %v, want %v", dst, want)
+	}
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+
+	"github.com/gorilla/websocket"
+)
+
+// Health check defaults for zero HealthCheck fields.
+const (
+	DefaultHealthInterval       = 10 * time.Second
+	DefaultHealthTimeout        = 2 * time.Second
+	DefaultHealthUnhealthyAfter = 2
+	DefaultHealthHealthyAfter   = 1
+)
+
+// HealthCheck configures active probes of a pool's members. A probe is a
+// WebSocket handshake to the member URL, closed right away, or an HTTP GET
+// of Path when it is set. Zero fields use the Default* values.
+type HealthCheck struct {
+	Interval       time.Duration
+	Timeout        time.Duration
+	Path           string
+	UnhealthyAfter int
+	HealthyAfter   int
+}
+
+func (hc *HealthCheck) interval() time.Duration {
+	return cmp.Or(hc.Interval, DefaultHealthInterval)
+}
+
+// backendHealth is the probe state of one pool member. Members start
+// healthy, so a new member takes sessions before its first probe.
+type backendHealth struct {
+	mu        sync.Mutex
+	down      bool
+	probing   bool
+	lastProbe time.Time
+	fails     int
+	passes    int
+}
+
+func (h *backendHealth) healthy() bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.down
+}
+
+// due claims the next probe when interval has passed since the last one.
+func (h *backendHealth) due(now time.Time, interval time.Duration) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.probing || now.Sub(h.lastProbe) < interval {
+		return false
+	}
+	h.probing, h.lastProbe = true, now
+	return true
+}
+
+// record counts a probe result and reports whether the member's state
+// flipped.
+func (h *backendHealth) record(hc *HealthCheck, err error) (changed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.probing = false
+	if err != nil {
+		h.fails, h.passes = h.fails+1, 0
+		if !h.down && h.fails >= cmp.Or(hc.UnhealthyAfter, DefaultHealthUnhealthyAfter) {
+			h.down = true
+			return true
+		}
+		return false
+	}
+	h.fails, h.passes = 0, h.passes+1
+	if h.down && h.passes >= cmp.Or(hc.HealthyAfter, DefaultHealthHealthyAfter) {
+		h.down = false
+		return true
+	}
+	return false
+}
+
+// RunHealthChecks probes the members of every pool with a HealthCheck,
+// each at its pool's interval, until ctx is done. Pools added at runtime are
+// picked up on the next tick.
+func (p *Proxy) RunHealthChecks(ctx context.Context, tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.checkHealth(ctx, now)
+		}
+	}
+}
+
+// checkHealth starts the probes that are due at now.
+func (p *Proxy) checkHealth(ctx context.Context, now time.Time) {
+	for _, pool := range p.runtimeConfig().Pools {
+		hc := pool.HealthCheck
+		if hc == nil {
+			continue
+		}
+		for _, b := range pool.Backends {
+			if b.health == nil || !b.health.due(now, hc.interval()) {
+				continue
+			}
+			go func() {
+				err := p.probe(ctx, hc, b.URL)
+				if b.health.record(hc, err) {
+					if err != nil {
+						slog.Warn("pool backend unhealthy", "pool", pool.Name, "backend", b.Name, "err", err)
+					} else {
+						slog.Info("pool backend healthy again", "pool", pool.Name, "backend", b.Name)
+					}
+				}
+				healthy := 0.0
+				if b.health.healthy() {
+					healthy = 1
+				}
+				metrics.BackendHealthy.WithLabelValues(pool.Name, b.Name).Set(healthy)
+			}()
+		}
+	}
+}
+
+// probe checks one member once.
+func (p *Proxy) probe(ctx context.Context, hc *HealthCheck, u *url.URL) error {
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(hc.Timeout, DefaultHealthTimeout))
+	defer cancel()
+	if hc.Path == "" {
+		dialer := &websocket.Dialer{TLSClientConfig: p.BackendTLSConfig, NetDialContext: p.egressDial()}
+		if proto := p.backendProtocol(nil); proto == BackendHTTP2 || proto == BackendHTTP3 {
+			p.useExtendedConnect(dialer, proto)
+		}
+		dialer, target := websocketTarget(dialer, u)
+		ws, resp, err := dialer.DialContext(ctx, target, nil)
+		if resp != nil && resp.Body != nil {
+			_ = resp.Body.Close()
+		}
+		if err != nil {
+			return err
+		}
+		_ = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		return ws.Close()
+	}
+	client := p.healthClient()
+	target := *u
+	if sock, ok := unixSocket(u); ok {
+		target.Host = "localhost"
+		client = &http.Client{Transport: &http.Transport{DialContext: dialUnix(sock), TLSClientConfig: p.BackendTLSConfig, DisableKeepAlives: true}}
+	}
+	target.Scheme = "http"
+	if u.Scheme == "wss" || u.Scheme == "wss+unix" {
+		target.Scheme = "https"
+	}
+	target.Path = hc.Path
+	target.RawPath = ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+func (p *Proxy) healthClient() *http.Client {
+	p.healthClientOnce.Do(func() {
+		p.healthHTTP = &http.Client{Transport: &http.Transport{TLSClientConfig: p.BackendTLSConfig, DialContext: p.egressDial()}}
+	})
+	return p.healthHTTP
+}
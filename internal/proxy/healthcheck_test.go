@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitHealthy(t *testing.T, b *PoolBackend, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for b.health.healthy() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("backend %s: healthy=%v, want %v", b.Name, !want, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthCheckWebSocket(t *testing.T) {
+	upURL, stopUp := startEchoBackend(t)
+	defer stopUp()
+	downURL, stopDown := startEchoBackend(t)
+	stopDown()
+
+	up, _ := url.Parse(upURL)
+	down, _ := url.Parse(downURL)
+	p := &Proxy{}
+	p.SetRuntimeConfig(&RuntimeConfig{Pools: []*BackendPool{{
+		Name:        "p",
+		HealthCheck: &HealthCheck{Interval: time.Millisecond, UnhealthyAfter: 1},
+		Backends:    []*PoolBackend{{Name: "up", URL: up}, {Name: "down", URL: down}},
+	}}})
+	pool := p.runtimeConfig().Pools[0]
+
+	p.checkHealth(context.Background(), time.Now())
+	waitHealthy(t, pool.Backends[1], false)
+	for range 4 {
+		if got := pool.pick(BalanceUnset, ""); got.Name != "up" {
+			t.Fatalf("pick: got %q", got.Name)
+		}
+	}
+	if info := p.Pools()[0].Backends; !info[0].Healthy || info[1].Healthy {
+		t.Fatalf("pool info: %+v", info)
+	}
+}
+
+func TestHealthCheckHTTPPath(t *testing.T) {
+	var ok atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || !ok.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	u, _ := url.Parse("ws" + srv.URL[len("http"):])
+
+	p := &Proxy{}
+	hc := &HealthCheck{Interval: time.Millisecond, Path: "/health", UnhealthyAfter: 2, HealthyAfter: 1}
+	p.SetRuntimeConfig(&RuntimeConfig{Pools: []*BackendPool{{Name: "p", HealthCheck: hc, Backends: []*PoolBackend{{Name: "a", URL: u}}}}})
+	b := p.runtimeConfig().Pools[0].Backends[0]
+
+	// One failure is below the threshold.
+	if err := p.probe(context.Background(), hc, u); err == nil || b.health.record(hc, err) {
+		t.Fatalf("first failure: err=%v healthy=%v", err, b.health.healthy())
+	}
+	p.checkHealth(context.Background(), time.Now())
+	waitHealthy(t, b, false)
+	if got := p.runtimeConfig().Pools[0].pick(BalanceUnset, ""); got != nil {
+		t.Fatalf("pick from unhealthy pool: got %q", got.Name)
+	}
+
+	ok.Store(true)
+	p.checkHealth(context.Background(), time.Now().Add(time.Second))
+	waitHealthy(t, b, true)
+
+	// The state is kept across a config update that keeps the member.
+	b.health.record(hc, context.DeadlineExceeded)
+	b.health.record(hc, context.DeadlineExceeded)
+	p.SetRuntimeConfig(&RuntimeConfig{Pools: []*BackendPool{{Name: "p", HealthCheck: hc, Backends: []*PoolBackend{{Name: "a", URL: u}}}}})
+	if p.runtimeConfig().Pools[0].Backends[0].health.healthy() {
+		t.Fatal("health state lost on update")
+	}
+}
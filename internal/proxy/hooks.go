@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// Hooks lets an embedder observe and veto sessions without changing the
+// pumps: custom authorization, auditing or metrics. The proxy calls them
+// synchronously on the session's goroutines, so they must be safe for
+// concurrent use and return quickly; OnMessage in particular runs once
+// per relayed message. Embed NopHooks to implement only some of them.
+type Hooks interface {
+	// OnAccept is called for a CONNECT that passed the built-in
+	// authentication and policy checks, before the backend is dialed. An
+	// error refuses the session with 403 and the error's text.
+	OnAccept(r *http.Request) error
+	// OnBackendConnected is called once the backend handshake succeeded
+	// and the session is relaying.
+	OnBackendConnected(s SessionInfo)
+	// OnMessage is called for every data message relayed, as it is
+	// forwarded.
+	OnMessage(sessionID string, m Message)
+	// OnClose is called when a session that reached OnBackendConnected
+	// has ended.
+	OnClose(s SessionInfo, c CloseInfo)
+}
+
+// Message describes a relayed data message.
+type Message struct {
+	// Direction is "h3_to_h1" (client to backend) or "h1_to_h3".
+	Direction string
+	Text      bool
+	Size      int64
+	// Payload is the message, nil when it was relayed frame by frame
+	// (streamed, opaque or passthrough sessions). It must not be retained
+	// or modified.
+	Payload []byte
+}
+
+// CloseInfo describes how a session ended.
+type CloseInfo struct {
+	// ClientCode and BackendCode are the close codes each side sent (0 =
+	// none).
+	ClientCode  int
+	BackendCode int
+	// Err is why the session failed, nil when it ended with a close
+	// handshake or a clean disconnect.
+	Err error
+	// Duration is how long the session relayed.
+	Duration time.Duration
+}
+
+// NopHooks implements Hooks doing nothing and accepting every session.
+type NopHooks struct{}
+
+func (NopHooks) OnAccept(*http.Request) error   { return nil }
+func (NopHooks) OnBackendConnected(SessionInfo) {}
+func (NopHooks) OnMessage(string, Message)      {}
+func (NopHooks) OnClose(SessionInfo, CloseInfo) {}
+
+// onMessage reports a relayed message to the session's hooks, if any.
+// kind is "text" or "binary".
+func (s *session) onMessage(dir, kind string, payload []byte, size int64) {
+	if s.hooks == nil {
+		return
+	}
+	s.hooks.OnMessage(s.id, Message{Direction: dir, Text: kind == "text", Size: size, Payload: payload})
+}
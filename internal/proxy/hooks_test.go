@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"h3ws2h1ws-proxy/internal/config"
+)
+
+type recordingHooks struct {
+	NopHooks
+	mu        sync.Mutex
+	connected []SessionInfo
+	messages  []Message
+	closed    []CloseInfo
+	closedIDs []string
+}
+
+func (h *recordingHooks) OnAccept(r *http.Request) error {
+	if r.URL.Query().Get("user") == "mallory" {
+		return errors.New("mallory is banned")
+	}
+	return nil
+}
+
+func (h *recordingHooks) OnBackendConnected(s SessionInfo) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connected = append(h.connected, s)
+}
+
+func (h *recordingHooks) OnMessage(id string, m Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m.Payload = append([]byte(nil), m.Payload...)
+	h.messages = append(h.messages, m)
+}
+
+func (h *recordingHooks) OnClose(s SessionInfo, c CloseInfo) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closedIDs = append(h.closedIDs, s.ID)
+	h.closed = append(h.closed, c)
+}
+
+func TestHooks(t *testing.T) {
+	backendURL, closeBackend := startEchoBackend(t)
+	defer closeBackend()
+	backend, _ := url.Parse(backendURL)
+	hooks := &recordingHooks{}
+	p := &Proxy{
+		Backend: backend,
+		Limits:  config.Limits{MaxFrameSize: 1 << 20, MaxMessageSize: 1 << 20, MaxConns: 10, WriteTimeout: 5 * time.Second},
+		Hooks:   hooks,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(p.HandleH3WebSocket))
+	defer srv.Close()
+	proxyURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	_, resp, err := websocket.DefaultDialer.Dial(proxyURL+"?user=mallory", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("refused session: resp=%v err=%v, want 403", resp, err)
+	}
+
+	c, _, err := websocket.DefaultDialer.Dial(proxyURL+"?user=alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"), time.Now().Add(time.Second))
+	c.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		hooks.mu.Lock()
+		n := len(hooks.closed)
+		hooks.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("OnClose not called")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	if len(hooks.connected) != 1 || hooks.connected[0].Path != "/ws" {
+		t.Fatalf("OnBackendConnected calls = %+v, want one for /ws", hooks.connected)
+	}
+	id := hooks.connected[0].ID
+	want := []Message{
+		{Direction: "h3_to_h1", Text: true, Size: 5, Payload: []byte("hello")},
+		{Direction: "h1_to_h3", Text: true, Size: 5, Payload: []byte("hello")},
+	}
+	if len(hooks.messages) != len(want) {
+		t.Fatalf("messages = %+v, want %+v", hooks.messages, want)
+	}
+	for i, m := range hooks.messages {
+		if m.Direction != want[i].Direction || m.Text != want[i].Text || m.Size != want[i].Size || string(m.Payload) != string(want[i].Payload) {
+			t.Errorf("message %d = %+v, want %+v", i, m, want[i])
+		}
+	}
+	if len(hooks.closed) != 1 || hooks.closedIDs[0] != id {
+		t.Fatalf("OnClose sessions = %v, want [%s]", hooks.closedIDs, id)
+	}
+	if c := hooks.closed[0]; c.ClientCode != 1000 || c.BackendCode != 1000 || c.Err != nil {
+		t.Errorf("close = %+v, want 1000/1000 without error", c)
+	}
+}
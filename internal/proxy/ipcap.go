@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ipSessions counts running sessions per client IP for MaxConnsPerIP.
+// Addresses without sessions are dropped, so the map only holds active
+// clients.
+type ipSessions struct {
+	mu     sync.Mutex
+	counts map[netip.Addr]int64
+}
+
+// acquire takes a slot for ip unless it already has limit sessions.
+func (s *ipSessions) acquire(ip netip.Addr, limit int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts[ip] >= limit {
+		return false
+	}
+	if s.counts == nil {
+		s.counts = make(map[netip.Addr]int64)
+	}
+	s.counts[ip]++
+	return true
+}
+
+func (s *ipSessions) release(ip netip.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts[ip] <= 1 {
+		delete(s.counts, ip)
+		return
+	}
+	s.counts[ip]--
+}
+
+// writeIPCapped answers a CONNECT from a client IP at its session cap. It
+// is a per-client limit, so it shares the rate_limit rejection override.
+func writeIPCapped(w http.ResponseWriter, rc *RuntimeConfig, route *Route, retryAfter time.Duration) {
+	if s := retryAfterSeconds(retryAfter); s > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(s))
+	}
+	rc.reject(w, route, "rate_limit", http.StatusTooManyRequests, "too many sessions from this address")
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+// DefaultPingMisses is how many consecutive pings may go unanswered before
+// a session is torn down.
+const DefaultPingMisses = 3
+
+// keepAlive pings one side of the session every interval and terminates the
+// session with 1001 once misses pings in a row got no pong. The pings are
+// RTT probes, so their pongs are consumed by the pumps and measured as
+// well. With idleOnly, pings are only sent while the session has carried no
+// frames for interval; traffic starts the count over. The client side is
+// not pinged while the session is parked for a resume.
+func keepAlive(ctx context.Context, sess *session, side string, interval time.Duration, misses int, idleOnly bool, ping func(payload []byte, now time.Time) error) {
+	pongAt := &sess.clientPongAt
+	if side == "backend" {
+		pongAt = &sess.backendPongAt
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	missed := 0
+	var sent time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if side == "client" && sess.parked.Load() {
+				// Pings would only be buffered for a client that may
+				// come back within the resume window; start over then.
+				missed, sent = 0, time.Time{}
+				continue
+			}
+			if idleOnly && sess.idleFor(now) < interval {
+				missed, sent = 0, time.Time{}
+				continue
+			}
+			if !sent.IsZero() {
+				if pongAt.Load() < sent.UnixNano() {
+					missed++
+				} else {
+					missed = 0
+				}
+			}
+			if missed >= misses {
+				metrics.KeepaliveTimeouts.WithLabelValues(side).Inc()
+				sess.debugf("%s missed %d pings, closing session", side, missed)
+				sess.terminate(1001, "ping timeout")
+				return
+			}
+			sent = now
+			_ = ping(rttProbePayload(now), now)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientPingTimeout(t *testing.T) {
+	backendURL, closeBackend := startEchoBackend(t)
+	defer closeBackend()
+	for _, answer := range []bool{true, false} {
+		backendConn, _, err := websocket.DefaultDialer.Dial(backendURL, nil)
+		if err != nil {
+			t.Fatalf("dial backend websocket: %v", err)
+		}
+		quicSide, proxySide := net.Pipe()
+		terminated := make(chan int, 1)
+		sess := &session{id: "s1", started: time.Now()}
+		sess.terminate = func(code int, _ string) { terminated <- code }
+		limits := config.Limits{MaxFrameSize: 1024, MaxMessageSize: 1024, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() { _ = pumpH3ToBackend(ctx, proxySide, backendConn, limits, &sessionTrafficStats{}, sess, "", "") }()
+		go keepAlive(ctx, sess, "client", 10*time.Millisecond, 3, false, func(payload []byte, _ time.Time) error {
+			return ws.WriteControlFrame(proxySide, ws.OpPing, payload)
+		})
+		go func() {
+			br := bufio.NewReader(quicSide)
+			for {
+				f, err := ws.ReadFrame(br, 0)
+				if err != nil {
+					return
+				}
+				if answer && f.Opcode == ws.OpPing {
+					_ = ws.WriteDataFrame(quicSide, ws.OpPong, f.Payload, true, 0)
+				}
+			}
+		}()
+
+		select {
+		case code := <-terminated:
+			if answer {
+				t.Fatalf("answering client terminated with %d", code)
+			}
+			if code != 1001 {
+				t.Fatalf("close code = %d, want 1001", code)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if !answer {
+				t.Fatal("silent client was not terminated")
+			}
+		}
+		cancel()
+		quicSide.Close()
+		proxySide.Close()
+		backendConn.Close()
+	}
+}
+
+func TestClientPingPausedWhileParked(t *testing.T) {
+	const (
+		interval     = 10 * time.Millisecond
+		misses       = 3
+		resumeWindow = 150 * time.Millisecond
+	)
+	terminated := make(chan int, 1)
+	sess := &session{id: "s1", started: time.Now()}
+	sess.terminate = func(code int, _ string) { terminated <- code }
+	cw := newClientWriter(io.Discard, 1<<20)
+	cw.detach()
+	sess.parked.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go keepAlive(ctx, sess, "client", interval, misses, false, func(payload []byte, _ time.Time) error {
+		return ws.WriteControlFrame(cw, ws.OpPing, payload)
+	})
+
+	// The resume window is far longer than interval*misses: the parked
+	// session must still be there when it ends.
+	select {
+	case code := <-terminated:
+		t.Fatalf("parked session terminated with %d", code)
+	case <-time.After(resumeWindow):
+	}
+
+	// Resumed by a client that never answers, the count starts again.
+	sess.parked.Store(false)
+	if n, err := cw.attach(io.Discard); err != nil || n != 0 {
+		t.Fatalf("attach: replayed %d frames, err %v; want no buffered pings", n, err)
+	}
+	select {
+	case code := <-terminated:
+		if code != 1001 {
+			t.Fatalf("close code = %d, want 1001", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("silent resumed client was not terminated")
+	}
+}
+
+func TestBackendPingTimeout(t *testing.T) {
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if r.URL.Query().Has("mute") {
+			conn.SetPingHandler(func(string) error { return nil })
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	for _, answer := range []bool{true, false} {
+		u := wsURL
+		if !answer {
+			u += "?mute"
+		}
+		backendConn, _, err := websocket.DefaultDialer.Dial(u, nil)
+		if err != nil {
+			t.Fatalf("dial backend websocket: %v", err)
+		}
+		quicSide, proxySide := net.Pipe()
+		go func() { _, _ = io.Copy(io.Discard, quicSide) }()
+		terminated := make(chan int, 1)
+		sess := &session{id: "s1", started: time.Now()}
+		sess.terminate = func(code int, _ string) { terminated <- code }
+		limits := config.Limits{MaxFrameSize: 1024, MaxMessageSize: 1024, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() { _ = pumpBackendToH3(ctx, backendConn, proxySide, limits, &sessionTrafficStats{}, sess, "", "") }()
+		go keepAlive(ctx, sess, "backend", 10*time.Millisecond, 3, true, func(payload []byte, now time.Time) error {
+			return backendConn.WriteControl(websocket.PingMessage, payload, now.Add(time.Second))
+		})
+
+		select {
+		case code := <-terminated:
+			if answer {
+				t.Fatalf("answering backend terminated with %d", code)
+			}
+			if code != 1001 {
+				t.Fatalf("close code = %d, want 1001", code)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if !answer {
+				t.Fatal("silent backend was not terminated")
+			}
+		}
+		cancel()
+		quicSide.Close()
+		proxySide.Close()
+		backendConn.Close()
+	}
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"runtime"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+// ParseLogLevel maps a level name to its slog level.
+func ParseLogLevel(name string) (slog.Level, error) {
+	switch name {
+	case LogLevelDebug:
+		return slog.LevelDebug, nil
+	case LogLevelInfo:
+		return slog.LevelInfo, nil
+	case LogLevelWarn:
+		return slog.LevelWarn, nil
+	case LogLevelError:
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("level must be one of %s, %s, %s or %s, got %q", LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError, name)
+}
+
+func logLevelName(l slog.Level) string {
+	switch {
+	case l <= slog.LevelDebug:
+		return LogLevelDebug
+	case l <= slog.LevelInfo:
+		return LogLevelInfo
+	case l <= slog.LevelWarn:
+		return LogLevelWarn
+	}
+	return LogLevelError
+}
+
+// DebugTargets selects sessions whose debug logs are written while the
+// global level is info. A session matches if its client IP, route or ID
+// matches any entry.
+type DebugTargets struct {
+	// ClientIPs holds addresses or CIDR prefixes.
+	ClientIPs []string `json:"client_ips,omitempty"`
+	Routes    []string `json:"routes,omitempty"`
+	Sessions  []string `json:"sessions,omitempty"`
+	// Until switches the targets off automatically; zero keeps them.
+	Until time.Time `json:"until,omitzero"`
+}
+
+// LogSettings is the runtime logging state exposed by the admin API.
+type LogSettings struct {
+	Level   string        `json:"level"`
+	Targets *DebugTargets `json:"targets,omitempty"`
+}
+
+type debugFilter struct {
+	spec     DebugTargets
+	prefixes []netip.Prefix
+}
+
+func compileDebugTargets(t DebugTargets) (*debugFilter, error) {
+	f := &debugFilter{spec: t}
+	for _, s := range t.ClientIPs {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(s)
+			if aerr != nil {
+				return nil, fmt.Errorf("client ip %q: not an address or CIDR prefix", s)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		f.prefixes = append(f.prefixes, prefix.Masked())
+	}
+	return f, nil
+}
+
+func (f *debugFilter) matches(s *session, now time.Time) bool {
+	if !f.spec.Until.IsZero() && now.After(f.spec.Until) {
+		return false
+	}
+	if s.clientIP.IsValid() {
+		for _, p := range f.prefixes {
+			if p.Contains(s.clientIP) {
+				return true
+			}
+		}
+	}
+	return slices.Contains(f.spec.Routes, routeName(s.route)) || (s.id != "" && slices.Contains(f.spec.Sessions, s.id))
+}
+
+// logControl holds the runtime log level and debug targets.
+type logControl struct {
+	level  *slog.LevelVar
+	filter atomic.Pointer[debugFilter]
+}
+
+func (l *logControl) debug() bool {
+	return l.level.Level() <= slog.LevelDebug
+}
+
+func (l *logControl) enabledFor(s *session) bool {
+	if l.debug() {
+		return true
+	}
+	f := l.filter.Load()
+	return f != nil && f.matches(s, time.Now())
+}
+
+// logControl returns the proxy's log control. Without LogLevel the level
+// is seeded from Debug on first use.
+func (p *Proxy) logControl() *logControl {
+	p.logsOnce.Do(func() {
+		p.logs.level = p.LogLevel
+		if p.logs.level == nil {
+			p.logs.level = new(slog.LevelVar)
+			if p.Debug {
+				p.logs.level.Set(slog.LevelDebug)
+			}
+		}
+	})
+	return &p.logs
+}
+
+func (p *Proxy) debugf(format string, args ...any) {
+	if p.logControl().debug() {
+		writeDebug("", format, args...)
+	}
+}
+
+// writeDebug logs a debug record even when the logger's level is higher:
+// callers have already decided it is wanted, e.g. for a debug target. A
+// non-empty session adds a session attribute.
+func writeDebug(session, format string, args ...any) {
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:])
+	r := slog.NewRecord(time.Now(), slog.LevelDebug, fmt.Sprintf(format, args...), pcs[0])
+	if session != "" {
+		r.AddAttrs(slog.String("session", session))
+	}
+	_ = slog.Default().Handler().Handle(context.Background(), r)
+}
+
+// LogSettings returns the current level and the debug targets, if any are
+// still active.
+func (p *Proxy) LogSettings() LogSettings {
+	l := p.logControl()
+	s := LogSettings{Level: logLevelName(l.level.Level())}
+	if f := l.filter.Load(); f != nil && (f.spec.Until.IsZero() || time.Now().Before(f.spec.Until)) {
+		t := f.spec
+		s.Targets = &t
+	}
+	return s
+}
+
+// SetLogSettings switches the level and replaces the debug targets. Running
+// sessions pick up the change with their next log line.
+func (p *Proxy) SetLogSettings(s LogSettings) error {
+	level, err := ParseLogLevel(s.Level)
+	if err != nil {
+		return err
+	}
+	var f *debugFilter
+	if s.Targets != nil {
+		if f, err = compileDebugTargets(*s.Targets); err != nil {
+			return err
+		}
+	}
+	l := p.logControl()
+	l.level.Set(level)
+	l.filter.Store(f)
+	return nil
+}
+
+// debugging reports whether debug logs are on for this session.
+func (s *session) debugging() bool {
+	return s.logs != nil && s.logs.enabledFor(s)
+}
+
+func (s *session) debugf(format string, args ...any) {
+	if s.debugging() {
+		writeDebug(s.id, format, args...)
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bytes"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// debugLogs returns a log control with debug on, for tests that exercise
+// the debug logging paths.
+func debugLogs() *logControl {
+	l := &logControl{level: new(slog.LevelVar)}
+	l.level.Set(slog.LevelDebug)
+	return l
+}
+
+func TestDebugTargets(t *testing.T) {
+	p := &Proxy{}
+	newSession := func(ip, route, id string) *session {
+		return &session{logs: p.logControl(), clientIP: netip.MustParseAddr(ip), route: &Route{Name: route}, id: id}
+	}
+	a := newSession("203.0.113.7", "chat", "aaaa")
+	b := newSession("198.51.100.1", "feed", "bbbb")
+	c := newSession("198.51.100.2", "chat", "cccc")
+	if a.debugging() || b.debugging() {
+		t.Fatal("debug on without targets")
+	}
+
+	err := p.SetLogSettings(LogSettings{Level: LogLevelInfo, Targets: &DebugTargets{ClientIPs: []string{"203.0.113.0/24"}, Sessions: []string{"bbbb"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.debugging() || !b.debugging() || c.debugging() {
+		t.Fatalf("ip/session targets: a=%v b=%v c=%v", a.debugging(), b.debugging(), c.debugging())
+	}
+
+	if err := p.SetLogSettings(LogSettings{Level: LogLevelInfo, Targets: &DebugTargets{Routes: []string{"chat"}, Until: time.Now().Add(-time.Second)}}); err != nil {
+		t.Fatal(err)
+	}
+	if c.debugging() || p.LogSettings().Targets != nil {
+		t.Fatal("expired targets still active")
+	}
+
+	if err := p.SetLogSettings(LogSettings{Level: LogLevelDebug}); err != nil {
+		t.Fatal(err)
+	}
+	if !b.debugging() || p.LogSettings().Level != LogLevelDebug {
+		t.Fatal("global debug level not applied")
+	}
+
+	for _, bad := range []LogSettings{{Level: "trace"}, {Level: LogLevelInfo, Targets: &DebugTargets{ClientIPs: []string{"not-an-ip"}}}} {
+		if err := p.SetLogSettings(bad); err == nil {
+			t.Errorf("SetLogSettings(%+v) succeeded", bad)
+		}
+	}
+}
+
+func TestLogLevelShared(t *testing.T) {
+	level := new(slog.LevelVar)
+	p := &Proxy{LogLevel: level, Debug: true}
+	if p.LogSettings().Level != LogLevelInfo {
+		t.Errorf("Debug overrode the shared level: %s", p.LogSettings().Level)
+	}
+	if err := p.SetLogSettings(LogSettings{Level: LogLevelWarn}); err != nil {
+		t.Fatal(err)
+	}
+	if level.Level() != slog.LevelWarn || p.LogSettings().Level != LogLevelWarn {
+		t.Errorf("level = %s, settings = %s", level.Level(), p.LogSettings().Level)
+	}
+}
+
+func TestWriteDebugBypassesLevel(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	defer slog.SetDefault(prev)
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	s := &session{logs: debugLogs(), id: "aaaa"}
+	s.debugf("traced session=%s", s.id)
+	slog.Debug("dropped")
+	if out := buf.String(); !strings.Contains(out, `level=DEBUG msg="traced session=aaaa"`) || strings.Contains(out, "dropped") {
+		t.Errorf("log output %q", out)
+	}
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"h3ws2h1ws-proxy/internal/schema"
+	"h3ws2h1ws-proxy/internal/ws"
+)
+
+// MessagePolicy is what happens to a client message that fails validation.
+type MessagePolicy int8
+
+const (
+	// MessageClose ends the session with 1008 (policy violation).
+	MessageClose MessagePolicy = iota
+	// MessageReject drops the message and keeps the session.
+	MessageReject
+	// MessageLog forwards the message and only records the violation.
+	MessageLog
+)
+
+func ParseMessagePolicy(s string) (MessagePolicy, error) {
+	switch s {
+	case "", "close":
+		return MessageClose, nil
+	case "reject":
+		return MessageReject, nil
+	case "log":
+		return MessageLog, nil
+	}
+	return MessageClose, fmt.Errorf("unknown message policy %q", s)
+}
+
+func (p MessagePolicy) String() string {
+	switch p {
+	case MessageReject:
+		return "reject"
+	case MessageLog:
+		return "log"
+	default:
+		return "close"
+	}
+}
+
+// MessageRules validates client->backend messages on a route. Nil fields
+// and zero lengths are not checked.
+type MessageRules struct {
+	TextSchema      *schema.Schema
+	BinaryMinLength int
+	BinaryMaxLength int
+	BinaryMagic     []byte
+	BinaryProto     *schema.Proto // checks what follows BinaryMagic
+	Policy          MessagePolicy
+}
+
+func (m *MessageRules) check(op byte, msg []byte) error {
+	if m == nil {
+		return nil
+	}
+	switch op {
+	case ws.OpText:
+		if m.TextSchema != nil {
+			return m.TextSchema.Validate(msg)
+		}
+	case ws.OpBinary:
+		if len(msg) < m.BinaryMinLength {
+			return fmt.Errorf("binary message shorter than %d bytes", m.BinaryMinLength)
+		}
+		if m.BinaryMaxLength > 0 && len(msg) > m.BinaryMaxLength {
+			return fmt.Errorf("binary message longer than %d bytes", m.BinaryMaxLength)
+		}
+		if !bytes.HasPrefix(msg, m.BinaryMagic) {
+			return errors.New("binary message has wrong magic prefix")
+		}
+		if m.BinaryProto != nil {
+			return m.BinaryProto.Validate(msg[len(m.BinaryMagic):])
+		}
+	}
+	return nil
+}
+
+func (s *session) messageRules() *MessageRules {
+	if s.route == nil {
+		return nil
+	}
+	return s.route.Messages
+}
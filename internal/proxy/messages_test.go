@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/schema"
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMessageRulesPolicies(t *testing.T) {
+	textSchema, err := schema.Compile([]byte(`{"type":"object","required":["op"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := config.Limits{MaxFrameSize: 1024, MaxMessageSize: 1024, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
+
+	run := func(t *testing.T, policy MessagePolicy) (net.Conn, *bufio.Reader) {
+		backendURL, closeBackend := startEchoBackend(t)
+		t.Cleanup(closeBackend)
+		backendConn, _, err := websocket.DefaultDialer.Dial(backendURL, nil)
+		if err != nil {
+			t.Fatalf("dial backend websocket: %v", err)
+		}
+		t.Cleanup(func() { _ = backendConn.Close() })
+		quicSide, proxySide := net.Pipe()
+		t.Cleanup(func() { _ = quicSide.Close(); _ = proxySide.Close() })
+
+		route := &Route{Name: "api", Messages: &MessageRules{
+			TextSchema:      textSchema,
+			BinaryMagic:     []byte{0xca, 0xfe},
+			BinaryMaxLength: 8,
+			Policy:          policy,
+		}}
+		sess := &session{route: route}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		stats := &sessionTrafficStats{}
+		go func() { _ = pumpH3ToBackend(ctx, proxySide, backendConn, limits, stats, sess, "", "") }()
+		go func() { _ = pumpBackendToH3(ctx, backendConn, proxySide, limits, stats, sess, "", "") }()
+		if err := quicSide.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		return quicSide, bufio.NewReader(quicSide)
+	}
+	send := func(t *testing.T, c net.Conn, op byte, msg string) {
+		if err := ws.WriteDataFrame(c, op, []byte(msg), true, 0); err != nil {
+			t.Fatalf("write frame: %v", err)
+		}
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		c, br := run(t, MessageReject)
+		send(t, c, ws.OpText, `{"foo":1}`)
+		send(t, c, ws.OpBinary, "\x00\x01")
+		send(t, c, ws.OpBinary, "\xca\xfe\x01")
+		op, msg, err := readWSMessage(br, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != ws.OpBinary || string(msg) != "\xca\xfe\x01" {
+			t.Fatalf("got op=%d msg=%q, want only the valid binary message", op, msg)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		c, br := run(t, MessageClose)
+		send(t, c, ws.OpText, `{"op":"sub"}`)
+		if _, msg, err := readWSMessage(br, 0); err != nil || string(msg) != `{"op":"sub"}` {
+			t.Fatalf("valid message: %q, %v", msg, err)
+		}
+		send(t, c, ws.OpText, `[]`)
+		f, err := ws.ReadFrame(br, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code, _ := ws.ParseClosePayload(f.Payload); f.Opcode != ws.OpClose || code != 1008 {
+			t.Fatalf("got opcode=%d code=%d, want close 1008", f.Opcode, code)
+		}
+	})
+
+	t.Run("log", func(t *testing.T) {
+		c, br := run(t, MessageLog)
+		send(t, c, ws.OpText, `"not an object"`)
+		if _, msg, err := readWSMessage(br, 0); err != nil || string(msg) != `"not an object"` {
+			t.Fatalf("logged message not forwarded: %q, %v", msg, err)
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+// MessageRateAction is what happens to a session whose client sends
+// messages faster than MessageRate allows.
+type MessageRateAction int8
+
+const (
+	// MessageRateClose closes the session with 1008.
+	MessageRateClose MessageRateAction = iota
+	// MessageRateThrottle stops reading from the client until the bucket
+	// has refilled.
+	MessageRateThrottle
+)
+
+func ParseMessageRateAction(s string) (MessageRateAction, error) {
+	switch s {
+	case "", "close":
+		return MessageRateClose, nil
+	case "throttle":
+		return MessageRateThrottle, nil
+	}
+	return MessageRateClose, fmt.Errorf("unknown message rate action %q (want close or throttle)", s)
+}
+
+func (a MessageRateAction) String() string {
+	if a == MessageRateThrottle {
+		return "throttle"
+	}
+	return "close"
+}
+
+// errMessageRate fails a session whose client exceeded the message rate
+// under MessageRateClose.
+var errMessageRate = errors.New("client message rate exceeded")
+
+// admitMessage is called when a client message starts. It returns
+// errMessageRate or waits, depending on the action, when the session is
+// over its message rate.
+func (s *session) admitMessage(ctx context.Context) error {
+	if s.msgLimiter == nil {
+		return nil
+	}
+	counted := false
+	for {
+		d, _ := s.msgLimiter.Allow(ctx, "")
+		if d.Allowed {
+			return nil
+		}
+		if !counted {
+			metrics.MessageRateLimited.WithLabelValues(s.msgAction.String()).Inc()
+			counted = true
+		}
+		if s.msgAction == MessageRateClose {
+			return errMessageRate
+		}
+		timer := time.NewTimer(d.RetryAfter)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/ratelimit"
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMessageRateClosesFloodingClient(t *testing.T) {
+	backendURL, closeBackend := startEchoBackend(t)
+	defer closeBackend()
+	backendConn, _, err := websocket.DefaultDialer.Dial(backendURL, nil)
+	if err != nil {
+		t.Fatalf("dial backend websocket: %v", err)
+	}
+	defer backendConn.Close()
+	quicSide, proxySide := net.Pipe()
+	defer quicSide.Close()
+	defer proxySide.Close()
+
+	sess := &session{id: "s1", started: time.Now(), msgLimiter: ratelimit.NewLocal(1, 2), msgAction: MessageRateClose}
+	limits := config.Limits{MaxFrameSize: 1024, MaxMessageSize: 1024, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- pumpH3ToBackend(ctx, proxySide, backendConn, limits, &sessionTrafficStats{}, sess, "", "")
+	}()
+
+	if err := quicSide.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := ws.WriteDataFrame(quicSide, ws.OpText, []byte("spam"), true, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() { _ = ws.WriteDataFrame(quicSide, ws.OpText, []byte("spam"), true, 0) }()
+	f, err := ws.ReadFrame(bufio.NewReader(quicSide), 0)
+	if err != nil {
+		t.Fatalf("read close: %v", err)
+	}
+	if code, _ := ws.ParseClosePayload(f.Payload); f.Opcode != ws.OpClose || code != 1008 {
+		t.Fatalf("got opcode %d code %d, want close 1008", f.Opcode, code)
+	}
+	if err := <-errCh; !errors.Is(err, errMessageRate) {
+		t.Fatalf("pump error = %v, want errMessageRate", err)
+	}
+}
+
+func TestMessageRateThrottleWaits(t *testing.T) {
+	sess := &session{msgLimiter: ratelimit.NewLocal(20, 1), msgAction: MessageRateThrottle}
+	start := time.Now()
+	for range 3 {
+		if err := sess.admitMessage(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("three messages at 20/s with a burst of 1 took %s, want 100ms", elapsed)
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"regexp"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+// ClientCertPolicy admits a route's sessions by the client certificate the
+// TLS handshake verified. Allow and Deny match the subject DN and the SANs
+// as returned by clientCertIdentities.
+type ClientCertPolicy struct {
+	Required bool
+	Allow    []*regexp.Regexp
+	Deny     []*regexp.Regexp
+}
+
+// permits reports whether a session with the verified leaf cert (nil when
+// the client sent none) may use the route.
+func (p *ClientCertPolicy) permits(cert *x509.Certificate) bool {
+	if p == nil {
+		return true
+	}
+	if cert == nil {
+		return !p.Required && len(p.Allow) == 0
+	}
+	ids := clientCertIdentities(cert)
+	if matchesAny(p.Deny, ids) {
+		return false
+	}
+	return len(p.Allow) == 0 || matchesAny(p.Allow, ids)
+}
+
+func matchesAny(res []*regexp.Regexp, ids []string) bool {
+	for _, re := range res {
+		for _, id := range ids {
+			if re.MatchString(id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clientCertIdentities lists the subject DN and the SANs of cert, the
+// latter prefixed with their kind: dns:, email:, uri: or ip:.
+func clientCertIdentities(cert *x509.Certificate) []string {
+	ids := []string{cert.Subject.String()}
+	for _, n := range cert.DNSNames {
+		ids = append(ids, "dns:"+n)
+	}
+	for _, e := range cert.EmailAddresses {
+		ids = append(ids, "email:"+e)
+	}
+	for _, u := range cert.URIs {
+		ids = append(ids, "uri:"+u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		ids = append(ids, "ip:"+ip.String())
+	}
+	return ids
+}
+
+// verifiedClientCert returns the client certificate of r if the TLS
+// handshake verified it against -client-ca.
+func verifiedClientCert(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// rejectClientCert refuses a CONNECT whose client certificate the route's
+// policy does not admit.
+func rejectClientCert(w http.ResponseWriter, rt *RuntimeConfig, route *Route, r *http.Request) bool {
+	if route == nil || route.ClientCert.permits(verifiedClientCert(r.TLS)) {
+		return false
+	}
+	metrics.Rejected.WithLabelValues("mtls").Inc()
+	rejectRoute(route, "mtls")
+	rt.reject(w, route, "mtls", http.StatusForbidden, "client certificate not allowed")
+	return true
+}
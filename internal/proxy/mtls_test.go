@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+func TestClientCertPolicy(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://acme/billing")
+	billing := &x509.Certificate{Subject: pkix.Name{CommonName: "billing", Organization: []string{"Acme"}}, URIs: []*url.URL{spiffe}}
+	intern := &x509.Certificate{Subject: pkix.Name{CommonName: "intern", Organization: []string{"Acme"}}, DNSNames: []string{"laptop.acme.test"}}
+
+	tests := []struct {
+		name   string
+		policy *ClientCertPolicy
+		cert   *x509.Certificate
+		want   bool
+	}{
+		{"no policy", nil, nil, true},
+		{"optional without cert", &ClientCertPolicy{}, nil, true},
+		{"required without cert", &ClientCertPolicy{Required: true}, nil, false},
+		{"allow list without cert", &ClientCertPolicy{Allow: []*regexp.Regexp{regexp.MustCompile(`^uri:spiffe://acme/`)}}, nil, false},
+		{"allowed san", &ClientCertPolicy{Allow: []*regexp.Regexp{regexp.MustCompile(`^uri:spiffe://acme/`)}}, billing, true},
+		{"not allowed", &ClientCertPolicy{Allow: []*regexp.Regexp{regexp.MustCompile(`^uri:spiffe://acme/`)}}, intern, false},
+		{"allowed subject", &ClientCertPolicy{Allow: []*regexp.Regexp{regexp.MustCompile(`O=Acme`)}}, intern, true},
+		{"denied wins", &ClientCertPolicy{Allow: []*regexp.Regexp{regexp.MustCompile(`O=Acme`)}, Deny: []*regexp.Regexp{regexp.MustCompile(`^dns:.*\.acme\.test$`)}}, intern, false},
+	}
+	for _, tc := range tests {
+		if got := tc.policy.permits(tc.cert); got != tc.want {
+			t.Errorf("%s: permits = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	route := &Route{Name: "billing", Path: regexp.MustCompile(`^/billing`), ClientCert: &ClientCertPolicy{Required: true}}
+	rt := &RuntimeConfig{Routes: []*Route{route}}
+	r := httptest.NewRequest(http.MethodConnect, "/billing", nil)
+	rr := httptest.NewRecorder()
+	if !rejectClientCert(rr, rt, route, r) || rr.Code != http.StatusForbidden {
+		t.Fatalf("session without a certificate: rejected=%d", rr.Code)
+	}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{billing}}}
+	if rejectClientCert(httptest.NewRecorder(), rt, route, r) {
+		t.Fatal("session with a verified certificate was rejected")
+	}
+}
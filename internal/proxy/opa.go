@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/jwt"
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+// Policy asks an Open Policy Agent whether a session may start, using
+// OPA's data API: URL names the decision, e.g.
+// http://127.0.0.1:8181/v1/data/h3ws/session.
+//
+// The decision is either a boolean or an object with a boolean "allow"
+// and optional "labels", string values attached to the session for
+// logging and the admin API. A "priority" label (low, normal or high) also
+// sets the session's priority class. An undefined decision denies.
+type Policy struct {
+	URL     string
+	Client  *http.Client
+	Timeout time.Duration
+}
+
+// PolicyInput is the "input" document a policy sees.
+type PolicyInput struct {
+	Method   string            `json:"method"`
+	Path     string            `json:"path"`
+	Query    string            `json:"query,omitempty"`
+	Host     string            `json:"host"`
+	SNI      string            `json:"sni,omitempty"`
+	ClientIP string            `json:"client_ip"`
+	Headers  map[string]string `json:"headers"`
+	Route    string            `json:"route"`
+	Tenant   string            `json:"tenant"`
+	Claims   jwt.Claims        `json:"claims,omitempty"`
+}
+
+type policyDecision struct {
+	Allow  bool
+	Labels map[string]string
+}
+
+func (d *policyDecision) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &d.Allow); err == nil {
+		return nil
+	}
+	var obj struct {
+		Allow  bool           `json:"allow"`
+		Labels map[string]any `json:"labels"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return fmt.Errorf("decision is neither a boolean nor an object with allow: %w", err)
+	}
+	d.Allow = obj.Allow
+	if len(obj.Labels) > 0 {
+		d.Labels = make(map[string]string, len(obj.Labels))
+		for k, v := range obj.Labels {
+			d.Labels[k] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+func (p *Policy) decide(ctx context.Context, input PolicyInput) (policyDecision, error) {
+	body, err := json.Marshal(map[string]any{"input": input})
+	if err != nil {
+		return policyDecision{}, err
+	}
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return policyDecision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	metrics.PolicyDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return policyDecision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return policyDecision{}, fmt.Errorf("OPA answered %s", resp.Status)
+	}
+	var out struct {
+		Result *policyDecision `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return policyDecision{}, fmt.Errorf("bad OPA response: %w", err)
+	}
+	if out.Result == nil {
+		return policyDecision{}, nil
+	}
+	return *out.Result, nil
+}
+
+func policyInput(r *http.Request, route *Route, tenant *Tenant, claims jwt.Claims) PolicyInput {
+	in := PolicyInput{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Query:    r.URL.RawQuery,
+		Host:     requestHost(r),
+		ClientIP: clientIP(r),
+		Headers:  make(map[string]string, len(r.Header)),
+		Route:    routeName(route),
+		Tenant:   tenantName(tenant),
+		Claims:   claims,
+	}
+	if r.TLS != nil {
+		in.SNI = r.TLS.ServerName
+	}
+	for name, values := range r.Header {
+		in.Headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+	return in
+}
+
+// checkPolicy consults the Policy for r. It answers the CONNECT and returns
+// false when the session may not proceed; on success the decision's labels
+// are kept in sess, and a "priority" label sets its class.
+func (p *Proxy) checkPolicy(w http.ResponseWriter, rt *RuntimeConfig, route *Route, tenant *Tenant, r *http.Request, sess *session) bool {
+	if p.Policy == nil {
+		return true
+	}
+	d, err := p.Policy.decide(r.Context(), policyInput(r, route, tenant, sess.claims))
+	if err != nil {
+		slog.Error("policy query failed", "session", sess.id, "url", p.Policy.URL, "err", err)
+		metrics.PolicyDecisions.WithLabelValues("error").Inc()
+		metrics.Rejected.WithLabelValues("acl").Inc()
+		rejectRoute(route, "acl")
+		rt.reject(w, route, "acl", http.StatusServiceUnavailable, "authorization unavailable")
+		return false
+	}
+	if !d.Allow {
+		sess.debugf("policy: denied: remote=%s path=%s", r.RemoteAddr, r.URL.Path)
+		metrics.PolicyDecisions.WithLabelValues("deny").Inc()
+		metrics.Rejected.WithLabelValues("acl").Inc()
+		rejectRoute(route, "acl")
+		rt.reject(w, route, "acl", http.StatusForbidden, "forbidden by policy")
+		return false
+	}
+	metrics.PolicyDecisions.WithLabelValues("allow").Inc()
+	sess.labels = d.Labels
+	sess.setIdentityPriority("policy: priority label", d.Labels["priority"])
+	return true
+}
+
+// formatLabels renders policy labels as sorted k=v pairs for log lines.
+func formatLabels(labels map[string]string) string {
+	var b strings.Builder
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", k, labels[k])
+	}
+	return b.String()
+}
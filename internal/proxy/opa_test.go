@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		input  PolicyInput
+		answer string
+	)
+	opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Input PolicyInput }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		input = body.Input
+		if answer == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(answer))
+	}))
+	defer opa.Close()
+	p := &Proxy{Policy: &Policy{URL: opa.URL}}
+	rt := &RuntimeConfig{}
+	route := &Route{Name: "chat"}
+	setAnswer := func(a string) {
+		mu.Lock()
+		defer mu.Unlock()
+		answer = a
+	}
+	check := func() (*httptest.ResponseRecorder, *session, bool) {
+		r := httptest.NewRequest(http.MethodConnect, "/chat?room=1", nil)
+		r.Host = "chat.example.com:443"
+		r.TLS = &tls.ConnectionState{ServerName: "chat.example.com"}
+		r.Header.Set("X-Team", "blue")
+		w := httptest.NewRecorder()
+		sess := &session{}
+		ok := p.checkPolicy(w, rt, route, nil, r, sess)
+		return w, sess, ok
+	}
+
+	setAnswer(`{"result": {"allow": true, "labels": {"team": "blue", "tier": 2}}}`)
+	_, sess, ok := check()
+	if !ok || !reflect.DeepEqual(sess.labels, map[string]string{"team": "blue", "tier": "2"}) {
+		t.Errorf("allowed: ok=%v labels=%v", ok, sess.labels)
+	}
+	want := PolicyInput{Method: "CONNECT", Path: "/chat", Query: "room=1", Host: "chat.example.com", SNI: "chat.example.com", ClientIP: "192.0.2.1", Headers: map[string]string{"x-team": "blue"}, Route: "chat", Tenant: "default"}
+	mu.Lock()
+	if !reflect.DeepEqual(input, want) {
+		t.Errorf("input = %+v", input)
+	}
+	mu.Unlock()
+	if got := formatLabels(sess.labels); got != `team="blue",tier="2"` {
+		t.Errorf("formatLabels = %s", got)
+	}
+
+	setAnswer(`{"result": true}`)
+	if _, _, ok := check(); !ok {
+		t.Error("boolean true decision denied")
+	}
+	for decision, status := range map[string]int{
+		`{"result": false}`:            http.StatusForbidden,
+		`{"result": {"allow": false}}`: http.StatusForbidden,
+		`{}`:                           http.StatusForbidden, // undefined
+		`{"result": "yes"}`:            http.StatusServiceUnavailable,
+		``:                             http.StatusServiceUnavailable,
+	} {
+		setAnswer(decision)
+		if w, _, ok := check(); ok || w.Code != status {
+			t.Errorf("%q: ok=%v status=%d, want %d", decision, ok, w.Code, status)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/metrics"
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/gorilla/websocket"
+)
+
+// opaqueChunk is how much payload an opaque relay moves per copy; it is
+// also the largest frame it sends to the client.
+const opaqueChunk = 32 << 10
+
+// errUnknownOpcode fails a client frame with an opcode RFC 6455 reserves.
+var errUnknownOpcode = errors.New("protocol error: reserved opcode")
+
+// relayClientOpaque streams client data frames into backend messages
+// without holding them: only frame headers are parsed, and payloads are
+// copied from the stream into NextWriter as they arrive. Message size is
+// checked against frame headers, before their payload is read.
+func relayClientOpaque(ctx context.Context, s io.ReadWriter, bws *websocket.Conn, lim config.Limits, st *sessionTrafficStats, sess *session) error {
+	br := bufio.NewReaderSize(s, opaqueChunk)
+	buf := make([]byte, opaqueChunk)
+	var mw io.WriteCloser
+	var messageSize int64
+	var kind string
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		h, err := ws.ReadFrameHeader(br)
+		if err != nil {
+			if errors.Is(err, io.EOF) || ws.IsNetClose(err) {
+				sess.debugf("h3->h1 input half-closed: %v", err)
+				return nil
+			}
+			if errors.Is(err, ws.ErrBadControlFrame) {
+				metrics.Errors.WithLabelValues("protocol").Inc()
+				_ = ws.WriteCloseFrame(s, 1002, "invalid control frame")
+			}
+			return err
+		}
+		if sess.requireMask && !h.Masked {
+			metrics.Errors.WithLabelValues("protocol").Inc()
+			_ = ws.WriteCloseFrame(s, 1002, "unmasked frame")
+			return errUnmaskedFrame
+		}
+		// Opaque sessions negotiate no extensions with the client.
+		if h.Rsv1 || h.Rsv2 || h.Rsv3 {
+			metrics.Errors.WithLabelValues("protocol").Inc()
+			_ = ws.WriteCloseFrame(s, 1002, "reserved bits set")
+			return ws.ErrReservedBits
+		}
+		if h.Opcode >= ws.OpClose {
+			payload := make([]byte, h.Length)
+			if _, err := io.ReadFull(h.PayloadReader(br), payload); err != nil {
+				return err
+			}
+			if done, err := relayClientControl(s, bws, sess, h.Opcode, payload); done || err != nil {
+				return err
+			}
+			continue
+		}
+
+		sess.touch()
+		sess.touchData("h3_to_h1")
+		if err := sess.throttle(ctx, "h3_to_h1", int(h.Length)); err != nil {
+			return err
+		}
+		metrics.Frames.WithLabelValues("h3_to_h1", frameKind(h.Opcode)).Inc()
+		switch h.Opcode {
+		case ws.OpText, ws.OpBinary:
+			if mw != nil {
+				return errors.New("protocol error: new data frame while assembling")
+			}
+			if err := sess.admitMessage(ctx); err != nil {
+				if errors.Is(err, errMessageRate) {
+					_ = ws.WriteCloseFrame(s, 1008, "message rate exceeded")
+				}
+				return err
+			}
+			kind = frameKind(h.Opcode)
+			if mw, err = bws.NextWriter(int(h.Opcode)); err != nil {
+				return err
+			}
+		case ws.OpCont:
+			if mw == nil {
+				return errors.New("protocol error: continuation without start")
+			}
+		default:
+			metrics.Errors.WithLabelValues("protocol").Inc()
+			_ = ws.WriteCloseFrame(s, 1002, "reserved opcode")
+			return errUnknownOpcode
+		}
+		messageSize += h.Length
+		if messageSize > lim.MaxMessageSize {
+			metrics.OversizeDrops.WithLabelValues("message").Inc()
+			_ = ws.WriteCloseFrame(s, 1009, "message too big")
+			return errors.New("message too big")
+		}
+		if err := bws.SetWriteDeadline(time.Now().Add(lim.WriteTimeout)); err != nil {
+			return err
+		}
+		n, err := io.CopyBuffer(mw, h.PayloadReader(br), buf)
+		metrics.Bytes.WithLabelValues("h3_to_h1").Add(float64(n))
+		atomic.AddUint64(&st.h3ToH1Bytes, uint64(n))
+		if err == nil && n < h.Length {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			sess.debugf("h3->h1 opaque copy error: %v", err)
+			return err
+		}
+		if h.Fin {
+			if err := mw.Close(); err != nil {
+				return err
+			}
+			mw = nil
+			metrics.Messages.WithLabelValues("h3_to_h1", kind).Inc()
+			sess.onMessage("h3_to_h1", kind, nil, messageSize)
+			metrics.MessageSize.WithLabelValues("h3_to_h1", kind).Observe(float64(messageSize))
+			atomic.AddUint64(&st.h3ToH1Messages, 1)
+			messageSize = 0
+		}
+	}
+}
+
+// relayClientControl handles a client control frame for an opaque relay.
+// done reports the client's close, which has been forwarded.
+func relayClientControl(s io.Writer, bws *websocket.Conn, sess *session, opcode byte, payload []byte) (done bool, err error) {
+	metrics.Frames.WithLabelValues("h3_to_h1", frameKind(opcode)).Inc()
+	switch opcode {
+	case ws.OpPing:
+		sess.touch()
+		metrics.Ctrl.WithLabelValues("ping").Inc()
+		if err := ws.WriteControlFrame(s, ws.OpPong, payload); err != nil {
+			return false, err
+		}
+		_ = bws.WriteControl(websocket.PingMessage, payload, time.Now().Add(5*time.Second))
+	case ws.OpPong:
+		if d, ok := parseRTTProbe(payload, time.Now()); ok {
+			sess.recordRTT("client", d)
+			return false, nil
+		}
+		sess.touch()
+		metrics.Ctrl.WithLabelValues("pong").Inc()
+		_ = bws.WriteControl(websocket.PongMessage, payload, time.Now().Add(5*time.Second))
+	case ws.OpClose:
+		metrics.Ctrl.WithLabelValues("close").Inc()
+		code, reason := ws.ParseClosePayload(payload)
+		sess.clientClose.Store(int32(code))
+		code = sess.forwardedClose("client", code)
+		_ = bws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(5*time.Second))
+		sess.debugf("h3->h1 close forwarded code=%d reason=%q", code, reason)
+		return true, io.EOF
+	default:
+		metrics.Errors.WithLabelValues("protocol").Inc()
+		_ = ws.WriteCloseFrame(s, 1002, "reserved opcode")
+		return true, errUnknownOpcode
+	}
+	return false, nil
+}
+
+// relayBackendOpaque streams backend messages to the client from
+// NextReader, one frame per opaqueChunk of payload, so no message is held
+// whole. gorilla/websocket enforces the read limit.
+func relayBackendOpaque(ctx context.Context, bws *websocket.Conn, s io.Writer, st *sessionTrafficStats, sess *session) error {
+	closeForwarded := setBackendHandlers(bws, s, sess)
+	buf := make([]byte, opaqueChunk)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		mt, r, err := bws.NextReader()
+		if err != nil {
+			return backendReadError(err, s, sess, *closeForwarded)
+		}
+		sess.touch()
+		sess.touchData("h1_to_h3")
+		opcode := byte(mt)
+		kind := frameKind(opcode)
+		var size int64
+		for fin := false; !fin; {
+			n, eof, err := fill(r, buf)
+			if err != nil {
+				return backendReadError(err, s, sess, *closeForwarded)
+			}
+			fin = eof
+			if err := sess.throttle(ctx, "h1_to_h3", n); err != nil {
+				return err
+			}
+			metrics.Frames.WithLabelValues("h1_to_h3", frameKind(opcode)).Inc()
+			if err := ws.WriteFrame(s, ws.Frame{Fin: fin, Opcode: opcode, Payload: buf[:n]}); err != nil {
+				sess.debugf("h1->h3 opaque write error: %v", err)
+				return err
+			}
+			opcode = ws.OpCont
+			size += int64(n)
+			metrics.Bytes.WithLabelValues("h1_to_h3").Add(float64(n))
+			atomic.AddUint64(&st.h1ToH3Bytes, uint64(n))
+		}
+		metrics.Messages.WithLabelValues("h1_to_h3", kind).Inc()
+		sess.onMessage("h1_to_h3", kind, nil, size)
+		metrics.MessageSize.WithLabelValues("h1_to_h3", kind).Observe(float64(size))
+		atomic.AddUint64(&st.h1ToH3Messages, 1)
+	}
+}
+
+// fill reads into buf until it is full or r is at EOF. Unlike io.ReadFull
+// it tells a message that ended from a connection that broke mid-message.
+func fill(r io.Reader, buf []byte) (n int, eof bool, err error) {
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err == io.EOF {
+			return n, true, nil
+		}
+		if err != nil {
+			return n, false, err
+		}
+	}
+	return n, false, nil
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOpaqueRelayStreamsMessages(t *testing.T) {
+	backendURL, closeBackend := startEchoBackend(t)
+	defer closeBackend()
+	backendConn, _, err := websocket.DefaultDialer.Dial(backendURL, nil)
+	if err != nil {
+		t.Fatalf("dial backend websocket: %v", err)
+	}
+	defer backendConn.Close()
+	quicSide, proxySide := net.Pipe()
+	defer quicSide.Close()
+	defer proxySide.Close()
+
+	sess := &session{id: "s1", started: time.Now()}
+	limits := config.Limits{MaxFrameSize: 1 << 20, MaxMessageSize: 1 << 20, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
+	backendConn.SetReadLimit(limits.MaxMessageSize)
+	st := &sessionTrafficStats{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = relayClientOpaque(ctx, proxySide, backendConn, limits, st, sess) }()
+	go func() { _ = relayBackendOpaque(ctx, backendConn, proxySide, st, sess) }()
+
+	if err := quicSide.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 100_000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	// Three masked fragments with a ping in between.
+	go func() {
+		_ = ws.WriteFrame(quicSide, ws.Frame{Opcode: ws.OpBinary, Masked: true, Payload: msg[:40_000]})
+		_ = ws.WriteFrame(quicSide, ws.Frame{Fin: true, Opcode: ws.OpPing, Masked: true, Payload: []byte("p")})
+		_ = ws.WriteFrame(quicSide, ws.Frame{Opcode: ws.OpCont, Masked: true, Payload: msg[40_000:70_000]})
+		_ = ws.WriteFrame(quicSide, ws.Frame{Fin: true, Opcode: ws.OpCont, Masked: true, Payload: msg[70_000:]})
+	}()
+
+	br := bufio.NewReader(quicSide)
+	var got []byte
+	frames := 0
+	for {
+		f, err := ws.ReadFrame(br, 0)
+		if err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		if f.Opcode == ws.OpPong {
+			continue
+		}
+		if (frames == 0) != (f.Opcode == ws.OpBinary) {
+			t.Fatalf("frame %d has opcode %d", frames, f.Opcode)
+		}
+		frames++
+		got = append(got, f.Payload...)
+		if f.Fin {
+			break
+		}
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("echo of %d bytes differs from the %d sent", len(got), len(msg))
+	}
+	if frames < 4 {
+		t.Fatalf("echo came in %d frames, want chunks of at most %d bytes", frames, opaqueChunk)
+	}
+	// The backend relay counts the message after its last frame is out.
+	for deadline := time.Now().Add(time.Second); atomic.LoadUint64(&st.h1ToH3Messages) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadUint64(&st.h3ToH1Messages) != 1 || atomic.LoadUint64(&st.h1ToH3Messages) != 1 || atomic.LoadUint64(&st.h1ToH3Bytes) != 100_000 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
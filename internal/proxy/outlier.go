@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"cmp"
+	"log/slog"
+	"sync"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+// Outlier detection defaults for zero OutlierDetection fields.
+const (
+	DefaultOutlierConsecutiveFailures = 5
+	DefaultOutlierMinSessions         = 10
+	DefaultOutlierInterval            = 10 * time.Second
+	DefaultOutlierBaseEjection        = 30 * time.Second
+	DefaultOutlierMaxEjection         = 5 * time.Minute
+)
+
+// OutlierDetection ejects misbehaving pool members from the rotation for a
+// while, judged by the sessions sent to them rather than by probes. A
+// member is ejected after ConsecutiveFailures failed dials in a row, or
+// when at least MinSessions sessions ended within Interval and the share
+// that failed on the backend side reached ErrorRate (0 = off). An ejection
+// lasts BaseEjection, doubled for each ejection that follows within
+// MaxEjection of the previous one ending, up to MaxEjection.
+type OutlierDetection struct {
+	ConsecutiveFailures int
+	ErrorRate           float64
+	MinSessions         int
+	Interval            time.Duration
+	BaseEjection        time.Duration
+	MaxEjection         time.Duration
+}
+
+// backendOutlier is the passive failure state of one pool member.
+type backendOutlier struct {
+	mu           sync.Mutex
+	consecutive  int
+	windowStart  time.Time
+	sessions     int
+	failed       int
+	ejections    int
+	ejectedUntil time.Time
+}
+
+func (o *backendOutlier) ejected(now time.Time) bool {
+	if o == nil {
+		return false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return now.Before(o.ejectedUntil)
+}
+
+// dialed counts a dial result and returns the reason to eject, if any.
+func (o *backendOutlier) dialed(od *OutlierDetection, failed bool) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !failed {
+		o.consecutive = 0
+		return ""
+	}
+	o.consecutive++
+	if o.consecutive >= cmp.Or(od.ConsecutiveFailures, DefaultOutlierConsecutiveFailures) {
+		return "dial_failures"
+	}
+	return ""
+}
+
+// ended counts a finished session at now and returns the reason to eject,
+// if any.
+func (o *backendOutlier) ended(od *OutlierDetection, now time.Time, failed bool) string {
+	if od.ErrorRate <= 0 {
+		return ""
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if now.Sub(o.windowStart) >= cmp.Or(od.Interval, DefaultOutlierInterval) {
+		o.windowStart, o.sessions, o.failed = now, 0, 0
+	}
+	o.sessions++
+	if failed {
+		o.failed++
+	}
+	if o.sessions >= cmp.Or(od.MinSessions, DefaultOutlierMinSessions) && float64(o.failed)/float64(o.sessions) >= od.ErrorRate {
+		return "error_rate"
+	}
+	return ""
+}
+
+// eject takes the member out of the rotation from now and returns for how
+// long.
+func (o *backendOutlier) eject(od *OutlierDetection, now time.Time) time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	maxEjection := cmp.Or(od.MaxEjection, DefaultOutlierMaxEjection)
+	if now.Sub(o.ejectedUntil) > maxEjection {
+		o.ejections = 0
+	}
+	d := min(cmp.Or(od.BaseEjection, DefaultOutlierBaseEjection)<<min(o.ejections, 30), maxEjection)
+	o.ejections++
+	o.ejectedUntil = now.Add(d)
+	o.consecutive, o.sessions, o.failed = 0, 0, 0
+	return d
+}
+
+// reportDial feeds a session's backend dial result to outlier detection.
+func (p *BackendPool) reportDial(b *PoolBackend, err error) {
+	if p == nil || b == nil || b.outlier == nil {
+		return
+	}
+	if reason := b.outlier.dialed(p.Outliers, err != nil); reason != "" {
+		p.eject(b, reason, time.Now())
+	}
+}
+
+// reportSession feeds how a session on b ended to outlier detection.
+func (p *BackendPool) reportSession(b *PoolBackend, failed bool) {
+	if p == nil || b == nil || b.outlier == nil {
+		return
+	}
+	now := time.Now()
+	if reason := b.outlier.ended(p.Outliers, now, failed); reason != "" {
+		p.eject(b, reason, now)
+	}
+}
+
+// eject ejects b unless it is the pool's last available member: sending
+// sessions to a bad backend beats rejecting them all.
+func (p *BackendPool) eject(b *PoolBackend, reason string, now time.Time) {
+	others := false
+	for _, other := range p.Backends {
+		if other != b && other.available(now) {
+			others = true
+			break
+		}
+	}
+	if !others || b.outlier.ejected(now) {
+		return
+	}
+	d := b.outlier.eject(p.Outliers, now)
+	metrics.BackendEjections.WithLabelValues(p.Name, b.Name, reason).Inc()
+	slog.Warn("pool backend ejected", "pool", p.Name, "backend", b.Name, "reason", reason, "for", d)
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOutlierEjectsAfterDialFailures(t *testing.T) {
+	p := &Proxy{}
+	od := &OutlierDetection{ConsecutiveFailures: 2, BaseEjection: time.Minute, MaxEjection: 3 * time.Minute}
+	p.SetRuntimeConfig(&RuntimeConfig{Pools: []*BackendPool{{
+		Name:     "p",
+		Outliers: od,
+		Backends: []*PoolBackend{{Name: "a", URL: &url.URL{Scheme: "ws", Host: "a:80"}}, {Name: "b", URL: &url.URL{Scheme: "ws", Host: "b:80"}}},
+	}}})
+	pool := p.runtimeConfig().Pools[0]
+	a, b := pool.Backends[0], pool.Backends[1]
+	errDial := errors.New("connection refused")
+
+	// A success in between resets the streak.
+	pool.reportDial(a, errDial)
+	pool.reportDial(a, nil)
+	pool.reportDial(a, errDial)
+	if a.outlier.ejected(time.Now()) {
+		t.Fatal("ejected without consecutive failures")
+	}
+	pool.reportDial(a, errDial)
+	if !a.outlier.ejected(time.Now()) {
+		t.Fatal("not ejected after consecutive failures")
+	}
+	for range 3 {
+		if got := pool.pick(BalanceUnset, ""); got != b {
+			t.Fatalf("pick: got %q", got.Name)
+		}
+	}
+
+	// The last available member is never ejected.
+	pool.reportDial(b, errDial)
+	pool.reportDial(b, errDial)
+	if b.outlier.ejected(time.Now()) {
+		t.Fatal("last available member ejected")
+	}
+
+	// Repeated ejections back off exponentially up to the cap.
+	now := time.Now()
+	for _, want := range []time.Duration{2 * time.Minute, 3 * time.Minute} {
+		if got := a.outlier.eject(od, now); got != want {
+			t.Fatalf("ejection: got %s want %s", got, want)
+		}
+		now = now.Add(want)
+	}
+	// A member that stayed in long enough starts over.
+	if got := a.outlier.eject(od, now.Add(4*time.Minute)); got != time.Minute {
+		t.Fatalf("ejection after recovery: got %s", got)
+	}
+}
+
+func TestOutlierEjectsOnErrorRate(t *testing.T) {
+	od := &OutlierDetection{ErrorRate: 0.5, MinSessions: 4, Interval: time.Minute}
+	o := &backendOutlier{}
+	now := time.Now()
+	results := []bool{true, false, true}
+	for _, failed := range results {
+		if reason := o.ended(od, now, failed); reason != "" {
+			t.Fatalf("ejected below min_sessions: %s", reason)
+		}
+	}
+	if reason := o.ended(od, now, false); reason != "error_rate" {
+		t.Fatalf("2 of 4 failed: got %q", reason)
+	}
+	// A new window forgets the old sessions.
+	if reason := o.ended(od, now.Add(time.Minute), true); reason != "" {
+		t.Fatalf("new window: got %q", reason)
+	}
+}
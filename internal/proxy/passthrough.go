@@ -0,0 +1,519 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/metrics"
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/gorilla/websocket"
+)
+
+// With extension passthrough the client's Sec-WebSocket-Extensions offer
+// goes to the backend as it is and the backend's answer back to the client,
+// so permessage-deflate (or any other extension) is negotiated end to end.
+// The proxy cannot read the messages then: frames are relayed one by one
+// with their reserved bits, without reassembly, message rules or chaos.
+
+// deflatePassthrough reports whether a route relays extensions end to end.
+func (p *Proxy) deflatePassthrough(route *Route) bool {
+	if route != nil && route.DeflatePassthrough != nil {
+		return *route.DeflatePassthrough
+	}
+	return p.DeflatePassthrough
+}
+
+// withExtensions returns a copy of dialer whose connections offer the
+// backend offer as Sec-WebSocket-Extensions, which gorilla/websocket will
+// not send itself. The dialer sees the handshake answer without the
+// backend's extensions, as it would refuse those it does not know.
+func withExtensions(dialer *websocket.Dialer, offer string) *websocket.Dialer {
+	d := *dialer
+	d.EnableCompression = false
+	base := d.NetDialContext
+	if base == nil {
+		base = (&net.Dialer{}).DialContext
+	}
+	// The connection must be the one the dialer writes the handshake to,
+	// so the proxy and TLS layers below it are dialed here.
+	if d.Proxy != nil {
+		envProxy, plain := d.Proxy, base
+		base = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			u, err := envProxy(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+			if err != nil {
+				return nil, err
+			}
+			if u == nil {
+				return plain(ctx, network, addr)
+			}
+			return (&BackendProxy{URL: u}).dialer(nil)(ctx, network, addr)
+		}
+		d.Proxy = nil
+	}
+	tlsBase := d.NetDialTLSContext
+	if tlsBase == nil {
+		tlsBase = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := base(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+			if d.TLSClientConfig != nil {
+				cfg = d.TLSClientConfig.Clone()
+			}
+			if cfg.ServerName == "" {
+				cfg.ServerName, _, _ = net.SplitHostPort(addr)
+			}
+			tc := tls.Client(conn, cfg)
+			if err := tc.HandshakeContext(ctx); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			return tc, nil
+		}
+	}
+	wrap := func(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &extensionConn{Conn: conn, offer: offer, br: bufio.NewReaderSize(conn, 16<<10)}, nil
+		}
+	}
+	d.NetDialContext = wrap(base)
+	d.NetDialTLSContext = wrap(tlsBase)
+	return &d
+}
+
+// extensionConn adds the extension offer to the upgrade request and takes
+// the backend's answer out of the response.
+type extensionConn struct {
+	net.Conn
+	offer string
+	req   bytes.Buffer
+	sent  bool
+	br    *bufio.Reader
+	// resp is the rest of the response head for the dialer.
+	resp     bytes.Reader
+	answered bool
+	// accepted is the backend's Sec-WebSocket-Extensions.
+	accepted string
+}
+
+func (c *extensionConn) Write(b []byte) (int, error) {
+	if c.sent {
+		return c.Conn.Write(b)
+	}
+	c.req.Write(b)
+	head, rest, ok := bytes.Cut(c.req.Bytes(), []byte("\r\n\r\n"))
+	if !ok {
+		return len(b), nil
+	}
+	c.sent = true
+	var out bytes.Buffer
+	out.Write(head)
+	out.WriteString("\r\nSec-WebSocket-Extensions: " + c.offer + "\r\n\r\n")
+	out.Write(rest)
+	if _, err := c.Conn.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read hands the dialer the response head and nothing after it, so the
+// frames that follow stay in br for the relay.
+func (c *extensionConn) Read(b []byte) (int, error) {
+	if !c.answered {
+		if err := c.readHead(); err != nil {
+			return 0, err
+		}
+	}
+	if c.resp.Len() > 0 {
+		return c.resp.Read(b)
+	}
+	return c.br.Read(b)
+}
+
+func (c *extensionConn) readHead() error {
+	var head bytes.Buffer
+	var accepted []string
+	for {
+		line, err := c.br.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		name, value, _ := strings.Cut(string(line), ":")
+		if head.Len() > 0 && strings.EqualFold(strings.TrimSpace(name), "Sec-WebSocket-Extensions") {
+			accepted = append(accepted, strings.TrimSpace(value))
+			continue
+		}
+		head.Write(line)
+		if len(bytes.TrimSpace(line)) == 0 {
+			break
+		}
+		if head.Len() > 64<<10 {
+			return errors.New("backend handshake response too large")
+		}
+	}
+	c.answered = true
+	c.accepted = strings.Join(accepted, ", ")
+	c.resp.Reset(head.Bytes())
+	return nil
+}
+
+// frameConn is the backend connection of a passthrough session. It reads
+// and writes whole frames on the connection the handshake was made on;
+// the message methods serve the session's close and RTT probes.
+type frameConn struct {
+	conn *extensionConn
+	wmu  sync.Mutex
+
+	readLimit    int64
+	pingHandler  func(appData string) error
+	pongHandler  func(appData string) error
+	closeHandler func(code int, text string) error
+}
+
+// newFrameConn takes over the connection under bws. It reports false when
+// bws was not dialed by withExtensions.
+func newFrameConn(bws *websocket.Conn) (*frameConn, bool) {
+	ec, ok := bws.UnderlyingConn().(*extensionConn)
+	if !ok {
+		return nil, false
+	}
+	return &frameConn{conn: ec}, true
+}
+
+func (c *frameConn) readFrame(maxFramePayload int64) (ws.Frame, error) {
+	return ws.ReadFrame(c.conn.br, maxFramePayload)
+}
+
+// writeFrame masks f, as the client side of the connection must.
+func (c *frameConn) writeFrame(f ws.Frame) error {
+	f.Masked = true
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return ws.WriteFrame(c.conn, f)
+}
+
+func (c *frameConn) SetReadLimit(limit int64)           { c.readLimit = limit }
+func (c *frameConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *frameConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+func (c *frameConn) SetPingHandler(h func(string) error) {
+	c.pingHandler = h
+}
+func (c *frameConn) SetPongHandler(h func(string) error) {
+	c.pongHandler = h
+}
+func (c *frameConn) SetCloseHandler(h func(int, string) error) {
+	c.closeHandler = h
+}
+func (c *frameConn) Close() error { return c.conn.Close() }
+
+func (c *frameConn) ReadMessage() (int, []byte, error) {
+	var op byte
+	var msg []byte
+	for {
+		f, err := c.readFrame(0)
+		if err != nil {
+			return 0, nil, err
+		}
+		var handler func(string) error
+		switch f.Opcode {
+		case ws.OpPing:
+			handler = c.pingHandler
+		case ws.OpPong:
+			handler = c.pongHandler
+		case ws.OpClose:
+			code, text := ws.ParseClosePayload(f.Payload)
+			if c.closeHandler != nil {
+				_ = c.closeHandler(code, text)
+			}
+			return 0, nil, &websocket.CloseError{Code: code, Text: text}
+		default:
+			if f.Opcode != ws.OpCont {
+				op = f.Opcode
+			}
+			msg = append(msg, f.Payload...)
+			if c.readLimit > 0 && int64(len(msg)) > c.readLimit {
+				return 0, nil, websocket.ErrReadLimit
+			}
+			if f.Fin {
+				return int(op), msg, nil
+			}
+			continue
+		}
+		if handler != nil {
+			if err := handler(string(f.Payload)); err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+}
+
+func (c *frameConn) WriteMessage(messageType int, data []byte) error {
+	return c.writeFrame(ws.Frame{Fin: true, Opcode: byte(messageType), Payload: data})
+}
+
+func (c *frameConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	return &frameMessageWriter{c: c, messageType: messageType}, nil
+}
+
+func (c *frameConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if len(data) > ws.MaxControlPayload {
+		return ws.ErrControlTooLong
+	}
+	if err := c.conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	return c.writeFrame(ws.Frame{Fin: true, Opcode: byte(messageType), Payload: data})
+}
+
+// frameMessageWriter sends a message as one frame when it is closed.
+type frameMessageWriter struct {
+	c           *frameConn
+	messageType int
+	buf         bytes.Buffer
+}
+
+func (w *frameMessageWriter) Write(b []byte) (int, error) { return w.buf.Write(b) }
+func (w *frameMessageWriter) Close() error {
+	return w.c.WriteMessage(w.messageType, w.buf.Bytes())
+}
+
+// relayClientFrames forwards the client's frames to the backend as they
+// are. A close is forwarded and ends the relay; the backend's answer comes
+// back through relayBackendFrames.
+func relayClientFrames(ctx context.Context, s io.ReadWriter, fc *frameConn, lim config.Limits, st *sessionTrafficStats, sess *session) error {
+	br := bufio.NewReaderSize(s, 32<<10)
+	// messageSize and kind describe the message being relayed; its
+	// size is what went over the wire, compressed or not.
+	var messageSize int64
+	var kind string
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		f, err := ws.ReadFrame(br, lim.MaxFrameSize)
+		if err != nil {
+			if errors.Is(err, io.EOF) || ws.IsNetClose(err) {
+				sess.debugf("h3->h1 input half-closed: %v", err)
+				return nil
+			}
+			if errors.Is(err, ws.ErrBadControlFrame) {
+				metrics.Errors.WithLabelValues("protocol").Inc()
+				_ = ws.WriteCloseFrame(s, 1002, "invalid control frame")
+				return err
+			}
+			sess.debugf("h3->h1 read frame error: %v", err)
+			return &h3ReadError{err: err}
+		}
+		if sess.requireMask && !f.Masked {
+			metrics.Errors.WithLabelValues("protocol").Inc()
+			_ = ws.WriteCloseFrame(s, 1002, "unmasked frame")
+			return errUnmaskedFrame
+		}
+		// Whatever the backend accepted decides what the bits mean; with
+		// nothing accepted they must stay clear.
+		if fc.conn.accepted == "" && (f.Rsv1 || f.Rsv2 || f.Rsv3) {
+			metrics.Errors.WithLabelValues("protocol").Inc()
+			_ = ws.WriteCloseFrame(s, 1002, "reserved bits set")
+			return ws.ErrReservedBits
+		}
+		if f.Opcode == ws.OpPong {
+			if d, ok := parseRTTProbe(f.Payload, time.Now()); ok {
+				sess.recordRTT("client", d)
+				sess.debugf("client rtt=%s", d)
+				continue
+			}
+		}
+		sess.touch()
+		if f.Opcode <= ws.OpBinary {
+			sess.touchData("h3_to_h1")
+			if err := sess.throttle(ctx, "h3_to_h1", len(f.Payload)); err != nil {
+				return err
+			}
+			if f.Opcode != ws.OpCont {
+				if err := sess.admitMessage(ctx); err != nil {
+					if errors.Is(err, errMessageRate) {
+						_ = ws.WriteCloseFrame(s, 1008, "message rate exceeded")
+					}
+					return err
+				}
+			}
+		}
+		sess.debugf("h3->h1 frame opcode=%d fin=%v rsv1=%v payload=%d", f.Opcode, f.Fin, f.Rsv1, len(f.Payload))
+		metrics.Frames.WithLabelValues("h3_to_h1", frameKind(f.Opcode)).Inc()
+
+		switch f.Opcode {
+		case ws.OpText, ws.OpBinary, ws.OpCont:
+			messageSize += int64(len(f.Payload))
+			if messageSize > lim.MaxMessageSize {
+				metrics.OversizeDrops.WithLabelValues("message").Inc()
+				_ = ws.WriteCloseFrame(s, 1009, "message too big")
+				return errors.New("message too big")
+			}
+			if f.Opcode != ws.OpCont {
+				kind = frameKind(f.Opcode)
+			}
+			metrics.Bytes.WithLabelValues("h3_to_h1").Add(float64(len(f.Payload)))
+			atomic.AddUint64(&st.h3ToH1Bytes, uint64(len(f.Payload)))
+			if f.Fin {
+				metrics.Messages.WithLabelValues("h3_to_h1", kind).Inc()
+				sess.onMessage("h3_to_h1", kind, nil, messageSize)
+				metrics.MessageSize.WithLabelValues("h3_to_h1", kind).Observe(float64(messageSize))
+				messageSize = 0
+				atomic.AddUint64(&st.h3ToH1Messages, 1)
+			}
+		case ws.OpPing, ws.OpPong:
+			metrics.Ctrl.WithLabelValues(frameKind(f.Opcode)).Inc()
+		case ws.OpClose:
+			metrics.Ctrl.WithLabelValues("close").Inc()
+			code, reason := ws.ParseClosePayload(f.Payload)
+			sess.clientClose.Store(int32(code))
+			if out := sess.forwardedClose("client", code); out != code {
+				f.Payload = websocket.FormatCloseMessage(out, reason)
+			}
+		}
+		if err := fc.SetWriteDeadline(time.Now().Add(lim.WriteTimeout)); err != nil {
+			return err
+		}
+		if err := fc.writeFrame(f); err != nil {
+			sess.debugf("h3->h1 write frame error: %v", err)
+			return err
+		}
+		if f.Opcode == ws.OpClose {
+			code, reason := ws.ParseClosePayload(f.Payload)
+			sess.debugf("h3->h1 close forwarded code=%d reason=%q", code, reason)
+			return io.EOF
+		}
+	}
+}
+
+// relayBackendFrames forwards the backend's frames to the client as they
+// are, until the backend closes.
+func relayBackendFrames(ctx context.Context, fc *frameConn, s io.Writer, lim config.Limits, st *sessionTrafficStats, sess *session) error {
+	var messageSize int64
+	var kind string
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		f, err := fc.readFrame(lim.MaxFrameSize)
+		if err != nil {
+			if errors.Is(err, io.EOF) || ws.IsNetClose(err) {
+				sess.debugf("h1->h3 backend input half-closed: %v", err)
+				return nil
+			}
+			sess.debugf("h1->h3 backend read error: %v", err)
+			if errors.Is(err, ws.ErrBadControlFrame) {
+				metrics.Errors.WithLabelValues("protocol").Inc()
+				_ = fc.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(1002, "invalid control frame"), time.Now().Add(time.Second))
+			}
+			_ = ws.WriteCloseFrame(s, 1011, "backend read error")
+			return err
+		}
+		if fc.conn.accepted == "" && (f.Rsv1 || f.Rsv2 || f.Rsv3) {
+			metrics.Errors.WithLabelValues("protocol").Inc()
+			_ = fc.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(1002, "reserved bits set"), time.Now().Add(time.Second))
+			_ = ws.WriteCloseFrame(s, 1011, "backend read error")
+			return ws.ErrReservedBits
+		}
+		if f.Opcode == ws.OpPong {
+			if d, ok := parseRTTProbe(f.Payload, time.Now()); ok {
+				sess.recordRTT("backend", d)
+				sess.debugf("backend rtt=%s", d)
+				continue
+			}
+		}
+		sess.touch()
+		if f.Opcode <= ws.OpBinary {
+			sess.touchData("h1_to_h3")
+			if err := sess.throttle(ctx, "h1_to_h3", len(f.Payload)); err != nil {
+				return err
+			}
+		}
+		sess.debugf("h1->h3 frame opcode=%d fin=%v rsv1=%v payload=%d", f.Opcode, f.Fin, f.Rsv1, len(f.Payload))
+		metrics.Frames.WithLabelValues("h1_to_h3", frameKind(f.Opcode)).Inc()
+
+		switch f.Opcode {
+		case ws.OpText, ws.OpBinary, ws.OpCont:
+			messageSize += int64(len(f.Payload))
+			if messageSize > lim.MaxMessageSize {
+				metrics.OversizeDrops.WithLabelValues("message").Inc()
+				_ = ws.WriteCloseFrame(s, 1009, "message too big")
+				return errors.New("backend message too big")
+			}
+			if f.Opcode != ws.OpCont {
+				kind = frameKind(f.Opcode)
+			}
+			metrics.Bytes.WithLabelValues("h1_to_h3").Add(float64(len(f.Payload)))
+			atomic.AddUint64(&st.h1ToH3Bytes, uint64(len(f.Payload)))
+			if f.Fin {
+				metrics.Messages.WithLabelValues("h1_to_h3", kind).Inc()
+				sess.onMessage("h1_to_h3", kind, nil, messageSize)
+				metrics.MessageSize.WithLabelValues("h1_to_h3", kind).Observe(float64(messageSize))
+				messageSize = 0
+				atomic.AddUint64(&st.h1ToH3Messages, 1)
+			}
+		case ws.OpPing, ws.OpPong:
+			metrics.Ctrl.WithLabelValues(frameKind(f.Opcode)).Inc()
+		case ws.OpClose:
+			metrics.Ctrl.WithLabelValues("close").Inc()
+			code, reason := ws.ParseClosePayload(f.Payload)
+			sess.backendClose.Store(int32(code))
+			if out := sess.forwardedClose("backend", code); out != code {
+				f.Payload = websocket.FormatCloseMessage(out, reason)
+			}
+		}
+		f.Masked = false
+		if err := ws.WriteFrame(s, f); err != nil {
+			sess.debugf("h1->h3 write frame error: %v", err)
+			return err
+		}
+		if f.Opcode == ws.OpClose {
+			code, reason := ws.ParseClosePayload(f.Payload)
+			sess.debugf("h1->h3 close forwarded code=%d reason=%q", code, reason)
+			return nil
+		}
+	}
+}
+
+// frameKind is the frames metric label of an opcode.
+func frameKind(opcode byte) string {
+	switch opcode {
+	case ws.OpText:
+		return "text"
+	case ws.OpBinary:
+		return "binary"
+	case ws.OpCont:
+		return "cont"
+	case ws.OpPing:
+		return "ping"
+	case ws.OpPong:
+		return "pong"
+	case ws.OpClose:
+		return "close"
+	}
+	return "other"
+}
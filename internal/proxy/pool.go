@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+// Balance is a pool's policy for spreading new sessions over its members.
+type Balance int8
+
+const (
+	// BalanceUnset defers to the pool's policy.
+	BalanceUnset Balance = iota
+	// BalanceRoundRobin takes turns in proportion to the weights.
+	BalanceRoundRobin
+	// BalanceLeastConn picks the member with the fewest running sessions
+	// per unit of weight, which keeps long-lived sessions even.
+	BalanceLeastConn
+	// BalanceHash sends sessions with the same HashOn key to the same
+	// member while the member set does not change.
+	BalanceHash
+)
+
+func ParseBalance(s string) (Balance, error) {
+	switch s {
+	case "":
+		return BalanceUnset, nil
+	case "round_robin":
+		return BalanceRoundRobin, nil
+	case "least_conn":
+		return BalanceLeastConn, nil
+	case "hash":
+		return BalanceHash, nil
+	}
+	return BalanceUnset, fmt.Errorf("unknown balance policy %q", s)
+}
+
+func (b Balance) String() string {
+	switch b {
+	case BalanceLeastConn:
+		return "least_conn"
+	case BalanceHash:
+		return "hash"
+	default:
+		return "round_robin"
+	}
+}
+
+// HashOn selects the request attribute the hash policy keys on. The zero
+// value is unset.
+type HashOn struct {
+	// Source is "ip", "header" or "query".
+	Source string
+	// Name is the header or query parameter.
+	Name string
+}
+
+func (h HashOn) key(r *http.Request) string {
+	switch h.Source {
+	case "ip":
+		return clientIP(r)
+	case "header":
+		return r.Header.Get(h.Name)
+	case "query":
+		return r.URL.Query().Get(h.Name)
+	}
+	return ""
+}
+
+// BackendPool is a named set of interchangeable backends. New sessions are
+// spread over the members that are not draining according to Balance.
+type BackendPool struct {
+	Name     string
+	Backends []*PoolBackend
+	Balance  Balance
+	HashOn   HashOn
+	// HealthCheck keeps new sessions off members that fail its probes (nil
+	// = no probes).
+	HealthCheck *HealthCheck
+	// DialRetries is how many other members a session tries when its dial
+	// fails, all within DialDeadline (0 = no overall deadline).
+	DialRetries  int
+	DialDeadline time.Duration
+	// Outliers ejects members that fail sessions (nil = off).
+	Outliers *OutlierDetection
+	mu       sync.Mutex
+	next     int
+}
+
+// PoolBackend is one member of a BackendPool.
+type PoolBackend struct {
+	Name string
+	// URL is used like Proxy.Backend: the request path and query are
+	// forwarded.
+	URL *url.URL
+	// Weight is the member's share of new sessions (0 = 1).
+	Weight int
+	// Priority ranks members: only available ones with the lowest value
+	// get new sessions.
+	Priority int
+	// Draining members keep their running sessions but get no new ones.
+	Draining bool
+	pool     string
+	current  int
+	active   *atomic.Int64
+	health   *backendHealth
+	outlier  *backendOutlier
+}
+
+// available reports whether the member may get new sessions at now.
+func (b *PoolBackend) available(now time.Time) bool {
+	return !b.Draining && b.health.healthy() && !b.outlier.ejected(now)
+}
+
+// pick returns an available member by the given policy (unset
+// = the pool's), or nil when there is none. key is the hash policy's
+// session key; without one the session is placed round robin. Members in
+// skip are passed over, for retries.
+func (p *BackendPool) pick(policy Balance, key string, skip ...*PoolBackend) *PoolBackend {
+	if policy == BalanceUnset {
+		policy = p.Balance
+	}
+	now := time.Now()
+	lowest := -1
+	for _, b := range p.Backends {
+		if (lowest < 0 || b.Priority < lowest) && b.available(now) && !slices.Contains(skip, b) {
+			lowest = b.Priority
+		}
+	}
+	usable := func(b *PoolBackend) bool {
+		return b.Priority == lowest && b.available(now) && !slices.Contains(skip, b)
+	}
+	if policy == BalanceHash && key != "" {
+		return p.hash(key, usable)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if policy == BalanceLeastConn {
+		return p.leastConn(usable)
+	}
+	return p.roundRobin(usable)
+}
+
+// hash is weighted rendezvous hashing: every member scores the key and the
+// highest score wins, so adding, removing or draining a member only moves
+// the keys that member gains or loses.
+func (p *BackendPool) hash(key string, usable func(*PoolBackend) bool) *PoolBackend {
+	var best *PoolBackend
+	bestScore := 0.0
+	for _, b := range p.Backends {
+		if !usable(b) {
+			continue
+		}
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(b.Name))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(key))
+		// Map the hash to (0, 1); w / -ln(u) is the weighted score.
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := float64(max(b.Weight, 1)) / -math.Log(u)
+		if best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+// roundRobin is smooth weighted round robin: members with weights 5, 1, 1
+// are picked a a b a c a a rather than in bursts.
+func (p *BackendPool) roundRobin(usable func(*PoolBackend) bool) *PoolBackend {
+	var best *PoolBackend
+	total := 0
+	for _, b := range p.Backends {
+		if !usable(b) {
+			continue
+		}
+		w := max(b.Weight, 1)
+		b.current += w
+		total += w
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+// leastConn picks the lowest sessions/weight ratio. Ties rotate, so an
+// idle pool is still filled evenly.
+func (p *BackendPool) leastConn(usable func(*PoolBackend) bool) *PoolBackend {
+	n := len(p.Backends)
+	var best *PoolBackend
+	var bestActive int64
+	for i := range n {
+		b := p.Backends[(p.next+i)%n]
+		if !usable(b) {
+			continue
+		}
+		active := b.counter().Load()
+		// active/weight < bestActive/bestWeight without dividing.
+		if best == nil || active*int64(max(best.Weight, 1)) < bestActive*int64(max(b.Weight, 1)) {
+			best, bestActive = b, active
+		}
+	}
+	if n > 0 {
+		p.next = (p.next + 1) % n
+	}
+	return best
+}
+
+func (b *PoolBackend) counter() *atomic.Int64 {
+	if b.active == nil {
+		b.active = new(atomic.Int64)
+	}
+	return b.active
+}
+
+func (b *PoolBackend) acquire() {
+	b.counter().Add(1)
+	metrics.BackendActiveSessions.WithLabelValues(b.pool, b.Name).Inc()
+}
+
+func (b *PoolBackend) release() {
+	b.counter().Add(-1)
+	metrics.BackendActiveSessions.WithLabelValues(b.pool, b.Name).Dec()
+}
+
+// PoolInfo describes a pool for the admin API.
+type PoolInfo struct {
+	Name     string            `json:"name"`
+	Balance  string            `json:"balance"`
+	HashOn   string            `json:"hash_on,omitempty"`
+	Backends []PoolBackendInfo `json:"backends"`
+}
+
+// PoolBackendInfo describes a pool member and its running sessions.
+type PoolBackendInfo struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Weight   int    `json:"weight"`
+	Priority int    `json:"priority,omitempty"`
+	Draining bool   `json:"draining,omitempty"`
+	Healthy  bool   `json:"healthy"`
+	Ejected  bool   `json:"ejected,omitempty"`
+	Sessions int64  `json:"sessions"`
+}
+
+// Pools lists the pools of the current runtime config.
+func (p *Proxy) Pools() []PoolInfo {
+	rt := p.runtimeConfig()
+	now := time.Now()
+	out := make([]PoolInfo, 0, len(rt.Pools))
+	for _, pool := range rt.Pools {
+		info := PoolInfo{Name: pool.Name, Balance: pool.Balance.String(), HashOn: pool.HashOn.String(), Backends: make([]PoolBackendInfo, 0, len(pool.Backends))}
+		for _, b := range pool.Backends {
+			info.Backends = append(info.Backends, PoolBackendInfo{Name: b.Name, URL: b.URL.String(), Weight: max(b.Weight, 1), Priority: b.Priority, Draining: b.Draining, Healthy: b.health.healthy(), Ejected: b.outlier.ejected(now), Sessions: b.counter().Load()})
+		}
+		out = append(out, info)
+	}
+	return out
+}
+
+// pool returns the pool a session is sent to: the route's, unless the route
+// names a backend of its own, then the tenant's, then the default pool.
+// Nil means the session uses a single backend URL.
+func (rc *RuntimeConfig) pool(route *Route, tenant *Tenant) *BackendPool {
+	if route != nil {
+		if route.Pool != nil {
+			return route.Pool
+		}
+		if route.Backend != nil {
+			return nil
+		}
+	}
+	if tenant != nil {
+		return tenant.Pool
+	}
+	return rc.DefaultPool
+}
+
+func (h HashOn) String() string {
+	if h.Name == "" {
+		return h.Source
+	}
+	return h.Source + ":" + h.Name
+}
+
+// balance returns the policy and session key for a session on pool: the
+// route's settings win over the pool's.
+func (p *BackendPool) balance(route *Route, r *http.Request) (Balance, string) {
+	policy, hashOn := p.Balance, p.HashOn
+	if route != nil {
+		if route.Balance != BalanceUnset {
+			policy = route.Balance
+		}
+		if route.HashOn.Source != "" {
+			hashOn = route.HashOn
+		}
+	}
+	if policy != BalanceHash {
+		return policy, ""
+	}
+	return policy, hashOn.key(r)
+}
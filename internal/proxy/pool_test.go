@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"h3ws2h1ws-proxy/internal/config"
+)
+
+func TestPoolPickSkipsDraining(t *testing.T) {
+	a := &PoolBackend{Name: "a", URL: &url.URL{Scheme: "ws", Host: "a:80"}}
+	b := &PoolBackend{Name: "b", URL: &url.URL{Scheme: "ws", Host: "b:80"}, Draining: true}
+	c := &PoolBackend{Name: "c", URL: &url.URL{Scheme: "ws", Host: "c:80"}}
+	pool := &BackendPool{Name: "p", Backends: []*PoolBackend{a, b, c}}
+
+	counts := map[string]int{}
+	for range 6 {
+		counts[pool.pick(BalanceUnset, "").Name]++
+	}
+	if counts["a"] != 3 || counts["c"] != 3 || counts["b"] != 0 {
+		t.Fatalf("picks: got %v", counts)
+	}
+
+	a.Draining, c.Draining = true, true
+	if got := pool.pick(BalanceUnset, ""); got != nil {
+		t.Fatalf("all draining: got %q", got.Name)
+	}
+}
+
+func TestPoolPickWeighted(t *testing.T) {
+	pool := &BackendPool{Name: "p", Backends: []*PoolBackend{
+		{Name: "a", Weight: 5},
+		{Name: "b"},
+		{Name: "c", Weight: 1},
+	}}
+	var order []byte
+	for range 14 {
+		order = append(order, pool.pick(BalanceUnset, "").Name[0])
+	}
+	// Smooth weighted round robin interleaves the light members.
+	if got, want := string(order), "aabacaaaabacaa"; got != want {
+		t.Fatalf("order: got %s want %s", got, want)
+	}
+}
+
+func TestPoolPickLeastConn(t *testing.T) {
+	a := &PoolBackend{Name: "a"}
+	b := &PoolBackend{Name: "b", Weight: 2}
+	c := &PoolBackend{Name: "c"}
+	pool := &BackendPool{Name: "p", Backends: []*PoolBackend{a, b, c}, Balance: BalanceLeastConn}
+
+	// An idle pool is filled in turn rather than all on the first member.
+	seen := map[string]bool{}
+	for range 3 {
+		seen[pool.pick(BalanceUnset, "").Name] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("idle picks: got %v", seen)
+	}
+
+	a.counter().Store(1)
+	b.counter().Store(1)
+	c.counter().Store(1)
+	// b has twice the weight, so one session is half its load.
+	if got := pool.pick(BalanceUnset, ""); got != b {
+		t.Fatalf("weighted pick: got %q", got.Name)
+	}
+	b.counter().Store(4)
+	if got := pool.pick(BalanceUnset, ""); got != a && got != c {
+		t.Fatalf("least loaded: got %q", got.Name)
+	}
+	// A route may still ask for round robin.
+	a.current, b.current, c.current = 0, 0, 0
+	if got := pool.pick(BalanceRoundRobin, ""); got != b {
+		t.Fatalf("round robin override: got %q", got.Name)
+	}
+}
+
+func TestPoolPickHash(t *testing.T) {
+	members := []*PoolBackend{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}
+	pool := &BackendPool{Name: "p", Backends: members, Balance: BalanceHash, HashOn: HashOn{Source: "query", Name: "room"}}
+
+	before := map[string]*PoolBackend{}
+	for i := range 200 {
+		key := fmt.Sprint("room-", i)
+		got := pool.pick(BalanceUnset, key)
+		if again := pool.pick(BalanceUnset, key); again != got {
+			t.Fatalf("key %s: got %q then %q", key, got.Name, again.Name)
+		}
+		before[key] = got
+	}
+
+	// Draining one member only moves the keys it had.
+	members[1].Draining = true
+	for key, was := range before {
+		got := pool.pick(BalanceUnset, key)
+		if was != members[1] && got != was {
+			t.Fatalf("key %s moved from %q to %q", key, was.Name, got.Name)
+		}
+		if got == members[1] {
+			t.Fatalf("key %s still on the draining member", key)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodConnect, "/chat?room=42", nil)
+	policy, key := pool.balance(nil, r)
+	if policy != BalanceHash || key != "42" {
+		t.Fatalf("balance: got %v %q", policy, key)
+	}
+	route := &Route{Name: "r", HashOn: HashOn{Source: "header", Name: "X-User"}}
+	r.Header.Set("X-User", "alice")
+	if _, key := pool.balance(route, r); key != "alice" {
+		t.Fatalf("route hash_on: got %q", key)
+	}
+}
+
+func TestPoolPickPriority(t *testing.T) {
+	primary := &PoolBackend{Name: "primary", Priority: 1}
+	backup := &PoolBackend{Name: "backup", Priority: 2}
+	pool := &BackendPool{Name: "p", Backends: []*PoolBackend{backup, primary}}
+	for range 3 {
+		if got := pool.pick(BalanceUnset, ""); got != primary {
+			t.Fatalf("pick: got %q", got.Name)
+		}
+	}
+	primary.Draining = true
+	if got := pool.pick(BalanceUnset, ""); got != backup {
+		t.Fatalf("pick with primary draining: got %v", got)
+	}
+	primary.Draining = false
+	if got := pool.pick(BalanceUnset, "", primary); got != backup {
+		t.Fatalf("retry pick: got %v", got)
+	}
+}
+
+func TestPoolCountersSurviveUpdate(t *testing.T) {
+	p := &Proxy{}
+	old := &PoolBackend{Name: "a", URL: &url.URL{Scheme: "ws", Host: "a:80"}}
+	p.SetRuntimeConfig(&RuntimeConfig{Pools: []*BackendPool{{Name: "p", Backends: []*PoolBackend{old}}}})
+	old.counter().Add(2)
+
+	next := &PoolBackend{Name: "a", URL: &url.URL{Scheme: "ws", Host: "a2:80"}, Draining: true}
+	p.SetRuntimeConfig(&RuntimeConfig{Pools: []*BackendPool{{Name: "p", Backends: []*PoolBackend{next}}}})
+	pools := p.Pools()
+	if len(pools) != 1 || len(pools[0].Backends) != 1 {
+		t.Fatalf("pools: got %+v", pools)
+	}
+	if got := pools[0].Backends[0]; got.Sessions != 2 || !got.Draining || got.URL != "ws://a2:80" {
+		t.Fatalf("backend: got %+v", got)
+	}
+}
+
+func TestPoolDialRetry(t *testing.T) {
+	upURL, stopUp := startEchoBackend(t)
+	defer stopUp()
+	downURL, stopDown := startEchoBackend(t)
+	stopDown()
+	up, _ := url.Parse(upURL)
+	down, _ := url.Parse(downURL)
+
+	p := &Proxy{Limits: config.Limits{MaxFrameSize: 1 << 20, MaxMessageSize: 1 << 20, MaxConns: 10, WriteTimeout: 5 * time.Second}}
+	pool := &BackendPool{
+		Name:         "default",
+		Backends:     []*PoolBackend{{Name: "down", URL: down}, {Name: "up", URL: up}},
+		DialDeadline: 5 * time.Second,
+	}
+	p.SetRuntimeConfig(&RuntimeConfig{Limits: p.Limits, Pools: []*BackendPool{pool}, DefaultPool: pool})
+	srv := httptest.NewServer(http.HandlerFunc(p.HandleH3WebSocket))
+	defer srv.Close()
+	target := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	// Without retries the session sent to the dead member fails.
+	if c, _, err := websocket.DefaultDialer.Dial(target, nil); err == nil {
+		c.Close()
+		t.Fatal("dial through a dead member succeeded without retries")
+	}
+
+	pool.DialRetries = 1
+	for range 2 {
+		c, _, err := websocket.DefaultDialer.Dial(target, nil)
+		if err != nil {
+			t.Fatalf("dial with retry: %v", err)
+		}
+		if err := c.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+		if _, data, err := c.ReadMessage(); err != nil || string(data) != "hi" {
+			t.Fatalf("echo: %q %v", data, err)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/jwt"
+	"h3ws2h1ws-proxy/internal/metrics"
+	"h3ws2h1ws-proxy/internal/ratelimit"
+	"h3ws2h1ws-proxy/internal/redact"
+)
+
+// Priority orders sessions for load shedding. The zero value means "not
+// set" and defers to the next source (the client's identity, then route,
+// then tenant, then normal).
+type Priority int8
+
+const (
+	PriorityUnset Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "":
+		return PriorityUnset, nil
+	case "low":
+		return PriorityLow, nil
+	case "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	}
+	return PriorityUnset, fmt.Errorf("unknown priority class %q", s)
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+func effectivePriority(route *Route, tenant *Tenant) Priority {
+	if route != nil && route.Priority != PriorityUnset {
+		return route.Priority
+	}
+	if tenant != nil && tenant.Priority != PriorityUnset {
+		return tenant.Priority
+	}
+	return PriorityNormal
+}
+
+// setIdentityPriority applies a class carried by the client's identity: a
+// JWT claim, an ExternalAuth header or a Policy label. Unknown classes are
+// ignored.
+func (s *session) setIdentityPriority(source, class string) {
+	if class == "" {
+		return
+	}
+	prio, err := ParsePriority(class)
+	if err != nil {
+		s.debugf("%s: %v", source, err)
+		return
+	}
+	s.priority = prio
+}
+
+// session is an established proxy session. The registry uses it to shed
+// sessions under overload; the pumps read the per-session message policy.
+type session struct {
+	id       string
+	priority Priority
+	route    *Route
+	deflate  *clientDeflate
+	redactor *redact.Redactor
+	// tag is the ConnectionTags label, empty when tagging is off.
+	tag string
+	// chaos injects faults into the session's messages (nil = none).
+	chaos *Chaos
+	// stream forwards fragmented client messages without reassembly.
+	stream bool
+	// requireMask fails the session on an unmasked client frame.
+	requireMask bool
+	// hooks are the embedder's Proxy.Hooks (nil = none).
+	hooks Hooks
+	// closeCodes replaces close codes forwarded between the sides.
+	closeCodes CloseCodeMap
+	// extensions is the client's Sec-WebSocket-Extensions offer when it is
+	// passed through to the backend (empty = the proxy terminates
+	// extensions).
+	extensions string
+	// logs decides whether debug lines are written for the session.
+	logs     *logControl
+	clientIP netip.Addr
+	// path and backend are the request path and the backend URL without
+	// its query, for listings.
+	path    string
+	backend string
+	// traffic counts the session's bytes and messages once it is accepted.
+	traffic *sessionTrafficStats
+	// identity is who the session's usage is accounted to.
+	identity string
+	// claims are those of the client's JWT (nil without Auth).
+	claims jwt.Claims
+	// authHeader holds the ExternalAuth response headers for the backend.
+	authHeader http.Header
+	// labels are the Policy decision's metadata for logs (nil = none).
+	labels map[string]string
+	// clientClose and backendClose are the close codes each side sent (0 =
+	// none).
+	clientClose  atomic.Int32
+	backendClose atomic.Int32
+	started      time.Time
+	// lastActive is the UnixNano time of the last frame in either direction.
+	lastActive atomic.Int64
+	// lastDataIn and lastDataOut are the UnixNano times of the last data
+	// message from the client and from the backend.
+	lastDataIn  atomic.Int64
+	lastDataOut atomic.Int64
+	// inThrottle and outThrottle pace client and backend data messages
+	// (nil = unlimited).
+	inThrottle  *ratelimit.Throttle
+	outThrottle *ratelimit.Throttle
+	// inShaper and outShaper are shared by all sessions (nil = unlimited).
+	inShaper  *ratelimit.Shaper
+	outShaper *ratelimit.Shaper
+	// msgLimiter caps client messages per second (nil = unlimited).
+	msgLimiter *ratelimit.Local
+	msgAction  MessageRateAction
+	// clientRTT and backendRTT hold the last probe round trip in ns.
+	clientRTT  atomic.Int64
+	backendRTT atomic.Int64
+	// clientPongAt and backendPongAt are when each side last answered one
+	// of our pings.
+	clientPongAt  atomic.Int64
+	backendPongAt atomic.Int64
+	// parked is set while the client stream is gone and the session waits
+	// for a resume; the client keepalive does not count misses then.
+	parked atomic.Bool
+	// terminate closes the client stream with code and the backend with
+	// 1001 from outside the session's goroutines.
+	terminate func(code int, reason string)
+	// drain starts a close handshake with both sides and leaves the pumps
+	// running until it completes.
+	drain func(code int, reason string)
+	// slotTaken is set when the session's global slot was handed to the
+	// CONNECT that shed it, so its own teardown must not release it.
+	slotTaken atomic.Bool
+}
+
+// shed closes the session with 1013 so the client retries later.
+func (s *session) shed() {
+	s.terminate(1013, "try again later")
+}
+
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[*session]struct{}
+}
+
+func (r *sessionRegistry) add(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions == nil {
+		r.sessions = make(map[*session]struct{})
+	}
+	r.sessions[s] = struct{}{}
+}
+
+func (r *sessionRegistry) remove(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, s)
+}
+
+func (r *sessionRegistry) snapshot() []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]*session, 0, len(r.sessions))
+	for s := range r.sessions {
+		out = append(out, s)
+	}
+	return out
+}
+
+// claimVictim removes and returns the newest session of the lowest class
+// below p, marking its slot as taken, or nil when there is none.
+func (r *sessionRegistry) claimVictim(p Priority) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var victim *session
+	for s := range r.sessions {
+		if s.priority >= p {
+			continue
+		}
+		if victim == nil || s.priority < victim.priority || (s.priority == victim.priority && s.started.After(victim.started)) {
+			victim = s
+		}
+	}
+	if victim != nil {
+		delete(r.sessions, victim)
+		victim.slotTaken.Store(true)
+	}
+	return victim
+}
+
+// admit takes a global session slot for an accepted CONNECT of class prio.
+// held reports that the caller already reserved a free slot before
+// authenticating, which admit then keeps or gives back. Low priority
+// CONNECTs are capped at a share of the limit; when the limit is reached,
+// the longest-idle session (with ShedIdle set) or else a lower-priority
+// session is shed and its slot handed over before falling back to the
+// admission queue. Shedding is never done for a CONNECT that has not passed
+// authentication, so refused clients cannot evict sessions.
+func (p *Proxy) admit(ctx context.Context, rt *RuntimeConfig, prio Priority, held bool) bool {
+	limit := rt.Limits.MaxConns
+	if share := rt.Admission.LowPriorityShare; prio == PriorityLow && share > 0 && share < 1 {
+		n := p.sessions.count()
+		if held {
+			n--
+		}
+		if float64(n) >= share*float64(limit) {
+			if held {
+				p.sessions.release(limit)
+			}
+			return false
+		}
+	}
+	if held || p.sessions.acquire(ctx, limit, noQueue) {
+		return true
+	}
+	if idle := rt.Admission.ShedIdle; idle > 0 {
+		if victim := p.registry.claimIdle(prio, idle, true); victim != nil {
+			metrics.IdleShed.WithLabelValues("connections").Inc()
+			p.debugf("shedding idle session to admit %s priority CONNECT: session=%s", prio, victim.id)
+			go victim.shed()
+			return true
+		}
+	}
+	if victim := p.registry.claimVictim(prio); victim != nil {
+		metrics.ShedSessions.WithLabelValues(victim.priority.String()).Inc()
+		p.debugf("shedding %s priority session to admit %s priority CONNECT", victim.priority, prio)
+		go victim.shed()
+		return true
+	}
+	return p.sessions.acquire(ctx, limit, rt.Admission)
+}
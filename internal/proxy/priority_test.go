@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/jwt"
+)
+
+func TestAdmitShedsLowerPriority(t *testing.T) {
+	p := &Proxy{}
+	rt := &RuntimeConfig{Limits: config.Limits{MaxConns: 2}}
+	ctx := context.Background()
+
+	shed := make(chan Priority, 2)
+	register := func(prio Priority, started time.Time) *session {
+		s := &session{priority: prio, started: started}
+		s.terminate = func(int, string) { shed <- s.priority }
+		p.registry.add(s)
+		return s
+	}
+	if !p.admit(ctx, rt, PriorityLow, false) || !p.admit(ctx, rt, PriorityNormal, false) {
+		t.Fatal("admission below the cap failed")
+	}
+	now := time.Now()
+	low := register(PriorityLow, now)
+	register(PriorityNormal, now.Add(time.Second))
+
+	// Nothing below low to shed.
+	if p.admit(ctx, rt, PriorityLow, false) {
+		t.Fatal("low CONNECT admitted over the cap")
+	}
+	// The lowest class goes first, even if a normal session is newer.
+	if !p.admit(ctx, rt, PriorityHigh, false) {
+		t.Fatal("high CONNECT not admitted")
+	}
+	if got := <-shed; got != PriorityLow {
+		t.Fatalf("shed %s session, want low", got)
+	}
+	if !low.slotTaken.Load() {
+		t.Fatal("shed session still owns its slot")
+	}
+	if n := p.sessions.count(); n != 2 {
+		t.Fatalf("active = %d, want 2 (slot handed over)", n)
+	}
+	// Same class does not shed.
+	if p.admit(ctx, rt, PriorityNormal, false) {
+		t.Fatal("normal CONNECT admitted over the cap")
+	}
+}
+
+func TestAdmitLowPriorityShare(t *testing.T) {
+	p := &Proxy{}
+	rt := &RuntimeConfig{Limits: config.Limits{MaxConns: 4}, Admission: config.Admission{LowPriorityShare: 0.5}}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if !p.admit(ctx, rt, PriorityLow, false) {
+			t.Fatalf("low CONNECT %d rejected below its share", i)
+		}
+	}
+	if p.admit(ctx, rt, PriorityLow, false) {
+		t.Fatal("low CONNECT admitted beyond its share")
+	}
+	if !p.admit(ctx, rt, PriorityNormal, false) {
+		t.Fatal("normal CONNECT rejected below the cap")
+	}
+}
+
+func TestIdentityPriority(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Priority", r.Header.Get("X-Want"))
+	}))
+	defer authSrv.Close()
+	p := &Proxy{
+		Auth:         &Auth{Verifier: &jwt.Verifier{Keys: jwt.StaticKey{Public: pub}}, PriorityClaim: "tier"},
+		ExternalAuth: &ExternalAuth{URL: authSrv.URL, PriorityHeader: "X-Priority"},
+	}
+	rt := &RuntimeConfig{}
+
+	for _, c := range []struct {
+		tier, header string
+		want         Priority
+	}{
+		{"", "", PriorityUnset},
+		{"high", "", PriorityHigh},
+		{"bogus", "", PriorityUnset},
+		{"high", "low", PriorityLow},
+	} {
+		r := httptest.NewRequest(http.MethodConnect, "/ws", nil)
+		r.Header.Set("Authorization", "Bearer "+signEdDSA(priv, map[string]any{"sub": "alice", "tier": c.tier}))
+		r.Header.Set("X-Want", c.header)
+		sess := &session{}
+		w := httptest.NewRecorder()
+		if _, ok := p.authenticate(w, rt, nil, r, sess); !ok || !p.authorizeExternal(w, rt, nil, r, sess) {
+			t.Fatalf("tier=%q header=%q refused: %d", c.tier, c.header, w.Code)
+		}
+		if sess.priority != c.want {
+			t.Errorf("tier=%q header=%q: priority %v, want %v", c.tier, c.header, sess.priority, c.want)
+		}
+	}
+}
@@ -1,13 +1,21 @@
 package proxy
 
 import (
+	"cmp"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -15,18 +23,155 @@ import (
 
 	"h3ws2h1ws-proxy/internal/config"
 	"h3ws2h1ws-proxy/internal/metrics"
+	"h3ws2h1ws-proxy/internal/ratelimit"
+	"h3ws2h1ws-proxy/internal/sockopt"
+	"h3ws2h1ws-proxy/internal/usage"
 	"h3ws2h1ws-proxy/internal/ws"
 
 	"github.com/gorilla/websocket"
-	"github.com/quic-go/quic-go/http3"
 )
 
 type Proxy struct {
 	Backend    *url.URL
 	PathRegexp *regexp.Regexp
 	Debug      bool
-	Limits     config.Limits
-	active     int64
+	// LogLevel is the level the admin API changes (nil = one seeded from
+	// Debug).
+	LogLevel  *slog.LevelVar
+	Limits    config.Limits
+	Resume    config.Resume
+	Reconnect config.Reconnect
+	Admission config.Admission
+
+	IPRateLimiter ratelimit.Limiter
+	// MaxConnsPerIP caps concurrent sessions per client IP (0 = only the
+	// global, tenant and route caps apply).
+	MaxConnsPerIP int64
+	// Auth, when set, rejects CONNECTs without a valid bearer token.
+	Auth *Auth
+	// ExternalAuth, when set, asks an HTTP service to admit every CONNECT.
+	ExternalAuth *ExternalAuth
+	// Policy, when set, must allow every session (Open Policy Agent).
+	Policy *Policy
+	// AccessLog, when set, records every completed session.
+	AccessLog *AccessLog
+	// Hooks, when set, are told about every session and may refuse it.
+	Hooks Hooks
+	// BackendNetDialer, when set, opens backend TCP connections (source
+	// address / interface binding).
+	BackendNetDialer *net.Dialer
+	// ForwardHeaders are copied from the client request into the backend
+	// handshake (canonical names, see ForwardHeaders).
+	ForwardHeaders []string
+	// BackendTLSConfig is used for wss:// backends (nil = system roots,
+	// no client certificate).
+	BackendTLSConfig *tls.Config
+	// BackendDSCP marks backend TCP connections unless the route sets its own.
+	BackendDSCP int
+	// OverloadRetryAfter is the Retry-After hint sent with 503 responses
+	// caused by session caps.
+	OverloadRetryAfter time.Duration
+	// RTTProbeInterval, when set, pings the client and the backend of every
+	// session to measure round trip times.
+	RTTProbeInterval time.Duration
+	// ClientPingInterval, when set, pings the client of every session and
+	// terminates sessions whose client misses ClientPingMisses pongs in a
+	// row (0 = DefaultPingMisses), regardless of QUIC keepalives.
+	ClientPingInterval time.Duration
+	ClientPingMisses   int
+	// BackendPingInterval, when set, pings the backend of sessions that
+	// carried no frames for that long and terminates them once the backend
+	// misses BackendPingMisses pongs in a row (0 = DefaultPingMisses),
+	// well before ReadTimeout would notice.
+	BackendPingInterval time.Duration
+	BackendPingMisses   int
+	// StreamMessages forwards fragmented client messages to the backend as
+	// their frames arrive. Messages that need their whole payload first
+	// (compressed, validated by the route, or under chaos) are still
+	// reassembled.
+	StreamMessages bool
+	// ReadyWindow is how long a successful backend dial keeps Ready
+	// answering without probing (0 = DefaultReadyWindow).
+	ReadyWindow time.Duration
+	// DialTimeout bounds one backend handshake (0 = DefaultDialTimeout).
+	// DialRetries re-dials the same backend after connection errors and
+	// timeouts, waiting DialBackoff before the first retry and twice as
+	// long before each next one, up to maxDialBackoff, with jitter.
+	DialTimeout time.Duration
+	DialRetries int
+	DialBackoff time.Duration
+	// BackendProtocol carries backend handshakes over HTTP/2 or HTTP/3
+	// extended CONNECT unless the route sets its own (BackendProtocolUnset
+	// = HTTP/1.1 upgrades).
+	BackendProtocol BackendProtocol
+	// BackendProxy sends backend connections through an egress proxy unless
+	// the route sets its own (nil = HTTPS_PROXY/NO_PROXY from the
+	// environment).
+	BackendProxy *BackendProxy
+	// Resolver spreads backend dials over all addresses of the backend
+	// host (nil = the dialer resolves on every dial).
+	Resolver *BackendResolver
+	// StrictRFC9220 requires the RFC 9220 handshake: `:protocol websocket`
+	// and Sec-WebSocket-Version 13, with no Sec-WebSocket-Key/Accept
+	// exchange. Off, clients that omit the headers or send a key are
+	// accepted too.
+	StrictRFC9220 bool
+	// ClientMasking is the policy for client frames sent without a mask.
+	ClientMasking ClientMasking
+	// CloseCodes replaces close codes forwarded from one side to the other;
+	// invalid codes it does not name become 1002.
+	CloseCodes CloseCodeMap
+	// CloseTimeout is how long a session waits for the reply to a close
+	// frame before tearing down both streams (0 = DefaultCloseTimeout).
+	CloseTimeout time.Duration
+	// FlushDelay, when set, lets frames to the client wait up to that long
+	// to be written together with the next ones, up to FlushBytes
+	// (0 = DefaultFlushBytes). Control frames are written at once, and
+	// resumable sessions are never buffered.
+	FlushDelay time.Duration
+	FlushBytes int
+	// SessionBandwidth caps the data messages of every session at this many
+	// bytes per second in each direction (0 = unlimited).
+	SessionBandwidth int64
+	// IngressShaper and EgressShaper cap the data messages of all sessions
+	// together, client to backend and backend to client, queuing sessions
+	// fairly (nil = unlimited).
+	IngressShaper *ratelimit.Shaper
+	EgressShaper  *ratelimit.Shaper
+	// MessageRate caps the messages per second each client may send, with
+	// bursts of MessageBurst (0 = one second's worth); MessageRateAction
+	// decides what happens beyond it (0 = unlimited).
+	MessageRate       float64
+	MessageBurst      int
+	MessageRateAction MessageRateAction
+	// ClientDeflate negotiates permessage-deflate with H3 clients only; the
+	// proxy compresses and inflates on their behalf. Routes may override it
+	// and BackendCompression.
+	ClientDeflate      DeflateOptions
+	BackendCompression BackendCompression
+	// DeflatePassthrough hands the client's extension offer to the backend
+	// and relays frames untouched instead, so permessage-deflate runs end
+	// to end. Message rules, chaos and reconnects do not apply then.
+	DeflatePassthrough bool
+	// Tags, when configured, label per-session traffic metrics.
+	Tags ConnectionTags
+	// Usage, when set, accumulates traffic per UsageIdentity for export.
+	Usage         *usage.Accumulator
+	UsageIdentity UsageIdentity
+	logs          logControl
+	logsOnce      sync.Once
+	sessions      sessionGate
+	ipSessions    ipSessions
+	registry      sessionRegistry
+	draining      atomic.Bool
+	// backendReachedAt is the last time a backend answered, in Unix
+	// nanoseconds.
+	backendReachedAt atomic.Int64
+	parked           sync.Map
+	runtime          atomic.Pointer[RuntimeConfig]
+	healthClientOnce sync.Once
+	healthHTTP       *http.Client
+	extConnect       extendedConnectClients
 }
 
 type websocketBufferPool struct {
@@ -56,62 +201,188 @@ func (p *websocketBufferPool) Put(x interface{}) {
 
 var backendWriteBufferPool = newWebsocketBufferPool(16 << 10)
 
-func (p *Proxy) debugf(format string, args ...any) {
-	if p.Debug {
-		log.Printf("[debug] "+format, args...)
+// backendNetDialer returns the TCP dialer for a route's backend connections,
+// or nil to use the websocket default.
+func (p *Proxy) backendNetDialer(route *Route) *net.Dialer {
+	dscp := p.BackendDSCP
+	if route != nil && route.DSCP != 0 {
+		dscp = route.DSCP
 	}
+	if dscp == 0 {
+		return p.BackendNetDialer
+	}
+	d := net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	if p.BackendNetDialer != nil {
+		d = *p.BackendNetDialer
+	}
+	d.Control = sockopt.Chain(d.Control, sockopt.Control(sockopt.DSCP(dscp)))
+	return &d
 }
 
-func (p *Proxy) backendURLForRequest(r *http.Request) *url.URL {
-	target := *p.Backend
-	target.Path = r.URL.Path
-	target.RawPath = r.URL.RawPath
+func backendURLForRequest(base *url.URL, r *http.Request) *url.URL {
+	target := *base
+	setHandshakePath(&target, r.URL.Path, r.URL.RawPath)
 	target.RawQuery = r.URL.RawQuery
 	target.Fragment = ""
 	return &target
 }
 
 func (p *Proxy) HandleH3WebSocket(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
 	p.debugf("incoming request: method=%s proto=%s path=%s remote=%s", r.Method, r.Proto, r.URL.String(), r.RemoteAddr)
 
-	if atomic.AddInt64(&p.active, 1) > p.Limits.MaxConns {
-		atomic.AddInt64(&p.active, -1)
-		metrics.Rejected.WithLabelValues("max_conns").Inc()
-		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+	rt := p.runtimeConfig()
+	route := rt.matchRoute(r)
+	if p.rejectDraining(w, rt, route) {
+		return
+	}
+	if token := r.Header.Get(ResumeTokenHeader); token != "" && rt.Resume.Window > 0 {
+		p.handleResume(w, r, rt, route, token)
 		return
 	}
-	defer atomic.AddInt64(&p.active, -1)
 
-	if r.Method != http.MethodConnect {
+	sess := &session{route: route, redactor: rt.Redactor, tag: p.Tags.tag(r), logs: p.logControl(), chaos: rt.Chaos.forRoute(route), stream: p.StreamMessages, requireMask: p.ClientMasking == MaskingRequire, closeCodes: p.CloseCodes, hooks: p.Hooks}
+	sess.inShaper, sess.outShaper = p.IngressShaper, p.EgressShaper
+	if p.MessageRate > 0 {
+		sess.msgLimiter = ratelimit.NewLocal(p.MessageRate, cmp.Or(p.MessageBurst, int(p.MessageRate)))
+		sess.msgAction = p.MessageRateAction
+	}
+	if p.SessionBandwidth > 0 {
+		sess.inThrottle = ratelimit.NewThrottle(float64(p.SessionBandwidth), int(p.SessionBandwidth))
+		sess.outThrottle = ratelimit.NewThrottle(float64(p.SessionBandwidth), int(p.SessionBandwidth))
+	}
+	sess.id = newSessionID()
+	// Rejections carry the ID too, so a refused client can quote it.
+	w.Header().Set(SessionIDHeader, sess.id)
+	if addr, err := netip.ParseAddr(clientIP(r)); err == nil {
+		sess.clientIP = addr.Unmap()
+	}
+	if p.Usage != nil {
+		sess.identity = p.UsageIdentity.identity(r)
+	}
+	// A free slot is reserved up front; waiting for one or shedding another
+	// session to make room happens in admit once the CONNECT is accepted.
+	held := p.sessions.acquire(r.Context(), rt.Limits.MaxConns, noQueue)
+	defer func() {
+		if held && !sess.slotTaken.Load() {
+			p.sessions.release(rt.Limits.MaxConns)
+		}
+	}()
+
+	if r.Method != http.MethodConnect && !IsUpgradeRequest(r) {
 		metrics.Rejected.WithLabelValues("method").Inc()
-		http.Error(w, "expected CONNECT", http.StatusMethodNotAllowed)
+		rt.reject(w, route, "method", http.StatusMethodNotAllowed, "expected CONNECT")
 		return
 	}
-	if p.PathRegexp != nil && !p.PathRegexp.MatchString(r.URL.Path) {
+	// A route with its own backend claims its paths; everything else must
+	// match -path.
+	if (route == nil || route.Backend == nil) && p.PathRegexp != nil && !p.PathRegexp.MatchString(r.URL.Path) {
 		metrics.Rejected.WithLabelValues("path").Inc()
-		http.Error(w, "path not allowed", http.StatusNotFound)
+		rt.reject(w, route, "path", http.StatusNotFound, "path not allowed")
+		return
+	}
+	if rejectClientCert(w, rt, route, r) {
 		return
 	}
 
-	// Compatibility note:
-	// Some clients / gateways still omit RFC8441 `:protocol` and
-	// Sec-WebSocket-Version over H3 Extended CONNECT.
-	// We reject only explicitly invalid values, but tolerate absence.
-	if proto := firstNonEmpty(
-		r.Header.Get(":protocol"),
-		r.Header.Get("protocol"),
-		r.Header.Get("Protocol"),
-	); proto != "" && proto != "websocket" {
-		metrics.Rejected.WithLabelValues("bad_headers").Inc()
-		http.Error(w, "missing/invalid :protocol websocket", http.StatusBadRequest)
+	if d, ok := allowRate(r.Context(), p.IPRateLimiter, clientIP(r)); !ok {
+		metrics.Rejected.WithLabelValues("rate_limit").Inc()
+		writeRateLimited(w, rt, route, d)
+		return
+	}
+	tenant, ok := p.authenticate(w, rt, route, r, sess)
+	if !ok || !p.authorizeExternal(w, rt, route, r, sess) || !p.checkPolicy(w, rt, route, tenant, r, sess) {
+		return
+	}
+	if sess.hooks != nil {
+		if err := sess.hooks.OnAccept(r); err != nil {
+			sess.debugf("hooks: refused: remote=%s path=%s err=%v", r.RemoteAddr, r.URL.Path, err)
+			metrics.Rejected.WithLabelValues("acl").Inc()
+			rejectRoute(route, "acl")
+			rt.reject(w, route, "acl", http.StatusForbidden, err.Error())
+			return
+		}
+	}
+	if p.MaxConnsPerIP > 0 && sess.clientIP.IsValid() {
+		if !p.ipSessions.acquire(sess.clientIP, p.MaxConnsPerIP) {
+			metrics.Rejected.WithLabelValues("ip_conns").Inc()
+			rejectRoute(route, "ip_conns")
+			writeIPCapped(w, rt, route, p.OverloadRetryAfter)
+			return
+		}
+		defer p.ipSessions.release(sess.clientIP)
+	}
+	// The class is only known once the client is authenticated.
+	if sess.priority == PriorityUnset {
+		sess.priority = effectivePriority(route, tenant)
+	}
+	if held = p.admit(r.Context(), rt, sess.priority, held); !held {
+		metrics.Rejected.WithLabelValues("max_conns").Inc()
+		writeOverloaded(w, rt, route, p.OverloadRetryAfter)
 		return
 	}
 
-	key := r.Header.Get("Sec-WebSocket-Key")
-	ver := r.Header.Get("Sec-WebSocket-Version")
-	if ver != "" && ver != "13" {
+	if route != nil {
+		if !route.acquire(r.Context(), rt.Admission) {
+			metrics.Rejected.WithLabelValues("max_conns").Inc()
+			rejectRoute(route, "max_conns")
+			writeOverloaded(w, rt, route, p.OverloadRetryAfter)
+			return
+		}
+		defer route.release()
+	}
+
+	lim := rt.Limits
+	backendBase := p.Backend
+	if rt.Backend != nil {
+		backendBase = rt.Backend
+	}
+	if tenant != nil {
+		if d, ok := allowRate(r.Context(), tenant.RateLimiter, tenant.Name); !ok {
+			metrics.Rejected.WithLabelValues("rate_limit").Inc()
+			rejectTenant(tenant, "rate_limit")
+			writeRateLimited(w, rt, route, d)
+			return
+		}
+		if !tenant.acquire() {
+			metrics.Rejected.WithLabelValues("max_conns").Inc()
+			rejectTenant(tenant, "max_conns")
+			writeOverloaded(w, rt, route, p.OverloadRetryAfter)
+			return
+		}
+		defer tenant.release()
+		lim = tenant.Limits
+		backendBase = tenant.Backend
+		sess.debugf("tenant matched: tenant=%s path=%s", tenant.Name, r.URL.Path)
+	}
+	pool := rt.pool(route, tenant)
+	var (
+		member  *PoolBackend
+		balance Balance
+		hashKey string
+	)
+	if pool != nil {
+		balance, hashKey = pool.balance(route, r)
+		member = pool.pick(balance, hashKey)
+		if member == nil {
+			metrics.Rejected.WithLabelValues("no_backend").Inc()
+			rejectRoute(route, "no_backend")
+			rejectTenant(tenant, "no_backend")
+			rt.reject(w, route, "no_backend", http.StatusServiceUnavailable, "no backend available")
+			return
+		}
+		member.acquire()
+		// A dial retry may move the session to another member.
+		defer func() { member.release() }()
+		backendBase = member.URL
+		sess.debugf("pool backend picked: pool=%s backend=%s", pool.Name, member.Name)
+	}
+
+	accept, problem := p.checkHandshake(r)
+	if problem != "" {
 		metrics.Rejected.WithLabelValues("bad_headers").Inc()
-		http.Error(w, "missing/invalid websocket headers", http.StatusBadRequest)
+		rejectTenant(tenant, "bad_headers")
+		rt.reject(w, route, "bad_headers", http.StatusBadRequest, problem)
 		return
 	}
 
@@ -120,68 +391,128 @@ func (p *Proxy) HandleH3WebSocket(w http.ResponseWriter, r *http.Request) {
 	if err := rc.EnableFullDuplex(); err == nil {
 		fullDuplexEnabled = true
 	} else if !errors.Is(err, http.ErrNotSupported) {
-		p.debugf("enable full duplex failed: %v", err)
+		sess.debugf("enable full duplex failed: %v", err)
 	}
 
-	hs, ok := w.(http3.HTTPStreamer)
+	takeOver, ok := clientStreamer(w, r)
 	if !ok {
 		metrics.Errors.WithLabelValues("no_stream_takeover").Inc()
-		http.Error(w, "http3 stream takeover not supported", http.StatusInternalServerError)
+		http.Error(w, "stream takeover not supported", http.StatusInternalServerError)
 		return
 	}
 
-	if key != "" {
-		w.Header().Set("Sec-WebSocket-Accept", ws.ComputeAccept(key))
-	}
-
-	subp := r.Header.Get("Sec-WebSocket-Protocol")
-	if subp != "" {
-		w.Header().Set("Sec-WebSocket-Protocol", ws.PickFirstToken(subp))
-	}
-	w.WriteHeader(http.StatusOK)
-	p.debugf("rfc9220 handshake response sent: status=200 path=%s", r.URL.Path)
-	if f, ok := w.(http.Flusher); ok {
-		f.Flush()
-	}
-
-	stream := hs.HTTPStream()
-	defer func() { _ = stream.Close() }()
-	if !fullDuplexEnabled {
-		// HTTP/3 handlers may not implement ResponseController full-duplex hook,
-		// but stream takeover gives us bidirectional access to the request stream.
-		fullDuplexEnabled = true
-	}
-	p.debugf("full duplex mode: enabled=%v", fullDuplexEnabled)
-	p.debugf("http3 stream takeover success: path=%s", r.URL.Path)
-
 	dialer := websocket.Dialer{
 		Proxy:             http.ProxyFromEnvironment,
 		ReadBufferSize:    16 << 10,
 		WriteBufferSize:   16 << 10,
 		WriteBufferPool:   backendWriteBufferPool,
-		HandshakeTimeout:  10 * time.Second,
+		HandshakeTimeout:  cmp.Or(p.DialTimeout, DefaultDialTimeout),
 		EnableCompression: false,
+		TLSClientConfig:   p.BackendTLSConfig,
+	}
+	backendCompression := p.backendCompression(route)
+	dialer.EnableCompression = backendCompression.Enabled
+	if offer := r.Header.Get("Sec-WebSocket-Extensions"); offer != "" && p.deflatePassthrough(route) {
+		// The offer goes to the backend as it is (see withExtensions).
+		sess.extensions = offer
+		backendCompression = BackendCompression{}
+	}
+	nd := p.backendNetDialer(route)
+	bp := p.backendProxy(route)
+	switch {
+	case bp != nil && bp.URL != nil:
+		// The proxy resolves the backend host.
+		dialer.Proxy = nil
+		dialer.NetDialContext = bp.dialer(nd)
+	case p.Resolver != nil:
+		dialer.NetDialContext = p.Resolver.dialer(nd)
+	case nd != nil:
+		dialer.NetDialContext = nd.DialContext
+	}
+	if bp != nil && bp.URL == nil {
+		dialer.Proxy = nil
+	}
+	if proto := p.backendProtocol(route); proto == BackendHTTP2 || proto == BackendHTTP3 {
+		p.useExtendedConnect(&dialer, proto)
 	}
 	backendHeader := http.Header{}
 	backendHeader["connection"] = []string{"Upgrade"}
 	backendHeader["upgrade"] = []string{"websocket"}
-	if subp != "" {
-		backendHeader.Set("Sec-WebSocket-Protocol", ws.PickFirstToken(subp))
+	// The backend picks the subprotocol from everything the client offered
+	// and the client is told its choice.
+	if subp := r.Header.Get("Sec-WebSocket-Protocol"); subp != "" {
+		backendHeader.Set("Sec-WebSocket-Protocol", subp)
+	}
+	copyForwardHeaders(backendHeader, r.Header, p.ForwardHeaders)
+	for name, values := range sess.authHeader {
+		backendHeader[name] = values
+	}
+	backendHeader.Set(RequestIDHeader, sess.id)
+	if headers := rt.backendHeaders(route); len(headers) > 0 {
+		data := HeaderData{
+			RemoteAddr: r.RemoteAddr,
+			RemoteIP:   clientIP(r),
+			Host:       requestHost(r),
+			Path:       r.URL.Path,
+			SessionID:  sess.id,
+			Route:      routeName(route),
+			Tenant:     tenantName(tenant),
+			Claims:     sess.claims,
+			request:    r,
+		}
+		if err := headers.render(backendHeader, data); err != nil {
+			metrics.Errors.WithLabelValues("backend_header").Inc()
+			sess.debugf("%v", err)
+		}
+	}
+	backendURL := backendURLForRequest(backendBase, r)
+	if route != nil && route.Backend != nil && route.Pool == nil {
+		backendURL = route.backendURL(r)
+	}
+	sess.debugf("dial backend websocket: %s", backendURL.String())
+	dialCtx := r.Context()
+	if pool != nil && pool.DialDeadline > 0 {
+		var cancelDial context.CancelFunc
+		dialCtx, cancelDial = context.WithTimeout(dialCtx, pool.DialDeadline)
+		defer cancelDial()
+	}
+	bws, resp, err := p.dialBackend(dialCtx, &dialer, backendURL, backendHeader, sess)
+	// Failed dials move on to other members of the pool while the retry
+	// budget and deadline allow.
+	tried := []*PoolBackend{member}
+	for err != nil && pool != nil && len(tried) <= pool.DialRetries && dialCtx.Err() == nil {
+		next := pool.pick(balance, hashKey, tried...)
+		if next == nil {
+			break
+		}
+		pool.reportDial(member, err)
+		metrics.BackendDialRetries.Inc()
+		sess.debugf("backend dial failed to %s: %v; retrying with pool backend %s", backendURL.String(), err, next.Name)
+		if resp != nil && resp.Body != nil {
+			_ = resp.Body.Close()
+		}
+		member.release()
+		member = next
+		member.acquire()
+		tried = append(tried, member)
+		backendURL = backendURLForRequest(member.URL, r)
+		bws, resp, err = p.dialBackend(dialCtx, &dialer, backendURL, backendHeader, sess)
 	}
-	backendURL := p.backendURLForRequest(r)
-	p.debugf("dial backend websocket: %s", backendURL.String())
-	bws, resp, err := dialer.Dial(backendURL.String(), backendHeader)
 	if resp != nil && resp.Body != nil {
 		defer func() { _ = resp.Body.Close() }()
 	}
+	if err == nil {
+		err = backendCompression.apply(bws)
+	}
 	if err != nil {
 		metrics.Errors.WithLabelValues("backend_dial").Inc()
+		pool.reportDial(member, err)
 		if resp != nil {
-			p.debugf("backend dial failed to %s: %v (status=%s)", backendURL.String(), err, resp.Status)
+			sess.debugf("backend dial failed to %s: %v (status=%s)", backendURL.String(), err, resp.Status)
 		} else {
-			p.debugf("backend dial failed to %s: %v", backendURL.String(), err)
+			sess.debugf("backend dial failed to %s: %v", backendURL.String(), err)
 		}
-		_ = ws.WriteCloseFrame(stream, 1011, "backend dial failed")
+		writeBackendFailure(w, resp, err, sess.id)
 		return
 	}
 	defer func() { _ = bws.Close() }()
@@ -197,24 +528,119 @@ func (p *Proxy) HandleH3WebSocket(w http.ResponseWriter, r *http.Request) {
 		backendProto = resp.Header.Get("Sec-WebSocket-Protocol")
 		if resp.StatusCode != http.StatusSwitchingProtocols {
 			metrics.Errors.WithLabelValues("backend_dial").Inc()
-			p.debugf("backend websocket handshake unexpected status: backend=%s status=%s", backendURL.String(), resp.Status)
-			_ = ws.WriteCloseFrame(stream, 1011, "backend handshake failed")
+			pool.reportDial(member, fmt.Errorf("backend answered %s", resp.Status))
+			sess.debugf("backend websocket handshake unexpected status: backend=%s status=%s", backendURL.String(), resp.Status)
+			writeBackendFailure(w, resp, nil, sess.id)
+			return
+		}
+	}
+	pool.reportDial(member, nil)
+	sess.debugf("backend dial ok: remote=%s path=%s backend=%s status=%s upgrade=%q connection=%q subprotocol=%q", r.RemoteAddr, r.URL.Path, backendURL.String(), backendStatus, backendUpgrade, backendConnection, backendProto)
+	sess.debugf("backend websocket connected: %s (status=%s upgrade=%q connection=%q subprotocol=%q)", backendURL.String(), backendStatus, backendUpgrade, backendConnection, backendProto)
+
+	if accept != "" {
+		w.Header().Set("Sec-WebSocket-Accept", accept)
+	}
+
+	if backendProto != "" {
+		w.Header().Set("Sec-WebSocket-Protocol", backendProto)
+	}
+	var frames *frameConn
+	opaque := route != nil && route.Opaque && sess.extensions == ""
+	if sess.extensions != "" {
+		var ok bool
+		if frames, ok = newFrameConn(bws); !ok {
+			metrics.Errors.WithLabelValues("backend_dial").Inc()
+			writeBackendFailure(w, nil, errors.New("backend connection does not pass extensions through"), sess.id)
 			return
 		}
+		if ext := frames.conn.accepted; ext != "" {
+			w.Header().Set("Sec-WebSocket-Extensions", ext)
+		}
+		sess.debugf("extensions passed through: offered=%q accepted=%q", sess.extensions, frames.conn.accepted)
+	} else if opaque {
+		sess.debugf("opaque relay: client extensions declined")
+	} else if dfl, ext := negotiateClientDeflate(p.clientDeflateOptions(route), r.Header.Get("Sec-WebSocket-Extensions")); dfl != nil {
+		sess.deflate = dfl
+		w.Header().Set("Sec-WebSocket-Extensions", ext)
+	}
+	resumeToken := ""
+	if rt.Resume.Window > 0 && !opaque {
+		token, err := newResumeToken()
+		if err != nil {
+			metrics.Errors.WithLabelValues("resume_token").Inc()
+			sess.debugf("resume token generation failed: %v", err)
+		} else {
+			resumeToken = token
+			w.Header().Set(ResumeTokenHeader, resumeToken)
+		}
+	}
+	stream, err := takeOver()
+	if err != nil {
+		metrics.Errors.WithLabelValues("no_stream_takeover").Inc()
+		sess.debugf("stream takeover failed: path=%s err=%v", r.URL.Path, err)
+		return
 	}
-	p.debugf("backend dial ok: remote=%s path=%s backend=%s status=%s upgrade=%q connection=%q subprotocol=%q", r.RemoteAddr, r.URL.Path, backendURL.String(), backendStatus, backendUpgrade, backendConnection, backendProto)
-	p.debugf("backend websocket connected: %s (status=%s upgrade=%q connection=%q subprotocol=%q)", backendURL.String(), backendStatus, backendUpgrade, backendConnection, backendProto)
+	defer func() { _ = stream.Close() }()
+	sess.debugf("handshake response sent: proto=%s path=%s", r.Proto, r.URL.Path)
+	if !fullDuplexEnabled {
+		// HTTP/3 handlers may not implement ResponseController full-duplex hook,
+		// but stream takeover gives us bidirectional access to the request stream.
+		fullDuplexEnabled = true
+	}
+	sess.debugf("full duplex mode: enabled=%v", fullDuplexEnabled)
+	sess.debugf("stream takeover success: proto=%s path=%s", r.Proto, r.URL.Path)
 
 	metrics.Accepted.Inc()
+	metrics.HandshakeDuration.WithLabelValues(routeName(route)).Observe(time.Since(received).Seconds())
 	metrics.ActiveSessions.Inc()
 	defer metrics.ActiveSessions.Dec()
+	metrics.TenantAccepted.WithLabelValues(tenantName(tenant)).Inc()
+	metrics.TenantActiveSessions.WithLabelValues(tenantName(tenant)).Inc()
+	defer metrics.TenantActiveSessions.WithLabelValues(tenantName(tenant)).Dec()
+	metrics.RouteActiveSessions.WithLabelValues(routeName(route)).Inc()
+	defer metrics.RouteActiveSessions.WithLabelValues(routeName(route)).Dec()
 
 	sessionStarted := time.Now()
 	st := &sessionTrafficStats{}
+	defer p.Usage.Track(sess.identity, st.usage)()
 
-	ctx, cancel := context.WithCancel(r.Context())
+	sessionCtx := r.Context()
+	if resumeToken != "" {
+		// The request context dies with the client stream; a resumable session
+		// must outlive it while parked.
+		sessionCtx = context.WithoutCancel(sessionCtx)
+	}
+	ctx, cancel := context.WithCancel(sessionCtx)
 	defer cancel()
-	bws.SetReadLimit(p.Limits.MaxMessageSize)
+
+	var backend backendConn = bws
+	switch {
+	case frames != nil:
+		// A re-dialed backend could answer the offer differently; passthrough
+		// sessions end with their connection.
+		backend = frames
+	case opaque:
+		// The relay reads the connection itself; opaque sessions end with
+		// it.
+	case rt.Reconnect.Timeout > 0:
+		redial := func(ctx context.Context) (*websocket.Conn, error) {
+			sess.debugf("re-dial backend websocket: %s", backendURL.String())
+			d, target := websocketTarget(&dialer, backendURL)
+			c, resp, err := d.DialContext(ctx, target, backendHeader)
+			if resp != nil && resp.Body != nil {
+				_ = resp.Body.Close()
+			}
+			if err == nil {
+				if err = backendCompression.apply(c); err != nil {
+					_ = c.Close()
+				}
+			}
+			return c, err
+		}
+		backend = newBackendLink(ctx, bws, redial, rt.Reconnect.Timeout, rt.Reconnect.MaxBuffer, sess.debugf)
+	}
+	backend.SetReadLimit(lim.MaxMessageSize)
 
 	upstream, proto := logContextFields(r)
 
@@ -226,36 +652,196 @@ func (p *Proxy) HandleH3WebSocket(w http.ResponseWriter, r *http.Request) {
 	var wg sync.WaitGroup
 	errCh := make(chan pumpResult, 2)
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		errCh <- pumpResult{dir: "h3_to_h1", err: pumpH3ToBackend(ctx, stream, bws, p.Limits, st, p.Debug, upstream, proto)}
-	}()
+	var h3Stream io.ReadWriteCloser = stream
+	var h3Writer io.Writer = &lockedWriter{w: stream}
+	var cw *clientWriter
+	var releaseStream chan struct{}
+	var fw *flushWriter
+	if resumeToken != "" {
+		cw = newClientWriter(stream, rt.Resume.MaxBuffer)
+		h3Writer = cw
+		defer func() {
+			if releaseStream != nil {
+				close(releaseStream)
+			}
+		}()
+	} else if p.FlushDelay > 0 {
+		fw = newFlushWriter(stream, p.FlushDelay, cmp.Or(p.FlushBytes, DefaultFlushBytes))
+		h3Writer = fw
+	}
+
+	sess.path = r.URL.Path
+	sess.backend = (&url.URL{Scheme: backendURL.Scheme, Host: backendURL.Host, Path: backendURL.Path}).String()
+	sess.traffic = st
+	sess.started = time.Now()
+	sess.terminate = func(code int, reason string) {
+		sess.debugf("session terminated: path=%s priority=%s code=%d reason=%q", r.URL.Path, sess.priority, code, reason)
+		_ = ws.WriteCloseFrame(h3Writer, uint16(code), reason)
+		_ = backend.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+		_ = backend.Close()
+	}
+	sess.drain = func(code int, reason string) {
+		sess.debugf("session draining: path=%s code=%d reason=%q", r.URL.Path, code, reason)
+		_ = ws.WriteCloseFrame(h3Writer, uint16(code), reason)
+		_ = backend.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	}
+	p.registry.add(sess)
+	defer p.registry.remove(sess)
+	if sess.hooks != nil {
+		sess.hooks.OnBackendConnected(sess.info(time.Now()))
+	}
+	if p.RTTProbeInterval > 0 {
+		go probeRTT(ctx, h3Writer, backend, p.RTTProbeInterval)
+	}
+	if p.ClientPingInterval > 0 {
+		go keepAlive(ctx, sess, "client", p.ClientPingInterval, cmp.Or(p.ClientPingMisses, DefaultPingMisses), false, func(payload []byte, _ time.Time) error {
+			return ws.WriteControlFrame(h3Writer, ws.OpPing, payload)
+		})
+	}
+	if p.BackendPingInterval > 0 {
+		go keepAlive(ctx, sess, "backend", p.BackendPingInterval, cmp.Or(p.BackendPingMisses, DefaultPingMisses), true, func(payload []byte, now time.Time) error {
+			return backend.WriteControl(websocket.PingMessage, payload, now.Add(5*time.Second))
+		})
+	}
+
+	outstanding := 0
+	startH3Pump := func(rs io.Reader) {
+		outstanding++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := struct {
+				io.Reader
+				io.Writer
+			}{rs, h3Writer}
+			if frames != nil {
+				errCh <- pumpResult{dir: "h3_to_h1", err: relayClientFrames(ctx, s, frames, lim, st, sess)}
+				return
+			}
+			if opaque {
+				errCh <- pumpResult{dir: "h3_to_h1", err: relayClientOpaque(ctx, s, bws, lim, st, sess)}
+				return
+			}
+			errCh <- pumpResult{dir: "h3_to_h1", err: pumpH3ToBackend(ctx, s, backend, lim, st, sess, upstream, proto)}
+		}()
+	}
+	startH3Pump(h3Stream)
 
+	outstanding++
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		errCh <- pumpResult{dir: "h1_to_h3", err: pumpBackendToH3(ctx, bws, stream, p.Limits, st, p.Debug, upstream, proto)}
+		if frames != nil {
+			errCh <- pumpResult{dir: "h1_to_h3", err: relayBackendFrames(ctx, frames, h3Writer, lim, st, sess)}
+			return
+		}
+		if opaque {
+			errCh <- pumpResult{dir: "h1_to_h3", err: relayBackendOpaque(ctx, bws, h3Writer, st, sess)}
+			return
+		}
+		errCh <- pumpResult{dir: "h1_to_h3", err: pumpBackendToH3(ctx, backend, h3Writer, lim, st, sess, upstream, proto)}
 	}()
 
 	first := <-errCh
-	p.debugf("pump finished: dir=%s err=%v", first.dir, first.err)
+	outstanding--
+	sess.debugf("pump finished: dir=%s err=%v", first.dir, first.err)
+	for first.dir == "h3_to_h1" && cw != nil && isResumableClientError(first.err) {
+		cw.detach()
+		sess.parked.Store(true)
+		_ = h3Stream.Close()
+		sess.debugf("client stream lost, parking session for resume: path=%s window=%s err=%v", r.URL.Path, rt.Resume.Window, first.err)
+		ps := p.parkSession(resumeToken, sess.id, r.URL.Path, resumeOwner(r, sess.claims))
+		timer := time.NewTimer(rt.Resume.Window)
+		var next resumeAttach
+		resumed := false
+		select {
+		case next = <-ps.attach:
+			resumed = true
+		case <-timer.C:
+			metrics.Resumes.WithLabelValues("expired").Inc()
+		case first = <-errCh:
+			outstanding--
+			sess.debugf("pump finished while parked: dir=%s err=%v", first.dir, first.err)
+		}
+		timer.Stop()
+		p.unparkSession(resumeToken, ps)
+		sess.parked.Store(false)
+		if !resumed {
+			break
+		}
+		if releaseStream != nil {
+			close(releaseStream)
+		}
+		h3Stream, releaseStream = next.stream, next.done
+		replayed, err := cw.attach(next.stream)
+		if err != nil {
+			metrics.Resumes.WithLabelValues("replay_failed").Inc()
+			first = pumpResult{dir: "h3_to_h1", err: err}
+			break
+		}
+		metrics.Resumes.WithLabelValues("resumed").Inc()
+		sess.debugf("session resumed: path=%s replayed_frames=%d", r.URL.Path, replayed)
+		startH3Pump(next.stream)
+		first = <-errCh
+		outstanding--
+		sess.debugf("pump finished: dir=%s err=%v", first.dir, first.err)
+	}
 	err1 := first.err
-	if first.dir == "h3_to_h1" && (first.err == nil || errors.Is(first.err, io.EOF) || ws.IsNetClose(first.err)) {
-		p.debugf("h3_to_h1 finished first with graceful close; waiting for backend->client pump to finish")
-		second := <-errCh
-		p.debugf("pump finished: dir=%s err=%v", second.dir, second.err)
-		err1 = second.err
-	} else {
-		cancel()
-		_ = stream.Close()
-		_ = bws.Close()
-		second := <-errCh
-		p.debugf("pump finished after cancel: dir=%s err=%v", second.dir, second.err)
+	if errors.Is(err1, errResumeBufferFull) {
+		metrics.Resumes.WithLabelValues("buffer_overflow").Inc()
+	}
+	// A close from one side waits up to closeTimeout for the other side's
+	// reply, which the other pump forwards, before the streams are torn
+	// down; a side that does not answer is answered by the proxy.
+	closeTimeout := cmp.Or(p.CloseTimeout, DefaultCloseTimeout)
+	switch {
+	case first.dir == "h3_to_h1" && (first.err == nil || errors.Is(first.err, io.EOF) || ws.IsNetClose(first.err)):
+		sess.debugf("h3_to_h1 finished first with graceful close; waiting for backend->client pump to finish")
+		if outstanding == 0 {
+			break
+		}
+		// Without a close frame the client only half-closed its stream and
+		// the backend may go on sending.
+		var timeout <-chan time.Time
+		if code := sess.clientClose.Load(); code != 0 {
+			timer := time.NewTimer(closeTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case second := <-errCh:
+			outstanding--
+			sess.debugf("pump finished: dir=%s err=%v", second.dir, second.err)
+			err1 = second.err
+		case <-timeout:
+			metrics.CloseTimeouts.WithLabelValues("backend").Inc()
+			sess.debugf("backend did not answer the close within %s", closeTimeout)
+			_ = ws.WriteCloseFrame(h3Writer, replyCloseCode(sess.clientClose.Load()), "")
+		}
+	case first.dir == "h1_to_h3" && sess.backendClose.Load() != 0 && outstanding > 0:
+		sess.debugf("backend closed; waiting for the client's close")
+		timer := time.NewTimer(closeTimeout)
+		select {
+		case second := <-errCh:
+			outstanding--
+			sess.debugf("pump finished: dir=%s err=%v", second.dir, second.err)
+		case <-timer.C:
+			metrics.CloseTimeouts.WithLabelValues("client").Inc()
+			sess.debugf("client did not answer the close within %s", closeTimeout)
+			_ = backend.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(int(replyCloseCode(sess.backendClose.Load())), ""), time.Now().Add(time.Second))
+		}
+		timer.Stop()
 	}
 	cancel()
-	_ = stream.Close()
-	_ = bws.Close()
+	if fw != nil {
+		_ = fw.Flush()
+	}
+	_ = h3Stream.Close()
+	_ = backend.Close()
+	if outstanding > 0 {
+		second := <-errCh
+		sess.debugf("pump finished after cancel: dir=%s err=%v", second.dir, second.err)
+	}
 	wg.Wait()
 
 	dur := time.Since(sessionStarted)
@@ -266,16 +852,82 @@ func (p *Proxy) HandleH3WebSocket(w http.ResponseWriter, r *http.Request) {
 	metrics.SessionDuration.Observe(dur.Seconds())
 	metrics.SessionTrafficBytes.WithLabelValues("h3_to_h1").Observe(float64(h3ToH1Bytes))
 	metrics.SessionTrafficBytes.WithLabelValues("h1_to_h3").Observe(float64(h1ToH3Bytes))
-	p.debugf("session finished: path=%s dur=%s h3_to_h1_bytes=%d h1_to_h3_bytes=%d h3_to_h1_msgs=%d h1_to_h3_msgs=%d err=%v", r.URL.Path, dur, h3ToH1Bytes, h1ToH3Bytes, h3ToH1Messages, h1ToH3Messages, err1)
-	p.debugf("backend session summary: remote=%s path=%s dur=%s h3_to_h1_bytes=%d h1_to_h3_bytes=%d h3_to_h1_msgs=%d h1_to_h3_msgs=%d err=%v", r.RemoteAddr, r.URL.Path, dur, h3ToH1Bytes, h1ToH3Bytes, h3ToH1Messages, h1ToH3Messages, err1)
+	metrics.TenantBytes.WithLabelValues(tenantName(tenant), "h3_to_h1").Add(float64(h3ToH1Bytes))
+	metrics.TenantBytes.WithLabelValues(tenantName(tenant), "h1_to_h3").Add(float64(h1ToH3Bytes))
+	if sess.tag != "" {
+		metrics.TagBytes.WithLabelValues(sess.tag, "h3_to_h1").Add(float64(h3ToH1Bytes))
+		metrics.TagBytes.WithLabelValues(sess.tag, "h1_to_h3").Add(float64(h1ToH3Bytes))
+		metrics.TagMessages.WithLabelValues(sess.tag, "h3_to_h1").Add(float64(h3ToH1Messages))
+		metrics.TagMessages.WithLabelValues(sess.tag, "h1_to_h3").Add(float64(h1ToH3Messages))
+	}
+	sess.debugf("session finished: path=%s labels=%s dur=%s h3_to_h1_bytes=%d h1_to_h3_bytes=%d h3_to_h1_msgs=%d h1_to_h3_msgs=%d err=%v", r.URL.Path, formatLabels(sess.labels), dur, h3ToH1Bytes, h1ToH3Bytes, h3ToH1Messages, h1ToH3Messages, err1)
+	sess.debugf("backend session summary: remote=%s path=%s dur=%s h3_to_h1_bytes=%d h1_to_h3_bytes=%d h3_to_h1_msgs=%d h1_to_h3_msgs=%d err=%v", r.RemoteAddr, r.URL.Path, dur, h3ToH1Bytes, h1ToH3Bytes, h3ToH1Messages, h1ToH3Messages, err1)
 	if h1ToH3Messages == 0 {
-		p.debugf("backend diagnostic: no backend->client messages observed for remote=%s path=%s (backend=%s)", r.RemoteAddr, r.URL.Path, backendURL.String())
+		sess.debugf("backend diagnostic: no backend->client messages observed for remote=%s path=%s (backend=%s)", r.RemoteAddr, r.URL.Path, backendURL.String())
 	}
 
-	if err1 != nil && !errors.Is(err1, context.Canceled) && !ws.IsNetClose(err1) {
+	if code := sess.clientClose.Load(); code != 0 {
+		metrics.CloseCodes.WithLabelValues("client", strconv.Itoa(int(code))).Inc()
+	}
+	if code := sess.backendClose.Load(); code != 0 {
+		metrics.CloseCodes.WithLabelValues("backend", strconv.Itoa(int(code))).Inc()
+	}
+	sess.debugf("session close codes: client=%d backend=%d", sess.clientClose.Load(), sess.backendClose.Load())
+
+	failed := err1 != nil && !errors.Is(err1, context.Canceled) && !ws.IsNetClose(err1)
+	pool.reportSession(member, failed && first.dir == "h1_to_h3")
+	if failed {
 		metrics.Errors.WithLabelValues("session").Inc()
-		log.Printf("session ended: %v", err1)
+		slog.Warn("session ended", "session", sess.id, "labels", formatLabels(sess.labels), "err", err1)
+	}
+	if p.AccessLog != nil {
+		rec := map[string]any{
+			"time":               sessionStarted.UTC(),
+			"session":            sess.id,
+			"client_ip":          clientIP(r),
+			"host":               requestHost(r),
+			"path":               r.URL.Path,
+			"route":              routeName(route),
+			"tenant":             tenantName(tenant),
+			"identity":           sess.identity,
+			"subprotocol":        backendProto,
+			"backend":            sess.backend,
+			"duration_ms":        dur.Milliseconds(),
+			"bytes_in":           h3ToH1Bytes,
+			"bytes_out":          h1ToH3Bytes,
+			"messages_in":        h3ToH1Messages,
+			"messages_out":       h1ToH3Messages,
+			"client_close_code":  sess.clientClose.Load(),
+			"backend_close_code": sess.backendClose.Load(),
+		}
+		if len(sess.labels) > 0 {
+			rec["labels"] = sess.labels
+		}
+		if failed {
+			rec["error"] = err1.Error()
+		}
+		p.AccessLog.write(rec)
+	}
+	if sess.hooks != nil {
+		c := CloseInfo{ClientCode: int(sess.clientClose.Load()), BackendCode: int(sess.backendClose.Load()), Duration: dur}
+		if failed {
+			c.Err = err1
+		}
+		sess.hooks.OnClose(sess.info(time.Now()), c)
+	}
+}
+
+// DefaultCloseTimeout bounds the wait for a peer's close reply when
+// Proxy.CloseTimeout is unset.
+const DefaultCloseTimeout = 5 * time.Second
+
+// replyCloseCode is the code the proxy echoes for a peer that did not
+// answer a close with code.
+func replyCloseCode(code int32) uint16 {
+	if !ws.ValidCloseCode(int(code)) {
+		return 1000
 	}
+	return uint16(code)
 }
 
 func logContextFields(r *http.Request) (string, string) {
@@ -304,6 +956,20 @@ func logContextFields(r *http.Request) (string, string) {
 	return upstream, proto
 }
 
+// SessionIDHeader carries the session ID on the CONNECT response so clients
+// can quote the ID that appears in the proxy's logs.
+const SessionIDHeader = "X-H3WS-Session-Id"
+
+// RequestIDHeader carries the session ID to the backend, so its logs can be
+// matched with the proxy's.
+const RequestIDHeader = "X-Request-Id"
+
+func newSessionID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
 func firstNonEmpty(v ...string) string {
 	for _, s := range v {
 		if s != "" {
@@ -48,6 +48,7 @@ func TestRealTrafficClientQUICBackendRoundTrip(t *testing.T) {
 			MaxConns:       100,
 			WriteTimeout:   5 * time.Second,
 		},
+		ForwardHeaders: []string{"Cookie", "Origin"},
 	}
 
 	tlsCert := mustMakeTLSCert(t)
@@ -97,6 +98,10 @@ func TestRealTrafficClientQUICBackendRoundTrip(t *testing.T) {
 	req.ProtoMinor = 0
 	req.Header.Set("protocol", "websocket")
 	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", "chat.v1, chat.v2")
+	req.Header["Cookie"] = []string{"a=1", "b=2"}
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("User-Agent", "not-forwarded")
 
 	if err := stream.SendRequestHeader(req); err != nil {
 		t.Fatalf("send request headers: %v", err)
@@ -108,6 +113,15 @@ func TestRealTrafficClientQUICBackendRoundTrip(t *testing.T) {
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("unexpected CONNECT status: got %d", resp.StatusCode)
 	}
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != "chat.v2" {
+		t.Fatalf("subprotocol = %q, want the backend's choice %q", got, "chat.v2")
+	}
+	if id := resp.Header.Get(SessionIDHeader); len(id) != 16 {
+		t.Fatalf("unexpected %s header: %q", SessionIDHeader, id)
+	}
+	if got := headerCapture.Get(RequestIDHeader); got != resp.Header.Get(SessionIDHeader) {
+		t.Fatalf("backend %s = %q, want the session ID %q", RequestIDHeader, got, resp.Header.Get(SessionIDHeader))
+	}
 
 	if got := strings.ToLower(headerCapture.Get("Connection")); got != "upgrade" {
 		t.Fatalf("backend Connection header mismatch: got %q want %q", got, "upgrade")
@@ -115,6 +129,15 @@ func TestRealTrafficClientQUICBackendRoundTrip(t *testing.T) {
 	if got := strings.ToLower(headerCapture.Get("Upgrade")); got != "websocket" {
 		t.Fatalf("backend Upgrade header mismatch: got %q want %q", got, "websocket")
 	}
+	if got := headerCapture.Get("Cookie"); got != "a=1; b=2" {
+		t.Fatalf("backend Cookie header: got %q", got)
+	}
+	if got := headerCapture.Get("Origin"); got != "https://app.example.com" {
+		t.Fatalf("backend Origin header: got %q", got)
+	}
+	if got := headerCapture.Get("User-Agent"); got == "not-forwarded" {
+		t.Fatal("User-Agent was forwarded without being listed")
+	}
 
 	payload := []byte("real-traffic-client-quic-backend-roundtrip")
 	if err := ws.WriteDataFrame(stream, ws.OpBinary, payload, true, 1<<20); err != nil {
@@ -163,7 +186,10 @@ func (c *backendHeaderCapture) Get(key string) string {
 func startEchoBackendWithCapture(t *testing.T, capture *backendHeaderCapture) (string, func()) {
 	t.Helper()
 
-	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	upgrader := websocket.Upgrader{
+		CheckOrigin:  func(r *http.Request) bool { return true },
+		Subprotocols: []string{"chat.v2"},
+	}
 
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		capture.Set(r.Header)
@@ -219,3 +245,125 @@ func mustMakeTLSCert(t *testing.T) tls.Certificate {
 	}
 	return cert
 }
+
+func TestBackendTLSClientCertificate(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	backendSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		peer := r.TLS.PeerCertificates[0].Subject.CommonName
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(peer))
+	}))
+	backendSrv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	backendSrv.StartTLS()
+	defer backendSrv.Close()
+	backend, err := url.Parse("wss" + strings.TrimPrefix(backendSrv.URL, "https"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(backendSrv.Certificate())
+	p := &Proxy{
+		Backend:          backend,
+		Limits:           config.Limits{MaxFrameSize: 1 << 20, MaxMessageSize: 1 << 20, MaxConns: 10, WriteTimeout: 5 * time.Second},
+		BackendTLSConfig: &tls.Config{RootCAs: roots},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(p.HandleH3WebSocket))
+	defer srv.Close()
+	proxyURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	// Without a client certificate the backend handshake fails.
+	if _, resp, err := websocket.DefaultDialer.Dial(proxyURL, nil); err == nil || resp == nil || resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("dial without a backend client certificate: resp=%v err=%v", resp, err)
+	} else if id := resp.Header.Get(SessionIDHeader); len(id) != 16 {
+		t.Fatalf("failed CONNECT %s header: %q", SessionIDHeader, id)
+	}
+
+	p.BackendTLSConfig.Certificates = []tls.Certificate{mustMakeTLSCert(t)}
+	c, _, err := websocket.DefaultDialer.Dial(proxyURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, msg, err := c.ReadMessage(); err != nil || string(msg) != "127.0.0.1" {
+		t.Fatalf("backend saw client certificate %q, err=%v", msg, err)
+	}
+}
+
+func TestCloseHandshakeSequencing(t *testing.T) {
+	replies := make(chan int, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if r.URL.Path == "/silent" {
+			// Never reads, so the client's close is never answered.
+			time.Sleep(2 * time.Second)
+			return
+		}
+		conn.SetCloseHandler(func(code int, _ string) error {
+			replies <- code
+			return nil
+		})
+		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "bye"), time.Now().Add(time.Second))
+		_, _, _ = conn.ReadMessage()
+	}))
+	defer srv.Close()
+	backend, _ := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http"))
+	p := &Proxy{
+		Backend:      backend,
+		Limits:       config.Limits{MaxFrameSize: 1 << 20, MaxMessageSize: 1 << 20, MaxConns: 10, WriteTimeout: 5 * time.Second},
+		CloseTimeout: 100 * time.Millisecond,
+	}
+	front := httptest.NewServer(http.HandlerFunc(p.HandleH3WebSocket))
+	defer front.Close()
+	frontURL := "ws" + strings.TrimPrefix(front.URL, "http")
+
+	// The backend closes first and gets the client's reply.
+	c, _, err := websocket.DefaultDialer.Dial(frontURL+"/talkative", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadMessage(); !websocket.IsCloseError(err, 4000) {
+		t.Fatalf("client read: %v, want close 4000", err)
+	}
+	select {
+	case code := <-replies:
+		if code != 4000 {
+			t.Fatalf("backend got close reply %d, want 4000", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend got no close reply")
+	}
+	c.Close()
+
+	// The client closes first; the silent backend is answered for.
+	c, _, err = websocket.DefaultDialer.Dial(frontURL+"/silent", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	answer := 0
+	c.SetCloseHandler(func(code int, _ string) error {
+		answer = code
+		return nil
+	})
+	sent := time.Now()
+	if err := c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(4001, "done"), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := c.ReadMessage(); !websocket.IsCloseError(err, 4001) || answer != 4001 {
+		t.Fatalf("client read: %v, want the proxy's close 4001", err)
+	}
+	if waited := time.Since(sent); waited < p.CloseTimeout {
+		t.Fatalf("proxy answered after %s, before the close timeout", waited)
+	}
+}
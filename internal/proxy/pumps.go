@@ -5,8 +5,9 @@ import (
 	"context"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"sync/atomic"
 	"time"
 
@@ -24,63 +25,146 @@ type sessionTrafficStats struct {
 	h1ToH3Messages uint64
 }
 
-func debugf(enabled bool, format string, args ...any) {
-	if enabled {
-		log.Printf("[debug] "+format, args...)
-	}
-}
-
-func debugWSPayload(enabled bool, flow string, payload []byte) {
-	if !enabled {
+// debugPayload logs a short preview of a payload after redaction.
+func (s *session) debugPayload(flow string, payload []byte) {
+	if !s.debugging() {
 		return
 	}
 	const previewLimit = 32
-	preview := payload
+	preview := s.redactor.Apply(payload)
 	if len(preview) > previewLimit {
 		preview = preview[:previewLimit]
 	}
-	log.Printf("[ws] payload flow=%s len=%d preview_hex=%s", flow, len(payload), hex.EncodeToString(preview))
+	writeDebug(s.id, "ws payload flow=%s len=%d preview_hex=%s", flow, len(payload), hex.EncodeToString(preview))
 }
 
-func pumpH3ToBackend(ctx context.Context, s io.ReadWriter, bws *websocket.Conn, lim config.Limits, st *sessionTrafficStats, debug bool, upstream, proto string) error {
+// pumpH3ToBackend forwards client frames to the backend. It reads the next
+// frame only once the previous message is written, so a stalled backend
+// stops reads from the stream and QUIC flow control pushes back on the
+// client; at most one message per session is held in memory.
+func pumpH3ToBackend(ctx context.Context, s io.ReadWriter, bws backendConn, lim config.Limits, st *sessionTrafficStats, sess *session, upstream, proto string) error {
 	_ = upstream
 	_ = proto
 	// Keep per-session buffering modest to lower baseline RSS under high concurrency.
 	br := bufio.NewReaderSize(s, 32<<10)
 
 	var (
-		assembling   bool
-		assemOpcode  byte
-		assemPayload []byte
+		assembling      bool
+		assemOpcode     byte
+		assemCompressed bool
+		assemPayload    []byte
+		// streamed is the backend writer of a message forwarded frame by
+		// frame, streamedSize the bytes written to it so far.
+		streamed     io.WriteCloser
+		streamedSize int64
 	)
 
+	// inflate undoes client-side permessage-deflate; the backend always
+	// receives plain messages.
+	inflate := func(msg []byte, compressed bool) ([]byte, error) {
+		if !compressed {
+			return msg, nil
+		}
+		out, err := sess.deflate.inflate(msg, lim.MaxMessageSize)
+		switch {
+		case errors.Is(err, ws.ErrMessageTooBig):
+			metrics.OversizeDrops.WithLabelValues("message").Inc()
+			_ = ws.WriteCloseFrame(s, 1009, "message too big")
+		case errors.Is(err, errUnexpectedCompression):
+			_ = ws.WriteCloseFrame(s, 1002, "unexpected compressed message")
+		case err != nil:
+			_ = ws.WriteCloseFrame(s, 1007, "invalid compressed message")
+		}
+		return out, err
+	}
+
+	rules := sess.messageRules()
+	canStream := sess.stream && rules == nil && sess.chaos == nil
+
+	// streamFrame writes one frame of a streamed message to the backend and
+	// finishes the message on fin.
+	streamFrame := func(payload []byte, fin bool) error {
+		streamedSize += int64(len(payload))
+		if streamedSize > lim.MaxMessageSize {
+			metrics.OversizeDrops.WithLabelValues("message").Inc()
+			_ = ws.WriteCloseFrame(s, 1009, "message too big")
+			return errors.New("message too big")
+		}
+		if err := bws.SetWriteDeadline(time.Now().Add(lim.WriteTimeout)); err != nil {
+			return err
+		}
+		if _, err := streamed.Write(payload); err != nil {
+			return err
+		}
+		if !fin {
+			return nil
+		}
+		if err := streamed.Close(); err != nil {
+			return err
+		}
+		kind := "binary"
+		if assemOpcode == ws.OpText {
+			kind = "text"
+		}
+		metrics.Messages.WithLabelValues("h3_to_h1", kind).Inc()
+		sess.onMessage("h3_to_h1", kind, nil, streamedSize)
+		metrics.MessageSize.WithLabelValues("h3_to_h1", kind).Observe(float64(streamedSize))
+		metrics.Bytes.WithLabelValues("h3_to_h1").Add(float64(streamedSize))
+		atomic.AddUint64(&st.h3ToH1Bytes, uint64(streamedSize))
+		atomic.AddUint64(&st.h3ToH1Messages, 1)
+		sess.debugf("h3->h1 %s message streamed bytes=%d", kind, streamedSize)
+		assembling = false
+		streamed = nil
+		return nil
+	}
+
 	flushMessage := func(op byte, msg []byte) error {
+		if err := rules.check(op, msg); err != nil {
+			metrics.MessageViolations.WithLabelValues(routeName(sess.route), rules.Policy.String()).Inc()
+			switch rules.Policy {
+			case MessageLog:
+				slog.Warn("message failed validation, forwarding", "session", sess.id, "route", routeName(sess.route), "err", err)
+			case MessageReject:
+				sess.debugf("h3->h1 message dropped: route=%s err=%v", routeName(sess.route), err)
+				return nil
+			default:
+				sess.debugf("h3->h1 message failed validation, closing: route=%s err=%v", routeName(sess.route), err)
+				_ = ws.WriteCloseFrame(s, 1008, "message failed validation")
+				return fmt.Errorf("message failed validation: %w", err)
+			}
+		}
+		msg, drop, err := sess.chaos.message(ctx, s, msg)
+		if err != nil || drop {
+			return err
+		}
 		if err := bws.SetWriteDeadline(time.Now().Add(lim.WriteTimeout)); err != nil {
 			return err
 		}
 		switch op {
 		case ws.OpText:
 			metrics.Messages.WithLabelValues("h3_to_h1", "text").Inc()
+			sess.onMessage("h3_to_h1", "text", msg, int64(len(msg)))
 			metrics.MessageSize.WithLabelValues("h3_to_h1", "text").Observe(float64(len(msg)))
 			metrics.Bytes.WithLabelValues("h3_to_h1").Add(float64(len(msg)))
 			atomic.AddUint64(&st.h3ToH1Bytes, uint64(len(msg)))
 			atomic.AddUint64(&st.h3ToH1Messages, 1)
 			err := bws.WriteMessage(websocket.TextMessage, msg)
 			if err == nil {
-				debugWSPayload(debug, "proxy->backend", msg)
-				debugf(debug, "h3->h1 text message forwarded bytes=%d", len(msg))
+				sess.debugPayload("proxy->backend", msg)
+				sess.debugf("h3->h1 text message forwarded bytes=%d", len(msg))
 			}
 			return err
 		case ws.OpBinary:
 			metrics.Messages.WithLabelValues("h3_to_h1", "binary").Inc()
+			sess.onMessage("h3_to_h1", "binary", msg, int64(len(msg)))
 			metrics.MessageSize.WithLabelValues("h3_to_h1", "binary").Observe(float64(len(msg)))
 			metrics.Bytes.WithLabelValues("h3_to_h1").Add(float64(len(msg)))
 			atomic.AddUint64(&st.h3ToH1Bytes, uint64(len(msg)))
 			atomic.AddUint64(&st.h3ToH1Messages, 1)
 			err := bws.WriteMessage(websocket.BinaryMessage, msg)
 			if err == nil {
-				debugWSPayload(debug, "proxy->backend", msg)
-				debugf(debug, "h3->h1 binary message forwarded bytes=%d", len(msg))
+				sess.debugPayload("proxy->backend", msg)
+				sess.debugf("h3->h1 binary message forwarded bytes=%d", len(msg))
 			}
 			return err
 		default:
@@ -98,17 +182,56 @@ func pumpH3ToBackend(ctx context.Context, s io.ReadWriter, bws *websocket.Conn,
 		f, err := ws.ReadFrame(br, lim.MaxFrameSize)
 		if err != nil {
 			if errors.Is(err, io.EOF) || ws.IsNetClose(err) {
-				debugf(debug, "h3->h1 input half-closed: %v", err)
+				sess.debugf("h3->h1 input half-closed: %v", err)
 				return nil
 			}
-			debugf(debug, "h3->h1 read frame error: %v", err)
+			if errors.Is(err, ws.ErrBadControlFrame) {
+				metrics.Errors.WithLabelValues("protocol").Inc()
+				_ = ws.WriteCloseFrame(s, 1002, "invalid control frame")
+				return err
+			}
+			sess.debugf("h3->h1 read frame error: %v", err)
+			return &h3ReadError{err: err}
+		}
+		if sess.requireMask && !f.Masked {
+			metrics.Errors.WithLabelValues("protocol").Inc()
+			sess.debugf("h3->h1 unmasked frame rejected: opcode=%d", f.Opcode)
+			_ = ws.WriteCloseFrame(s, 1002, "unmasked frame")
+			return errUnmaskedFrame
+		}
+		if err := ws.CheckReserved(f, sess.deflate != nil); err != nil {
+			metrics.Errors.WithLabelValues("protocol").Inc()
+			sess.debugf("h3->h1 frame rejected: opcode=%d rsv1=%v rsv2=%v rsv3=%v", f.Opcode, f.Rsv1, f.Rsv2, f.Rsv3)
+			_ = ws.WriteCloseFrame(s, 1002, "reserved bits set")
 			return err
 		}
-		debugf(debug, "h3->h1 frame opcode=%d fin=%v payload=%d", f.Opcode, f.Fin, len(f.Payload))
+		if f.Opcode == ws.OpPong {
+			if d, ok := parseRTTProbe(f.Payload, time.Now()); ok {
+				sess.recordRTT("client", d)
+				sess.debugf("client rtt=%s", d)
+				continue
+			}
+		}
+		sess.touch()
+		if f.Opcode <= ws.OpBinary {
+			sess.touchData("h3_to_h1")
+			if err := sess.throttle(ctx, "h3_to_h1", len(f.Payload)); err != nil {
+				return err
+			}
+			if f.Opcode != ws.OpCont {
+				if err := sess.admitMessage(ctx); err != nil {
+					if errors.Is(err, errMessageRate) {
+						_ = ws.WriteCloseFrame(s, 1008, "message rate exceeded")
+					}
+					return err
+				}
+			}
+		}
+		sess.debugf("h3->h1 frame opcode=%d fin=%v payload=%d", f.Opcode, f.Fin, len(f.Payload))
 
 		switch f.Opcode {
 		case ws.OpText, ws.OpBinary:
-			debugWSPayload(debug, "h3->proxy", f.Payload)
+			sess.debugPayload("h3->proxy", f.Payload)
 			if f.Opcode == ws.OpText {
 				metrics.Frames.WithLabelValues("h3_to_h1", "text").Inc()
 			} else {
@@ -123,14 +246,34 @@ func pumpH3ToBackend(ctx context.Context, s io.ReadWriter, bws *websocket.Conn,
 					_ = ws.WriteCloseFrame(s, 1009, "message too big")
 					return errors.New("message too big")
 				}
-				if err := flushMessage(f.Opcode, f.Payload); err != nil {
-					debugf(debug, "h3->h1 write message error: %v", err)
+				msg, err := inflate(f.Payload, f.Rsv1)
+				if err != nil {
+					return err
+				}
+				if err := flushMessage(f.Opcode, msg); err != nil {
+					sess.debugf("h3->h1 write message error: %v", err)
 					return err
 				}
 				continue
 			}
 			assembling = true
 			assemOpcode = f.Opcode
+			assemCompressed = f.Rsv1
+			if canStream && !f.Rsv1 {
+				mt := websocket.BinaryMessage
+				if f.Opcode == ws.OpText {
+					mt = websocket.TextMessage
+				}
+				if streamed, err = bws.NextWriter(mt); err != nil {
+					return err
+				}
+				streamedSize = 0
+				if err := streamFrame(f.Payload, false); err != nil {
+					sess.debugf("h3->h1 stream message error: %v", err)
+					return err
+				}
+				continue
+			}
 			assemPayload = append(assemPayload[:0], f.Payload...)
 			if int64(len(assemPayload)) > lim.MaxMessageSize {
 				metrics.OversizeDrops.WithLabelValues("message").Inc()
@@ -139,11 +282,18 @@ func pumpH3ToBackend(ctx context.Context, s io.ReadWriter, bws *websocket.Conn,
 			}
 
 		case ws.OpCont:
-			debugWSPayload(debug, "h3->proxy", f.Payload)
+			sess.debugPayload("h3->proxy", f.Payload)
 			metrics.Frames.WithLabelValues("h3_to_h1", "cont").Inc()
 			if !assembling {
 				return errors.New("protocol error: continuation without start")
 			}
+			if streamed != nil {
+				if err := streamFrame(f.Payload, f.Fin); err != nil {
+					sess.debugf("h3->h1 stream message error: %v", err)
+					return err
+				}
+				continue
+			}
 			assemPayload = append(assemPayload, f.Payload...)
 			if int64(len(assemPayload)) > lim.MaxMessageSize {
 				metrics.OversizeDrops.WithLabelValues("message").Inc()
@@ -151,7 +301,10 @@ func pumpH3ToBackend(ctx context.Context, s io.ReadWriter, bws *websocket.Conn,
 				return errors.New("message too big")
 			}
 			if f.Fin {
-				msg := assemPayload
+				msg, err := inflate(assemPayload, assemCompressed)
+				if err != nil {
+					return err
+				}
 				assembling = false
 				// Avoid retaining large backing arrays after occasional big fragmented messages.
 				if cap(assemPayload) > 64<<10 {
@@ -160,80 +313,53 @@ func pumpH3ToBackend(ctx context.Context, s io.ReadWriter, bws *websocket.Conn,
 					assemPayload = assemPayload[:0]
 				}
 				if err := flushMessage(assemOpcode, msg); err != nil {
-					debugf(debug, "h3->h1 write reassembled message error: %v", err)
+					sess.debugf("h3->h1 write reassembled message error: %v", err)
 					return err
 				}
 			}
 
 		case ws.OpPing:
-			debugWSPayload(debug, "h3->proxy", f.Payload)
+			sess.debugPayload("h3->proxy", f.Payload)
 			metrics.Frames.WithLabelValues("h3_to_h1", "ping").Inc()
 			metrics.Ctrl.WithLabelValues("ping").Inc()
 			if err := ws.WriteControlFrame(s, ws.OpPong, f.Payload); err != nil {
-				debugf(debug, "h3->h1 pong write error: %v", err)
+				sess.debugf("h3->h1 pong write error: %v", err)
 				return err
 			}
 			if err := bws.WriteControl(websocket.PingMessage, f.Payload, time.Now().Add(5*time.Second)); err == nil {
-				debugf(debug, "h3->h1 ping forwarded payload=%d", len(f.Payload))
+				sess.debugf("h3->h1 ping forwarded payload=%d", len(f.Payload))
 			}
 
 		case ws.OpPong:
-			debugWSPayload(debug, "h3->proxy", f.Payload)
+			sess.debugPayload("h3->proxy", f.Payload)
 			metrics.Frames.WithLabelValues("h3_to_h1", "pong").Inc()
 			metrics.Ctrl.WithLabelValues("pong").Inc()
 			if err := bws.WriteControl(websocket.PongMessage, f.Payload, time.Now().Add(5*time.Second)); err == nil {
-				debugf(debug, "h3->h1 pong forwarded payload=%d", len(f.Payload))
+				sess.debugf("h3->h1 pong forwarded payload=%d", len(f.Payload))
 			}
 
 		case ws.OpClose:
-			debugWSPayload(debug, "h3->proxy", f.Payload)
+			sess.debugPayload("h3->proxy", f.Payload)
 			metrics.Frames.WithLabelValues("h3_to_h1", "close").Inc()
 			metrics.Ctrl.WithLabelValues("close").Inc()
 			code, reason := ws.ParseClosePayload(f.Payload)
+			sess.clientClose.Store(int32(code))
+			code = sess.forwardedClose("client", code)
 			if err := bws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(5*time.Second)); err == nil {
-				debugf(debug, "h3->h1 close forwarded code=%d reason=%q", code, reason)
+				sess.debugf("h3->h1 close forwarded code=%d reason=%q", code, reason)
 			}
-			debugWSPayload(debug, "proxy->backend", websocket.FormatCloseMessage(code, reason))
-			_ = ws.WriteCloseFrame(s, uint16(code), reason)
+			sess.debugPayload("proxy->backend", websocket.FormatCloseMessage(code, reason))
+			// The backend's reply reaches the client through the other
+			// pump; the session waits for it up to Proxy.CloseTimeout.
 			return io.EOF
 		}
 	}
 }
 
-func pumpBackendToH3(ctx context.Context, bws *websocket.Conn, s io.Writer, lim config.Limits, st *sessionTrafficStats, debug bool, upstream, proto string) error {
+func pumpBackendToH3(ctx context.Context, bws backendConn, s io.Writer, lim config.Limits, st *sessionTrafficStats, sess *session, upstream, proto string) error {
 	_ = upstream
 	_ = proto
-	bws.SetPingHandler(func(appData string) error {
-		debugWSPayload(debug, "backend->proxy", []byte(appData))
-		metrics.Frames.WithLabelValues("h1_to_h3", "ping").Inc()
-		metrics.Ctrl.WithLabelValues("ping").Inc()
-		debugWSPayload(debug, "proxy->h3", []byte(appData))
-		if err := ws.WriteControlFrame(s, ws.OpPing, []byte(appData)); err == nil {
-			debugf(debug, "h1->h3 ping forwarded payload=%d", len(appData))
-		}
-		return bws.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(5*time.Second))
-	})
-	bws.SetPongHandler(func(appData string) error {
-		debugWSPayload(debug, "backend->proxy", []byte(appData))
-		metrics.Frames.WithLabelValues("h1_to_h3", "pong").Inc()
-		metrics.Ctrl.WithLabelValues("pong").Inc()
-		debugWSPayload(debug, "proxy->h3", []byte(appData))
-		if err := ws.WriteControlFrame(s, ws.OpPong, []byte(appData)); err == nil {
-			debugf(debug, "h1->h3 pong forwarded payload=%d", len(appData))
-		}
-		return nil
-	})
-	bws.SetCloseHandler(func(code int, text string) error {
-		closePayload := websocket.FormatCloseMessage(code, text)
-		debugWSPayload(debug, "backend->proxy", closePayload)
-		metrics.Frames.WithLabelValues("h1_to_h3", "close").Inc()
-		metrics.Ctrl.WithLabelValues("close").Inc()
-		debugWSPayload(debug, "proxy->h3", closePayload)
-		if err := ws.WriteCloseFrame(s, uint16(code), text); err == nil {
-			debugf(debug, "h1->h3 close forwarded code=%d reason=%q", code, text)
-		}
-		return nil
-	})
+	closeForwarded := setBackendHandlers(bws, s, sess)
 
 	for {
 		select {
@@ -251,30 +377,14 @@ func pumpBackendToH3(ctx context.Context, bws *websocket.Conn, s io.Writer, lim
 		}
 		mt, data, err := bws.ReadMessage()
 		if err != nil {
-			if ws.IsNetClose(err) {
-				debugf(debug, "h1->h3 backend input half-closed: %v", err)
-				return nil
-			}
-			if ce, ok := err.(*websocket.CloseError); ok {
-				switch ce.Code {
-				case websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived:
-					debugf(debug, "h1->h3 backend input half-closed: code=%d reason=%q", ce.Code, ce.Text)
-					debugWSPayload(debug, "proxy->h3", websocket.FormatCloseMessage(ce.Code, ce.Text))
-					_ = ws.WriteCloseFrame(s, uint16(ce.Code), ce.Text)
-					return nil
-				}
-			}
-			debugf(debug, "h1->h3 backend read error: %v", err)
-			if ce, ok := err.(*websocket.CloseError); ok {
-				debugWSPayload(debug, "proxy->h3", websocket.FormatCloseMessage(ce.Code, ce.Text))
-				_ = ws.WriteCloseFrame(s, uint16(ce.Code), ce.Text)
-			} else {
-				debugWSPayload(debug, "proxy->h3", websocket.FormatCloseMessage(1011, "backend read error"))
-				_ = ws.WriteCloseFrame(s, 1011, "backend read error")
-			}
+			return backendReadError(err, s, sess, *closeForwarded)
+		}
+		sess.touch()
+		sess.touchData("h1_to_h3")
+		if err := sess.throttle(ctx, "h1_to_h3", len(data)); err != nil {
 			return err
 		}
-		debugf(debug, "h1->h3 message type=%d payload=%d", mt, len(data))
+		sess.debugf("h1->h3 message type=%d payload=%d", mt, len(data))
 
 		if int64(len(data)) > lim.MaxMessageSize {
 			metrics.OversizeDrops.WithLabelValues("message").Inc()
@@ -282,35 +392,136 @@ func pumpBackendToH3(ctx context.Context, bws *websocket.Conn, s io.Writer, lim
 			return errors.New("backend message too big")
 		}
 
+		data, drop, err := sess.chaos.message(ctx, s, data)
+		if err != nil {
+			return err
+		}
+		if drop {
+			continue
+		}
+
 		switch mt {
 		case websocket.TextMessage:
-			debugWSPayload(debug, "backend->proxy", data)
+			sess.debugPayload("backend->proxy", data)
 			metrics.Frames.WithLabelValues("h1_to_h3", "text").Inc()
 			metrics.Messages.WithLabelValues("h1_to_h3", "text").Inc()
+			sess.onMessage("h1_to_h3", "text", data, int64(len(data)))
 			metrics.MessageSize.WithLabelValues("h1_to_h3", "text").Observe(float64(len(data)))
 			metrics.Bytes.WithLabelValues("h1_to_h3").Add(float64(len(data)))
 			atomic.AddUint64(&st.h1ToH3Bytes, uint64(len(data)))
 			atomic.AddUint64(&st.h1ToH3Messages, 1)
-			if err := ws.WriteDataFrame(s, ws.OpText, data, false, lim.MaxFrameSize); err != nil {
-				debugf(debug, "h1->h3 write text frame error: %v", err)
+			var err error
+			if sess.deflate.compresses(len(data)) {
+				var compressed []byte
+				if compressed, err = sess.deflate.deflate(data); err == nil {
+					err = ws.WriteCompressedDataFrame(s, ws.OpText, compressed, lim.MaxFrameSize)
+				}
+			} else {
+				err = ws.WriteDataFrame(s, ws.OpText, data, false, lim.MaxFrameSize)
+			}
+			if err != nil {
+				sess.debugf("h1->h3 write text frame error: %v", err)
 				return err
 			}
-			debugWSPayload(debug, "proxy->h3", data)
-			debugf(debug, "h1->h3 text message forwarded bytes=%d", len(data))
+			sess.debugPayload("proxy->h3", data)
+			sess.debugf("h1->h3 text message forwarded bytes=%d", len(data))
 		case websocket.BinaryMessage:
-			debugWSPayload(debug, "backend->proxy", data)
+			sess.debugPayload("backend->proxy", data)
 			metrics.Frames.WithLabelValues("h1_to_h3", "binary").Inc()
 			metrics.Messages.WithLabelValues("h1_to_h3", "binary").Inc()
+			sess.onMessage("h1_to_h3", "binary", data, int64(len(data)))
 			metrics.MessageSize.WithLabelValues("h1_to_h3", "binary").Observe(float64(len(data)))
 			metrics.Bytes.WithLabelValues("h1_to_h3").Add(float64(len(data)))
 			atomic.AddUint64(&st.h1ToH3Bytes, uint64(len(data)))
 			atomic.AddUint64(&st.h1ToH3Messages, 1)
 			if err := ws.WriteDataFrame(s, ws.OpBinary, data, false, lim.MaxFrameSize); err != nil {
-				debugf(debug, "h1->h3 write binary frame error: %v", err)
+				sess.debugf("h1->h3 write binary frame error: %v", err)
 				return err
 			}
-			debugWSPayload(debug, "proxy->h3", data)
-			debugf(debug, "h1->h3 binary message forwarded bytes=%d", len(data))
+			sess.debugPayload("proxy->h3", data)
+			sess.debugf("h1->h3 binary message forwarded bytes=%d", len(data))
+		}
+	}
+}
+
+// setBackendHandlers forwards the backend's pings, pongs and close to the
+// client, consuming pongs to RTT probes. The returned flag is set once the
+// backend's close went to the client.
+func setBackendHandlers(bws backendConn, s io.Writer, sess *session) *bool {
+	bws.SetPingHandler(func(appData string) error {
+		sess.debugPayload("backend->proxy", []byte(appData))
+		metrics.Frames.WithLabelValues("h1_to_h3", "ping").Inc()
+		metrics.Ctrl.WithLabelValues("ping").Inc()
+		sess.debugPayload("proxy->h3", []byte(appData))
+		if err := ws.WriteControlFrame(s, ws.OpPing, []byte(appData)); err == nil {
+			sess.debugf("h1->h3 ping forwarded payload=%d", len(appData))
+		}
+		return bws.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(5*time.Second))
+	})
+	bws.SetPongHandler(func(appData string) error {
+		if d, ok := parseRTTProbe([]byte(appData), time.Now()); ok {
+			sess.recordRTT("backend", d)
+			sess.debugf("backend rtt=%s", d)
+			return nil
+		}
+		sess.debugPayload("backend->proxy", []byte(appData))
+		metrics.Frames.WithLabelValues("h1_to_h3", "pong").Inc()
+		metrics.Ctrl.WithLabelValues("pong").Inc()
+		sess.debugPayload("proxy->h3", []byte(appData))
+		if err := ws.WriteControlFrame(s, ws.OpPong, []byte(appData)); err == nil {
+			sess.debugf("h1->h3 pong forwarded payload=%d", len(appData))
+		}
+		return nil
+	})
+	// closeForwarded is set once the backend's close went to the client.
+	closeForwarded := new(bool)
+	bws.SetCloseHandler(func(code int, text string) error {
+		*closeForwarded = true
+		sess.backendClose.Store(int32(code))
+		code = sess.forwardedClose("backend", code)
+		closePayload := websocket.FormatCloseMessage(code, text)
+		sess.debugPayload("backend->proxy", closePayload)
+		metrics.Frames.WithLabelValues("h1_to_h3", "close").Inc()
+		metrics.Ctrl.WithLabelValues("close").Inc()
+		sess.debugPayload("proxy->h3", closePayload)
+		if err := ws.WriteCloseFrame(s, uint16(code), text); err == nil {
+			sess.debugf("h1->h3 close forwarded code=%d reason=%q", code, text)
+		}
+		return nil
+	})
+	return closeForwarded
+}
+
+// backendReadError ends the backend to client pump after a failed read,
+// telling the client why unless the backend's close was forwarded already.
+// Graceful closes return nil.
+func backendReadError(err error, s io.Writer, sess *session, closeForwarded bool) error {
+	if ws.IsNetClose(err) {
+		sess.debugf("h1->h3 backend input half-closed: %v", err)
+		return nil
+	}
+	if ce, ok := err.(*websocket.CloseError); ok {
+		switch ce.Code {
+		case websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived:
+			sess.debugf("h1->h3 backend input half-closed: code=%d reason=%q", ce.Code, ce.Text)
+			if !closeForwarded {
+				code := sess.forwardedClose("backend", ce.Code)
+				sess.debugPayload("proxy->h3", websocket.FormatCloseMessage(code, ce.Text))
+				_ = ws.WriteCloseFrame(s, uint16(code), ce.Text)
+			}
+			return nil
+		}
+	}
+	sess.debugf("h1->h3 backend read error: %v", err)
+	if ce, ok := err.(*websocket.CloseError); ok {
+		if !closeForwarded {
+			code := sess.forwardedClose("backend", ce.Code)
+			sess.debugPayload("proxy->h3", websocket.FormatCloseMessage(code, ce.Text))
+			_ = ws.WriteCloseFrame(s, uint16(code), ce.Text)
 		}
+	} else {
+		sess.debugPayload("proxy->h3", websocket.FormatCloseMessage(1011, "backend read error"))
+		_ = ws.WriteCloseFrame(s, 1011, "backend read error")
 	}
+	return err
 }
@@ -50,11 +50,11 @@ func TestQUICToBackendAndBackWithoutLoss(t *testing.T) {
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		errCh <- pumpH3ToBackend(ctx, proxySide, backendConn, limits, stats, true, "test-upstream", "h3")
+		errCh <- pumpH3ToBackend(ctx, proxySide, backendConn, limits, stats, &session{logs: debugLogs()}, "test-upstream", "h3")
 	}()
 	go func() {
 		defer wg.Done()
-		errCh <- pumpBackendToH3(ctx, backendConn, proxySide, limits, stats, true, "test-upstream", "h3")
+		errCh <- pumpBackendToH3(ctx, backendConn, proxySide, limits, stats, &session{logs: debugLogs()}, "test-upstream", "h3")
 	}()
 
 	original := bytes.Repeat([]byte("quic-payload-"), 10)
@@ -143,3 +143,238 @@ func startEchoBackend(t *testing.T) (string, func()) {
 	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
 	return wsURL, srv.Close
 }
+
+// rawFrame encodes an unmasked frame; fragmented messages cannot be written
+// with ws.WriteDataFrame.
+func rawFrame(op byte, fin bool, payload []byte) []byte {
+	b0 := op
+	if fin {
+		b0 |= 0x80
+	}
+	if len(payload) < 126 {
+		return append([]byte{b0, byte(len(payload))}, payload...)
+	}
+	return append([]byte{b0, 126, byte(len(payload) >> 8), byte(len(payload))}, payload...)
+}
+
+func TestStreamMessagesForwardsFramesBeforeFin(t *testing.T) {
+	firstChunk := make(chan []byte, 1)
+	whole := make(chan []byte, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, rd, err := conn.NextReader()
+		if err != nil {
+			return
+		}
+		head := make([]byte, 1024)
+		if _, err := io.ReadFull(rd, head); err != nil {
+			return
+		}
+		firstChunk <- head
+		rest, _ := io.ReadAll(rd)
+		whole <- append(head, rest...)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	dialer := websocket.Dialer{WriteBufferSize: 1024}
+	backendConn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial backend websocket: %v", err)
+	}
+	defer backendConn.Close()
+
+	quicSide, proxySide := net.Pipe()
+	defer quicSide.Close()
+	defer proxySide.Close()
+	limits := config.Limits{MaxFrameSize: 8192, MaxMessageSize: 6000, WriteTimeout: 5 * time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- pumpH3ToBackend(ctx, proxySide, backendConn, limits, &sessionTrafficStats{}, &session{stream: true}, "", "")
+	}()
+	if err := quicSide.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	first := bytes.Repeat([]byte("a"), 4096)
+	if _, err := quicSide.Write(rawFrame(ws.OpBinary, false, first)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case head := <-firstChunk:
+		if !bytes.Equal(head, first[:1024]) {
+			t.Fatalf("first chunk = %q", head)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend saw nothing before the final frame")
+	}
+	if _, err := quicSide.Write(rawFrame(ws.OpCont, true, []byte("tail"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-whole; !bytes.Equal(got, append(first, "tail"...)) {
+		t.Fatalf("backend got %d bytes, want %d", len(got), len(first)+4)
+	}
+
+	// -max-message still applies to the streamed total.
+	if _, err := quicSide.Write(rawFrame(ws.OpBinary, false, first)); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _, _ = quicSide.Write(rawFrame(ws.OpCont, true, first)) }()
+	f, err := ws.ReadFrame(bufio.NewReader(quicSide), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := ws.ParseClosePayload(f.Payload); f.Opcode != ws.OpClose || code != 1009 {
+		t.Fatalf("got opcode=%d code=%d, want a 1009 close", f.Opcode, code)
+	}
+	if err := <-errCh; err == nil || !strings.Contains(err.Error(), "too big") {
+		t.Fatalf("pump error = %v", err)
+	}
+}
+
+func TestReservedBitsFailTheSession(t *testing.T) {
+	backendURL, closeBackend := startEchoBackend(t)
+	defer closeBackend()
+	dfl, _ := negotiateClientDeflate(DeflateOptions{Enabled: true}, "permessage-deflate")
+	cases := []struct {
+		name    string
+		deflate *clientDeflate
+		b0      byte
+	}{
+		{"rsv1 without deflate", nil, 0x80 | 0x40 | ws.OpText},
+		{"rsv2", dfl, 0x80 | 0x20 | ws.OpBinary},
+		{"rsv3", dfl, 0x80 | 0x10 | ws.OpText},
+		{"rsv1 on a control frame", dfl, 0x80 | 0x40 | ws.OpPing},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			backendConn, _, err := websocket.DefaultDialer.Dial(backendURL, nil)
+			if err != nil {
+				t.Fatalf("dial backend websocket: %v", err)
+			}
+			defer backendConn.Close()
+			quicSide, proxySide := net.Pipe()
+			defer quicSide.Close()
+			defer proxySide.Close()
+			limits := config.Limits{MaxFrameSize: 1 << 16, MaxMessageSize: 1 << 16, WriteTimeout: 5 * time.Second}
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- pumpH3ToBackend(context.Background(), proxySide, backendConn, limits, &sessionTrafficStats{}, &session{deflate: c.deflate}, "", "")
+			}()
+			if err := quicSide.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := quicSide.Write([]byte{c.b0, 2, 'h', 'i'}); err != nil {
+				t.Fatal(err)
+			}
+			f, err := ws.ReadFrame(bufio.NewReader(quicSide), 0)
+			if err != nil {
+				t.Fatalf("read close: %v", err)
+			}
+			if code, _ := ws.ParseClosePayload(f.Payload); f.Opcode != ws.OpClose || code != 1002 {
+				t.Fatalf("got opcode=%d code=%d, want close 1002", f.Opcode, code)
+			}
+			if err := <-errCh; !errors.Is(err, ws.ErrReservedBits) {
+				t.Fatalf("pump error = %v", err)
+			}
+		})
+	}
+}
+
+func TestInvalidControlFramesFailTheSession(t *testing.T) {
+	backendURL, closeBackend := startEchoBackend(t)
+	defer closeBackend()
+	for name, frame := range map[string][]byte{
+		"fragmented ping": rawFrame(ws.OpPing, false, []byte("hi")),
+		"oversized ping":  rawFrame(ws.OpPing, true, bytes.Repeat([]byte("x"), 126)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			backendConn, _, err := websocket.DefaultDialer.Dial(backendURL, nil)
+			if err != nil {
+				t.Fatalf("dial backend websocket: %v", err)
+			}
+			defer backendConn.Close()
+			quicSide, proxySide := net.Pipe()
+			defer quicSide.Close()
+			defer proxySide.Close()
+			limits := config.Limits{MaxFrameSize: 1 << 16, MaxMessageSize: 1 << 16, WriteTimeout: 5 * time.Second}
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- pumpH3ToBackend(context.Background(), proxySide, backendConn, limits, &sessionTrafficStats{}, &session{}, "", "")
+			}()
+			if err := quicSide.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			go func() { _, _ = quicSide.Write(frame) }()
+			f, err := ws.ReadFrame(bufio.NewReader(quicSide), 0)
+			if err != nil {
+				t.Fatalf("read close: %v", err)
+			}
+			if code, _ := ws.ParseClosePayload(f.Payload); f.Opcode != ws.OpClose || code != 1002 {
+				t.Fatalf("got opcode=%d code=%d, want close 1002", f.Opcode, code)
+			}
+			if err := <-errCh; !errors.Is(err, ws.ErrBadControlFrame) {
+				t.Fatalf("pump error = %v", err)
+			}
+		})
+	}
+	if err := ws.WriteControlFrame(io.Discard, ws.OpPing, make([]byte, 126)); !errors.Is(err, ws.ErrControlTooLong) {
+		t.Fatalf("oversized ping write: %v", err)
+	}
+}
+
+func TestRequiredMasking(t *testing.T) {
+	backendURL, closeBackend := startEchoBackend(t)
+	defer closeBackend()
+	backendConn, _, err := websocket.DefaultDialer.Dial(backendURL, nil)
+	if err != nil {
+		t.Fatalf("dial backend websocket: %v", err)
+	}
+	defer backendConn.Close()
+	quicSide, proxySide := net.Pipe()
+	defer quicSide.Close()
+	defer proxySide.Close()
+	limits := config.Limits{MaxFrameSize: 1 << 16, MaxMessageSize: 1 << 16, WriteTimeout: 5 * time.Second}
+	sess := &session{requireMask: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- pumpH3ToBackend(ctx, proxySide, backendConn, limits, &sessionTrafficStats{}, sess, "", "")
+	}()
+	go func() { _ = pumpBackendToH3(ctx, backendConn, proxySide, limits, &sessionTrafficStats{}, sess, "", "") }()
+	if err := quicSide.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(quicSide)
+
+	if err := ws.WriteDataFrame(quicSide, ws.OpText, []byte("masked"), true, 0); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := ws.ReadFrame(br, 0); err != nil || string(f.Payload) != "masked" {
+		t.Fatalf("echo of a masked frame: %q %v", f.Payload, err)
+	}
+
+	go func() { _ = ws.WriteDataFrame(quicSide, ws.OpText, []byte("plain"), false, 0) }()
+	f, err := ws.ReadFrame(br, 0)
+	if err != nil {
+		t.Fatalf("read close: %v", err)
+	}
+	if code, _ := ws.ParseClosePayload(f.Payload); f.Opcode != ws.OpClose || code != 1002 {
+		t.Fatalf("got opcode=%d code=%d, want close 1002", f.Opcode, code)
+	}
+	if err := <-errCh; !errors.Is(err, errUnmaskedFrame) {
+		t.Fatalf("pump error = %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/ratelimit"
+)
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allowRate consults l for key; a nil limiter always allows. Limiter errors
+// are handled inside the limiters (fallback to local state), so the error is
+// only informational here.
+func allowRate(ctx context.Context, l ratelimit.Limiter, key string) (ratelimit.Decision, bool) {
+	if l == nil {
+		return ratelimit.Decision{Allowed: true}, true
+	}
+	d, _ := l.Allow(ctx, key)
+	return d, d.Allowed
+}
+
+// writeRateLimited answers a rate limited CONNECT with 429 plus Retry-After
+// and RateLimit-* headers computed from the limiter decision.
+func writeRateLimited(w http.ResponseWriter, rc *RuntimeConfig, route *Route, d ratelimit.Decision) {
+	setRateLimitHeaders(w.Header(), d)
+	rc.reject(w, route, "rate_limit", http.StatusTooManyRequests, "too many requests")
+}
+
+func setRateLimitHeaders(h http.Header, d ratelimit.Decision) {
+	reset := retryAfterSeconds(d.RetryAfter)
+	if d.Limit > 0 {
+		h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(max(d.Remaining, 0)))
+		h.Set("RateLimit-Reset", strconv.Itoa(reset))
+	}
+	if reset > 0 {
+		h.Set("Retry-After", strconv.Itoa(reset))
+	}
+}
+
+// writeOverloaded answers a CONNECT rejected by a session cap with 503. There
+// is no limiter state to derive the wait from, so the configured hint is used.
+func writeOverloaded(w http.ResponseWriter, rc *RuntimeConfig, route *Route, retryAfter time.Duration) {
+	if s := retryAfterSeconds(retryAfter); s > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(s))
+	}
+	rc.reject(w, route, "overload", http.StatusServiceUnavailable, "too many connections")
+}
+
+// retryAfterSeconds rounds up, so clients never retry before a token exists.
+func retryAfterSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
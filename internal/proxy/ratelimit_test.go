@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/ratelimit"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWriteRateLimitedHeaders(t *testing.T) {
+	rr := httptest.NewRecorder()
+	writeRateLimited(rr, &RuntimeConfig{}, nil, ratelimit.Decision{Limit: 10, Remaining: 0, RetryAfter: 1500 * time.Millisecond})
+
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d", rr.Code)
+	}
+	want := map[string]string{
+		"Retry-After":         "2",
+		"RateLimit-Limit":     "10",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "2",
+	}
+	for k, v := range want {
+		if got := rr.Header().Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestWriteOverloadedRetryAfter(t *testing.T) {
+	rr := httptest.NewRecorder()
+	writeOverloaded(rr, &RuntimeConfig{}, nil, 0)
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "" {
+		t.Fatalf("status=%d retry-after=%q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	rr = httptest.NewRecorder()
+	writeOverloaded(rr, &RuntimeConfig{}, nil, 3*time.Second)
+	if got := rr.Header().Get("Retry-After"); got != "3" {
+		t.Fatalf("Retry-After = %q", got)
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	backendURL, closeBackend := startEchoBackend(t)
+	defer closeBackend()
+	backend, _ := url.Parse(backendURL)
+	p := &Proxy{
+		Backend:       backend,
+		Limits:        config.Limits{MaxFrameSize: 1 << 20, MaxMessageSize: 1 << 20, MaxConns: 10, WriteTimeout: 5 * time.Second},
+		MaxConnsPerIP: 1,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(p.HandleH3WebSocket))
+	defer srv.Close()
+	proxyURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	first, _, err := websocket.DefaultDialer.Dial(proxyURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(proxyURL, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second session from the same IP: resp=%v err=%v", resp, err)
+	}
+
+	// The slot frees up once the first session ends.
+	_ = first.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, _, err := websocket.DefaultDialer.Dial(proxyURL, nil)
+		if err == nil {
+			c.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slot not released: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
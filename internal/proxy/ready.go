@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// DefaultReadyWindow is how long a successful backend dial keeps the proxy
+// ready when Proxy.ReadyWindow is unset.
+const DefaultReadyWindow = 30 * time.Second
+
+// errDraining is reported by Ready once Drain has started.
+var errDraining = errors.New("draining")
+
+// markBackendReachable records that a backend answered, for Ready.
+func (p *Proxy) markBackendReachable() {
+	p.backendReachedAt.Store(time.Now().UnixNano())
+}
+
+// Ready reports whether the proxy should be sent traffic: it is not
+// draining and a backend answered within ReadyWindow, either on a session's
+// dial or on a TCP connect to the default backend that Ready makes itself
+// when no session has dialed recently.
+func (p *Proxy) Ready(ctx context.Context) error {
+	if p.draining.Load() {
+		return errDraining
+	}
+	window := p.ReadyWindow
+	if window <= 0 {
+		window = DefaultReadyWindow
+	}
+	if last := p.backendReachedAt.Load(); last != 0 && time.Since(time.Unix(0, last)) < window {
+		return nil
+	}
+	backend := p.runtimeConfig().Backend
+	if backend == nil {
+		backend = p.Backend
+	}
+	if backend == nil {
+		return errors.New("no backend configured")
+	}
+	d := p.backendNetDialer(nil)
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	network, addr := "tcp", backendAddr(backend)
+	if sock, ok := unixSocket(backend); ok {
+		network, addr = "unix", sock
+	} else if p.BackendProtocol == BackendHTTP3 {
+		// There is no TCP listener to try; a QUIC handshake shows the
+		// backend is up.
+		if _, err := p.h3RoundTripper(ctx, addr, backend.Host); err != nil {
+			return fmt.Errorf("backend %s unreachable: %w", addr, err)
+		}
+		p.markBackendReachable()
+		return nil
+	}
+	dial := d.DialContext
+	if egress := p.egressDial(); egress != nil && network == "tcp" {
+		dial = egress
+	}
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return fmt.Errorf("backend %s unreachable: %w", addr, err)
+	}
+	_ = conn.Close()
+	p.markBackendReachable()
+	return nil
+}
+
+// backendAddr is the host:port of a ws:// or wss:// URL.
+func backendAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
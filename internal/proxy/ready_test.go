@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestReady(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{Backend: &url.URL{Scheme: "ws", Host: ln.Addr().String()}, ReadyWindow: time.Hour}
+	ctx := context.Background()
+	if err := p.Ready(ctx); err != nil {
+		t.Fatalf("listening backend: %v", err)
+	}
+
+	// The probe's success counts for the window, so a backend that goes
+	// away is only noticed once the window has passed.
+	_ = ln.Close()
+	if err := p.Ready(ctx); err != nil {
+		t.Fatalf("within the window: %v", err)
+	}
+	p.backendReachedAt.Store(time.Now().Add(-2 * time.Hour).UnixNano())
+	if err := p.Ready(ctx); err == nil {
+		t.Fatal("ready with an unreachable backend")
+	}
+
+	p.markBackendReachable()
+	p.draining.Store(true)
+	if err := p.Ready(ctx); err == nil {
+		t.Fatal("ready while draining")
+	}
+}
+
+func TestBackendAddr(t *testing.T) {
+	for raw, want := range map[string]string{
+		"ws://backend":         "backend:80",
+		"wss://backend":        "backend:443",
+		"ws://backend:8080/ws": "backend:8080",
+		"wss://[::1]/ws":       "[::1]:443",
+	} {
+		u, _ := url.Parse(raw)
+		if got := backendAddr(u); got != want {
+			t.Errorf("%s: got %s, want %s", raw, got, want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+// claimStale removes and returns every session idle for at least timeout
+// as measured by idleFor.
+func (r *sessionRegistry) claimStale(timeout time.Duration, idleFor func(*session, time.Time) time.Duration) []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	var stale []*session
+	for s := range r.sessions {
+		if idleFor(s, now) >= timeout {
+			delete(r.sessions, s)
+			stale = append(stale, s)
+		}
+	}
+	return stale
+}
+
+// ReapStale closes sessions that carried no frames in either direction for
+// timeout. QUIC keepalives do not count, so a client that is gone but whose
+// connection is still alive is cleaned up too. It returns when ctx is done.
+func (p *Proxy) ReapStale(ctx context.Context, timeout time.Duration) {
+	ticker := time.NewTicker(reapInterval(timeout))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, s := range p.registry.claimStale(timeout, (*session).idleFor) {
+			metrics.ReapedSessions.Inc()
+			p.debugf("reaping stale session: session=%s idle=%s", s.id, s.idleFor(time.Now()).Round(time.Second))
+			go s.terminate(1001, "idle timeout")
+		}
+	}
+}
+
+// ReapIdle closes sessions with code that carried no data messages in
+// either direction for timeout. Unlike ReapStale it ignores control frames,
+// so pings of the client, the backend or the proxy keep no session open.
+// It returns when ctx is done.
+func (p *Proxy) ReapIdle(ctx context.Context, timeout time.Duration, code int) {
+	ticker := time.NewTicker(reapInterval(timeout))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, s := range p.registry.claimStale(timeout, (*session).dataIdleFor) {
+			metrics.IdleTimeouts.Inc()
+			p.debugf("closing idle session: session=%s idle=%s", s.id, s.dataIdleFor(time.Now()).Round(time.Second))
+			go s.terminate(code, "idle timeout")
+		}
+	}
+}
+
+func reapInterval(timeout time.Duration) time.Duration {
+	return min(max(timeout/4, 10*time.Millisecond), 30*time.Second)
+}
+
+// touchData records a data message in direction dir ("h3_to_h1" or
+// "h1_to_h3").
+func (s *session) touchData(dir string) {
+	now := time.Now().UnixNano()
+	if dir == "h3_to_h1" {
+		s.lastDataIn.Store(now)
+	} else {
+		s.lastDataOut.Store(now)
+	}
+}
+
+// dataIdleFor is how long the session has carried no data messages.
+func (s *session) dataIdleFor(now time.Time) time.Duration {
+	last := max(s.lastDataIn.Load(), s.lastDataOut.Load())
+	if last == 0 {
+		return now.Sub(s.started)
+	}
+	return now.Sub(time.Unix(0, last))
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReapStale(t *testing.T) {
+	p := &Proxy{}
+	closed := make(chan string, 2)
+	register := func(id string) *session {
+		s := &session{id: id, started: time.Now()}
+		s.terminate = func(code int, _ string) {
+			if code != 1001 {
+				t.Errorf("session %s closed with %d, want 1001", id, code)
+			}
+			closed <- id
+		}
+		p.registry.add(s)
+		return s
+	}
+	active := register("active")
+	register("stale")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.ReapStale(ctx, 100*time.Millisecond)
+
+	deadline := time.After(2 * time.Second)
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case id := <-closed:
+			if id != "stale" {
+				t.Fatalf("reaped %s session", id)
+			}
+			if p.registry.len() != 1 {
+				t.Fatalf("registry holds %d sessions, want 1", p.registry.len())
+			}
+			return
+		case <-tick.C:
+			active.touch()
+		case <-deadline:
+			t.Fatal("stale session not reaped")
+		}
+	}
+}
+
+func TestReapIdleIgnoresControlFrames(t *testing.T) {
+	p := &Proxy{}
+	closed := make(chan string, 2)
+	register := func(id string) *session {
+		s := &session{id: id, started: time.Now()}
+		s.terminate = func(code int, _ string) {
+			if code != 4000 {
+				t.Errorf("session %s closed with %d, want 4000", id, code)
+			}
+			closed <- id
+		}
+		p.registry.add(s)
+		return s
+	}
+	chatty := register("chatty")
+	pinging := register("pinging")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.ReapIdle(ctx, 100*time.Millisecond, 4000)
+
+	deadline := time.After(2 * time.Second)
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case id := <-closed:
+			if id != "pinging" {
+				t.Fatalf("reaped %s session", id)
+			}
+			return
+		case <-tick.C:
+			chatty.touchData("h1_to_h3")
+			pinging.touch()
+		case <-deadline:
+			t.Fatal("idle session not reaped")
+		}
+	}
+}
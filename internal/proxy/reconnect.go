@@ -0,0 +1,374 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+
+	"github.com/gorilla/websocket"
+)
+
+var errBackendBufferFull = errors.New("backend reconnect buffer full")
+
+// backendConn is the subset of *websocket.Conn used by the pumps.
+type backendConn interface {
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	ReadMessage() (int, []byte, error)
+	WriteMessage(messageType int, data []byte) error
+	NextWriter(messageType int) (io.WriteCloser, error)
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetPingHandler(h func(appData string) error)
+	SetPongHandler(h func(appData string) error)
+	SetCloseHandler(h func(code int, text string) error)
+	Close() error
+}
+
+type pendingBackendMessage struct {
+	messageType int
+	data        []byte
+}
+
+// backendLink is a backendConn that transparently re-dials the backend when
+// the connection drops, buffering client messages written during the gap.
+// Reconnection is driven from ReadMessage, i.e. by the backend->client pump.
+// Once maxBuf bytes are buffered, writers wait for the reconnect instead of
+// failing, which stops the client pump and lets QUIC flow control hold the
+// client back.
+type backendLink struct {
+	ctx       context.Context
+	dial      func(ctx context.Context) (*websocket.Conn, error)
+	timeout   time.Duration
+	maxBuf    int64
+	readLimit int64
+	debugf    func(format string, args ...any)
+
+	// wmu serializes data writes; mu guards the fields below.
+	wmu          sync.Mutex
+	mu           sync.Mutex
+	conn         *websocket.Conn
+	down         bool
+	closed       bool
+	gaveUp       bool
+	drained      sync.Cond
+	pending      []pendingBackendMessage
+	pendingBytes int64
+	pingHandler  func(string) error
+	pongHandler  func(string) error
+	closeHandler func(int, string) error
+}
+
+func newBackendLink(ctx context.Context, conn *websocket.Conn, dial func(context.Context) (*websocket.Conn, error), timeout time.Duration, maxBuf int64, debugf func(format string, args ...any)) *backendLink {
+	l := &backendLink{ctx: ctx, conn: conn, dial: dial, timeout: timeout, maxBuf: maxBuf, debugf: debugf}
+	l.drained.L = &l.mu
+	return l
+}
+
+func (l *backendLink) current() *websocket.Conn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conn
+}
+
+func (l *backendLink) SetReadLimit(limit int64) {
+	l.mu.Lock()
+	l.readLimit = limit
+	l.mu.Unlock()
+	l.current().SetReadLimit(limit)
+}
+
+func (l *backendLink) SetReadDeadline(t time.Time) error {
+	return l.current().SetReadDeadline(t)
+}
+
+func (l *backendLink) SetWriteDeadline(t time.Time) error {
+	l.mu.Lock()
+	down, c := l.down, l.conn
+	l.mu.Unlock()
+	if down {
+		return nil
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// WriteMessage writes to the current connection, or buffers while it is
+// down. mu is only held to look at and change the link state, never for
+// the write itself, so a slow backend does not hold up the reader or
+// control frames; wmu keeps data writes in order.
+func (l *backendLink) WriteMessage(messageType int, data []byte) error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	for {
+		l.mu.Lock()
+		if l.down && l.pendingBytes > 0 && l.pendingBytes+int64(len(data)) > l.maxBuf {
+			start := time.Now()
+			for l.down && !l.closed && !l.gaveUp {
+				l.drained.Wait()
+			}
+			metrics.Backpressure.WithLabelValues("h3_to_h1").Add(time.Since(start).Seconds())
+		}
+		if l.closed {
+			l.mu.Unlock()
+			return net.ErrClosed
+		}
+		if l.down {
+			defer l.mu.Unlock()
+			if l.pendingBytes+int64(len(data)) > l.maxBuf {
+				metrics.BackendReconnects.WithLabelValues("buffer_overflow").Inc()
+				return errBackendBufferFull
+			}
+			l.pending = append(l.pending, pendingBackendMessage{messageType: messageType, data: append([]byte(nil), data...)})
+			l.pendingBytes += int64(len(data))
+			return nil
+		}
+		c := l.conn
+		l.mu.Unlock()
+
+		err := c.WriteMessage(messageType, data)
+		if err == nil {
+			return nil
+		}
+		l.mu.Lock()
+		if l.conn == c && !l.down {
+			l.debugf("backend write failed, buffering until reconnect: %v", err)
+			l.down = true
+			// Make the reader notice the failure and start re-dialing.
+			_ = c.Close()
+		}
+		l.mu.Unlock()
+		// Buffer the message, or write it to the connection a reconnect
+		// installed meanwhile.
+	}
+}
+
+// NextWriter buffers the message and hands it to WriteMessage on Close, so
+// a message cut off by a reconnect can still be replayed whole.
+func (l *backendLink) NextWriter(messageType int) (io.WriteCloser, error) {
+	return &linkMessageWriter{link: l, messageType: messageType}, nil
+}
+
+type linkMessageWriter struct {
+	link        *backendLink
+	messageType int
+	buf         []byte
+}
+
+func (w *linkMessageWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (w *linkMessageWriter) Close() error {
+	return w.link.WriteMessage(w.messageType, w.buf)
+}
+
+func (l *backendLink) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	l.mu.Lock()
+	if l.down || l.closed {
+		if messageType == websocket.CloseMessage {
+			// The client is going away; there is nothing left to reconnect for.
+			l.closed = true
+			l.drained.Broadcast()
+		}
+		l.mu.Unlock()
+		return nil
+	}
+	c := l.conn
+	l.mu.Unlock()
+	return c.WriteControl(messageType, data, deadline)
+}
+
+func (l *backendLink) SetPingHandler(h func(appData string) error) {
+	l.mu.Lock()
+	l.pingHandler = h
+	c := l.conn
+	l.mu.Unlock()
+	c.SetPingHandler(h)
+}
+
+func (l *backendLink) SetPongHandler(h func(appData string) error) {
+	l.mu.Lock()
+	l.pongHandler = h
+	c := l.conn
+	l.mu.Unlock()
+	c.SetPongHandler(h)
+}
+
+func (l *backendLink) SetCloseHandler(h func(code int, text string) error) {
+	l.mu.Lock()
+	l.closeHandler = l.wrapCloseHandler(h)
+	c := l.conn
+	l.mu.Unlock()
+	c.SetCloseHandler(l.closeHandler)
+}
+
+// wrapCloseHandler keeps reconnectable backend closes (deploys, restarts)
+// from being forwarded to the client.
+func (l *backendLink) wrapCloseHandler(h func(int, string) error) func(int, string) error {
+	return func(code int, text string) error {
+		if isReconnectableCloseCode(code) {
+			l.debugf("backend closed with code=%d reason=%q, will try to reconnect", code, text)
+			return nil
+		}
+		return h(code, text)
+	}
+}
+
+func (l *backendLink) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	l.drained.Broadcast()
+	c := l.conn
+	l.mu.Unlock()
+	return c.Close()
+}
+
+func (l *backendLink) ReadMessage() (int, []byte, error) {
+	for {
+		mt, data, err := l.current().ReadMessage()
+		if err == nil {
+			return mt, data, nil
+		}
+		if !l.reconnectable(err) {
+			return mt, data, err
+		}
+		if rerr := l.reconnect(err); rerr != nil {
+			l.debugf("backend reconnect failed: %v", rerr)
+			l.mu.Lock()
+			l.gaveUp = true
+			l.drained.Broadcast()
+			l.mu.Unlock()
+			return mt, data, err
+		}
+	}
+}
+
+func (l *backendLink) reconnectable(err error) bool {
+	l.mu.Lock()
+	closed := l.closed
+	l.mu.Unlock()
+	if closed || l.ctx.Err() != nil {
+		return false
+	}
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) {
+		return isReconnectableCloseCode(ce.Code)
+	}
+	return isConnectionLost(err)
+}
+
+// isConnectionLost reports whether err means the backend connection broke.
+// Read timeouts and oversized messages are not: they end the session like
+// they do without reconnects.
+func isConnectionLost(err error) bool {
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return false
+	}
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && !ne.Timeout()
+}
+
+func isReconnectableCloseCode(code int) bool {
+	switch code {
+	case websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseInternalServerErr,
+		websocket.CloseServiceRestart, websocket.CloseTryAgainLater, 1014:
+		return true
+	}
+	return false
+}
+
+func (l *backendLink) reconnect(cause error) error {
+	l.mu.Lock()
+	l.down = true
+	old := l.conn
+	l.mu.Unlock()
+	_ = old.Close()
+
+	l.debugf("backend connection lost, reconnecting: %v", cause)
+	deadline := time.Now().Add(l.timeout)
+	backoff := 100 * time.Millisecond
+	for {
+		l.mu.Lock()
+		closed := l.closed
+		l.mu.Unlock()
+		if closed {
+			return net.ErrClosed
+		}
+
+		dctx, cancel := context.WithDeadline(l.ctx, deadline)
+		c, err := l.dial(dctx)
+		cancel()
+		if err == nil {
+			if err = l.install(c); err == nil {
+				metrics.BackendReconnects.WithLabelValues("success").Inc()
+				l.debugf("backend reconnected")
+				return nil
+			}
+			_ = c.Close()
+		}
+		l.debugf("backend re-dial attempt failed: %v", err)
+
+		if time.Now().Add(backoff).After(deadline) {
+			metrics.BackendReconnects.WithLabelValues("failed").Inc()
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-l.ctx.Done():
+			metrics.BackendReconnects.WithLabelValues("failed").Inc()
+			return l.ctx.Err()
+		}
+		backoff *= 2
+		if backoff > 2*time.Second {
+			backoff = 2 * time.Second
+		}
+	}
+}
+
+func (l *backendLink) install(c *websocket.Conn) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return net.ErrClosed
+	}
+	c.SetReadLimit(l.readLimit)
+	if l.pingHandler != nil {
+		c.SetPingHandler(l.pingHandler)
+	}
+	if l.pongHandler != nil {
+		c.SetPongHandler(l.pongHandler)
+	}
+	if l.closeHandler != nil {
+		c.SetCloseHandler(l.closeHandler)
+	}
+	if err := c.SetWriteDeadline(time.Now().Add(l.timeout)); err != nil {
+		return err
+	}
+	replayed := 0
+	for len(l.pending) > 0 {
+		m := l.pending[0]
+		if err := c.WriteMessage(m.messageType, m.data); err != nil {
+			return err
+		}
+		l.pending = l.pending[1:]
+		l.pendingBytes -= int64(len(m.data))
+		replayed++
+	}
+	l.debugf("backend reconnect replayed %d buffered messages", replayed)
+	l.pending = nil
+	l.conn = c
+	l.down = false
+	l.drained.Broadcast()
+	return nil
+}
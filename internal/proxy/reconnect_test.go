@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startRestartingBackend serves an echo backend whose first connection is
+// closed with 1012 right away. It returns a link over that first connection
+// that may re-dial once allowRedial is closed.
+func startRestartingBackend(t *testing.T, maxBuf int64) (link *backendLink, conns *int32, allowRedial chan struct{}, cleanup func()) {
+	t.Helper()
+	conns = new(int32)
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if atomic.AddInt32(conns, 1) == 1 {
+			// Simulate a rolling restart of the first backend instance.
+			_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, "restart"), time.Now().Add(time.Second))
+			return
+		}
+		for {
+			mt, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(mt, data); err != nil {
+				return
+			}
+		}
+	}))
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	dial := func(ctx context.Context) (*websocket.Conn, error) {
+		c, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
+		return c, err
+	}
+	first, err := dial(context.Background())
+	if err != nil {
+		t.Fatalf("dial backend: %v", err)
+	}
+
+	allowRedial = make(chan struct{})
+	redial := func(ctx context.Context) (*websocket.Conn, error) {
+		<-allowRedial
+		return dial(ctx)
+	}
+	link = newBackendLink(context.Background(), first, redial, 5*time.Second, maxBuf, t.Logf)
+	return link, conns, allowRedial, func() {
+		_ = link.Close()
+		srv.Close()
+	}
+}
+
+// waitDown waits for link to notice that its connection is gone.
+func waitDown(t *testing.T, link *backendLink) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		link.mu.Lock()
+		down := link.down
+		link.mu.Unlock()
+		if down {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("backend link did not notice the restart")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackendLinkReconnectsAndReplaysBufferedMessages(t *testing.T) {
+	link, conns, allowRedial, cleanup := startRestartingBackend(t, 1<<10)
+	defer cleanup()
+	link.SetCloseHandler(func(code int, text string) error {
+		t.Errorf("reconnectable close should not reach the pump: code=%d", code)
+		return nil
+	})
+
+	readCh := make(chan string, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		_, data, err := link.ReadMessage()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		readCh <- string(data)
+	}()
+
+	// Wait for the restart close to be observed, then write during the gap.
+	waitDown(t, link)
+	if err := link.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatalf("write through link: %v", err)
+	}
+	close(allowRedial)
+
+	select {
+	case got := <-readCh:
+		if got != "hello" {
+			t.Fatalf("echo mismatch: got %q", got)
+		}
+	case err := <-errCh:
+		t.Fatalf("read through link: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for echo after reconnect")
+	}
+	if n := atomic.LoadInt32(conns); n != 2 {
+		t.Fatalf("backend connections: got %d want 2", n)
+	}
+}
+
+func TestBackendLinkFullBufferWaitsForReconnect(t *testing.T) {
+	link, _, allowRedial, cleanup := startRestartingBackend(t, 8)
+	defer cleanup()
+	link.SetCloseHandler(func(int, string) error { return nil })
+
+	readCh := make(chan string, 2)
+	go func() {
+		for {
+			_, data, err := link.ReadMessage()
+			if err != nil {
+				return
+			}
+			readCh <- string(data)
+		}
+	}()
+	waitDown(t, link)
+	if err := link.WriteMessage(websocket.TextMessage, []byte("first")); err != nil {
+		t.Fatalf("buffer first message: %v", err)
+	}
+	// The second message does not fit: the writer has to wait instead of
+	// failing the session.
+	written := make(chan error, 1)
+	go func() { written <- link.WriteMessage(websocket.TextMessage, []byte("second")) }()
+	select {
+	case err := <-written:
+		t.Fatalf("write over a full buffer returned early: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(allowRedial)
+	if err := <-written; err != nil {
+		t.Fatalf("write after reconnect: %v", err)
+	}
+	for _, want := range []string{"first", "second"} {
+		select {
+		case got := <-readCh:
+			if got != want {
+				t.Fatalf("echo = %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+func TestBackendLinkBlockedWriteDoesNotBlockReads(t *testing.T) {
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	send := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Never read, so the client's large write stalls on TCP.
+		<-send
+		_ = conn.WriteMessage(websocket.TextMessage, []byte("from backend"))
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := newBackendLink(context.Background(), conn, nil, time.Second, 1<<10, t.Logf)
+	defer link.Close()
+
+	go func() { _ = link.WriteMessage(websocket.BinaryMessage, make([]byte, 64<<20)) }()
+	time.Sleep(100 * time.Millisecond)
+
+	read := make(chan string, 1)
+	go func() {
+		_ = link.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, _ := link.ReadMessage()
+		read <- string(data)
+	}()
+	close(send)
+	select {
+	case got := <-read:
+		if got != "from backend" {
+			t.Fatalf("read %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ReadMessage blocked behind a stalled write")
+	}
+	ping := make(chan error, 1)
+	go func() { ping <- link.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)) }()
+	select {
+	case <-ping:
+	case <-time.After(2 * time.Second):
+		t.Fatal("WriteControl blocked behind a stalled write")
+	}
+}
+
+func TestIsConnectionLost(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{io.ErrUnexpectedEOF, true},
+		{net.ErrClosed, true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, false},
+		{websocket.ErrReadLimit, false},
+		{errors.New("bad frame"), false},
+	} {
+		if got := isConnectionLost(c.err); got != c.want {
+			t.Errorf("isConnectionLost(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+// minResolveTTL keeps a zero or tiny DNS TTL from turning every dial into
+// a lookup.
+const minResolveTTL = time.Second
+
+// BackendResolver resolves backend host names itself and spreads dials
+// round robin over all returned addresses, instead of leaving the dialer to
+// try them in resolver order, which pins every session to the first one.
+// Names are re-resolved when their DNS TTL runs out, but at least every
+// MaxInterval (the TTL is not known for answers from the system's cgo
+// resolver or /etc/hosts). A failed re-resolution keeps the old addresses.
+type BackendResolver struct {
+	MaxInterval time.Duration
+	// lookup resolves host and returns the addresses and the smallest TTL
+	// of the answers (0 = unknown); tests replace it.
+	lookup func(ctx context.Context, host string) ([]netip.Addr, time.Duration, error)
+	mu     sync.Mutex
+	hosts  map[string]*resolvedHost
+}
+
+type resolvedHost struct {
+	mu         sync.Mutex
+	addrs      []netip.Addr
+	expires    time.Time
+	refreshing bool
+	next       atomic.Uint64
+}
+
+func NewBackendResolver(maxInterval time.Duration) *BackendResolver {
+	return &BackendResolver{MaxInterval: maxInterval, lookup: lookupWithTTL}
+}
+
+// dialer returns a NetDialContext for websocket.Dialer that dials through
+// the resolver with nd (nil = a default net.Dialer).
+func (br *BackendResolver) dialer(nd *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if nd == nil {
+		nd = &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := netip.ParseAddr(host); err == nil {
+			return nd.DialContext(ctx, network, addr)
+		}
+		addrs, err := br.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		// Start at the next address in turn and fall through the rest when
+		// one cannot be reached.
+		start := br.host(host).next.Add(1) - 1
+		var firstErr error
+		for i := range len(addrs) {
+			a := addrs[(start+uint64(i))%uint64(len(addrs))]
+			c, err := nd.DialContext(ctx, network, net.JoinHostPort(a.String(), port))
+			if err == nil {
+				return c, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, firstErr
+	}
+}
+
+func (br *BackendResolver) host(name string) *resolvedHost {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if br.hosts == nil {
+		br.hosts = make(map[string]*resolvedHost)
+	}
+	h := br.hosts[name]
+	if h == nil {
+		h = &resolvedHost{}
+		br.hosts[name] = h
+	}
+	return h
+}
+
+// resolve returns the addresses of name. The first lookup blocks; after
+// that expired addresses keep being used while one refresh runs in the
+// background.
+func (br *BackendResolver) resolve(ctx context.Context, name string) ([]netip.Addr, error) {
+	h := br.host(name)
+	h.mu.Lock()
+	addrs, expired := h.addrs, time.Now().After(h.expires)
+	refresh := expired && !h.refreshing && addrs != nil
+	if refresh {
+		h.refreshing = true
+	}
+	h.mu.Unlock()
+	if refresh {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = br.refresh(ctx, name, h)
+		}()
+	}
+	if addrs != nil {
+		return addrs, nil
+	}
+	if err := br.refresh(ctx, name, h); err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.addrs, nil
+}
+
+func (br *BackendResolver) refresh(ctx context.Context, name string, h *resolvedHost) error {
+	addrs, ttl, err := br.lookup(ctx, name)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no addresses")
+	}
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.refreshing = false
+	if err != nil {
+		metrics.BackendResolutions.WithLabelValues("error").Inc()
+		// Retry soon, but not on every dial.
+		h.expires = now.Add(minResolveTTL)
+		return err
+	}
+	metrics.BackendResolutions.WithLabelValues("ok").Inc()
+	h.addrs = addrs
+	valid := br.MaxInterval
+	if ttl > 0 {
+		valid = min(valid, ttl)
+	}
+	h.expires = now.Add(max(valid, minResolveTTL))
+	return nil
+}
+
+// lookupWithTTL resolves host with the pure Go resolver and reads the TTL
+// off the DNS answers it receives over UDP.
+func lookupWithTTL(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	var (
+		mu  sync.Mutex
+		ttl time.Duration
+	)
+	seen := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ttl == 0 || d < ttl {
+			ttl = d
+		}
+	}
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			c, err := d.DialContext(ctx, network, address)
+			if udp, ok := c.(*net.UDPConn); ok && err == nil {
+				return &ttlConn{UDPConn: udp, seen: seen}, nil
+			}
+			return c, err
+		},
+	}
+	addrs, err := r.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, a := range addrs {
+		addrs[i] = a.Unmap()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return addrs, ttl, nil
+}
+
+// ttlConn passes DNS datagrams through and reports the smallest TTL of
+// the A and AAAA answers in each. It stays a net.PacketConn, which the
+// resolver needs to use datagram rather than TCP framing.
+type ttlConn struct {
+	*net.UDPConn
+	seen func(time.Duration)
+}
+
+func (c *ttlConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if n > 0 {
+		if ttl, ok := answerTTL(b[:n]); ok {
+			c.seen(ttl)
+		}
+	}
+	return n, err
+}
+
+func answerTTL(msg []byte) (time.Duration, bool) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return 0, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return 0, false
+	}
+	var (
+		ttl   uint32
+		found bool
+	)
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		if (h.Type == dnsmessage.TypeA || h.Type == dnsmessage.TypeAAAA) && (!found || h.TTL < ttl) {
+			ttl, found = h.TTL, true
+		}
+		if err := p.SkipAnswer(); err != nil {
+			break
+		}
+	}
+	return time.Duration(ttl) * time.Second, found
+}
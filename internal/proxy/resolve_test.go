@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestBackendResolverSpreadsDials(t *testing.T) {
+	ln1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln1.Close()
+	port := ln1.Addr().(*net.TCPAddr).Port
+	ln2, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", strconv.Itoa(port)))
+	if err != nil {
+		t.Skipf("no second loopback address: %v", err)
+	}
+	defer ln2.Close()
+
+	var mu sync.Mutex
+	accepted := map[string]int{}
+	for _, ln := range []net.Listener{ln1, ln2} {
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				accepted[ln.Addr().String()]++
+				mu.Unlock()
+				c.Close()
+			}
+		}()
+	}
+
+	lookups := 0
+	br := NewBackendResolver(time.Minute)
+	br.lookup = func(context.Context, string) ([]netip.Addr, time.Duration, error) {
+		lookups++
+		return []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("127.0.0.2")}, 0, nil
+	}
+	dial := br.dialer(nil)
+	for range 4 {
+		c, err := dial(context.Background(), "tcp", net.JoinHostPort("backend.test", strconv.Itoa(port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		a, b := accepted[ln1.Addr().String()], accepted[ln2.Addr().String()]
+		mu.Unlock()
+		if a == 2 && b == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("accepted: %d and %d, want 2 each", a, b)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if lookups != 1 {
+		t.Fatalf("lookups: got %d want 1", lookups)
+	}
+
+	// A dead address is skipped.
+	ln2.Close()
+	for range 2 {
+		c, err := dial(context.Background(), "tcp", net.JoinHostPort("backend.test", strconv.Itoa(port)))
+		if err != nil {
+			t.Fatalf("dial with one dead address: %v", err)
+		}
+		c.Close()
+	}
+}
+
+func TestBackendResolverRefreshesOnTTL(t *testing.T) {
+	var mu sync.Mutex
+	answer := []netip.Addr{netip.MustParseAddr("10.0.0.1")}
+	br := NewBackendResolver(time.Hour)
+	br.lookup = func(context.Context, string) ([]netip.Addr, time.Duration, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return answer, 30 * time.Second, nil
+	}
+	ctx := context.Background()
+	if _, err := br.resolve(ctx, "backend.test"); err != nil {
+		t.Fatal(err)
+	}
+	h := br.host("backend.test")
+	h.mu.Lock()
+	if ttl := time.Until(h.expires); ttl > 30*time.Second || ttl < 29*time.Second {
+		t.Errorf("expiry follows the TTL: got %s", ttl)
+	}
+	h.expires = time.Now().Add(-time.Second)
+	h.mu.Unlock()
+
+	mu.Lock()
+	answer = []netip.Addr{netip.MustParseAddr("10.0.0.2")}
+	mu.Unlock()
+	// The expired answer is served while the refresh runs.
+	addrs, _ := br.resolve(ctx, "backend.test")
+	if addrs[0].String() != "10.0.0.1" {
+		t.Fatalf("stale answer: got %v", addrs)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		addrs, _ := br.resolve(ctx, "backend.test")
+		if addrs[0].String() == "10.0.0.2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not re-resolved")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAnswerTTL(t *testing.T) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	name := dnsmessage.MustNewName("backend.test.")
+	_ = b.StartQuestions()
+	_ = b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	_ = b.StartAnswers()
+	for _, ttl := range []uint32{300, 20} {
+		_ = b.AResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: ttl}, dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}})
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl, ok := answerTTL(msg); !ok || ttl != 20*time.Second {
+		t.Fatalf("ttl: got %s %v", ttl, ok)
+	}
+	if _, ok := answerTTL([]byte{1, 2}); ok {
+		t.Fatal("garbage parsed")
+	}
+}
@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"h3ws2h1ws-proxy/internal/jwt"
+	"h3ws2h1ws-proxy/internal/metrics"
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/quic-go/quic-go"
+)
+
+const ResumeTokenHeader = "X-H3WS-Resume-Token"
+
+var errResumeBufferFull = errors.New("resume buffer full")
+
+// clientWriter is the H3-side writer of a resumable session. While a client
+// stream is attached writes go straight through; once the stream fails the
+// writer detaches and buffers whole frames (ws.writeFrame emits one Write per
+// frame) until a new stream is attached or the buffer budget is exhausted.
+type clientWriter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	buf      [][]byte
+	bufBytes int64
+	maxBuf   int64
+}
+
+func newClientWriter(w io.Writer, maxBuf int64) *clientWriter {
+	return &clientWriter{w: w, maxBuf: maxBuf}
+}
+
+func (c *clientWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.w != nil {
+		n, err := c.w.Write(p)
+		if err == nil {
+			return n, nil
+		}
+		// The frame may have been partially written to a dead stream; the
+		// client never saw it complete, so it is replayed in full.
+		c.w = nil
+	}
+	if c.bufBytes+int64(len(p)) > c.maxBuf {
+		return 0, errResumeBufferFull
+	}
+	c.buf = append(c.buf, append([]byte(nil), p...))
+	c.bufBytes += int64(len(p))
+	return len(p), nil
+}
+
+func (c *clientWriter) detach() {
+	c.mu.Lock()
+	c.w = nil
+	c.mu.Unlock()
+}
+
+func (c *clientWriter) attach(w io.Writer) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	replayed := 0
+	for len(c.buf) > 0 {
+		if _, err := w.Write(c.buf[0]); err != nil {
+			return replayed, err
+		}
+		c.bufBytes -= int64(len(c.buf[0]))
+		c.buf = c.buf[1:]
+		replayed++
+	}
+	c.buf = nil
+	c.w = w
+	return replayed, nil
+}
+
+// h3ReadError marks errors returned while reading from the client stream, so
+// that transport loss can be told apart from backend write failures.
+type h3ReadError struct {
+	err error
+}
+
+func (e *h3ReadError) Error() string { return e.err.Error() }
+func (e *h3ReadError) Unwrap() error { return e.err }
+
+func isResumableClientError(err error) bool {
+	var re *h3ReadError
+	if !errors.As(err, &re) {
+		return false
+	}
+	var (
+		idle  *quic.IdleTimeoutError
+		reset *quic.StatelessResetError
+		app   *quic.ApplicationError
+		tr    *quic.TransportError
+		ne    net.Error
+	)
+	return errors.As(re.err, &idle) ||
+		errors.As(re.err, &reset) ||
+		errors.As(re.err, &app) ||
+		errors.As(re.err, &tr) ||
+		errors.As(re.err, &ne)
+}
+
+type resumeAttach struct {
+	stream io.ReadWriteCloser
+	done   chan struct{}
+}
+
+type parkedSession struct {
+	id   string
+	path string
+	// owner is the resumeOwner of the CONNECT that started the session.
+	owner  string
+	attach chan resumeAttach
+	gone   chan struct{}
+}
+
+// resumeOwner identifies the client of r for resumption: the fingerprint of
+// its verified certificate and the subject of its JWT, when it has them. A
+// stolen token is useless to a client that cannot present both.
+func resumeOwner(r *http.Request, claims jwt.Claims) string {
+	var b strings.Builder
+	if cert := verifiedClientCert(r.TLS); cert != nil {
+		sum := sha256.Sum256(cert.Raw)
+		b.WriteString("cert:" + hex.EncodeToString(sum[:]))
+	}
+	if sub := claims.Subject(); sub != "" {
+		b.WriteString(" sub:" + sub)
+	}
+	return b.String()
+}
+
+func newResumeToken() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+func (p *Proxy) parkSession(token, id, path, owner string) *parkedSession {
+	ps := &parkedSession{id: id, path: path, owner: owner, attach: make(chan resumeAttach), gone: make(chan struct{})}
+	p.parked.Store(token, ps)
+	return ps
+}
+
+func (p *Proxy) unparkSession(token string, ps *parkedSession) {
+	p.parked.CompareAndDelete(token, ps)
+	close(ps.gone)
+}
+
+// handleResume splices a CONNECT carrying a resume token onto its parked
+// session. The client goes through the same certificate, rate limit,
+// authorization and OnAccept checks as a new session and must be the
+// session's owner.
+func (p *Proxy) handleResume(w http.ResponseWriter, r *http.Request, rt *RuntimeConfig, route *Route, token string) {
+	if r.Method != http.MethodConnect && !IsUpgradeRequest(r) {
+		metrics.Rejected.WithLabelValues("method").Inc()
+		http.Error(w, "expected CONNECT", http.StatusMethodNotAllowed)
+		return
+	}
+	if rejectClientCert(w, rt, route, r) {
+		return
+	}
+	if d, ok := allowRate(r.Context(), p.IPRateLimiter, clientIP(r)); !ok {
+		metrics.Rejected.WithLabelValues("rate_limit").Inc()
+		writeRateLimited(w, rt, route, d)
+		return
+	}
+	check := &session{id: newSessionID(), route: route, logs: p.logControl()}
+	tenant, ok := p.authenticate(w, rt, route, r, check)
+	if !ok || !p.authorizeExternal(w, rt, route, r, check) || !p.checkPolicy(w, rt, route, tenant, r, check) {
+		return
+	}
+	if p.Hooks != nil {
+		if err := p.Hooks.OnAccept(r); err != nil {
+			check.debugf("hooks: refused resume: remote=%s path=%s err=%v", r.RemoteAddr, r.URL.Path, err)
+			metrics.Rejected.WithLabelValues("acl").Inc()
+			rejectRoute(route, "acl")
+			rt.reject(w, route, "acl", http.StatusForbidden, err.Error())
+			return
+		}
+	}
+	v, ok := p.parked.Load(token)
+	if !ok || v.(*parkedSession).path != r.URL.Path {
+		metrics.Resumes.WithLabelValues("unknown_token").Inc()
+		http.Error(w, "unknown or expired resume token", http.StatusGone)
+		return
+	}
+	if v.(*parkedSession).owner != resumeOwner(r, check.claims) {
+		// The token stays parked for its owner.
+		check.debugf("resume refused: token belongs to another client: remote=%s path=%s", r.RemoteAddr, r.URL.Path)
+		metrics.Resumes.WithLabelValues("forbidden").Inc()
+		metrics.Rejected.WithLabelValues("acl").Inc()
+		rejectRoute(route, "acl")
+		rt.reject(w, route, "acl", http.StatusForbidden, "resume token belongs to another client")
+		return
+	}
+	if !p.parked.CompareAndDelete(token, v) {
+		metrics.Resumes.WithLabelValues("unknown_token").Inc()
+		http.Error(w, "unknown or expired resume token", http.StatusGone)
+		return
+	}
+	ps := v.(*parkedSession)
+
+	takeOver, ok := clientStreamer(w, r)
+	if !ok {
+		metrics.Errors.WithLabelValues("no_stream_takeover").Inc()
+		http.Error(w, "stream takeover not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(ResumeTokenHeader, token)
+	w.Header().Set(SessionIDHeader, ps.id)
+	stream, err := takeOver()
+	if err != nil {
+		metrics.Errors.WithLabelValues("no_stream_takeover").Inc()
+		return
+	}
+	defer func() { _ = stream.Close() }()
+
+	req := resumeAttach{stream: stream, done: make(chan struct{})}
+	select {
+	case ps.attach <- req:
+	case <-ps.gone:
+		_ = ws.WriteCloseFrame(stream, 1001, "session expired")
+		return
+	case <-r.Context().Done():
+		return
+	}
+	p.debugf("resume stream attached: path=%s remote=%s", r.URL.Path, r.RemoteAddr)
+	// The session owner keeps using this stream; hold the handler until it is done.
+	select {
+	case <-req.done:
+	case <-r.Context().Done():
+	}
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"h3ws2h1ws-proxy/internal/jwt"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("stream gone") }
+
+func TestClientWriterBuffersWhileDetachedAndReplays(t *testing.T) {
+	cw := newClientWriter(failingWriter{}, 8)
+
+	if _, err := cw.Write([]byte("abc")); err != nil {
+		t.Fatalf("write after stream failure should be buffered: %v", err)
+	}
+	if _, err := cw.Write([]byte("defg")); err != nil {
+		t.Fatalf("write while detached: %v", err)
+	}
+	if _, err := cw.Write([]byte("hi")); !errors.Is(err, errResumeBufferFull) {
+		t.Fatalf("expected buffer full error, got %v", err)
+	}
+
+	var out bytes.Buffer
+	replayed, err := cw.attach(&out)
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	if replayed != 2 {
+		t.Fatalf("replayed frames: got %d want 2", replayed)
+	}
+	if _, err := cw.Write([]byte("xyz")); err != nil {
+		t.Fatalf("write after attach: %v", err)
+	}
+	if got, want := out.String(), "abcdefgxyz"; got != want {
+		t.Fatalf("replayed output: got %q want %q", got, want)
+	}
+}
+
+func TestResumeRequiresSessionOwner(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	p := &Proxy{Auth: &Auth{Verifier: &jwt.Verifier{Keys: jwt.StaticKey{Public: pub}}}}
+	rt := &RuntimeConfig{}
+	owner := resumeOwner(httptest.NewRequest(http.MethodConnect, "/ws", nil), jwt.Claims{"sub": "alice"})
+	ps := p.parkSession("token", "session", "/ws", owner)
+	defer p.unparkSession("token", ps)
+
+	for _, c := range []struct {
+		name   string
+		claims map[string]any
+		want   int
+	}{
+		{"no token", nil, http.StatusUnauthorized},
+		{"other subject", map[string]any{"sub": "mallory"}, http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodConnect, "/ws", nil)
+		if c.claims != nil {
+			r.Header.Set("Authorization", "Bearer "+signEdDSA(priv, c.claims))
+		}
+		w := httptest.NewRecorder()
+		p.handleResume(w, r, rt, nil, "token")
+		if w.Code != c.want {
+			t.Errorf("%s: status %d, want %d", c.name, w.Code, c.want)
+		}
+	}
+	if _, ok := p.parked.Load("token"); !ok {
+		t.Fatal("refused resume attempts consumed the token")
+	}
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+// Route applies per-path policy. Routes are matched in order against the
+// request path and, with Hosts, the request host; the first match wins.
+type Route struct {
+	Name string
+	Path *regexp.Regexp
+	// Tenant restricts the route to sessions of that tenant ("default"
+	// for those matching none); others are refused with "acl". Empty
+	// serves every tenant.
+	Tenant string
+	// Hosts restricts the route to these :authority names (exact or
+	// "*.example.com"; empty = any host).
+	Hosts []string
+	// MaxConns caps concurrent sessions on the route (0 = only the global
+	// and tenant caps apply).
+	MaxConns int64
+	Priority Priority
+	// DSCP marks backend TCP connections of the route (0 = the proxy-wide
+	// BackendDSCP).
+	DSCP       int
+	Rejections map[string]Rejection
+	Messages   *MessageRules
+	// ClientDeflate and BackendCompression replace the proxy-wide
+	// compression settings when set.
+	ClientDeflate      *DeflateOptions
+	BackendCompression *BackendCompression
+	// DeflatePassthrough replaces Proxy.DeflatePassthrough (nil = no
+	// override).
+	DeflatePassthrough *bool
+	// Opaque streams the route's messages through without holding them:
+	// client frames are parsed up to their headers and copied into the
+	// backend message as they arrive, backend messages go out in chunks
+	// as they are read. Size limits apply per frame header rather than per
+	// byte, and deflate, message rules, chaos, reconnects and resumption
+	// do not apply. Passthrough sessions ignore it.
+	Opaque bool
+	// Backend receives the route's sessions instead of the tenant or
+	// default backend (nil = no override). A path in it is a template
+	// expanded with Path's capture groups ($1, ${name}); without one the
+	// request path is forwarded.
+	Backend *url.URL
+	// BackendProtocol replaces the proxy-wide backend handshake protocol
+	// (BackendProtocolUnset = no override).
+	BackendProtocol BackendProtocol
+	// BackendProxy replaces the proxy-wide egress proxy for the route's
+	// backend connections (nil = no override).
+	BackendProxy *BackendProxy
+	// Pool receives the route's sessions instead of the tenant or default
+	// backend (nil = no override).
+	Pool *BackendPool
+	// Balance and HashOn override the pool's policy for the route's
+	// sessions.
+	Balance Balance
+	HashOn  HashOn
+	// ClientCert admits sessions by their TLS client certificate (nil =
+	// any client).
+	ClientCert *ClientCertPolicy
+	// Claims must all be carried by the session's JWT (see jwt.Claims.Has);
+	// without Auth a route with Claims admits nobody.
+	Claims map[string]string
+	// BackendHeaders are added to the route's backend handshakes, replacing
+	// global ones of the same name.
+	BackendHeaders HeaderTemplates
+	sessions       *sessionGate
+}
+
+// Rejection overrides the response sent for one rejection reason. A zero
+// Status or empty Body keeps the built-in one.
+type Rejection struct {
+	Status int
+	Body   string
+	Header http.Header
+}
+
+func (rc *RuntimeConfig) matchRoute(r *http.Request) *Route {
+	for _, rt := range rc.Routes {
+		if rt.matchesHost(r) && rt.Path.MatchString(r.URL.Path) {
+			return rt
+		}
+	}
+	return nil
+}
+
+func (rt *Route) matchesHost(r *http.Request) bool {
+	if len(rt.Hosts) == 0 {
+		return true
+	}
+	host := requestHost(r)
+	for _, pattern := range rt.Hosts {
+		if matchServerName(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHost is the :authority (Host) of r without the port, or the TLS
+// server name when the request carries none.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" && r.TLS != nil {
+		host = r.TLS.ServerName
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// backendURL returns the backend URL for r on this route. The request query
+// is always forwarded.
+func (rt *Route) backendURL(r *http.Request) *url.URL {
+	path := handshakePath(rt.Backend)
+	if path == "" {
+		return backendURLForRequest(rt.Backend, r)
+	}
+	target := *rt.Backend
+	m := rt.Path.FindStringSubmatchIndex(r.URL.Path)
+	setHandshakePath(&target, string(rt.Path.ExpandString(nil, path, r.URL.Path, m)), "")
+	target.RawQuery = r.URL.RawQuery
+	target.Fragment = ""
+	return &target
+}
+
+func (rt *Route) acquire(ctx context.Context, q config.Admission) bool {
+	return rt.sessions.acquire(ctx, unlimited(rt.MaxConns), q)
+}
+
+func (rt *Route) release() {
+	rt.sessions.release(unlimited(rt.MaxConns))
+}
+
+func routeName(rt *Route) string {
+	if rt == nil {
+		return "default"
+	}
+	return rt.Name
+}
+
+func rejectRoute(rt *Route, reason string) {
+	metrics.RouteRejected.WithLabelValues(routeName(rt), reason).Inc()
+}
+
+// reject writes the response for a rejected CONNECT. The route's override
+// for reason wins over the global one, which wins over status and body.
+func (rc *RuntimeConfig) reject(w http.ResponseWriter, route *Route, reason string, status int, body string) {
+	rej, ok := Rejection{}, false
+	if route != nil {
+		rej, ok = route.Rejections[reason]
+	}
+	if !ok {
+		rej, ok = rc.Rejections[reason]
+	}
+	if !ok {
+		http.Error(w, body, status)
+		return
+	}
+	if rej.Status != 0 {
+		status = rej.Status
+	}
+	if rej.Body == "" {
+		rej.Body = body + "\n"
+	}
+	h := w.Header()
+	for k, vs := range rej.Header {
+		h[k] = vs
+	}
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(rej.Body))
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"h3ws2h1ws-proxy/internal/config"
+)
+
+func TestRejectOverrides(t *testing.T) {
+	chat := &Route{
+		Name: "chat",
+		Path: regexp.MustCompile(`^/chat`),
+		Rejections: map[string]Rejection{
+			"overload": {Status: 429, Body: `{"error":"busy"}`, Header: http.Header{"Content-Type": {"application/json"}, "X-Retry-Class": {"soft"}}},
+		},
+	}
+	rc := &RuntimeConfig{
+		Routes: []*Route{chat},
+		Rejections: map[string]Rejection{
+			"overload": {Status: 503, Body: "global busy"},
+			"method":   {Header: http.Header{"X-Reason": {"method"}}},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		reason      string
+		status      int
+		body        string
+		contentType string
+	}{
+		{name: "route override", path: "/chat/1", reason: "overload", status: 429, body: `{"error":"busy"}`, contentType: "application/json"},
+		{name: "global override", path: "/other", reason: "overload", status: 503, body: "global busy", contentType: "text/plain; charset=utf-8"},
+		{name: "route falls back to global", path: "/chat/1", reason: "method", status: 405, body: "expected CONNECT\n", contentType: "text/plain; charset=utf-8"},
+		{name: "built-in", path: "/other", reason: "bad_headers", status: 400, body: "bad\n", contentType: "text/plain; charset=utf-8"},
+	}
+	defaults := map[string]int{"overload": 503, "method": 405, "bad_headers": 400}
+	bodies := map[string]string{"overload": "too many connections", "method": "expected CONNECT", "bad_headers": "bad"}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodConnect, tc.path, nil)
+			rr := httptest.NewRecorder()
+			rc.reject(rr, rc.matchRoute(r), tc.reason, defaults[tc.reason], bodies[tc.reason])
+			if rr.Code != tc.status || rr.Body.String() != tc.body {
+				t.Fatalf("got %d %q, want %d %q", rr.Code, rr.Body.String(), tc.status, tc.body)
+			}
+			if got := rr.Header().Get("Content-Type"); got != tc.contentType {
+				t.Fatalf("Content-Type = %q, want %q", got, tc.contentType)
+			}
+		})
+	}
+}
+
+func TestRouteSessionCap(t *testing.T) {
+	p := &Proxy{}
+	rt := &Route{Name: "chat", Path: regexp.MustCompile(`^/chat`), MaxConns: 1}
+	p.SetRuntimeConfig(&RuntimeConfig{Routes: []*Route{rt}})
+
+	ctx := context.Background()
+	if !rt.acquire(ctx, config.Admission{}) {
+		t.Fatal("first session rejected")
+	}
+	if rt.acquire(ctx, config.Admission{}) {
+		t.Fatal("second session admitted over the cap")
+	}
+
+	// A config update keeps the count for a route with the same name.
+	next := &Route{Name: "chat", Path: regexp.MustCompile(`^/chat`), MaxConns: 1}
+	p.SetRuntimeConfig(&RuntimeConfig{Routes: []*Route{next}})
+	if next.acquire(ctx, config.Admission{}) {
+		t.Fatal("cap reset by config update")
+	}
+	rt.release()
+	if !next.acquire(ctx, config.Admission{}) {
+		t.Fatal("slot not freed after release")
+	}
+}
+
+func TestRouteBackendURL(t *testing.T) {
+	mustURL := func(s string) *url.URL {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	tests := []struct {
+		path, backend, target, want string
+	}{
+		{`^/chat/(?P<room>\w+)$`, "ws://chat:8080/rooms/${room}", "/chat/lobby?v=2", "ws://chat:8080/rooms/lobby?v=2"},
+		{`^/api/v(\d+)/(.*)$`, "wss://api:443/$2/v$1", "/api/v3/stream", "wss://api:443/stream/v3"},
+		{`^/feed`, "ws://feed:9000", "/feed/live?x=1", "ws://feed:9000/feed/live?x=1"},
+		{`^/chat/(\w+)$`, "ws+unix:///run/chat.sock:/rooms/$1", "/chat/lobby", "ws+unix:///run/chat.sock:/rooms/lobby"},
+		{`^/feed`, "ws+unix:///run/feed.sock", "/feed/live?x=1", "ws+unix:///run/feed.sock:/feed/live?x=1"},
+	}
+	for _, tc := range tests {
+		rt := &Route{Name: "r", Path: regexp.MustCompile(tc.path), Backend: mustURL(tc.backend)}
+		r := httptest.NewRequest(http.MethodConnect, tc.target, nil)
+		if got := rt.backendURL(r).String(); got != tc.want {
+			t.Errorf("%s -> %s: got %s, want %s", tc.target, tc.backend, got, tc.want)
+		}
+	}
+}
+
+func TestMatchRouteByHost(t *testing.T) {
+	rc := &RuntimeConfig{Routes: []*Route{
+		{Name: "chat", Path: regexp.MustCompile(`^/ws$`), Hosts: []string{"chat.example.com"}},
+		{Name: "tenants", Path: regexp.MustCompile(`^/ws$`), Hosts: []string{"*.apps.example.com"}},
+		{Name: "any", Path: regexp.MustCompile(`^/`)},
+	}}
+	tests := map[string]string{
+		"chat.example.com":        "chat",
+		"CHAT.example.com:443":    "chat",
+		"chat.example.com.":       "chat",
+		"a.apps.example.com":      "tenants",
+		"apps.example.com":        "any",
+		"other.example.com":       "any",
+		"b.apps.example.com:8443": "tenants",
+	}
+	for host, want := range tests {
+		r := httptest.NewRequest(http.MethodConnect, "/ws", nil)
+		r.Host = host
+		if got := routeName(rc.matchRoute(r)); got != want {
+			t.Errorf("host %q: got route %q, want %q", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/gorilla/websocket"
+)
+
+// rttProbePrefix marks pings originated by the proxy. Their pongs are
+// consumed by the proxy and never forwarded to the other side.
+const rttProbePrefix = "h3ws-rtt:"
+
+func rttProbePayload(now time.Time) []byte {
+	b := make([]byte, len(rttProbePrefix)+8)
+	copy(b, rttProbePrefix)
+	binary.BigEndian.PutUint64(b[len(rttProbePrefix):], uint64(now.UnixNano()))
+	return b
+}
+
+// parseRTTProbe returns the round trip time of a pong to one of our probes.
+func parseRTTProbe(payload []byte, now time.Time) (time.Duration, bool) {
+	if len(payload) != len(rttProbePrefix)+8 || !bytes.HasPrefix(payload, []byte(rttProbePrefix)) {
+		return 0, false
+	}
+	sent := int64(binary.BigEndian.Uint64(payload[len(rttProbePrefix):]))
+	return now.Sub(time.Unix(0, sent)), true
+}
+
+func (s *session) recordRTT(side string, d time.Duration) {
+	metrics.PingRTT.WithLabelValues(side).Observe(d.Seconds())
+	if side == "client" {
+		s.clientRTT.Store(int64(d))
+		s.clientPongAt.Store(time.Now().UnixNano())
+	} else {
+		s.backendRTT.Store(int64(d))
+		s.backendPongAt.Store(time.Now().UnixNano())
+	}
+}
+
+// probeRTT pings the client and the backend every interval until ctx is
+// done. The pongs are matched in the pumps.
+func probeRTT(ctx context.Context, client io.Writer, backend backendConn, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			payload := rttProbePayload(now)
+			_ = ws.WriteControlFrame(client, ws.OpPing, payload)
+			_ = backend.WriteControl(websocket.PingMessage, payload, now.Add(5*time.Second))
+		}
+	}
+}
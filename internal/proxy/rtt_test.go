@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRTTProbesAreAnsweredAndConsumed(t *testing.T) {
+	backendURL, closeBackend := startEchoBackend(t)
+	defer closeBackend()
+	backendConn, _, err := websocket.DefaultDialer.Dial(backendURL, nil)
+	if err != nil {
+		t.Fatalf("dial backend websocket: %v", err)
+	}
+	defer backendConn.Close()
+	quicSide, proxySide := net.Pipe()
+	defer quicSide.Close()
+	defer proxySide.Close()
+
+	p := &Proxy{}
+	sess := &session{id: "s1", started: time.Now()}
+	p.registry.add(sess)
+	limits := config.Limits{MaxFrameSize: 1024, MaxMessageSize: 1024, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
+	stats := &sessionTrafficStats{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = pumpH3ToBackend(ctx, proxySide, backendConn, limits, stats, sess, "", "") }()
+	go func() { _ = pumpBackendToH3(ctx, backendConn, proxySide, limits, stats, sess, "", "") }()
+	go probeRTT(ctx, proxySide, backendConn, 20*time.Millisecond)
+
+	if err := quicSide.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(quicSide)
+	// Answer client probes like a browser would until both sides have a
+	// measurement; no backend pong may leak through to the client.
+	for sess.clientRTT.Load() == 0 || sess.backendRTT.Load() == 0 {
+		f, err := ws.ReadFrame(br, 0)
+		if err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		if f.Opcode != ws.OpPing {
+			t.Fatalf("unexpected opcode %d forwarded to client", f.Opcode)
+		}
+		if err := ws.WriteDataFrame(quicSide, ws.OpPong, f.Payload, true, 0); err != nil {
+			t.Fatal(err)
+		}
+		// The pong must not count as client activity.
+		if sess.lastActive.Load() != 0 {
+			t.Fatal("probe pong marked the session active")
+		}
+	}
+	infos := p.Sessions()
+	if len(infos) != 1 || infos[0].ID != "s1" || infos[0].ClientRTTMillis <= 0 || infos[0].BackendRTTMillis <= 0 {
+		t.Fatalf("unexpected session info: %+v", infos)
+	}
+}
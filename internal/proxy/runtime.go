@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"net/url"
+	"sync/atomic"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/metrics"
+	"h3ws2h1ws-proxy/internal/redact"
+)
+
+// RuntimeConfig holds the settings that can be replaced while the proxy is
+// serving (remote config, admin API, reloads). A session uses the snapshot
+// that was current when it was accepted.
+type RuntimeConfig struct {
+	// Backend serves sessions that match no tenant (nil = Proxy.Backend).
+	Backend   *url.URL
+	Limits    config.Limits
+	Resume    config.Resume
+	Reconnect config.Reconnect
+	Admission config.Admission
+	Tenants   []*Tenant
+	Routes    []*Route
+	// Rejections customizes rejection responses for requests that match no
+	// route, or whose route has no override for the reason.
+	Rejections map[string]Rejection
+	// BackendHeaders are added to every backend handshake; routes may
+	// override them by name.
+	BackendHeaders HeaderTemplates
+	// Redactor masks payloads before they are logged (nil = no redaction).
+	Redactor *redact.Redactor
+	// Chaos injects faults into new sessions (nil = off).
+	Chaos *Chaos
+	// Pools are the backend pools routes and tenants may use.
+	Pools []*BackendPool
+	// DefaultPool replaces Backend for sessions whose route and tenant name
+	// no backend (nil = use Backend).
+	DefaultPool *BackendPool
+}
+
+// SetRuntimeConfig atomically replaces the runtime config. Session counters
+// of tenants, routes and pool backends that keep their name are carried
+// over, so their caps and counts stay accurate across updates.
+func (p *Proxy) SetRuntimeConfig(rc *RuntimeConfig) {
+	prevTenants := make(map[string]*atomic.Int64)
+	prevRoutes := make(map[string]*sessionGate)
+	prevBackends := make(map[string]*atomic.Int64)
+	prevHealth := make(map[string]*backendHealth)
+	prevOutliers := make(map[string]*backendOutlier)
+	if old := p.runtime.Load(); old != nil {
+		for _, t := range old.Tenants {
+			prevTenants[t.Name] = t.active
+		}
+		for _, rt := range old.Routes {
+			prevRoutes[rt.Name] = rt.sessions
+		}
+		for _, pool := range old.Pools {
+			for _, b := range pool.Backends {
+				prevBackends[pool.Name+"/"+b.Name] = b.counter()
+				key := pool.Name + "/" + b.Name + "/" + b.URL.String()
+				if b.health != nil {
+					prevHealth[key] = b.health
+				}
+				if b.outlier != nil {
+					prevOutliers[key] = b.outlier
+				}
+			}
+		}
+	}
+	for _, pool := range rc.Pools {
+		for _, b := range pool.Backends {
+			b.pool = pool.Name
+			b.active = carryCounter(prevBackends, pool.Name+"/"+b.Name, b.active)
+			// Probe and ejection state survives updates unless the member
+			// moved or its pool stopped checking.
+			key := pool.Name + "/" + b.Name + "/" + b.URL.String()
+			b.health, b.outlier = nil, nil
+			if pool.HealthCheck != nil {
+				if b.health = prevHealth[key]; b.health == nil {
+					b.health = &backendHealth{}
+				}
+			}
+			if pool.Outliers != nil {
+				if b.outlier = prevOutliers[key]; b.outlier == nil {
+					b.outlier = &backendOutlier{}
+				}
+			}
+		}
+	}
+	for _, t := range rc.Tenants {
+		t.active = carryCounter(prevTenants, t.Name, t.active)
+	}
+	for _, rt := range rc.Routes {
+		rt.sessions = carryCounter(prevRoutes, rt.Name, rt.sessions)
+	}
+	p.runtime.Store(rc)
+	// A raised cap admits queued CONNECTs now rather than on the next release.
+	p.sessions.setLimit(rc.Limits.MaxConns)
+	for _, rt := range rc.Routes {
+		rt.sessions.setLimit(unlimited(rt.MaxConns))
+	}
+	metrics.LimitMaxConns.Set(float64(rc.Limits.MaxConns))
+	metrics.LimitMaxMessageBytes.Set(float64(rc.Limits.MaxMessageSize))
+	metrics.LimitMaxFrameBytes.Set(float64(rc.Limits.MaxFrameSize))
+}
+
+func carryCounter[T any](prev map[string]*T, name string, cur *T) *T {
+	if c, ok := prev[name]; ok {
+		return c
+	}
+	if cur == nil {
+		return new(T)
+	}
+	return cur
+}
+
+// RuntimeConfig returns the snapshot new sessions are accepted with.
+func (p *Proxy) RuntimeConfig() *RuntimeConfig {
+	return p.runtimeConfig()
+}
+
+// runtimeConfig returns the current snapshot, or one built from the static
+// Proxy fields when none was set.
+func (p *Proxy) runtimeConfig() *RuntimeConfig {
+	if rc := p.runtime.Load(); rc != nil {
+		return rc
+	}
+	return &RuntimeConfig{Limits: p.Limits, Resume: p.Resume, Reconnect: p.Reconnect, Admission: p.Admission}
+}
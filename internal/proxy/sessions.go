@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/ratelimit"
+)
+
+// SessionInfo describes a running session for the admin API.
+type SessionInfo struct {
+	ID       string `json:"id"`
+	Route    string `json:"route"`
+	Priority string `json:"priority"`
+	Tag      string `json:"tag,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	// Labels are the metadata the Policy decision attached.
+	Labels           map[string]string `json:"labels,omitempty"`
+	ClientIP         string            `json:"client_ip,omitempty"`
+	Path             string            `json:"path"`
+	Backend          string            `json:"backend"`
+	Started          time.Time         `json:"started"`
+	AgeSeconds       float64           `json:"age_seconds"`
+	IdleSeconds      float64           `json:"idle_seconds"`
+	BytesIn          uint64            `json:"bytes_in"`
+	BytesOut         uint64            `json:"bytes_out"`
+	MessagesIn       uint64            `json:"messages_in"`
+	MessagesOut      uint64            `json:"messages_out"`
+	ClientRTTMillis  float64           `json:"client_rtt_ms,omitempty"`
+	BackendRTTMillis float64           `json:"backend_rtt_ms,omitempty"`
+}
+
+// Sessions lists the running sessions, oldest first. RTTs are the last
+// probe results and stay zero without -rtt-probe-interval.
+func (p *Proxy) Sessions() []SessionInfo {
+	p.registry.mu.Lock()
+	defer p.registry.mu.Unlock()
+	now := time.Now()
+	out := make([]SessionInfo, 0, len(p.registry.sessions))
+	for s := range p.registry.sessions {
+		out = append(out, s.info(now))
+	}
+	slices.SortFunc(out, func(a, b SessionInfo) int { return a.Started.Compare(b.Started) })
+	return out
+}
+
+// info describes s as of now.
+func (s *session) info(now time.Time) SessionInfo {
+	info := SessionInfo{
+		ID:               s.id,
+		Route:            routeName(s.route),
+		Priority:         s.priority.String(),
+		Tag:              s.tag,
+		Identity:         s.identity,
+		Labels:           s.labels,
+		Path:             s.path,
+		Backend:          s.backend,
+		Started:          s.started,
+		AgeSeconds:       now.Sub(s.started).Seconds(),
+		IdleSeconds:      s.idleFor(now).Seconds(),
+		ClientRTTMillis:  float64(s.clientRTT.Load()) / float64(time.Millisecond),
+		BackendRTTMillis: float64(s.backendRTT.Load()) / float64(time.Millisecond),
+	}
+	if s.clientIP.IsValid() {
+		info.ClientIP = s.clientIP.String()
+	}
+	if st := s.traffic; st != nil {
+		info.BytesIn = atomic.LoadUint64(&st.h3ToH1Bytes)
+		info.BytesOut = atomic.LoadUint64(&st.h1ToH3Bytes)
+		info.MessagesIn = atomic.LoadUint64(&st.h3ToH1Messages)
+		info.MessagesOut = atomic.LoadUint64(&st.h1ToH3Messages)
+	}
+	return info
+}
+
+// CloseSession terminates the running session with the given ID: both
+// sides are sent a close frame with code and reason and the backend
+// connection is closed. It reports whether the session was found.
+func (p *Proxy) CloseSession(id string, code int, reason string) bool {
+	p.registry.mu.Lock()
+	var found *session
+	for s := range p.registry.sessions {
+		if s.id == id {
+			found = s
+			break
+		}
+	}
+	p.registry.mu.Unlock()
+	if found == nil {
+		return false
+	}
+	go found.terminate(code, reason)
+	return true
+}
+
+// CloseSessions terminates every running session with code and reason and
+// returns how many there were. Shutdown uses it to tell clients to
+// reconnect elsewhere instead of letting their streams reset.
+func (p *Proxy) CloseSessions(code int, reason string) int {
+	p.registry.mu.Lock()
+	sessions := make([]*session, 0, len(p.registry.sessions))
+	for s := range p.registry.sessions {
+		sessions = append(sessions, s)
+		delete(p.registry.sessions, s)
+	}
+	p.registry.mu.Unlock()
+	for _, s := range sessions {
+		go s.terminate(code, reason)
+	}
+	return len(sessions)
+}
+
+// Stats is a snapshot of session and rate limiter state for debug
+// endpoints.
+type Stats struct {
+	Sessions           int                        `json:"sessions"`
+	Parked             int                        `json:"parked"`
+	ByRoute            map[string]int             `json:"by_route"`
+	ByPriority         map[string]int             `json:"by_priority"`
+	IPRateLimiter      *ratelimit.Stats           `json:"ip_rate_limiter,omitempty"`
+	TenantRateLimiters map[string]ratelimit.Stats `json:"tenant_rate_limiters,omitempty"`
+}
+
+type limiterStats interface {
+	Stats() ratelimit.Stats
+}
+
+func (p *Proxy) Stats() Stats {
+	st := Stats{ByRoute: map[string]int{}, ByPriority: map[string]int{}}
+	p.registry.mu.Lock()
+	for s := range p.registry.sessions {
+		st.Sessions++
+		st.ByRoute[routeName(s.route)]++
+		st.ByPriority[s.priority.String()]++
+	}
+	p.registry.mu.Unlock()
+	p.parked.Range(func(_, _ any) bool {
+		st.Parked++
+		return true
+	})
+	if l, ok := p.IPRateLimiter.(limiterStats); ok {
+		ls := l.Stats()
+		st.IPRateLimiter = &ls
+	}
+	for _, t := range p.runtimeConfig().Tenants {
+		if l, ok := t.RateLimiter.(limiterStats); ok {
+			if st.TenantRateLimiters == nil {
+				st.TenantRateLimiters = map[string]ratelimit.Stats{}
+			}
+			st.TenantRateLimiters[t.Name] = l.Stats()
+		}
+	}
+	return st
+}
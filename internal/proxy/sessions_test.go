@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"h3ws2h1ws-proxy/internal/config"
+)
+
+func TestListAndCloseSession(t *testing.T) {
+	backendURL, closeBackend := startEchoBackend(t)
+	defer closeBackend()
+	backend, _ := url.Parse(backendURL)
+	p := &Proxy{
+		Backend: backend,
+		Limits:  config.Limits{MaxFrameSize: 1 << 20, MaxMessageSize: 1 << 20, MaxConns: 10, WriteTimeout: 5 * time.Second},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(p.HandleH3WebSocket))
+	defer srv.Close()
+
+	c, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?token=secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := p.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("%d sessions listed, want 1", len(sessions))
+	}
+	s := sessions[0]
+	if s.ID != resp.Header.Get(SessionIDHeader) || s.ClientIP != "127.0.0.1" || s.Path != "/ws" || s.Backend != backendURL+"/ws" {
+		t.Errorf("session = %+v", s)
+	}
+	if s.BytesIn != 5 || s.BytesOut != 5 || s.MessagesIn != 1 || s.MessagesOut != 1 || s.AgeSeconds <= 0 {
+		t.Errorf("counters = %+v", s)
+	}
+
+	if p.CloseSession("unknown", 1008, "closed by administrator") {
+		t.Error("closed an unknown session")
+	}
+	if !p.CloseSession(s.ID, 1008, "closed by administrator") {
+		t.Fatal("session not found")
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = c.ReadMessage()
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != 1008 {
+		t.Fatalf("read after close: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"runtime/metrics"
+	"time"
+
+	pmetrics "h3ws2h1ws-proxy/internal/metrics"
+)
+
+// touch records traffic on the session for idle-first shedding.
+func (s *session) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *session) idleFor(now time.Time) time.Duration {
+	last := s.lastActive.Load()
+	if last == 0 {
+		return now.Sub(s.started)
+	}
+	return now.Sub(time.Unix(0, last))
+}
+
+// claimIdle removes and returns the longest-idle session of class p or below
+// that has been idle for at least minIdle, or nil when there is none. With
+// takeSlot its slot is marked as taken in the same step, so the victim
+// cannot release it when it ends in between.
+func (r *sessionRegistry) claimIdle(p Priority, minIdle time.Duration, takeSlot bool) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	var victim *session
+	var victimIdle time.Duration
+	for s := range r.sessions {
+		if s.priority > p {
+			continue
+		}
+		if idle := s.idleFor(now); idle >= minIdle && (victim == nil || idle > victimIdle) {
+			victim, victimIdle = s, idle
+		}
+	}
+	if victim != nil {
+		delete(r.sessions, victim)
+		if takeSlot {
+			victim.slotTaken.Store(true)
+		}
+	}
+	return victim
+}
+
+func (r *sessionRegistry) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// heapInUse reports the bytes held by live and not yet swept heap objects.
+var heapInUse = func() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
+
+// WatchMemory sheds the longest-idle sessions while the heap is above
+// budget, about 1% of the sessions per interval, instead of refusing new
+// CONNECTs. It returns when ctx is done.
+func (p *Proxy) WatchMemory(ctx context.Context, budget uint64, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if heapInUse() <= budget {
+			continue
+		}
+		n := max(p.registry.len()/100, 1)
+		for range n {
+			victim := p.registry.claimIdle(PriorityHigh, 0, false)
+			if victim == nil {
+				break
+			}
+			pmetrics.IdleShed.WithLabelValues("memory").Inc()
+			p.debugf("heap above budget, shedding idle session: session=%s idle=%s", victim.id, victim.idleFor(time.Now()).Round(time.Second))
+			go victim.shed()
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/jwt"
+)
+
+func TestAdmitShedsLongestIdle(t *testing.T) {
+	p := &Proxy{}
+	rt := &RuntimeConfig{Limits: config.Limits{MaxConns: 3}, Admission: config.Admission{ShedIdle: time.Minute}}
+	ctx := context.Background()
+
+	shed := make(chan string, 3)
+	now := time.Now()
+	register := func(id string, prio Priority, idle time.Duration) *session {
+		if !p.admit(ctx, rt, prio, false) {
+			t.Fatalf("admit %s below the cap failed", id)
+		}
+		s := &session{id: id, priority: prio, started: now.Add(-time.Hour)}
+		s.lastActive.Store(now.Add(-idle).UnixNano())
+		s.terminate = func(int, string) { shed <- s.id }
+		p.registry.add(s)
+		return s
+	}
+	register("busy", PriorityNormal, time.Second)
+	register("idle-high", PriorityHigh, 30*time.Minute)
+	idle := register("idle", PriorityNormal, 10*time.Minute)
+
+	// The high priority session idles longer but is above the newcomer's class.
+	if !p.admit(ctx, rt, PriorityNormal, false) {
+		t.Fatal("normal CONNECT not admitted")
+	}
+	if got := <-shed; got != "idle" {
+		t.Fatalf("shed %s, want idle", got)
+	}
+	if !idle.slotTaken.Load() {
+		t.Fatal("shed session still owns its slot")
+	}
+	// The remaining normal session is busy, so nothing else qualifies.
+	if p.admit(ctx, rt, PriorityNormal, false) {
+		t.Fatal("CONNECT admitted by shedding a busy session")
+	}
+}
+
+func TestWatchMemoryShedsIdleSessions(t *testing.T) {
+	p := &Proxy{}
+	shed := make(chan string, 2)
+	now := time.Now()
+	for _, c := range []struct {
+		id   string
+		idle time.Duration
+	}{{"busy", 0}, {"idle", time.Hour}} {
+		s := &session{id: c.id, priority: PriorityHigh, started: now}
+		s.lastActive.Store(now.Add(-c.idle).UnixNano())
+		s.terminate = func(int, string) { shed <- s.id }
+		p.registry.add(s)
+	}
+
+	orig := heapInUse
+	heapInUse = func() uint64 { return 2 << 30 }
+	defer func() { heapInUse = orig }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.WatchMemory(ctx, 1<<30, 5*time.Millisecond)
+	select {
+	case got := <-shed:
+		if got != "idle" {
+			t.Fatalf("shed %s first, want idle", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no session shed above the memory budget")
+	}
+}
+
+func TestRefusedConnectDoesNotShed(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	limits := config.Limits{MaxConns: 1}
+	p := &Proxy{Limits: limits, Auth: &Auth{Verifier: &jwt.Verifier{Keys: jwt.StaticKey{Public: pub}}}}
+	rt := &RuntimeConfig{Limits: limits, Admission: config.Admission{ShedIdle: time.Minute}}
+	p.SetRuntimeConfig(rt)
+
+	if !p.admit(context.Background(), rt, PriorityNormal, false) {
+		t.Fatal("admit below the cap failed")
+	}
+	shed := make(chan string, 1)
+	s := &session{id: "idle", priority: PriorityNormal, started: time.Now()}
+	s.lastActive.Store(time.Now().Add(-time.Hour).UnixNano())
+	s.terminate = func(int, string) { shed <- s.id }
+	p.registry.add(s)
+
+	srv := httptest.NewServer(http.HandlerFunc(p.HandleH3WebSocket))
+	defer srv.Close()
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated CONNECT: resp=%v err=%v", resp, err)
+	}
+	select {
+	case id := <-shed:
+		t.Fatalf("session %s shed for a refused CONNECT", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if s.slotTaken.Load() || p.sessions.count() != 1 {
+		t.Fatalf("slot moved: taken=%v active=%d", s.slotTaken.Load(), p.sessions.count())
+	}
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// clientStreamer returns how to answer an accepted request and take over
+// the client's byte stream: HTTP/3 hands over the request stream and HTTP/2
+// (RFC 8441) pairs the request body with the response, both after a 200;
+// an HTTP/1.1 upgrade gets a 101 on the hijacked connection. It reports
+// false for transports that cannot carry a session.
+func clientStreamer(w http.ResponseWriter, r *http.Request) (func() (io.ReadWriteCloser, error), bool) {
+	if hs, ok := w.(http3.HTTPStreamer); ok {
+		return func() (io.ReadWriteCloser, error) {
+			writeOK(w)
+			return hs.HTTPStream(), nil
+		}, true
+	}
+	if r.ProtoMajor == 2 {
+		return func() (io.ReadWriteCloser, error) {
+			writeOK(w)
+			return &h2Stream{body: r.Body, w: w, rc: http.NewResponseController(w)}, nil
+		}, true
+	}
+	if hj, ok := w.(http.Hijacker); ok && IsUpgradeRequest(r) {
+		return func() (io.ReadWriteCloser, error) {
+			conn, brw, err := hj.Hijack()
+			if err != nil {
+				return nil, err
+			}
+			// Clear the server's read/write timeouts; the session has its own.
+			_ = conn.SetDeadline(time.Time{})
+			h := w.Header().Clone()
+			h.Set("Upgrade", "websocket")
+			h.Set("Connection", "Upgrade")
+			var b bytes.Buffer
+			b.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+			_ = h.Write(&b)
+			b.WriteString("\r\n")
+			if _, err := conn.Write(b.Bytes()); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			return &h1Stream{Conn: conn, r: brw.Reader}, nil
+		}, true
+	}
+	return nil, false
+}
+
+func writeOK(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// h2Stream is the tunnel of an HTTP/2 extended CONNECT. Writes are
+// serialized and flushed one by one, since the response writer is not safe
+// for concurrent use and frames must not sit in its buffer.
+type h2Stream struct {
+	body io.ReadCloser
+	w    http.ResponseWriter
+	rc   *http.ResponseController
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (s *h2Stream) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+func (s *h2Stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, net.ErrClosed
+	}
+	n, err := s.w.Write(p)
+	if err == nil {
+		err = s.rc.Flush()
+	}
+	return n, err
+}
+
+// Close stops writes, which must not outlive the handler, and ends the
+// request body.
+func (s *h2Stream) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	return s.body.Close()
+}
+
+// h1Stream is a hijacked HTTP/1.1 connection; reads drain what the server
+// already buffered first.
+type h1Stream struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (s *h1Stream) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+// lockedWriter serializes the writes of the pumps, keepalives and close
+// paths to a client stream, which quic-go does not allow concurrently.
+// Every frame goes out in one Write, so frames never interleave.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestHTTP2ExtendedConnectRoundTrip(t *testing.T) {
+	// Go's HTTP/2 server reads this setting once at startup, so the test
+	// runs itself again with it in the environment.
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHTTP2ExtendedConnectRoundTrip$", "-test.count=1")
+		cmd.Env = append(os.Environ(), "GODEBUG=http2xconnect=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		return
+	}
+
+	backendURL, closeBackend := startEchoBackend(t)
+	defer closeBackend()
+	backend, err := url.Parse(backendURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{
+		Backend:       backend,
+		StrictRFC9220: true,
+		Limits:        config.Limits{MaxFrameSize: 1 << 20, MaxMessageSize: 1 << 20, MaxConns: 10, WriteTimeout: 5 * time.Second},
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(p.HandleH3WebSocket))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// net/http's client cannot send :protocol, so speak HTTP/2 directly.
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		t.Fatal(err)
+	}
+	fr := http2.NewFramer(conn, conn)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if err := fr.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	for _, f := range [][2]string{
+		{":method", "CONNECT"}, {":protocol", "websocket"}, {":scheme", "https"},
+		{":path", "/ws"}, {":authority", srv.Listener.Addr().String()}, {"sec-websocket-version", "13"},
+	} {
+		_ = enc.WriteField(hpack.HeaderField{Name: f[0], Value: f[1]})
+	}
+	if err := fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block.Bytes(), EndHeaders: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	var tunnel bytes.Buffer
+	for sent := false; ; {
+		frame, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				_ = fr.WriteSettingsAck()
+			}
+		case *http2.MetaHeadersFrame:
+			if status := f.PseudoValue("status"); status != "200" {
+				t.Fatalf("CONNECT answered %s", status)
+			}
+			var msg bytes.Buffer
+			_ = ws.WriteDataFrame(&msg, ws.OpText, []byte("over h2"), true, 0)
+			if err := fr.WriteData(1, false, msg.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			sent = true
+		case *http2.DataFrame:
+			tunnel.Write(f.Data())
+			if !sent {
+				continue
+			}
+			got, err := ws.ReadFrame(bufio.NewReader(bytes.NewReader(tunnel.Bytes())), 0)
+			if err != nil {
+				continue
+			}
+			if got.Opcode != ws.OpText || string(got.Payload) != "over h2" {
+				t.Fatalf("echo: opcode=%d payload=%q", got.Opcode, got.Payload)
+			}
+			return
+		case *http2.RSTStreamFrame, *http2.GoAwayFrame:
+			t.Fatalf("server ended the tunnel: %v", f)
+		}
+	}
+}
+
+func TestHTTP1UpgradeRoundTrip(t *testing.T) {
+	backendURL, closeBackend := startEchoBackend(t)
+	defer closeBackend()
+	backend, err := url.Parse(backendURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{
+		Backend: backend,
+		Limits:  config.Limits{MaxFrameSize: 1 << 20, MaxMessageSize: 1 << 20, MaxConns: 10, WriteTimeout: 5 * time.Second},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(p.HandleH3WebSocket))
+	defer srv.Close()
+
+	c, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if id := resp.Header.Get(SessionIDHeader); id == "" {
+		t.Error("upgrade response has no session ID")
+	}
+	if err := c.WriteMessage(websocket.TextMessage, []byte("over h1")); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if mt, msg, err := c.ReadMessage(); err != nil || mt != websocket.TextMessage || string(msg) != "over h1" {
+		t.Fatalf("echo: type=%d msg=%q err=%v", mt, msg, err)
+	}
+
+	// A plain GET is not a session.
+	res, err := http.Get(srv.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("plain GET answered %d", res.StatusCode)
+	}
+}
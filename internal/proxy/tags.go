@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	tagNone  = "none"
+	tagOther = "other"
+)
+
+// ConnectionTags labels sessions with a client-supplied value such as the
+// app version or platform. Only allowlisted values become labels; anything
+// else is folded into "other" so clients cannot blow up metric cardinality.
+type ConnectionTags struct {
+	// Header is checked first, then the Query parameter.
+	Header string
+	Query  string
+	// Allowed holds the accepted values, lower-cased.
+	Allowed map[string]bool
+}
+
+func (t ConnectionTags) enabled() bool {
+	return t.Header != "" || t.Query != ""
+}
+
+// tag returns the session's tag, or "" when tagging is disabled.
+func (t ConnectionTags) tag(r *http.Request) string {
+	if !t.enabled() {
+		return ""
+	}
+	var v string
+	if t.Header != "" {
+		v = r.Header.Get(t.Header)
+	}
+	if v == "" && t.Query != "" {
+		v = r.URL.Query().Get(t.Query)
+	}
+	v = strings.ToLower(strings.TrimSpace(v))
+	switch {
+	case v == "":
+		return tagNone
+	case t.Allowed[v]:
+		return v
+	default:
+		return tagOther
+	}
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConnectionTags(t *testing.T) {
+	tags := ConnectionTags{Header: "X-Platform", Query: "platform", Allowed: map[string]bool{"ios": true, "android": true}}
+	cases := []struct {
+		header, target, want string
+	}{
+		{"iOS", "/ws", "ios"},
+		{"", "/ws?platform=android", "android"},
+		{"ios", "/ws?platform=android", "ios"},
+		{"", "/ws", tagNone},
+		{"symbian", "/ws", tagOther},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("CONNECT", c.target, nil)
+		if c.header != "" {
+			r.Header.Set("X-Platform", c.header)
+		}
+		if got := tags.tag(r); got != c.want {
+			t.Errorf("tag(header=%q, %s) = %q, want %q", c.header, c.target, got, c.want)
+		}
+	}
+	if got := (ConnectionTags{}).tag(httptest.NewRequest("CONNECT", "/ws", nil)); got != "" {
+		t.Errorf("disabled tagging returned %q", got)
+	}
+}
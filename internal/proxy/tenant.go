@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/jwt"
+	"h3ws2h1ws-proxy/internal/metrics"
+	"h3ws2h1ws-proxy/internal/ratelimit"
+)
+
+// Tenant is an isolated slice of the proxy: it has its own backend, limits,
+// authentication and session accounting, and its own label on tenant
+// metrics.
+type Tenant struct {
+	Name       string
+	SNI        []string
+	PathPrefix string
+	// Claims select the tenant by the client's identity: it only matches
+	// sessions whose JWT, verified by Proxy.Auth, carries all of them (see
+	// jwt.Claims.Has).
+	Claims map[string]string
+	// Auth, when set, requires the tenant's sessions to carry a JWT that
+	// its own Verifier accepts, in addition to any Proxy.Auth.
+	Auth    *Auth
+	Backend *url.URL
+	// Pool, when set, is used instead of Backend.
+	Pool   *BackendPool
+	Limits config.Limits
+	// RateLimiter caps the tenant's aggregate CONNECT rate (nil = unlimited).
+	RateLimiter ratelimit.Limiter
+	Priority    Priority
+	active      *atomic.Int64
+}
+
+func (t *Tenant) matches(r *http.Request, claims jwt.Claims) bool {
+	if t.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, t.PathPrefix) {
+		return false
+	}
+	for name, value := range t.Claims {
+		if !claims.Has(name, value) {
+			return false
+		}
+	}
+	if len(t.SNI) == 0 {
+		return true
+	}
+	serverName := ""
+	if r.TLS != nil {
+		serverName = r.TLS.ServerName
+	}
+	if serverName == "" {
+		serverName = r.Host
+		if h, _, err := net.SplitHostPort(serverName); err == nil {
+			serverName = h
+		}
+	}
+	for _, pattern := range t.SNI {
+		if matchServerName(pattern, serverName) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchServerName supports exact names and a single leading wildcard label
+// ("*.example.com").
+func matchServerName(pattern, name string) bool {
+	pattern = strings.ToLower(pattern)
+	name = strings.ToLower(name)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		i := strings.Index(name, ".")
+		return i > 0 && name[i+1:] == suffix
+	}
+	return pattern == name
+}
+
+func (rc *RuntimeConfig) matchTenant(r *http.Request, claims jwt.Claims) *Tenant {
+	for _, t := range rc.Tenants {
+		if t.matches(r, claims) {
+			return t
+		}
+	}
+	return nil
+}
+
+func (t *Tenant) acquire() bool {
+	if n := t.active.Add(1); t.Limits.MaxConns > 0 && n > t.Limits.MaxConns {
+		t.active.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (t *Tenant) release() {
+	t.active.Add(-1)
+}
+
+func tenantName(t *Tenant) string {
+	if t == nil {
+		return "default"
+	}
+	return t.Name
+}
+
+func rejectTenant(t *Tenant, reason string) {
+	metrics.TenantRejected.WithLabelValues(tenantName(t), reason).Inc()
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"h3ws2h1ws-proxy/internal/jwt"
+)
+
+func TestMatchTenant(t *testing.T) {
+	chat := &Tenant{Name: "chat", SNI: []string{"*.chat.example.com"}}
+	games := &Tenant{Name: "games", PathPrefix: "/games/"}
+	eu := &Tenant{Name: "eu", SNI: []string{"eu.example.com"}, PathPrefix: "/ws"}
+	p := &Proxy{}
+	p.SetRuntimeConfig(&RuntimeConfig{Tenants: []*Tenant{chat, games, eu}})
+
+	tests := []struct {
+		name string
+		sni  string
+		host string
+		path string
+		want *Tenant
+	}{
+		{name: "wildcard sni", sni: "a.chat.example.com", path: "/ws", want: chat},
+		{name: "wildcard does not match apex", sni: "chat.example.com", path: "/ws", want: nil},
+		{name: "path prefix", sni: "other.example.com", path: "/games/lobby", want: games},
+		{name: "sni and path", sni: "EU.example.com", path: "/ws", want: eu},
+		{name: "sni without path", sni: "eu.example.com", path: "/other", want: nil},
+		{name: "host fallback", host: "eu.example.com:443", path: "/ws", want: eu},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodConnect, tc.path, nil)
+			r.Host = tc.host
+			if tc.sni != "" {
+				r.TLS = &tls.ConnectionState{ServerName: tc.sni}
+			}
+			if got := p.runtimeConfig().matchTenant(r, nil); got != tc.want {
+				t.Fatalf("matchTenant: got %q want %q", tenantName(got), tenantName(tc.want))
+			}
+		})
+	}
+}
+
+func TestTenantIdentityAndAuth(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	tenantPub, tenantPriv, _ := ed25519.GenerateKey(rand.Reader)
+	acme := &Tenant{Name: "acme", Claims: map[string]string{"org": "acme"}}
+	partner := &Tenant{Name: "partner", PathPrefix: "/partner", Auth: &Auth{Verifier: &jwt.Verifier{Keys: jwt.StaticKey{Public: tenantPub}}, Query: "token"}}
+	rt := &RuntimeConfig{Tenants: []*Tenant{acme, partner}}
+
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		want       *Tenant
+		wantStatus int
+	}{
+		{name: "identity", path: "/ws", token: signEdDSA(priv, map[string]any{"org": "acme"}), want: acme},
+		{name: "other identity", path: "/ws", token: signEdDSA(priv, map[string]any{"org": "globex"})},
+		{name: "tenant key", path: "/partner?token=" + signEdDSA(tenantPriv, map[string]any{"sub": "p"}), want: partner},
+		{name: "global key at tenant", path: "/partner?token=" + signEdDSA(priv, map[string]any{"sub": "p"}), wantStatus: http.StatusUnauthorized},
+		{name: "no tenant token", path: "/partner", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{}
+			if tc.token != "" {
+				p.Auth = &Auth{Verifier: &jwt.Verifier{Keys: jwt.StaticKey{Public: pub}}}
+			}
+			r := httptest.NewRequest(http.MethodConnect, tc.path, nil)
+			if tc.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			w := httptest.NewRecorder()
+			got, ok := p.authenticate(w, rt, nil, r, &session{})
+			if tc.wantStatus != 0 {
+				if ok || w.Code != tc.wantStatus {
+					t.Fatalf("ok=%v status=%d, want %d", ok, w.Code, tc.wantStatus)
+				}
+				return
+			}
+			if !ok || got != tc.want {
+				t.Fatalf("ok=%v tenant %q, want %q", ok, tenantName(got), tenantName(tc.want))
+			}
+			if r.URL.Query().Has("token") {
+				t.Fatalf("tenant token left in the URL: %s", r.URL)
+			}
+		})
+	}
+}
+
+func TestTenantScopedRoute(t *testing.T) {
+	chat := &Tenant{Name: "chat", SNI: []string{"chat.example.com"}}
+	games := &Tenant{Name: "games", SNI: []string{"games.example.com"}}
+	route := &Route{Name: "games-admin", Tenant: "games"}
+	rt := &RuntimeConfig{Tenants: []*Tenant{chat, games}}
+
+	for _, tc := range []struct {
+		host string
+		ok   bool
+	}{
+		{"games.example.com", true},
+		{"chat.example.com", false},
+		{"other.example.com", false},
+	} {
+		r := httptest.NewRequest(http.MethodConnect, "/admin", nil)
+		r.TLS = &tls.ConnectionState{ServerName: tc.host}
+		w := httptest.NewRecorder()
+		_, ok := (&Proxy{}).authenticate(w, rt, route, r, &session{})
+		if ok != tc.ok {
+			t.Errorf("%s: ok=%v, want %v", tc.host, ok, tc.ok)
+		}
+		if !tc.ok && w.Code != http.StatusForbidden {
+			t.Errorf("%s: status=%d, want 403", tc.host, w.Code)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+// throttle waits until n more payload bytes may pass in direction dir
+// ("h3_to_h1" or "h1_to_h3"), first under the session's own limit and then
+// under the proxy-wide one. While it waits the pump reads nothing, so QUIC
+// and TCP flow control slow the sender down.
+func (s *session) throttle(ctx context.Context, dir string, n int) error {
+	t, sh := s.inThrottle, s.inShaper
+	if dir == "h1_to_h3" {
+		t, sh = s.outThrottle, s.outShaper
+	}
+	if t == nil && sh == nil {
+		return nil
+	}
+	start := time.Now()
+	defer func() {
+		if d := time.Since(start); d >= time.Millisecond {
+			metrics.ThrottleWait.WithLabelValues(dir).Add(d.Seconds())
+		}
+	}()
+	if t != nil {
+		if err := t.Wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	if sh != nil {
+		return sh.Wait(ctx, n)
+	}
+	return nil
+}
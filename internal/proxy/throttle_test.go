@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/ratelimit"
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSessionBandwidthThrottlesClientMessages(t *testing.T) {
+	backendURL, closeBackend := startEchoBackend(t)
+	defer closeBackend()
+	backendConn, _, err := websocket.DefaultDialer.Dial(backendURL, nil)
+	if err != nil {
+		t.Fatalf("dial backend websocket: %v", err)
+	}
+	defer backendConn.Close()
+	quicSide, proxySide := net.Pipe()
+	defer quicSide.Close()
+	defer proxySide.Close()
+
+	sess := &session{id: "s1", started: time.Now(), inThrottle: ratelimit.NewThrottle(100_000, 100_000)}
+	limits := config.Limits{MaxFrameSize: 1 << 20, MaxMessageSize: 1 << 20, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = pumpH3ToBackend(ctx, proxySide, backendConn, limits, &sessionTrafficStats{}, sess, "", "")
+	}()
+
+	start := time.Now()
+	payload := make([]byte, 50_000)
+	for range 3 {
+		if err := ws.WriteDataFrame(quicSide, ws.OpBinary, payload, true, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ws.WriteDataFrame(quicSide, ws.OpBinary, []byte("last"), true, 0); err != nil {
+		t.Fatal(err)
+	}
+	// 150 kB against a 100 kB burst at 100 kB/s: the fourth message cannot
+	// be read before half a second has passed.
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond {
+		t.Fatalf("messages passed after %s, want at least 500ms", elapsed)
+	}
+}
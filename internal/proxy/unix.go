@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// A backend URL with the ws+unix or wss+unix scheme reaches the backend over
+// a Unix domain socket. Its path is the socket, then a colon and the
+// handshake path: ws+unix:///var/run/app.sock:/ws.
+
+func isUnixScheme(scheme string) bool {
+	return scheme == "ws+unix" || scheme == "wss+unix"
+}
+
+// unixSocket returns the socket path of a ws+unix or wss+unix URL.
+func unixSocket(u *url.URL) (string, bool) {
+	if !isUnixScheme(u.Scheme) {
+		return "", false
+	}
+	sock, _, _ := strings.Cut(u.Path, ":")
+	return sock, true
+}
+
+// handshakePath returns the path the WebSocket handshake asks for.
+func handshakePath(u *url.URL) string {
+	if !isUnixScheme(u.Scheme) {
+		return u.Path
+	}
+	_, path, _ := strings.Cut(u.Path, ":")
+	return path
+}
+
+// setHandshakePath points u at path, keeping the socket of a Unix URL.
+func setHandshakePath(u *url.URL, path, rawPath string) {
+	sock, ok := unixSocket(u)
+	if !ok {
+		u.Path, u.RawPath = path, rawPath
+		return
+	}
+	u.Path = sock + ":" + path
+	u.RawPath = ""
+	if rawPath != "" {
+		u.RawPath = sock + ":" + rawPath
+	}
+}
+
+// websocketTarget returns the dialer and URL for a handshake with u. For a
+// Unix URL the dialer connects to the socket and the URL is the ws:// or
+// wss:// equivalent with localhost as its host.
+func websocketTarget(dialer *websocket.Dialer, u *url.URL) (*websocket.Dialer, string) {
+	sock, ok := unixSocket(u)
+	if !ok {
+		return dialer, u.String()
+	}
+	target := *u
+	target.Scheme = strings.TrimSuffix(u.Scheme, "+unix")
+	target.Host = "localhost"
+	setHandshakePath(&target, handshakePath(u), "")
+	if _, rawPath, ok := strings.Cut(u.RawPath, ":"); ok {
+		target.RawPath = rawPath
+	}
+	if target.Path == "" {
+		target.Path = "/"
+	}
+	d := *dialer
+	d.NetDialContext = dialUnix(sock)
+	d.NetDialTLSContext = nil
+	return &d, target.String()
+}
+
+func dialUnix(sock string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", sock)
+	}
+}
+
+// ParseBackendURL parses a backend URL: ws://, wss://, or ws+unix:// and
+// wss+unix:// for a Unix domain socket. The path, query and fragment of a
+// TCP backend are dropped; the handshake path comes from the request.
+func ParseBackendURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws", "wss":
+		u.Path = ""
+	case "ws+unix", "wss+unix":
+		// The path names the socket; only the handshake path after it goes.
+		sock, _, _ := strings.Cut(u.Path, ":")
+		if sock == "" {
+			return nil, errors.New("backend socket path is empty")
+		}
+		u.Path = sock
+	default:
+		return nil, fmt.Errorf("backend scheme must be ws, wss, ws+unix or wss+unix, got %q", u.Scheme)
+	}
+	u.RawPath = ""
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u, nil
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDialUnixBackend(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	paths := make(chan string, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.RequestURI()
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mt, data, err := conn.ReadMessage()
+		if err == nil {
+			_ = conn.WriteMessage(mt, data)
+		}
+	}))
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	base, err := url.Parse("ws+unix://" + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := backendURLForRequest(base, httptest.NewRequest(http.MethodConnect, "/ws/chat?room=1", nil))
+	if want := "ws+unix://" + sock + ":/ws/chat?room=1"; u.String() != want {
+		t.Fatalf("backend URL: got %s want %s", u, want)
+	}
+
+	p := &Proxy{}
+	c, _, err := p.dialBackend(context.Background(), &websocket.Dialer{}, u, nil, &session{})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	if got := <-paths; got != "/ws/chat?room=1" {
+		t.Fatalf("handshake path: got %s", got)
+	}
+	if err := c.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := c.ReadMessage(); err != nil || string(data) != "hi" {
+		t.Fatalf("echo: %q %v", data, err)
+	}
+	if err := p.probe(context.Background(), &HealthCheck{}, u); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync/atomic"
+
+	"h3ws2h1ws-proxy/internal/usage"
+)
+
+const anonymousIdentity = "anonymous"
+
+// UsageIdentity picks the identity a session's traffic is accounted to.
+type UsageIdentity struct {
+	// Header carries the identity, e.g. an API key or a user ID set by an
+	// auth layer in front of the proxy. Without it the subject of the
+	// session's JWT is used.
+	Header string
+	// Hash records the first 16 hex digits of the value's SHA-256 instead
+	// of the value itself, so API keys do not end up in usage files.
+	Hash bool
+}
+
+func (u UsageIdentity) identity(r *http.Request) string {
+	v := ""
+	if u.Header != "" {
+		v = r.Header.Get(u.Header)
+	}
+	return u.label(v)
+}
+
+// label turns an identity value into the one recorded.
+func (u UsageIdentity) label(v string) string {
+	if v == "" {
+		return anonymousIdentity
+	}
+	if u.Hash {
+		sum := sha256.Sum256([]byte(v))
+		return hex.EncodeToString(sum[:8])
+	}
+	return v
+}
+
+func (st *sessionTrafficStats) usage() usage.Counters {
+	return usage.Counters{
+		BytesFromClient:    atomic.LoadUint64(&st.h3ToH1Bytes),
+		BytesToClient:      atomic.LoadUint64(&st.h1ToH3Bytes),
+		MessagesFromClient: atomic.LoadUint64(&st.h3ToH1Messages),
+		MessagesToClient:   atomic.LoadUint64(&st.h1ToH3Messages),
+	}
+}
@@ -0,0 +1,127 @@
+package app
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go/logging"
+
+	"h3ws2h1ws-proxy/internal/metrics"
+)
+
+// quicStats exports transport statistics of QUIC connections: packet
+// counters as they happen and, every interval, the RTT, congestion window
+// and path MTU of each open connection.
+type quicStats struct {
+	mu    sync.Mutex
+	conns map[*quicConnStats]struct{}
+}
+
+// quicConnStats is written by the connection's tracer callbacks and read by
+// the sampler.
+type quicConnStats struct {
+	smoothedRTT atomic.Int64
+	cwnd        atomic.Int64
+	mtu         atomic.Int64
+}
+
+func newQUICStats() *quicStats {
+	return &quicStats{conns: map[*quicConnStats]struct{}{}}
+}
+
+// tracer returns a connection tracer feeding the stats, combined with next
+// when that is not nil.
+func (q *quicStats) tracer(next func(context.Context, logging.Perspective, logging.ConnectionID) *logging.ConnectionTracer) func(context.Context, logging.Perspective, logging.ConnectionID) *logging.ConnectionTracer {
+	return func(ctx context.Context, p logging.Perspective, id logging.ConnectionID) *logging.ConnectionTracer {
+		t := q.connTracer()
+		if next != nil {
+			return logging.NewMultiplexedConnectionTracer(t, next(ctx, p, id))
+		}
+		return t
+	}
+}
+
+func (q *quicStats) connTracer() *logging.ConnectionTracer {
+	c := &quicConnStats{}
+	var once sync.Once
+	closed := func() {
+		once.Do(func() {
+			q.mu.Lock()
+			delete(q.conns, c)
+			q.mu.Unlock()
+			metrics.QUICConnections.Dec()
+		})
+	}
+	sent := metrics.QUICPackets.WithLabelValues("sent")
+	received := metrics.QUICPackets.WithLabelValues("received")
+	lost := metrics.QUICPackets.WithLabelValues("lost")
+	dropped := metrics.QUICPackets.WithLabelValues("dropped")
+	return &logging.ConnectionTracer{
+		StartedConnection: func(_, _ net.Addr, _, _ logging.ConnectionID) {
+			q.mu.Lock()
+			q.conns[c] = struct{}{}
+			q.mu.Unlock()
+			metrics.QUICConnections.Inc()
+		},
+		SentLongHeaderPacket: func(*logging.ExtendedHeader, logging.ByteCount, logging.ECN, *logging.AckFrame, []logging.Frame) {
+			sent.Inc()
+		},
+		SentShortHeaderPacket: func(*logging.ShortHeader, logging.ByteCount, logging.ECN, *logging.AckFrame, []logging.Frame) {
+			sent.Inc()
+		},
+		ReceivedLongHeaderPacket: func(*logging.ExtendedHeader, logging.ByteCount, logging.ECN, []logging.Frame) {
+			received.Inc()
+		},
+		ReceivedShortHeaderPacket: func(*logging.ShortHeader, logging.ByteCount, logging.ECN, []logging.Frame) {
+			received.Inc()
+		},
+		LostPacket: func(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+			lost.Inc()
+		},
+		DroppedPacket: func(logging.PacketType, logging.PacketNumber, logging.ByteCount, logging.PacketDropReason) {
+			dropped.Inc()
+		},
+		UpdatedMetrics: func(rtt *logging.RTTStats, cwnd, _ logging.ByteCount, _ int) {
+			c.smoothedRTT.Store(int64(rtt.SmoothedRTT()))
+			c.cwnd.Store(int64(cwnd))
+		},
+		UpdatedMTU: func(mtu logging.ByteCount, _ bool) {
+			c.mtu.Store(int64(mtu))
+		},
+		ClosedConnection: func(error) { closed() },
+		Close:            closed,
+	}
+}
+
+// sample observes every open connection once.
+func (q *quicStats) sample() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for c := range q.conns {
+		if rtt := c.smoothedRTT.Load(); rtt > 0 {
+			metrics.QUICSmoothedRTT.Observe(time.Duration(rtt).Seconds())
+		}
+		if cwnd := c.cwnd.Load(); cwnd > 0 {
+			metrics.QUICCongestionWindow.Observe(float64(cwnd))
+		}
+		if mtu := c.mtu.Load(); mtu > 0 {
+			metrics.QUICPathMTU.Observe(float64(mtu))
+		}
+	}
+}
+
+func (q *quicStats) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			q.sample()
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/logging"
+)
+
+func TestQUICStatsTracksOpenConnections(t *testing.T) {
+	q := newQUICStats()
+	var nextCalled bool
+	newTracer := q.tracer(func(context.Context, logging.Perspective, logging.ConnectionID) *logging.ConnectionTracer {
+		return &logging.ConnectionTracer{UpdatedMTU: func(logging.ByteCount, bool) { nextCalled = true }}
+	})
+	tr := newTracer(context.Background(), logging.PerspectiveServer, logging.ConnectionID{})
+	tr.StartedConnection(nil, nil, logging.ConnectionID{}, logging.ConnectionID{})
+
+	rtt := &logging.RTTStats{}
+	rtt.UpdateRTT(30*time.Millisecond, 0, time.Now())
+	tr.UpdatedMetrics(rtt, 64<<10, 0, 0)
+	tr.UpdatedMTU(1400, true)
+	if !nextCalled {
+		t.Error("the debug tracer was not called")
+	}
+	q.mu.Lock()
+	var c *quicConnStats
+	for k := range q.conns {
+		c = k
+	}
+	q.mu.Unlock()
+	if c == nil {
+		t.Fatal("started connection not tracked")
+	}
+	if got := time.Duration(c.smoothedRTT.Load()); got != 30*time.Millisecond || c.cwnd.Load() != 64<<10 || c.mtu.Load() != 1400 {
+		t.Errorf("stats rtt=%s cwnd=%d mtu=%d", got, c.cwnd.Load(), c.mtu.Load())
+	}
+	q.sample()
+
+	tr.ClosedConnection(nil)
+	tr.Close()
+	if len(q.conns) != 0 {
+		t.Errorf("%d connections still tracked after close", len(q.conns))
+	}
+}
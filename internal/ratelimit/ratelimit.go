@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Decision is the outcome of a single Allow call. Limit is the bucket size,
+// Remaining the whole tokens left after this call and RetryAfter how long to
+// wait until the next token is available (zero when allowed).
+type Decision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+}
+
+type Limiter interface {
+	Allow(ctx context.Context, key string) (Decision, error)
+}
+
+// Stats is a snapshot of a limiter's settings and the number of keys it is
+// tracking, for debug endpoints.
+type Stats struct {
+	Kind  string  `json:"kind"`
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+	Keys  int     `json:"keys"`
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Local is an in-process token bucket limiter keyed by an arbitrary string.
+type Local struct {
+	rate  float64
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewLocal(rate float64, burst int) *Local {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Local{rate: rate, burst: burst, buckets: make(map[string]*bucket), now: time.Now}
+}
+
+func (l *Local) Allow(_ context.Context, key string) (Decision, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	d := Decision{Limit: l.burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	d.Remaining = int(b.tokens)
+	return d, nil
+}
+
+func (l *Local) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Stats{Kind: "local", Rate: l.rate, Burst: l.burst, Keys: len(l.buckets)}
+}
+
+// sweep drops buckets that have refilled completely, so idle keys (client
+// IPs) do not accumulate forever.
+func (l *Local) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, k)
+		}
+	}
+}
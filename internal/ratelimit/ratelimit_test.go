@@ -0,0 +1,160 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLocalTokenBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewLocal(1, 2)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if d, _ := l.Allow(context.Background(), "1.2.3.4"); !d.Allowed {
+			t.Fatalf("request %d should be allowed within burst", i)
+		}
+	}
+	d, _ := l.Allow(context.Background(), "1.2.3.4")
+	if d.Allowed {
+		t.Fatal("request beyond burst should be rejected")
+	}
+	if d.RetryAfter <= 0 || d.RetryAfter > time.Second {
+		t.Fatalf("unexpected retry-after: %s", d.RetryAfter)
+	}
+	if d, _ := l.Allow(context.Background(), "5.6.7.8"); !d.Allowed {
+		t.Fatal("other keys must have their own bucket")
+	}
+
+	now = now.Add(time.Second)
+	if d, _ := l.Allow(context.Background(), "1.2.3.4"); !d.Allowed {
+		t.Fatal("bucket should refill over time")
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("*3\r\n:1\r\n$3\r\nfoo\r\n+OK\r\n-ERR boom\r\n"))
+	v, err := readReply(br)
+	if err != nil {
+		t.Fatalf("read array: %v", err)
+	}
+	vals := v.([]any)
+	if vals[0].(int64) != 1 || vals[1].(string) != "foo" || vals[2].(string) != "OK" {
+		t.Fatalf("unexpected array reply: %#v", vals)
+	}
+	if _, err := readReply(br); err == nil || !strings.Contains(err.Error(), "ERR boom") {
+		t.Fatalf("expected redis error, got %v", err)
+	}
+}
+
+func TestRedisLimiterLeasesTokensLocally(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	var evals int32
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := readReply(br); err != nil {
+				return
+			}
+			// Grant three tokens on the first call, none afterwards.
+			if atomic.AddInt32(&evals, 1) == 1 {
+				_, _ = conn.Write([]byte("*3\r\n:3\r\n:7\r\n:0\r\n"))
+			} else {
+				_, _ = conn.Write([]byte("*3\r\n:0\r\n:0\r\n:250\r\n"))
+			}
+		}
+	}()
+
+	client, err := NewRedisClient("redis://"+ln.Addr().String()+"/0", time.Second)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	defer client.Close()
+	l := NewRedis(client, "test:", 10, 10, 3, func(err error) { t.Errorf("unexpected redis error: %v", err) })
+
+	for i := 0; i < 3; i++ {
+		if d, _ := l.Allow(context.Background(), "k"); !d.Allowed {
+			t.Fatalf("request %d should be served from the lease", i)
+		}
+	}
+	if got := atomic.LoadInt32(&evals); got != 1 {
+		t.Fatalf("redis round trips: got %d want 1", got)
+	}
+	d, _ := l.Allow(context.Background(), "k")
+	if d.Allowed || d.RetryAfter != 250*time.Millisecond {
+		t.Fatalf("expected rejection with 250ms retry-after, got %+v", d)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	now := time.Unix(1000, 0)
+	th := NewThrottle(100, 100)
+	th.now = func() time.Time { return now }
+	th.last = now
+
+	if d := th.reserve(100); d != 0 {
+		t.Fatalf("burst should pass without waiting, got %s", d)
+	}
+	if d := th.reserve(50); d != 500*time.Millisecond {
+		t.Fatalf("wait = %s, want 500ms", d)
+	}
+	// A take beyond the burst goes into debt instead of blocking forever.
+	now = now.Add(500 * time.Millisecond)
+	if d := th.reserve(300); d != 3*time.Second {
+		t.Fatalf("wait = %s, want 3s", d)
+	}
+}
+
+func TestShaperInterleavesStreams(t *testing.T) {
+	// 64 kB/s with a 64 kB burst: a 256 kB message alone would take the
+	// shaper for three seconds, yet a small message queued after it gets
+	// through once the quantum in flight is paid for.
+	s := NewShaper(64 << 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Wait(ctx, 64<<10); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.Wait(ctx, 256<<10) }()
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	if err := s.Wait(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("small message waited %s behind a large one", elapsed)
+	}
+}
+
+func TestRedisLimiterSweepsExpiredLeases(t *testing.T) {
+	now := time.Now()
+	l := NewRedis(nil, "test:", 10, 10, 3, nil)
+	l.now = func() time.Time { return now }
+	for i := 0; i < 100; i++ {
+		l.leases[strconv.Itoa(i)] = &lease{tokens: 2, expires: now.Add(-time.Millisecond)}
+	}
+	l.leases["live"] = &lease{tokens: 2, expires: now.Add(leaseTTL)}
+
+	if d, _ := l.Allow(context.Background(), "live"); !d.Allowed {
+		t.Fatal("request should be served from the live lease")
+	}
+	if got := l.Stats().Keys; got != 1 {
+		t.Fatalf("leases after sweep: got %d want 1", got)
+	}
+}
@@ -0,0 +1,333 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucketScript refills the bucket from Redis server time and grants up
+// to ARGV[3] tokens at once. It returns {granted, remaining, wait_ms}.
+const tokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local want = tonumber(ARGV[3])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+local granted = math.min(want, math.floor(tokens))
+tokens = tokens - granted
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+local wait = 0
+if granted < 1 then wait = math.ceil((1 - tokens) / rate * 1000) end
+return {granted, math.floor(tokens), wait}
+`
+
+// leaseTTL bounds how long locally cached tokens stay usable, which bounds
+// how far instances can overshoot the shared rate.
+const leaseTTL = time.Second
+
+type lease struct {
+	tokens  int
+	expires time.Time
+}
+
+// Redis is a token bucket limiter whose state lives in Redis, so every
+// instance behind a load balancer enforces the same limit. To save round
+// trips it leases up to Batch tokens per call and spends them locally.
+// When Redis is unreachable it degrades to the Fallback limiter.
+type Redis struct {
+	client   *RedisClient
+	prefix   string
+	rate     float64
+	burst    int
+	batch    int
+	fallback Limiter
+	onError  func(error)
+
+	mu        sync.Mutex
+	leases    map[string]*lease
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewRedis(client *RedisClient, prefix string, rate float64, burst, batch int, onError func(error)) *Redis {
+	if burst < 1 {
+		burst = 1
+	}
+	if batch < 1 {
+		batch = 1
+	}
+	if batch > burst {
+		batch = burst
+	}
+	return &Redis{
+		client:   client,
+		prefix:   prefix,
+		rate:     rate,
+		burst:    burst,
+		batch:    batch,
+		fallback: NewLocal(rate, burst),
+		onError:  onError,
+		leases:   make(map[string]*lease),
+		now:      time.Now,
+	}
+}
+
+func (r *Redis) Allow(ctx context.Context, key string) (Decision, error) {
+	now := r.now()
+	r.mu.Lock()
+	r.sweep(now)
+	if l, ok := r.leases[key]; ok && l.tokens > 0 && now.Before(l.expires) {
+		l.tokens--
+		remaining := l.tokens
+		r.mu.Unlock()
+		return Decision{Allowed: true, Limit: r.burst, Remaining: remaining}, nil
+	}
+	delete(r.leases, key)
+	r.mu.Unlock()
+
+	reply, err := r.client.Do(ctx, "EVAL", tokenBucketScript, "1", r.prefix+key,
+		strconv.FormatFloat(r.rate, 'f', -1, 64), strconv.Itoa(r.burst), strconv.Itoa(r.batch))
+	if err != nil {
+		if r.onError != nil {
+			r.onError(err)
+		}
+		return r.fallback.Allow(ctx, key)
+	}
+	vals, ok := reply.([]any)
+	if !ok || len(vals) != 3 {
+		err := fmt.Errorf("unexpected redis reply %T", reply)
+		if r.onError != nil {
+			r.onError(err)
+		}
+		return r.fallback.Allow(ctx, key)
+	}
+	granted, _ := vals[0].(int64)
+	remaining, _ := vals[1].(int64)
+	waitMs, _ := vals[2].(int64)
+
+	d := Decision{Limit: r.burst, Remaining: int(remaining)}
+	if granted < 1 {
+		d.RetryAfter = time.Duration(waitMs) * time.Millisecond
+		return d, nil
+	}
+	d.Allowed = true
+	if granted > 1 {
+		r.mu.Lock()
+		r.leases[key] = &lease{tokens: int(granted) - 1, expires: now.Add(leaseTTL)}
+		r.mu.Unlock()
+		d.Remaining += int(granted) - 1
+	}
+	return d, nil
+}
+
+// sweep drops expired leases, which are otherwise only replaced when their
+// key comes back, so one-off keys (client IPs) do not accumulate.
+func (r *Redis) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < leaseTTL {
+		return
+	}
+	r.lastSweep = now
+	for k, l := range r.leases {
+		if !now.Before(l.expires) {
+			delete(r.leases, k)
+		}
+	}
+}
+
+// Stats reports the locally held leases as Keys.
+func (r *Redis) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Stats{Kind: "redis", Rate: r.rate, Burst: r.burst, Keys: len(r.leases)}
+}
+
+// RedisClient is a minimal RESP2 client with a single lazily (re)established
+// connection. Commands are serialized, which is fine for handshake-rate
+// traffic.
+type RedisClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// NewRedisClient accepts redis://[:password@]host:port[/db] or a bare
+// host:port.
+func NewRedisClient(rawURL string, timeout time.Duration) (*RedisClient, error) {
+	c := &RedisClient{timeout: timeout}
+	if !strings.Contains(rawURL, "://") {
+		c.addr = rawURL
+		return c, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported redis scheme %q", u.Scheme)
+	}
+	c.addr = u.Host
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("bad redis db %q", db)
+		}
+	}
+	return c, nil
+}
+
+func (c *RedisClient) Do(ctx context.Context, args ...string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.roundTrip(ctx, args)
+	if err != nil {
+		var re redisError
+		if !errors.As(err, &re) {
+			_ = c.conn.Close()
+			c.conn = nil
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *RedisClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+func (c *RedisClient) connect(ctx context.Context) error {
+	d := net.Dialer{Timeout: c.timeout}
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.br = bufio.NewReader(conn)
+	if c.password != "" {
+		if _, err := c.roundTrip(ctx, []string{"AUTH", c.password}); err != nil {
+			_ = conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	if c.db != 0 {
+		if _, err := c.roundTrip(ctx, []string{"SELECT", strconv.Itoa(c.db)}); err != nil {
+			_ = conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *RedisClient) roundTrip(ctx context.Context, args []string) (any, error) {
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(encodeCommand(args)); err != nil {
+		return nil, err
+	}
+	return readReply(c.br)
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func encodeCommand(args []string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return []byte(b.String())
+}
+
+func readReply(br *bufio.Reader) (any, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed redis reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		vals := make([]any, n)
+		for i := range vals {
+			if vals[i], err = readReply(br); err != nil {
+				return nil, err
+			}
+		}
+		return vals, nil
+	default:
+		return nil, fmt.Errorf("unknown redis reply type %q", kind)
+	}
+}
@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Throttle paces byte streams to rate bytes per second with bursts of up to
+// burst bytes. It is safe for concurrent use, so streams sharing one
+// Throttle share its rate.
+type Throttle struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func NewThrottle(rate float64, burst int) *Throttle {
+	burst = max(burst, 1)
+	return &Throttle{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now(), now: time.Now}
+}
+
+// Wait takes n bytes from the bucket and sleeps until they are covered or
+// ctx is done.
+func (t *Throttle) Wait(ctx context.Context, n int) error {
+	d := t.reserve(n)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// reserve takes n bytes and returns how long the caller has to wait for
+// them. Takes larger than the bucket leave it in debt that later takes pay
+// off, so the rate holds for messages of any size.
+func (t *Throttle) reserve(n int) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.tokens = min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+	t.tokens -= float64(n)
+	if t.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-t.tokens / t.rate * float64(time.Second))
+}
+
+// shaperQuantum is the most a Shaper grants one caller at a time.
+const shaperQuantum = 16 << 10
+
+// Shaper is a Throttle shared by many streams that queues them fairly: it
+// hands out at most shaperQuantum bytes per take, so a large message waits
+// its turn behind the small ones that arrived meanwhile instead of holding
+// the whole rate until it is through.
+type Shaper struct {
+	t *Throttle
+}
+
+// NewShaper returns a Shaper for rate bytes per second with one second of
+// burst.
+func NewShaper(rate int64) *Shaper {
+	return &Shaper{t: NewThrottle(float64(rate), int(rate))}
+}
+
+// Wait blocks until n bytes may pass or ctx is done.
+func (s *Shaper) Wait(ctx context.Context, n int) error {
+	for n > 0 {
+		c := min(n, shaperQuantum)
+		if err := s.t.Wait(ctx, c); err != nil {
+			return err
+		}
+		n -= c
+	}
+	return nil
+}
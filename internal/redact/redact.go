@@ -0,0 +1,120 @@
+// Package redact masks sensitive values in message payloads before they are
+// written anywhere for observability.
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Mask replaces every redacted value.
+const Mask = "[REDACTED]"
+
+// Redactor applies JSON field and regexp rules to payloads. A nil Redactor
+// returns payloads unchanged.
+type Redactor struct {
+	fields   [][]string
+	patterns []*regexp.Regexp
+}
+
+// New builds a Redactor. A field without dots ("password") matches that key
+// at any depth; a dotted path ("user.card.number") is anchored at the root
+// and "*" matches any key or array element.
+func New(fields []string, patterns []*regexp.Regexp) *Redactor {
+	if len(fields) == 0 && len(patterns) == 0 {
+		return nil
+	}
+	r := &Redactor{patterns: patterns}
+	for _, f := range fields {
+		r.fields = append(r.fields, strings.Split(f, "."))
+	}
+	return r
+}
+
+// Apply returns payload with the rules applied. Field rules only take effect
+// when payload is a complete JSON document.
+func (r *Redactor) Apply(payload []byte) []byte {
+	if r == nil {
+		return payload
+	}
+	out := payload
+	if len(r.fields) > 0 {
+		out = r.redactJSON(out)
+	}
+	for _, re := range r.patterns {
+		out = re.ReplaceAll(out, []byte(Mask))
+	}
+	return out
+}
+
+func (r *Redactor) redactJSON(payload []byte) []byte {
+	var doc any
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil || dec.More() {
+		return payload
+	}
+	changed := false
+	for _, path := range r.fields {
+		if len(path) == 1 {
+			changed = redactKey(doc, path[0]) || changed
+		} else {
+			doc = redactPath(doc, path, &changed)
+		}
+	}
+	if !changed {
+		return payload
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return payload
+	}
+	return out
+}
+
+// redactKey masks key wherever it appears in v.
+func redactKey(v any, key string) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if k == key {
+				v[k] = Mask
+				changed = true
+				continue
+			}
+			changed = redactKey(child, key) || changed
+		}
+	case []any:
+		for _, child := range v {
+			changed = redactKey(child, key) || changed
+		}
+	}
+	return changed
+}
+
+func redactPath(v any, path []string, changed *bool) any {
+	if len(path) == 0 {
+		*changed = true
+		return Mask
+	}
+	seg, rest := path[0], path[1:]
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if seg == "*" || seg == k {
+				v[k] = redactPath(child, rest, changed)
+			}
+		}
+	case []any:
+		for i, child := range v {
+			if seg == "*" || seg == strconv.Itoa(i) {
+				v[i] = redactPath(child, rest, changed)
+			}
+		}
+	}
+	return v
+}
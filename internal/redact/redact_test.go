@@ -0,0 +1,29 @@
+package redact
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	r := New(
+		[]string{"password", "user.cards.*.number"},
+		[]*regexp.Regexp{regexp.MustCompile(`[\w.]+@[\w.]+`)},
+	)
+	cases := []struct{ in, want string }{
+		{`{"login":"a","password":"p"}`, `{"login":"a","password":"[REDACTED]"}`},
+		{`{"nested":[{"password":1}]}`, `{"nested":[{"password":"[REDACTED]"}]}`},
+		{`{"user":{"cards":[{"number":"4111","exp":"12/30"}]}}`, `{"user":{"cards":[{"exp":"12/30","number":"[REDACTED]"}]}}`},
+		{`{"cards":[{"number":"4111"}]}`, `{"cards":[{"number":"4111"}]}`},
+		{`mail bob@example.com now`, `mail [REDACTED] now`},
+		{`{"password":"p"`, `{"password":"p"`},
+	}
+	for _, c := range cases {
+		if got := string(r.Apply([]byte(c.in))); got != c.want {
+			t.Errorf("Apply(%s) = %s, want %s", c.in, got, c.want)
+		}
+	}
+	if got := string((*Redactor)(nil).Apply([]byte("x"))); got != "x" {
+		t.Errorf("nil redactor changed payload: %s", got)
+	}
+}
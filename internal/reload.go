@@ -0,0 +1,73 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/metrics"
+	"h3ws2h1ws-proxy/internal/proxy"
+)
+
+// watchReloads calls reload on every SIGHUP until ctx is done.
+func watchReloads(ctx context.Context, reload func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		if err := reload(); err != nil {
+			metrics.ConfigReloads.WithLabelValues("sighup", "invalid").Inc()
+			slog.Error("config reload failed, keeping the current config", "err", err)
+			continue
+		}
+		metrics.ConfigReloads.WithLabelValues("sighup", "applied").Inc()
+		slog.Info("config reloaded")
+	}
+}
+
+// reloadConfig parses args and re-reads the -config file, then applies the
+// backend URL, limits, structured settings and, unless ACME manages it
+// (certs is nil), the certificate. New sessions
+// use them; running sessions keep the settings they were accepted with.
+// Other flags, such as listen addresses, need a restart. With -config-url
+// the remote document stays in charge of the structured settings. Admin API
+// changes are re-applied on top either way.
+func reloadConfig(args []string, started config.Config, store *configStore, certs certSet, newLimiter limiterFactory) error {
+	next, err := config.Load(args)
+	if err != nil {
+		return err
+	}
+	backendURL, err := proxy.ParseBackendURL(next.BackendWS)
+	if err != nil {
+		return fmt.Errorf("bad -backend: %w", err)
+	}
+	var pairs []certPair
+	if certs != nil {
+		if pairs, err = loadCertPairs(next.CertFile, next.KeyFile); err != nil {
+			return fmt.Errorf("load TLS certificate: %w", err)
+		}
+		if len(pairs) != len(certs) {
+			return fmt.Errorf("%d certificates configured, %d loaded at startup: changing the number needs a restart", len(pairs), len(certs))
+		}
+	}
+	structured := next.Structured
+	if started.ConfigURL != "" {
+		structured = store.sourceFile()
+	}
+	if err := store.reset(runtimeBuilder(next, backendURL, newLimiter), structured); err != nil {
+		return err
+	}
+	if certs != nil {
+		certs.set(pairs)
+	}
+	return nil
+}
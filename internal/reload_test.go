@@ -0,0 +1,176 @@
+package app
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	"h3ws2h1ws-proxy/internal/proxy"
+	"h3ws2h1ws-proxy/internal/ratelimit"
+)
+
+// writeTestCert writes a self-signed certificate for cn to dir and returns
+// the cert and key paths.
+func writeTestCert(t *testing.T, dir, cn string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, cn+".crt"), filepath.Join(dir, cn+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	oldCert, oldKey := writeTestCert(t, dir, "old")
+	newCert, newKey := writeTestCert(t, dir, "new")
+	configFile := filepath.Join(dir, "proxy.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(configFile, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("backend: ws://old:8080\nmax-conns: 10\ncert: " + oldCert + "\nkey: " + oldKey + "\n")
+	args := []string{"-config", configFile, "-read-timeout", "5s"}
+
+	started, err := config.Load(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newLimiter := func(_ string, rate float64, burst int) ratelimit.Limiter { return ratelimit.NewLocal(rate, burst) }
+	backend, _ := proxy.ParseBackendURL(started.BackendWS)
+	p := &proxy.Proxy{}
+	store := newConfigStore(p, runtimeBuilder(started, backend, newLimiter))
+	if err := store.replace(started.Structured); err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := loadCertPairs(started.CertFile, started.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := newCertSet(pairs)
+
+	write("backend: ws://new:9090\nmax-conns: 20\ncert: " + newCert + "\nkey: " + newKey + "\n" +
+		"routes:\n  - name: chat\n    path: ^/chat$\n")
+	if err := reloadConfig(args, started, store, certs, newLimiter); err != nil {
+		t.Fatal(err)
+	}
+	rt := p.RuntimeConfig()
+	if rt.Backend.String() != "ws://new:9090" || rt.Limits.MaxConns != 20 || rt.Limits.ReadTimeout != 5*time.Second {
+		t.Errorf("after reload: backend=%s max_conns=%d read_timeout=%s", rt.Backend, rt.Limits.MaxConns, rt.Limits.ReadTimeout)
+	}
+	if len(rt.Routes) != 1 || rt.Routes[0].Name != "chat" {
+		t.Errorf("routes after reload: %+v", rt.Routes)
+	}
+	if file, leaf := certs[0].current(); file != newCert || leaf.Subject.CommonName != "new" {
+		t.Errorf("certificate after reload: %s %q", file, leaf.Subject.CommonName)
+	}
+
+	// A broken file leaves everything as it was.
+	write("backend: ftp://nope\n")
+	if err := reloadConfig(args, started, store, certs, newLimiter); err == nil {
+		t.Fatal("reload of an invalid config succeeded")
+	}
+	if p.RuntimeConfig() != rt {
+		t.Error("failed reload replaced the runtime config")
+	}
+	if file, _ := certs[0].current(); file != newCert {
+		t.Errorf("failed reload replaced the certificate with %s", file)
+	}
+}
+
+func TestWatchCertFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "old")
+	cert, leaf, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := &certHolder{}
+	certs.set(certFile, keyFile, cert, leaf)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchCertFiles(ctx, certs, 10*time.Millisecond)
+
+	// Renewal tools replace both files; the pair is picked up once it loads.
+	newCert, newKey := writeTestCert(t, dir, "new")
+	if err := os.Rename(newCert, certFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(newKey, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		file, leaf := certs.current()
+		if file == certFile && leaf.Subject.CommonName == "new" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate not reloaded: %s %q", file, leaf.Subject.CommonName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCertSetSelectsBySNI(t *testing.T) {
+	dir := t.TempDir()
+	aCert, aKey := writeTestCert(t, dir, "a.example.com")
+	bCert, bKey := writeTestCert(t, dir, "b.example.com")
+	if _, err := loadCertPairs(aCert+","+bCert, aKey); err == nil {
+		t.Fatal("mismatched -cert/-key lists accepted")
+	}
+	pairs, err := loadCertPairs(aCert+", "+bCert, aKey+", "+bKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := newCertSet(pairs)
+	for sni, want := range map[string]string{"a.example.com": "a.example.com", "b.example.com": "b.example.com", "": "a.example.com", "other.example.com": "a.example.com"} {
+		hello := &tls.ClientHelloInfo{
+			ServerName:        sni,
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedVersions: []uint16{tls.VersionTLS13},
+		}
+		cert, err := certs.getCertificate(hello)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.Leaf.Subject.CommonName != want {
+			t.Errorf("SNI %q got %q, want %q", sni, cert.Leaf.Subject.CommonName, want)
+		}
+	}
+}
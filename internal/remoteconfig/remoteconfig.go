@@ -0,0 +1,231 @@
+package remoteconfig
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const maxDocumentSize = 8 << 20
+
+// S3 describes an S3-compatible endpoint. Requests are path-style
+// (endpoint/bucket/key) and signed with SigV4 when credentials are set.
+type S3 struct {
+	Endpoint     string
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// S3FromEnv fills credentials from the usual AWS_* variables.
+func S3FromEnv(endpoint, region string) *S3 {
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	return &S3{
+		Endpoint:     strings.TrimRight(endpoint, "/"),
+		Region:       region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// Fetcher downloads a config document from an https:// URL or an
+// s3://bucket/key object, using the ETag to skip unchanged documents and,
+// for servers that send none, a hash of the body.
+type Fetcher struct {
+	URL    string
+	S3     *S3
+	Client *http.Client
+
+	// etag and sum identify the last applied document; nextETag and
+	// nextSum the last one fetched, until Commit adopts them.
+	etag     string
+	sum      [sha256.Size]byte
+	nextETag string
+	nextSum  [sha256.Size]byte
+	now      func() time.Time
+}
+
+// Fetch returns the document and true when it differs from the last
+// committed one, or nil and false when the server answered 304 or sent the
+// same document again. Call Commit once a changed document is applied, so
+// one that failed to apply is offered again by the next Fetch.
+func (f *Fetcher) Fetch(ctx context.Context) ([]byte, bool, error) {
+	req, err := f.newRequest(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	client := f.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, false, nil
+	case http.StatusOK:
+	default:
+		return nil, false, fmt.Errorf("fetch %s: unexpected status %s", f.URL, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDocumentSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(data) > maxDocumentSize {
+		return nil, false, fmt.Errorf("fetch %s: document larger than %d bytes", f.URL, maxDocumentSize)
+	}
+	etag := resp.Header.Get("ETag")
+	sum := sha256.Sum256(data)
+	if (etag != "" && etag == f.etag) || sum == f.sum {
+		f.etag = etag
+		return nil, false, nil
+	}
+	f.nextETag, f.nextSum = etag, sum
+	return data, true, nil
+}
+
+// Commit records the document last returned by Fetch as applied.
+func (f *Fetcher) Commit() {
+	f.etag, f.sum = f.nextETag, f.nextSum
+}
+
+func (f *Fetcher) newRequest(ctx context.Context) (*http.Request, error) {
+	u, err := url.Parse(f.URL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "https", "http":
+		return http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
+	case "s3":
+		if f.S3 == nil {
+			return nil, errors.New("s3 config URL requires S3 settings")
+		}
+		target := f.S3.Endpoint + "/" + u.Host + "/" + strings.TrimPrefix(u.Path, "/")
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now
+		if f.now != nil {
+			now = f.now
+		}
+		f.S3.sign(req, now().UTC())
+		return req, nil
+	default:
+		return nil, fmt.Errorf("unsupported config URL scheme %q", u.Scheme)
+	}
+}
+
+func (s *S3) sign(req *http.Request, now time.Time) {
+	if s.AccessKey == "" || s.SecretKey == "" {
+		return
+	}
+	const payloadHash = "UNSIGNED-PAYLOAD"
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.SessionToken)
+		signed = append(signed, "x-amz-security-token")
+	}
+
+	var canonHeaders strings.Builder
+	for _, h := range signed {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		canonHeaders.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Poll fetches the document every interval (which must be positive) and
+// hands changed documents to apply. Fetch and apply errors are logged and
+// reported through onResult; the previous config stays in effect and a
+// document that failed to apply is retried on the next poll.
+func Poll(ctx context.Context, f *Fetcher, interval time.Duration, apply func([]byte) error, onResult func(result string)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		data, changed, err := f.Fetch(ctx)
+		switch {
+		case err != nil:
+			slog.Error("remote config fetch failed", "err", err)
+			onResult("fetch_error")
+		case !changed:
+			onResult("unchanged")
+		default:
+			if err := apply(data); err != nil {
+				slog.Error("remote config rejected, keeping previous config", "err", err)
+				onResult("invalid")
+				continue
+			}
+			f.Commit()
+			slog.Info("remote config applied", "url", f.URL)
+			onResult("applied")
+		}
+	}
+}
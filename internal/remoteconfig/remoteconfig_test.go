@@ -0,0 +1,131 @@
+package remoteconfig
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetcherUsesETag(t *testing.T) {
+	body := `{"tenants":[]}`
+	etag := `"v1"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	f := &Fetcher{URL: srv.URL + "/config.json"}
+	data, changed, err := f.Fetch(context.Background())
+	if err != nil || !changed || string(data) != body {
+		t.Fatalf("first fetch: data=%q changed=%v err=%v", data, changed, err)
+	}
+	f.Commit()
+	if _, changed, err := f.Fetch(context.Background()); err != nil || changed {
+		t.Fatalf("second fetch should be unchanged: changed=%v err=%v", changed, err)
+	}
+
+	etag = `"v2"`
+	body = `{"tenants":[{"name":"a","sni":["a.example.com"]}]}`
+	data, changed, err = f.Fetch(context.Background())
+	if err != nil || !changed || string(data) != body {
+		t.Fatalf("fetch after update: data=%q changed=%v err=%v", data, changed, err)
+	}
+}
+
+func TestFetcherSignsS3Requests(t *testing.T) {
+	var gotPath, gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	f := &Fetcher{
+		URL: "s3://configs/edge/proxy.json",
+		S3:  &S3{Endpoint: srv.URL, Region: "eu-west-1", AccessKey: "AKID", SecretKey: "secret"},
+		now: func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) },
+	}
+	if _, _, err := f.Fetch(context.Background()); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if gotPath != "/configs/edge/proxy.json" {
+		t.Fatalf("path-style object path: got %q", gotPath)
+	}
+	if !strings.HasPrefix(gotAuth, "AWS4-HMAC-SHA256 Credential=AKID/20240501/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+		t.Fatalf("unexpected authorization header: %q", gotAuth)
+	}
+}
+
+func TestFetcherSkipsUnchangedBodyWithoutETag(t *testing.T) {
+	body := `{"tenants":[]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	f := &Fetcher{URL: srv.URL + "/config.json"}
+	if _, changed, err := f.Fetch(context.Background()); err != nil || !changed {
+		t.Fatalf("first fetch: changed=%v err=%v", changed, err)
+	}
+	f.Commit()
+	if _, changed, err := f.Fetch(context.Background()); err != nil || changed {
+		t.Fatalf("same body should be unchanged: changed=%v err=%v", changed, err)
+	}
+	body = `{"tenants":[{"name":"a"}]}`
+	if data, changed, err := f.Fetch(context.Background()); err != nil || !changed || string(data) != body {
+		t.Fatalf("fetch after update: data=%q changed=%v err=%v", data, changed, err)
+	}
+}
+
+func TestPollRetriesDocumentThatFailedToApply(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := &Fetcher{URL: srv.URL + "/config.json"}
+	attempts := 0
+	results := make(chan string, 16)
+	go Poll(ctx, f, 5*time.Millisecond, func([]byte) error {
+		// The first apply fails, e.g. a referenced file is not there yet.
+		if attempts++; attempts == 1 {
+			return errors.New("descriptor not found")
+		}
+		return nil
+	}, func(result string) {
+		select {
+		case results <- result:
+		default:
+		}
+	})
+
+	var got []string
+	for len(got) < 3 {
+		select {
+		case r := <-results:
+			got = append(got, r)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("poll results = %v", got)
+		}
+	}
+	if want := []string{"invalid", "applied", "unchanged"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("poll results = %v, want %v", got, want)
+	}
+}
@@ -1,26 +1,37 @@
 package app
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"log/slog"
+	"maps"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"h3ws2h1ws-proxy/internal/config"
 	"h3ws2h1ws-proxy/internal/metrics"
 	"h3ws2h1ws-proxy/internal/proxy"
+	"h3ws2h1ws-proxy/internal/ratelimit"
+	"h3ws2h1ws-proxy/internal/redact"
+	"h3ws2h1ws-proxy/internal/remoteconfig"
+	"h3ws2h1ws-proxy/internal/schema"
+	"h3ws2h1ws-proxy/internal/sockopt"
+	"h3ws2h1ws-proxy/internal/usage"
+	"h3ws2h1ws-proxy/internal/ws"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/quic-go/quic-go"
@@ -28,39 +39,108 @@ import (
 	"github.com/quic-go/quic-go/logging"
 )
 
-func Run() error {
-	cfg := parseConfig()
+// Run runs the serve command: it starts the proxy with the flags in args
+// and returns once it has shut down, after SIGINT or SIGTERM or once ctx
+// is done.
+func Run(ctx context.Context, args []string) error {
+	cfg := parseConfig(args)
+	logLevel, err := setupLogging(cfg, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	version, commit, goVersion := buildInfo()
+	slog.Info("starting", "version", version, "commit", commit, "go", goVersion)
+	metrics.BuildInfo.WithLabelValues(version, commit, goVersion).Set(1)
 
-	backendURL, err := url.Parse(cfg.BackendWS)
+	backendURL, err := proxy.ParseBackendURL(cfg.BackendWS)
 	if err != nil {
 		return fmt.Errorf("bad -backend: %w", err)
 	}
-	if backendURL.Scheme != "ws" && backendURL.Scheme != "wss" {
-		return fmt.Errorf("backend scheme must be ws or wss, got %q", backendURL.Scheme)
+	// Everything started below stops with ctx or is shut down on return,
+	// so an embedder can run the proxy again in the same process.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.MetricsAddr == "" {
+		slog.Info("metrics disabled (use -metrics to enable)")
+		if cfg.ExpVar {
+			return errors.New("-expvar requires -metrics")
+		}
+		if cfg.Pprof {
+			return errors.New("-pprof requires -metrics")
+		}
+	}
+	if cfg.GopsAddr != "" {
+		if err := startGops(cfg.GopsAddr); err != nil {
+			return fmt.Errorf("gops agent: %w", err)
+		}
+		slog.Info("gops agent listening", "addr", cfg.GopsAddr)
 	}
-	backendURL.Path = ""
-	backendURL.RawPath = ""
-	backendURL.RawQuery = ""
-	backendURL.Fragment = ""
 
+	newLimiter, err := rateLimiterFactory(cfg)
+	if err != nil {
+		return fmt.Errorf("bad -rate-limit-redis: %w", err)
+	}
+	p, err := newProxy(cfg, backendURL, newLimiter)
+	if err != nil {
+		return err
+	}
+	p.LogLevel = logLevel
+	store := newConfigStore(p, runtimeBuilder(cfg, backendURL, newLimiter))
+	if err := store.replace(cfg.Structured); err != nil {
+		return err
+	}
+	if cfg.ExpVar {
+		publishDebugVars(cfg, store)
+	}
 	if cfg.MetricsAddr != "" {
-		startMetricsServer(cfg.MetricsAddr)
-	} else {
-		log.Printf("metrics disabled (use -metrics to enable)")
+		srv, err := startMetricsServer(cfg.MetricsAddr, p.Ready, cfg.ExpVar, cfg.Pprof)
+		if err != nil {
+			return fmt.Errorf("metrics server: %w", err)
+		}
+		defer stopTCPServer(srv, cfg.GoAwayTimeout)
+	}
+	if cfg.ConfigURL != "" {
+		if err := startRemoteConfig(ctx, cfg, store); err != nil {
+			return fmt.Errorf("remote config: %w", err)
+		}
 	}
+	if cfg.AdminAddr != "" {
+		srv, err := startAdminServer(cfg, store)
+		if err != nil {
+			return fmt.Errorf("admin server: %w", err)
+		}
+		defer stopTCPServer(srv, cfg.GoAwayTimeout)
+	}
+	var usageDone <-chan struct{}
+	p.Usage, usageDone = startUsageExport(ctx, cfg)
+	p.UsageIdentity = proxy.UsageIdentity{Header: cfg.UsageIdentityHeader, Hash: cfg.UsageIdentityHash}
+	if p.Auth, err = startAuth(ctx, cfg); err != nil {
+		return fmt.Errorf("bad -jwt settings: %w", err)
+	}
+	accessLog, accessLogFile, err := openAccessLog(cfg)
+	if err != nil {
+		return fmt.Errorf("bad -access-log settings: %w", err)
+	}
+	if accessLogFile != nil {
+		defer accessLogFile.Close()
+	}
+	p.AccessLog = accessLog
 
-	p := &proxy.Proxy{
-		Backend:    backendURL,
-		PathRegexp: cfg.PathRegexp,
-		Debug:      cfg.Debug,
-		Limits: config.Limits{
-			MaxFrameSize:   cfg.MaxFrame,
-			MaxMessageSize: cfg.MaxMessage,
-			MaxConns:       cfg.MaxConns,
-			ReadTimeout:    cfg.ReadTimeout,
-			WriteTimeout:   cfg.WriteTimeout,
-		},
+	if cfg.MemoryBudget > 0 {
+		go p.WatchMemory(ctx, cfg.MemoryBudget, time.Second)
 	}
+	if cfg.StaleSessionTimeout > 0 {
+		go p.ReapStale(ctx, cfg.StaleSessionTimeout)
+	}
+	if cfg.IdleTimeout > 0 {
+		go p.ReapIdle(ctx, cfg.IdleTimeout, cfg.IdleCloseCode)
+	}
+	// Pools with health checks or discovery may be added at runtime, so
+	// these always run.
+	go p.RunHealthChecks(ctx, time.Second)
+	go runDiscovery(ctx, store, lookupSRV, time.Second)
 
 	var connHadRequest *sync.Map
 	var connRemoteAddr *sync.Map
@@ -72,13 +152,68 @@ func Run() error {
 	mux := newProxyHandler(cfg, p, connHadRequest)
 
 	quicCfg := defaultQUICConfig(cfg.Debug, connHadRequest, connRemoteAddr)
-	tlsCfg, err := loadServerTLSConfig(cfg.CertFile, cfg.KeyFile)
+	if cfg.QUICStatsInterval > 0 {
+		stats := newQUICStats()
+		quicCfg.Tracer = stats.tracer(quicCfg.Tracer)
+		go stats.run(ctx, cfg.QUICStatsInterval)
+	}
+	tlsCfg, err := config.ClientAuthTLSConfig(cfg.ClientCAFile, cfg.ClientCertReq)
 	if err != nil {
-		return fmt.Errorf("load TLS config: %w", err)
+		return fmt.Errorf("bad -client-ca: %w", err)
+	}
+	acmeManager, acmeDomains, err := newACMEManager(cfg)
+	if err != nil {
+		return fmt.Errorf("bad -acme-domains: %w", err)
+	}
+	// certs stays nil with ACME, which issues and renews on its own.
+	var certs certSet
+	if acmeManager != nil {
+		challenges, err := listenACMEChallenges(cfg.ACMEListen, acmeManager)
+		if err != nil {
+			return fmt.Errorf("bad -acme-listen: %w", err)
+		}
+		slog.Info("ACME certificates", "domains", cfg.ACMEDomains, "cache", cfg.ACMECacheDir, "challenge_addr", cfg.ACMEListen)
+		defer stopTCPServer(challenges, cfg.GoAwayTimeout)
+		tlsCfg.GetCertificate = acmeCertificate(acmeManager, acmeDomains[0])
+	} else {
+		pairs, err := loadCertPairs(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load TLS config: %w", err)
+		}
+		certs = newCertSet(pairs)
+		tlsCfg.GetCertificate = certs.getCertificate
+		for _, h := range certs {
+			startCertExpiryMonitor(ctx, h)
+			if cfg.CertWatchInterval > 0 {
+				watchCertFiles(ctx, h, cfg.CertWatchInterval)
+			}
+		}
+	}
+	go watchReloads(ctx, func() error { return reloadConfig(args, cfg, store, certs, newLimiter) })
+
+	listeners, err := parseListenSpecs(cfg.ListenAddr, cfg.ListenDevice, cfg.ListenDSCP)
+	if err != nil {
+		return fmt.Errorf("bad -listen: %w", err)
+	}
+
+	if cfg.ListenH2 != "" {
+		h2, err := listenHTTP2(cfg.ListenH2, tlsCfg, mux)
+		if err != nil {
+			return fmt.Errorf("bad -listen-h2: %w", err)
+		}
+		slog.Info("HTTP/2 WS proxy listening", "addr", cfg.ListenH2)
+		defer stopTCPServer(h2, cfg.GoAwayTimeout)
+	}
+	if cfg.ListenH1 != "" {
+		h1, err := listenHTTP1(cfg.ListenH1, mux)
+		if err != nil {
+			return fmt.Errorf("bad -listen-h1: %w", err)
+		}
+		slog.Info("HTTP/1.1 WS proxy listening", "addr", cfg.ListenH1)
+		defer stopTCPServer(h1, cfg.GoAwayTimeout)
 	}
 
 	server := http3.Server{
-		Addr:            cfg.ListenAddr,
 		Handler:         mux,
 		TLSConfig:       tlsCfg,
 		QUICConfig:      quicCfg,
@@ -86,9 +221,9 @@ func Run() error {
 	}
 
 	if cfg.Debug {
-		server.Logger = slog.New(newQuicDebugLogFilter(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+		server.Logger = slog.New(newQuicDebugLogFilter(slog.Default().Handler()))
 		server.ConnContext = func(ctx context.Context, c quic.Connection) context.Context {
-			log.Printf("[debug] http3 conn context: conn_id=%v local=%s remote=%s", c.Context().Value(quic.ConnectionTracingKey), c.LocalAddr(), c.RemoteAddr())
+			debugf("http3 conn context: conn_id=%v local=%s remote=%s", c.Context().Value(quic.ConnectionTracingKey), c.LocalAddr(), c.RemoteAddr())
 			return ctx
 		}
 		// Keep debug hooks passive: avoid StreamHijacker / UniStreamHijacker overrides,
@@ -96,21 +231,708 @@ func Run() error {
 	}
 
 	if cfg.Debug {
-		log.Printf("[debug] quic config: max_idle=%s keepalive=%s datagrams=%v allow_0rtt=%v incoming_streams=%d incoming_uni_streams=%d stream_recv_window=%d conn_recv_window=%d", quicCfg.MaxIdleTimeout, quicCfg.KeepAlivePeriod, quicCfg.EnableDatagrams, quicCfg.Allow0RTT, quicCfg.MaxIncomingStreams, quicCfg.MaxIncomingUniStreams, quicCfg.MaxStreamReceiveWindow, quicCfg.MaxConnectionReceiveWindow)
+		debugf("quic config: max_idle=%s keepalive=%s datagrams=%v allow_0rtt=%v incoming_streams=%d incoming_uni_streams=%d stream_recv_window=%d conn_recv_window=%d", quicCfg.MaxIdleTimeout, quicCfg.KeepAlivePeriod, quicCfg.EnableDatagrams, quicCfg.Allow0RTT, quicCfg.MaxIncomingStreams, quicCfg.MaxIncomingUniStreams, quicCfg.MaxStreamReceiveWindow, quicCfg.MaxConnectionReceiveWindow)
+	}
+
+	slog.Info("HTTP/3 WS proxy listening", "addr", cfg.ListenAddr, "path", cfg.PathPattern, "backend", backendURL.String(), "log_level", logLevel.Level().String())
+	drainSessions := func() {
+		drainCtx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+		defer cancel()
+		drained, terminated := p.Drain(drainCtx, cfg.DrainCloseCode, "going away")
+		slog.Info("shutdown: sessions drained", "drained", drained, "close_code", cfg.DrainCloseCode, "terminated", terminated, "drain_timeout", cfg.DrainTimeout)
+	}
+	err = serveHTTP3(ctx, &server, listeners, cfg.GoAwayTimeout, drainSessions)
+	stop()
+	if usageDone != nil {
+		// Export what the last sessions used before exiting.
+		<-usageDone
+	}
+	if err != nil {
+		return fmt.Errorf("serve: %w", err)
+	}
+	return nil
+}
+
+// newProxy builds the proxy for the flags in cfg and validates them. It
+// binds no sockets and starts nothing, so check can run it too.
+func newProxy(cfg config.Config, backendURL *url.URL, newLimiter limiterFactory) (*proxy.Proxy, error) {
+	var err error
+	base := runtimeBase(cfg)
+	p := &proxy.Proxy{
+		Backend:            backendURL,
+		PathRegexp:         cfg.PathRegexp,
+		Debug:              cfg.Debug,
+		Limits:             base.Limits,
+		Resume:             base.Resume,
+		Reconnect:          base.Reconnect,
+		Admission:          base.Admission,
+		OverloadRetryAfter: cfg.OverloadRetryAfter,
+		BackendDSCP:        cfg.BackendDSCP,
+		ClientDeflate: proxy.DeflateOptions{
+			Enabled: cfg.ClientDeflate,
+			Level:   cfg.ClientDeflateLevel,
+			MinSize: cfg.ClientDeflateMinSize,
+		},
+		BackendCompression: proxy.BackendCompression{
+			Enabled: cfg.BackendDeflate,
+			Level:   cfg.BackendDeflateLevel,
+		},
+		DeflatePassthrough:  cfg.DeflatePassthrough,
+		RTTProbeInterval:    cfg.RTTProbeInterval,
+		FlushDelay:          cfg.H3FlushDelay,
+		FlushBytes:          cfg.H3FlushBytes,
+		ClientPingInterval:  cfg.ClientPingInterval,
+		ClientPingMisses:    cfg.ClientPingMisses,
+		BackendPingInterval: cfg.BackendPingInterval,
+		BackendPingMisses:   cfg.BackendPingMisses,
+		StreamMessages:      cfg.StreamMessages,
+		ReadyWindow:         cfg.ReadyWindow,
+		DialTimeout:         cfg.BackendDialTimeout,
+		DialRetries:         cfg.BackendDialRetries,
+		DialBackoff:         cfg.BackendDialBackoff,
+		StrictRFC9220:       cfg.StrictRFC9220,
+		CloseTimeout:        cfg.CloseTimeout,
+		Tags:                connectionTags(cfg),
+	}
+	if cfg.BackendResolveInterval > 0 {
+		p.Resolver = proxy.NewBackendResolver(cfg.BackendResolveInterval)
+	}
+	if cfg.BackendDialTimeout <= 0 || cfg.BackendDialRetries < 0 || cfg.BackendDialBackoff < 0 {
+		return nil, errors.New("-backend-dial-timeout must be positive and -backend-dial-retries/-backend-dial-backoff not negative")
+	}
+	if cfg.ConfigURL != "" && cfg.ConfigPollInterval <= 0 {
+		return nil, errors.New("-config-poll-interval must be positive")
+	}
+	if !ws.ValidCloseCode(cfg.DrainCloseCode) {
+		return nil, fmt.Errorf("bad -drain-close-code %d: not a close code an endpoint may send", cfg.DrainCloseCode)
+	}
+	if (p.Tags.Header != "" || p.Tags.Query != "") && len(p.Tags.Allowed) == 0 {
+		return nil, errors.New("-tag-header/-tag-query require -tag-values")
+	}
+	if !config.ValidDeflateLevel(cfg.ClientDeflateLevel) || !config.ValidDeflateLevel(cfg.BackendDeflateLevel) {
+		return nil, errors.New("bad -client-deflate-level/-backend-deflate-level: must be -2..9")
+	}
+	if cfg.BackendDSCP < 0 || cfg.BackendDSCP > 63 {
+		return nil, fmt.Errorf("bad -backend-dscp %d: must be 0-63", cfg.BackendDSCP)
+	}
+	if p.BackendNetDialer, err = backendNetDialer(cfg); err != nil {
+		return nil, err
+	}
+	if !ws.ValidCloseCode(cfg.IdleCloseCode) {
+		return nil, fmt.Errorf("bad -idle-close-code %d: not a close code an endpoint may send", cfg.IdleCloseCode)
+	}
+	if cfg.H3FlushDelay > 0 && cfg.H3FlushBytes < 1 {
+		return nil, fmt.Errorf("bad -h3-flush-bytes %d: must be positive", cfg.H3FlushBytes)
+	}
+	if cfg.ClientPingMisses < 1 {
+		return nil, fmt.Errorf("bad -client-ping-misses %d: must be at least 1", cfg.ClientPingMisses)
+	}
+	if cfg.BackendPingMisses < 1 {
+		return nil, fmt.Errorf("bad -backend-ping-misses %d: must be at least 1", cfg.BackendPingMisses)
+	}
+	if p.CloseCodes, err = proxy.ParseCloseCodeMap(cfg.CloseCodeMap); err != nil {
+		return nil, fmt.Errorf("bad -close-code-map: %w", err)
+	}
+	if p.ClientMasking, err = proxy.ParseClientMasking(cfg.ClientMasking); err != nil {
+		return nil, fmt.Errorf("bad -client-masking: %w", err)
+	}
+	if p.BackendProtocol, err = proxy.ParseBackendProtocol(cfg.BackendProtocol); err != nil {
+		return nil, fmt.Errorf("bad -backend-protocol: %w", err)
+	}
+	if p.BackendProtocol == proxy.BackendHTTP3 && backendURL.Scheme != "wss" {
+		return nil, errors.New("-backend-protocol h3 needs a wss:// -backend")
+	}
+	if cfg.BackendProxy != "" {
+		if p.BackendProxy, err = proxy.ParseBackendProxy(cfg.BackendProxy); err != nil {
+			return nil, fmt.Errorf("bad -backend-proxy: %w", err)
+		}
+	}
+	if p.ForwardHeaders, err = proxy.ForwardHeaders(cfg.ForwardHeaders); err != nil {
+		return nil, fmt.Errorf("bad -forward-headers: %w", err)
+	}
+	p.BackendTLSConfig, err = config.BackendTLSConfig(cfg.BackendCAFile, cfg.BackendCertFile, cfg.BackendKeyFile, cfg.BackendSNI, cfg.BackendInsecure)
+	if err != nil {
+		return nil, fmt.Errorf("backend TLS: %w", err)
+	}
+	if cfg.BackendInsecure {
+		slog.Warn("-backend-insecure-skip-verify is set, wss:// backend certificates are not verified")
+	}
+	if cfg.RateLimitIP > 0 {
+		p.IPRateLimiter = newLimiter("ip", cfg.RateLimitIP, cfg.RateLimitIPBurst)
+	}
+	p.MaxConnsPerIP = cfg.MaxConnsPerIP
+	if cfg.MaxBPSPerSession < 0 {
+		return nil, fmt.Errorf("bad -max-bps-per-session %d: must not be negative", cfg.MaxBPSPerSession)
+	}
+	p.SessionBandwidth = cfg.MaxBPSPerSession
+	if cfg.MaxBPSIngress < 0 {
+		return nil, fmt.Errorf("bad -max-bps-ingress %d: must not be negative", cfg.MaxBPSIngress)
+	}
+	if cfg.MaxBPSEgress < 0 {
+		return nil, fmt.Errorf("bad -max-bps-egress %d: must not be negative", cfg.MaxBPSEgress)
+	}
+	if cfg.MaxMsgsPerSession < 0 {
+		return nil, fmt.Errorf("bad -max-msgs-per-session %g: must not be negative", cfg.MaxMsgsPerSession)
+	}
+	p.MessageRate, p.MessageBurst = cfg.MaxMsgsPerSession, cfg.MaxMsgsBurst
+	if p.MessageRateAction, err = proxy.ParseMessageRateAction(cfg.MsgRateAction); err != nil {
+		return nil, fmt.Errorf("bad -msg-rate-action: %w", err)
+	}
+	if cfg.MaxBPSIngress > 0 {
+		p.IngressShaper = ratelimit.NewShaper(cfg.MaxBPSIngress)
+	}
+	if cfg.MaxBPSEgress > 0 {
+		p.EgressShaper = ratelimit.NewShaper(cfg.MaxBPSEgress)
+	}
+	if (cfg.UsageFile != "" || cfg.UsageWebhook != "") && cfg.UsageInterval <= 0 {
+		return nil, errors.New("bad -usage-interval: must be positive")
+	}
+	if p.ExternalAuth, err = externalAuth(cfg); err != nil {
+		return nil, fmt.Errorf("bad -auth-url settings: %w", err)
+	}
+	if cfg.OPAURL != "" {
+		if u, err := url.Parse(cfg.OPAURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("bad -opa-url %q: want an http:// or https:// URL", cfg.OPAURL)
+		}
+		p.Policy = &proxy.Policy{URL: cfg.OPAURL, Timeout: cfg.OPATimeout}
+	}
+	return p, nil
+}
+
+// startUsageExport starts per-identity usage accounting when -usage-file or
+// -usage-webhook is set. The returned channel closes after the final export
+// that follows ctx being done.
+func startUsageExport(ctx context.Context, cfg config.Config) (*usage.Accumulator, <-chan struct{}) {
+	var sinks usage.Sinks
+	if cfg.UsageFile != "" {
+		sinks = append(sinks, usage.FileSink{Path: cfg.UsageFile})
+	}
+	if cfg.UsageWebhook != "" {
+		sinks = append(sinks, usage.WebhookSink{URL: cfg.UsageWebhook, Client: &http.Client{Timeout: 30 * time.Second}})
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	acc := usage.NewAccumulator()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		acc.Run(ctx, cfg.UsageInterval, sinks, func(result string) {
+			metrics.UsageExports.WithLabelValues(result).Inc()
+		})
+	}()
+	return acc, done
+}
+
+// connectionTags builds the session tagging settings from -tag-header,
+// -tag-query and the comma separated -tag-values allowlist.
+func connectionTags(cfg config.Config) proxy.ConnectionTags {
+	t := proxy.ConnectionTags{Header: cfg.TagHeader, Query: cfg.TagQuery, Allowed: map[string]bool{}}
+	for _, v := range strings.Split(cfg.TagValues, ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			t.Allowed[v] = true
+		}
+	}
+	return t
+}
+
+// backendNetDialer returns the dialer for backend TCP connections, or nil
+// when no source address or device is configured.
+func backendNetDialer(cfg config.Config) (*net.Dialer, error) {
+	if cfg.BackendSource == "" && cfg.BackendDevice == "" {
+		return nil, nil
+	}
+	d := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   sockopt.Control(sockopt.BindToDevice(cfg.BackendDevice)),
+	}
+	if cfg.BackendSource != "" {
+		ip := net.ParseIP(cfg.BackendSource)
+		if ip == nil {
+			return nil, fmt.Errorf("bad -backend-source %q: not an IP address", cfg.BackendSource)
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return d, nil
+}
+
+type limiterFactory func(scope string, rate float64, burst int) ratelimit.Limiter
+
+// rateLimiterFactory returns a constructor for limiters shared through Redis
+// when -rate-limit-redis is set, or process-local ones otherwise.
+func rateLimiterFactory(cfg config.Config) (limiterFactory, error) {
+	if cfg.RateLimitRedis == "" {
+		return func(_ string, rate float64, burst int) ratelimit.Limiter {
+			return ratelimit.NewLocal(rate, burst)
+		}, nil
+	}
+	client, err := ratelimit.NewRedisClient(cfg.RateLimitRedis, 200*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	onError := func(err error) {
+		metrics.RateLimitBackendErrors.Inc()
+		if cfg.Debug {
+			debugf("rate limit redis error, using local limiter: %v", err)
+		}
+	}
+	return func(scope string, rate float64, burst int) ratelimit.Limiter {
+		return ratelimit.NewRedis(client, "h3ws:rl:"+scope+":", rate, burst, cfg.RateLimitRedisBatch, onError)
+	}, nil
+}
+
+// runtimeBase returns the runtime settings given as flags, which the
+// structured config is applied on top of.
+func runtimeBase(cfg config.Config) proxy.RuntimeConfig {
+	return proxy.RuntimeConfig{
+		Limits: config.Limits{
+			MaxFrameSize:   cfg.MaxFrame,
+			MaxMessageSize: cfg.MaxMessage,
+			MaxConns:       cfg.MaxConns,
+			ReadTimeout:    cfg.ReadTimeout,
+			WriteTimeout:   cfg.WriteTimeout,
+		},
+		Resume: config.Resume{
+			Window:    cfg.ResumeWindow,
+			MaxBuffer: cfg.ResumeBuffer,
+		},
+		Reconnect: config.Reconnect{
+			Timeout:   cfg.BackendReconnectTimeout,
+			MaxBuffer: cfg.BackendReconnectBuffer,
+		},
+		Admission: config.Admission{
+			Wait:             cfg.AdmissionQueueWait,
+			MaxQueue:         cfg.AdmissionQueueSize,
+			LowPriorityShare: cfg.LowPriorityShare,
+			ShedIdle:         cfg.ShedIdleAfter,
+		},
+	}
+}
+
+// runtimeBuilder returns the config store's build function for the flag
+// settings in cfg.
+func runtimeBuilder(cfg config.Config, backendURL *url.URL, newLimiter limiterFactory) func(config.File) (*proxy.RuntimeConfig, error) {
+	base := runtimeBase(cfg)
+	return func(file config.File) (*proxy.RuntimeConfig, error) {
+		if file.Chaos != nil && !cfg.AllowChaos {
+			return nil, errors.New("chaos mode requires -allow-chaos")
+		}
+		rt, err := buildRuntimeConfig(file, backendURL, base, newLimiter)
+		if err == nil && rt.Chaos != nil {
+			slog.Warn("chaos mode is active, faults are injected into live traffic", "chaos", fmt.Sprintf("%+v", *rt.Chaos))
+		}
+		return rt, err
 	}
+}
 
-	log.Printf("HTTP/3 WS proxy listening on udp %s, path=%s, backend=%s, debug=%v", cfg.ListenAddr, cfg.PathPattern, backendURL.String(), cfg.Debug)
-	if err := server.ListenAndServe(); err != nil {
-		return fmt.Errorf("ListenAndServe: %w", err)
+// buildRuntimeConfig applies the structured config on top of base, which
+// carries the values given on the command line.
+func buildRuntimeConfig(file config.File, defaultBackend *url.URL, base proxy.RuntimeConfig, newLimiter limiterFactory) (*proxy.RuntimeConfig, error) {
+	rt := base
+	rt.Backend = defaultBackend
+	if l := file.Limits; l != nil {
+		if l.MaxConns > 0 {
+			rt.Limits.MaxConns = l.MaxConns
+		}
+		if l.MaxFrame > 0 {
+			rt.Limits.MaxFrameSize = l.MaxFrame
+		}
+		if l.MaxMessage > 0 {
+			rt.Limits.MaxMessageSize = l.MaxMessage
+		}
+		if l.ReadTimeout > 0 {
+			rt.Limits.ReadTimeout = time.Duration(l.ReadTimeout)
+		}
+		if l.WriteTimeout > 0 {
+			rt.Limits.WriteTimeout = time.Duration(l.WriteTimeout)
+		}
+		if l.QueueWait > 0 {
+			rt.Admission.Wait = time.Duration(l.QueueWait)
+		}
+		if l.QueueSize > 0 {
+			rt.Admission.MaxQueue = l.QueueSize
+		}
+		if l.ShedIdleAfter > 0 {
+			rt.Admission.ShedIdle = time.Duration(l.ShedIdleAfter)
+		}
+	}
+	if f := file.Features; f != nil {
+		if f.ResumeWindow != nil {
+			rt.Resume.Window = time.Duration(*f.ResumeWindow)
+		}
+		if f.BackendReconnectTimeout != nil {
+			rt.Reconnect.Timeout = time.Duration(*f.BackendReconnectTimeout)
+		}
+	}
+	if err := rt.Limits.Validate(); err != nil {
+		return nil, fmt.Errorf("limits: %w", err)
+	}
+	tenants, err := buildTenants(file.Tenants, defaultBackend, rt.Limits, newLimiter)
+	if err != nil {
+		return nil, err
+	}
+	rt.Tenants = tenants
+	if rt.Routes, err = buildRoutes(file.Routes); err != nil {
+		return nil, err
+	}
+	if err := assignPools(&rt, file); err != nil {
+		return nil, err
+	}
+	rt.Rejections = buildRejections(file.Rejections)
+	if rt.BackendHeaders, err = proxy.NewHeaderTemplates(file.BackendHeaders); err != nil {
+		return nil, fmt.Errorf("backend_headers: %w", err)
+	}
+	if rd := file.Redaction; rd != nil {
+		patterns := make([]*regexp.Regexp, 0, len(rd.Patterns))
+		for _, p := range rd.Patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("redaction: bad pattern: %w", err)
+			}
+			patterns = append(patterns, re)
+		}
+		rt.Redactor = redact.New(rd.Fields, patterns)
+	}
+	if c := file.Chaos; c != nil {
+		rt.Chaos = &proxy.Chaos{
+			DelayRate:       c.DelayRate,
+			MaxDelay:        time.Duration(c.MaxDelay),
+			DropRate:        c.DropRate,
+			TruncateRate:    c.TruncateRate,
+			CloseRate:       c.CloseRate,
+			DialFailureRate: c.DialFailureRate,
+			Routes:          slices.Clone(c.Routes),
+		}
+	}
+	return &rt, nil
+}
+
+// assignPools builds the backend pools and hands them to the routes and
+// tenants that name them. Tenants without a backend of their own share the
+// default pool, like they share the default backend.
+func assignPools(rt *proxy.RuntimeConfig, file config.File) error {
+	byName := make(map[string]*proxy.BackendPool, len(file.Pools))
+	for _, spec := range file.Pools {
+		balance, err := proxy.ParseBalance(spec.Balance)
+		if err != nil {
+			return fmt.Errorf("pool %q: %w", spec.Name, err)
+		}
+		hashOn, err := buildHashOn(spec.HashOn)
+		if err != nil {
+			return fmt.Errorf("pool %q: %w", spec.Name, err)
+		}
+		pool := &proxy.BackendPool{
+			Name:         spec.Name,
+			Balance:      balance,
+			HashOn:       hashOn,
+			DialRetries:  spec.DialRetries,
+			DialDeadline: time.Duration(spec.DialDeadline),
+		}
+		if hc := spec.HealthCheck; hc != nil {
+			pool.HealthCheck = &proxy.HealthCheck{
+				Interval:       time.Duration(hc.Interval),
+				Timeout:        time.Duration(hc.Timeout),
+				Path:           hc.Path,
+				UnhealthyAfter: hc.UnhealthyAfter,
+				HealthyAfter:   hc.HealthyAfter,
+			}
+		}
+		if od := spec.Outliers; od != nil {
+			pool.Outliers = &proxy.OutlierDetection{
+				ConsecutiveFailures: od.ConsecutiveFailures,
+				ErrorRate:           od.ErrorRate,
+				MinSessions:         od.MinSessions,
+				Interval:            time.Duration(od.Interval),
+				BaseEjection:        time.Duration(od.BaseEjection),
+				MaxEjection:         time.Duration(od.MaxEjection),
+			}
+		}
+		for _, b := range spec.Backends {
+			u, err := proxy.ParseBackendURL(b.URL)
+			if err != nil {
+				return fmt.Errorf("pool %q: backend %q: %w", spec.Name, b.Name, err)
+			}
+			pool.Backends = append(pool.Backends, &proxy.PoolBackend{Name: b.Name, URL: u, Weight: b.Weight, Priority: b.Priority, Draining: b.Draining})
+		}
+		rt.Pools = append(rt.Pools, pool)
+		byName[spec.Name] = pool
+	}
+	rt.DefaultPool = byName[config.DefaultPool]
+	for i, spec := range file.Routes {
+		rt.Routes[i].Pool = byName[spec.Pool]
+	}
+	for i, spec := range file.Tenants {
+		switch {
+		case spec.Pool != "":
+			rt.Tenants[i].Pool = byName[spec.Pool]
+		case spec.Backend == "":
+			rt.Tenants[i].Pool = rt.DefaultPool
+		}
 	}
 	return nil
 }
 
+func buildHashOn(spec string) (proxy.HashOn, error) {
+	if spec == "" {
+		return proxy.HashOn{}, nil
+	}
+	source, name, err := config.ParseHashOn(spec)
+	return proxy.HashOn{Source: source, Name: name}, err
+}
+
+func buildRoutes(specs []config.Route) ([]*proxy.Route, error) {
+	routes := make([]*proxy.Route, 0, len(specs))
+	for _, spec := range specs {
+		re, err := regexp.Compile(spec.Path)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: bad path: %w", spec.Name, err)
+		}
+		prio, err := proxy.ParsePriority(spec.Priority)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", spec.Name, err)
+		}
+		balance, err := proxy.ParseBalance(spec.Balance)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", spec.Name, err)
+		}
+		hashOn, err := buildHashOn(spec.HashOn)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", spec.Name, err)
+		}
+		messages, err := buildMessageRules(spec.Messages)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: messages: %w", spec.Name, err)
+		}
+		var backend *url.URL
+		if spec.Backend != "" {
+			if backend, err = url.Parse(spec.Backend); err != nil {
+				return nil, fmt.Errorf("route %q: bad backend: %w", spec.Name, err)
+			}
+		}
+		route := &proxy.Route{
+			Name:       spec.Name,
+			Path:       re,
+			Tenant:     spec.Tenant,
+			Hosts:      slices.Clone(spec.Hosts),
+			MaxConns:   spec.MaxConns,
+			Priority:   prio,
+			DSCP:       spec.DSCP,
+			Opaque:     spec.Opaque,
+			Rejections: buildRejections(spec.Rejections),
+			Messages:   messages,
+			Backend:    backend,
+			Balance:    balance,
+			HashOn:     hashOn,
+			Claims:     maps.Clone(spec.Claims),
+		}
+		if route.BackendProtocol, err = proxy.ParseBackendProtocol(spec.BackendProtocol); err != nil {
+			return nil, fmt.Errorf("route %q: %w", spec.Name, err)
+		}
+		if spec.BackendProxy != "" {
+			if route.BackendProxy, err = proxy.ParseBackendProxy(spec.BackendProxy); err != nil {
+				return nil, fmt.Errorf("route %q: backend_proxy: %w", spec.Name, err)
+			}
+		}
+		if cc := spec.ClientCert; cc != nil {
+			if route.ClientCert, err = buildClientCertPolicy(cc); err != nil {
+				return nil, fmt.Errorf("route %q: client_cert: %w", spec.Name, err)
+			}
+		}
+		if c := spec.Compression; c != nil {
+			route.ClientDeflate, route.BackendCompression = buildCompression(c)
+			route.DeflatePassthrough = c.Passthrough
+		}
+		if route.BackendHeaders, err = proxy.NewHeaderTemplates(spec.BackendHeaders); err != nil {
+			return nil, fmt.Errorf("route %q: backend_headers: %w", spec.Name, err)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func buildClientCertPolicy(spec *config.ClientCertPolicy) (*proxy.ClientCertPolicy, error) {
+	p := &proxy.ClientCertPolicy{Required: spec.Required}
+	for _, expr := range spec.Allow {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		p.Allow = append(p.Allow, re)
+	}
+	for _, expr := range spec.Deny {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		p.Deny = append(p.Deny, re)
+	}
+	return p, nil
+}
+
+func buildCompression(c *config.Compression) (*proxy.DeflateOptions, *proxy.BackendCompression) {
+	var client *proxy.DeflateOptions
+	if cl := c.Client; cl != nil {
+		client = &proxy.DeflateOptions{
+			Enabled:                 !cl.Disabled,
+			Level:                   deflateLevel(cl.Level),
+			MinSize:                 cl.MinSize,
+			ServerContextTakeover:   cl.ServerContextTakeover,
+			ClientNoContextTakeover: cl.ClientNoContextTakeover,
+			ClientMaxWindowBits:     cl.ClientMaxWindowBits,
+		}
+	}
+	var backend *proxy.BackendCompression
+	if b := c.Backend; b != nil {
+		backend = &proxy.BackendCompression{Enabled: !b.Disabled, Level: deflateLevel(b.Level)}
+	}
+	return client, backend
+}
+
+func deflateLevel(l *int) int {
+	if l == nil {
+		return config.DefaultDeflateLevel
+	}
+	return *l
+}
+
+func buildMessageRules(spec *config.MessageRules) (*proxy.MessageRules, error) {
+	if spec == nil {
+		return nil, nil
+	}
+	policy, err := proxy.ParseMessagePolicy(spec.Policy)
+	if err != nil {
+		return nil, err
+	}
+	m := &proxy.MessageRules{Policy: policy}
+	if len(bytes.TrimSpace(spec.TextSchema)) > 0 {
+		if m.TextSchema, err = schema.Compile(spec.TextSchema); err != nil {
+			return nil, fmt.Errorf("text_schema: %w", err)
+		}
+	}
+	if b := spec.Binary; b != nil {
+		m.BinaryMinLength = b.MinLength
+		m.BinaryMaxLength = b.MaxLength
+		if m.BinaryMagic, err = hex.DecodeString(b.Magic); err != nil {
+			return nil, fmt.Errorf("binary magic: %w", err)
+		}
+		if pr := b.Proto; pr != nil {
+			set, err := os.ReadFile(pr.Descriptor)
+			if err != nil {
+				return nil, fmt.Errorf("binary proto: %w", err)
+			}
+			if m.BinaryProto, err = schema.CompileProto(set, pr.Message); err != nil {
+				return nil, fmt.Errorf("binary proto: %w", err)
+			}
+			m.BinaryProto.AllowUnknown = pr.AllowUnknown
+		}
+	}
+	return m, nil
+}
+
+func buildRejections(specs map[string]config.Rejection) map[string]proxy.Rejection {
+	if len(specs) == 0 {
+		return nil
+	}
+	out := make(map[string]proxy.Rejection, len(specs))
+	for reason, spec := range specs {
+		rej := proxy.Rejection{Status: spec.Status, Body: spec.Body, Header: http.Header{}}
+		for k, v := range spec.Headers {
+			rej.Header.Set(k, v)
+		}
+		out[reason] = rej
+	}
+	return out
+}
+
+// startRemoteConfig fetches the config document once (failing startup if
+// that does not work) and then polls it in the background until ctx is
+// done.
+func startRemoteConfig(ctx context.Context, cfg config.Config, store *configStore) error {
+	fetcher := &remoteconfig.Fetcher{URL: cfg.ConfigURL}
+	if strings.HasPrefix(cfg.ConfigURL, "s3://") {
+		fetcher.S3 = remoteconfig.S3FromEnv(cfg.ConfigS3Endpoint, cfg.ConfigS3Region)
+	}
+	apply := func(data []byte) error {
+		file, err := config.ParseFile(cfg.ConfigURL, data)
+		if err != nil {
+			return err
+		}
+		return store.replace(file)
+	}
+
+	data, _, err := fetcher.Fetch(ctx)
+	if err != nil {
+		return err
+	}
+	if err := apply(data); err != nil {
+		return err
+	}
+	fetcher.Commit()
+	metrics.ConfigReloads.WithLabelValues("remote", "applied").Inc()
+	slog.Info("remote config loaded", "url", redactURL(cfg.ConfigURL), "poll_interval", cfg.ConfigPollInterval)
+
+	go remoteconfig.Poll(ctx, fetcher, cfg.ConfigPollInterval, apply, func(result string) {
+		metrics.ConfigReloads.WithLabelValues("remote", result).Inc()
+	})
+	return nil
+}
+
+func buildTenants(specs []config.Tenant, defaultBackend *url.URL, defaults config.Limits, newLimiter limiterFactory) ([]*proxy.Tenant, error) {
+	tenants := make([]*proxy.Tenant, 0, len(specs))
+	for _, spec := range specs {
+		t := &proxy.Tenant{
+			Name:       spec.Name,
+			SNI:        spec.SNI,
+			PathPrefix: spec.PathPrefix,
+			Claims:     spec.Claims,
+			Backend:    defaultBackend,
+			Limits:     defaults,
+		}
+		if spec.Auth != nil {
+			auth, err := tenantAuth(*spec.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("tenant %q: auth: %w", spec.Name, err)
+			}
+			t.Auth = auth
+		}
+		if spec.Backend != "" {
+			u, err := proxy.ParseBackendURL(spec.Backend)
+			if err != nil {
+				return nil, fmt.Errorf("tenant %q: bad backend: %w", spec.Name, err)
+			}
+			t.Backend = u
+		}
+		// The global max-conns still applies; a tenant without its own cap
+		// is only bounded by it.
+		t.Limits.MaxConns = spec.MaxConns
+		if spec.MaxFrame > 0 {
+			t.Limits.MaxFrameSize = spec.MaxFrame
+		}
+		if spec.MaxMessage > 0 {
+			t.Limits.MaxMessageSize = spec.MaxMessage
+		}
+		if err := t.Limits.Validate(); err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", spec.Name, err)
+		}
+		if spec.RateLimit > 0 {
+			t.RateLimiter = newLimiter("tenant", spec.RateLimit, spec.RateBurst)
+		}
+		prio, err := proxy.ParsePriority(spec.Priority)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", spec.Name, err)
+		}
+		t.Priority = prio
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
+
 func newProxyHandler(cfg config.Config, p *proxy.Proxy, connHadRequest *sync.Map) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if cfg.Debug {
-			log.Printf("[debug] incoming http request: method=%s proto=%s host=%s path=%s remote=%s", r.Method, r.Proto, r.Host, r.URL.String(), r.RemoteAddr)
+			debugf("incoming http request: method=%s proto=%s host=%s path=%s remote=%s", r.Method, r.Proto, r.Host, r.URL.String(), r.RemoteAddr)
 		}
 
 		if connHadRequest != nil {
@@ -127,7 +949,7 @@ func newProxyHandler(cfg config.Config, p *proxy.Proxy, connHadRequest *sync.Map
 			return
 		}
 
-		if r.Method != http.MethodConnect {
+		if r.Method != http.MethodConnect && !proxy.IsUpgradeRequest(r) {
 			if path == "/" {
 				w.WriteHeader(http.StatusOK)
 				_, _ = w.Write([]byte("ok\n"))
@@ -182,48 +1004,44 @@ func handleHealthRequest(w http.ResponseWriter, r *http.Request) {
 	// No websocket-specific response headers or frames are emitted here.
 	w.WriteHeader(http.StatusOK)
 }
-func parseConfig() config.Config {
-	var cfg config.Config
-
-	flag.StringVar(&cfg.ListenAddr, "listen", ":443", "UDP listen addr for HTTP/3 (e.g. :443, :8443)")
-	flag.StringVar(&cfg.CertFile, "cert", "cert.pem", "TLS cert PEM")
-	flag.StringVar(&cfg.KeyFile, "key", "key.pem", "TLS key PEM")
-
-	flag.StringVar(&cfg.BackendWS, "backend", "ws://127.0.0.1:8080", "backend ws:// or wss:// URL (HTTP/1.1 WebSocket), without path")
-	flag.StringVar(&cfg.PathPattern, "path", "^/ws$", "regexp pattern for RFC9220 websocket CONNECT path")
-
-	flag.StringVar(&cfg.MetricsAddr, "metrics", "", "TCP addr for Prometheus /metrics (empty disables metrics server)")
-	flag.Int64Var(&cfg.MaxFrame, "max-frame", 1<<20, "max ws frame payload bytes (H3 side)")
-	flag.Int64Var(&cfg.MaxMessage, "max-message", 8<<20, "max reassembled message bytes (H3 side)")
-	flag.Int64Var(&cfg.MaxConns, "max-conns", 2000, "max concurrent sessions")
-	flag.DurationVar(&cfg.ReadTimeout, "read-timeout", 120*time.Second, "read timeout")
-	flag.DurationVar(&cfg.WriteTimeout, "write-timeout", 15*time.Second, "write timeout")
-	flag.BoolVar(&cfg.Debug, "debug", false, "enable verbose debug logs for QUIC/HTTP3 and proxy flow")
-	flag.Parse()
-
-	pathRegexp, err := regexp.Compile(cfg.PathPattern)
+func parseConfig(args []string) config.Config {
+	cfg, err := config.Load(args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
-		log.Fatalf("bad -path regexp: %v", err)
+		slog.Error(err.Error())
+		os.Exit(2)
 	}
-	cfg.PathRegexp = pathRegexp
-
 	return cfg
 }
 
-func startMetricsServer(addr string) {
+func startMetricsServer(addr string, ready func(context.Context) error, debugVars, profiles bool) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	mux.Handle("/healthz", healthzHandler())
+	mux.Handle("/readyz", readyzHandler(ready))
+	if debugVars {
+		mux.Handle("/debug/vars", debugVarsHandler())
+	}
+	if profiles {
+		handlePprof(mux)
+	}
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
 	go func() {
-		mux := http.NewServeMux()
-		mux.Handle("/metrics", metricsHandler())
-		srv := &http.Server{
-			Addr:              addr,
-			Handler:           mux,
-			ReadHeaderTimeout: 5 * time.Second,
-		}
-		log.Printf("metrics listening on http://%s/metrics", addr)
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Printf("metrics server error: %v", err)
+		slog.Info("metrics listening", "url", "http://"+addr+"/metrics")
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server failed", "err", err)
 		}
 	}()
+	return srv, nil
 }
 
 func metricsHandler() http.Handler {
@@ -261,7 +1079,7 @@ func defaultQUICConfig(debug bool, connHadRequest, connRemoteAddr *sync.Map) *qu
 			var firstClientUniStreamID int64 = -1
 			var loggedClientUniFinHint bool
 
-			log.Printf("[debug] quic connection tracer attached: conn_id=%s", connID)
+			debugf("quic connection tracer attached: conn_id=%s", connID)
 			observeRxStreamFrames := func(frames []logging.Frame) {
 				for _, f := range frames {
 					sf, ok := f.(*logging.StreamFrame)
@@ -281,7 +1099,7 @@ func defaultQUICConfig(debug bool, connHadRequest, connRemoteAddr *sync.Map) *qu
 						}
 						if !loggedClientUniFinHint && sf.StreamID == 2 && sf.Offset == 0 && sf.Fin && sf.Length <= 16 {
 							loggedClientUniFinHint = true
-							log.Printf("[debug] quic conn hint: conn_id=%s first client uni stream closed immediately (id=2 off=%d len=%d fin=%v); this often indicates peer closed HTTP/3 control stream before opening request stream", connID, sf.Offset, sf.Length, sf.Fin)
+							debugf("quic conn hint: conn_id=%s first client uni stream closed immediately (id=2 off=%d len=%d fin=%v); this often indicates peer closed HTTP/3 control stream before opening request stream", connID, sf.Offset, sf.Length, sf.Fin)
 						}
 					case 3:
 						atomic.AddInt64(&rxServerUniStreamFrames, 1)
@@ -294,13 +1112,13 @@ func defaultQUICConfig(debug bool, connHadRequest, connRemoteAddr *sync.Map) *qu
 					if connRemoteAddr != nil {
 						connRemoteAddr.Store(connID, remote.String())
 					}
-					log.Printf("[debug] quic conn started: local=%s remote=%s src_conn_id=%s dest_conn_id=%s", local, remote, srcConnID, destConnID)
+					debugf("quic conn started: local=%s remote=%s src_conn_id=%s dest_conn_id=%s", local, remote, srcConnID, destConnID)
 				},
 				SentTransportParameters: func(tp *logging.TransportParameters) {
-					log.Printf("[debug] quic transport params sent: conn_id=%s max_idle=%s max_udp_payload=%d initial_max_streams_bidi=%d initial_max_streams_uni=%d", connID, tp.MaxIdleTimeout, tp.MaxUDPPayloadSize, tp.MaxBidiStreamNum, tp.MaxUniStreamNum)
+					debugf("quic transport params sent: conn_id=%s max_idle=%s max_udp_payload=%d initial_max_streams_bidi=%d initial_max_streams_uni=%d", connID, tp.MaxIdleTimeout, tp.MaxUDPPayloadSize, tp.MaxBidiStreamNum, tp.MaxUniStreamNum)
 				},
 				ReceivedTransportParameters: func(tp *logging.TransportParameters) {
-					log.Printf("[debug] quic transport params recv: conn_id=%s max_idle=%s max_udp_payload=%d initial_max_streams_bidi=%d initial_max_streams_uni=%d", connID, tp.MaxIdleTimeout, tp.MaxUDPPayloadSize, tp.MaxBidiStreamNum, tp.MaxUniStreamNum)
+					debugf("quic transport params recv: conn_id=%s max_idle=%s max_udp_payload=%d initial_max_streams_bidi=%d initial_max_streams_uni=%d", connID, tp.MaxIdleTimeout, tp.MaxUDPPayloadSize, tp.MaxBidiStreamNum, tp.MaxUniStreamNum)
 				},
 				ReceivedLongHeaderPacket: func(_ *logging.ExtendedHeader, _ logging.ByteCount, _ logging.ECN, frames []logging.Frame) {
 					observeRxStreamFrames(frames)
@@ -319,11 +1137,11 @@ func defaultQUICConfig(debug bool, connHadRequest, connRemoteAddr *sync.Map) *qu
 				DroppedPacket: func(pt logging.PacketType, _ logging.PacketNumber, _ logging.ByteCount, reason logging.PacketDropReason) {
 					atomic.AddInt64(&droppedPackets, 1)
 					if !isExpectedDroppedPacket(pt, reason) {
-						log.Printf("[debug] quic packet dropped: conn_id=%s packet_type=%s reason=%s", connID, packetTypeName(pt), packetDropReasonName(reason))
+						debugf("quic packet dropped: conn_id=%s packet_type=%s reason=%s", connID, packetTypeName(pt), packetDropReasonName(reason))
 					}
 				},
 				ChoseALPN: func(protocol string) {
-					log.Printf("[debug] quic conn alpn negotiated: conn_id=%s alpn=%q", connID, protocol)
+					debugf("quic conn alpn negotiated: conn_id=%s alpn=%q", connID, protocol)
 				},
 				ClosedConnection: func(err error) {
 					hadReq := false
@@ -345,11 +1163,11 @@ func defaultQUICConfig(debug bool, connHadRequest, connRemoteAddr *sync.Map) *qu
 							serverBidi := atomic.LoadInt64(&rxServerBidiStreamFrames)
 							serverUni := atomic.LoadInt64(&rxServerUniStreamFrames)
 							lifetime := time.Since(connStartedAt)
-							log.Printf("[debug] quic conn closed before any request: conn_id=%s err=%v lifetime=%s rx_packets=%d tx_packets=%d dropped_packets=%d rx_stream_frames(client_bidi=%d client_uni=%d server_bidi=%d server_uni=%d)", connID, err, lifetime, atomic.LoadInt64(&rxPackets), atomic.LoadInt64(&txPackets), atomic.LoadInt64(&droppedPackets), clientBidi, clientUni, serverBidi, serverUni)
+							debugf("quic conn closed before any request: conn_id=%s err=%v lifetime=%s rx_packets=%d tx_packets=%d dropped_packets=%d rx_stream_frames(client_bidi=%d client_uni=%d server_bidi=%d server_uni=%d)", connID, err, lifetime, atomic.LoadInt64(&rxPackets), atomic.LoadInt64(&txPackets), atomic.LoadInt64(&droppedPackets), clientBidi, clientUni, serverBidi, serverUni)
 							diagnoseMissingRequestStream(connID, err, clientBidi, clientUni, serverBidi, serverUni, firstClientUniStreamID)
 							return
 						}
-						log.Printf("[debug] quic conn closed: conn_id=%s err=%v rx_packets=%d tx_packets=%d dropped_packets=%d", connID, err, atomic.LoadInt64(&rxPackets), atomic.LoadInt64(&txPackets), atomic.LoadInt64(&droppedPackets))
+						debugf("quic conn closed: conn_id=%s err=%v rx_packets=%d tx_packets=%d dropped_packets=%d", connID, err, atomic.LoadInt64(&rxPackets), atomic.LoadInt64(&txPackets), atomic.LoadInt64(&droppedPackets))
 						return
 					}
 					if !hadReq {
@@ -358,14 +1176,14 @@ func defaultQUICConfig(debug bool, connHadRequest, connRemoteAddr *sync.Map) *qu
 						serverBidi := atomic.LoadInt64(&rxServerBidiStreamFrames)
 						serverUni := atomic.LoadInt64(&rxServerUniStreamFrames)
 						lifetime := time.Since(connStartedAt)
-						log.Printf("[debug] quic conn closed cleanly before any request: conn_id=%s lifetime=%s rx_packets=%d tx_packets=%d dropped_packets=%d rx_stream_frames(client_bidi=%d client_uni=%d server_bidi=%d server_uni=%d)", connID, lifetime, atomic.LoadInt64(&rxPackets), atomic.LoadInt64(&txPackets), atomic.LoadInt64(&droppedPackets), clientBidi, clientUni, serverBidi, serverUni)
+						debugf("quic conn closed cleanly before any request: conn_id=%s lifetime=%s rx_packets=%d tx_packets=%d dropped_packets=%d rx_stream_frames(client_bidi=%d client_uni=%d server_bidi=%d server_uni=%d)", connID, lifetime, atomic.LoadInt64(&rxPackets), atomic.LoadInt64(&txPackets), atomic.LoadInt64(&droppedPackets), clientBidi, clientUni, serverBidi, serverUni)
 						diagnoseMissingRequestStream(connID, err, clientBidi, clientUni, serverBidi, serverUni, firstClientUniStreamID)
 						return
 					}
-					log.Printf("[debug] quic conn closed cleanly: conn_id=%s rx_packets=%d tx_packets=%d dropped_packets=%d", connID, atomic.LoadInt64(&rxPackets), atomic.LoadInt64(&txPackets), atomic.LoadInt64(&droppedPackets))
+					debugf("quic conn closed cleanly: conn_id=%s rx_packets=%d tx_packets=%d dropped_packets=%d", connID, atomic.LoadInt64(&rxPackets), atomic.LoadInt64(&txPackets), atomic.LoadInt64(&droppedPackets))
 				},
 				Debug: func(name, msg string) {
-					log.Printf("[debug] quic conn event: conn_id=%s name=%s msg=%s", connID, name, msg)
+					debugf("quic conn event: conn_id=%s name=%s msg=%s", connID, name, msg)
 				},
 			}
 		}
@@ -434,27 +1252,27 @@ func diagnoseMissingRequestStream(connID quic.ConnectionID, closeErr error, clie
 		if closeErr != nil && strings.Contains(closeErr.Error(), "expected first frame to be a HEADERS frame") {
 			metrics.PreRequestClose.WithLabelValues("request_stream_invalid_first_frame_or_headers").Inc()
 			metrics.Errors.WithLabelValues("h3_framing").Inc()
-			log.Printf("[debug] quic conn request-stream diagnosis: conn_id=%s request stream failed before handler with reason=%q", connID, closeErr.Error())
-			log.Printf("[debug] quic conn request-stream diagnosis: conn_id=%s in quic-go this reason can mean either non-HEADERS first frame OR invalid HEADERS/QPACK block", connID)
-			log.Printf("[debug] quic conn request-stream diagnosis: conn_id=%s remediation: verify first request-stream frame is HEADERS (RFC9114) and header block is valid QPACK for Extended CONNECT (RFC9220)", connID)
+			debugf("quic conn request-stream diagnosis: conn_id=%s request stream failed before handler with reason=%q", connID, closeErr.Error())
+			debugf("quic conn request-stream diagnosis: conn_id=%s in quic-go this reason can mean either non-HEADERS first frame OR invalid HEADERS/QPACK block", connID)
+			debugf("quic conn request-stream diagnosis: conn_id=%s remediation: verify first request-stream frame is HEADERS (RFC9114) and header block is valid QPACK for Extended CONNECT (RFC9220)", connID)
 		}
 		return
 	}
-	log.Printf("[debug] quic conn request-stream hint: conn_id=%s no client-initiated bidi stream frames observed (expected stream id 0/4/8... for CONNECT requests)", connID)
+	debugf("quic conn request-stream hint: conn_id=%s no client-initiated bidi stream frames observed (expected stream id 0/4/8... for CONNECT requests)", connID)
 	switch {
 	case clientUni > 0 && serverBidi == 0 && serverUni == 0:
 		metrics.PreRequestClose.WithLabelValues("no_bidi_request_stream").Inc()
-		log.Printf("[debug] quic conn request-stream diagnosis: conn_id=%s only client unidirectional stream traffic observed (typically control stream / SETTINGS), no request stream created", connID)
+		debugf("quic conn request-stream diagnosis: conn_id=%s only client unidirectional stream traffic observed (typically control stream / SETTINGS), no request stream created", connID)
 		if firstClientUniStreamID >= 0 {
-			log.Printf("[debug] quic conn request-stream diagnosis: conn_id=%s first_client_uni_stream_id=%d (expected control stream id=2 on first h3 unidirectional stream)", connID, firstClientUniStreamID)
+			debugf("quic conn request-stream diagnosis: conn_id=%s first_client_uni_stream_id=%d (expected control stream id=2 on first h3 unidirectional stream)", connID, firstClientUniStreamID)
 		}
-		log.Printf("[debug] quic conn request-stream diagnosis: conn_id=%s peer likely closed before opening request stream; verify client actually sends CONNECT on client-initiated bidirectional stream", connID)
+		debugf("quic conn request-stream diagnosis: conn_id=%s peer likely closed before opening request stream; verify client actually sends CONNECT on client-initiated bidirectional stream", connID)
 	case clientUni == 0 && serverBidi == 0 && serverUni == 0:
 		metrics.PreRequestClose.WithLabelValues("no_h3_stream_activity").Inc()
-		log.Printf("[debug] quic conn request-stream diagnosis: conn_id=%s handshake completed but no HTTP/3 stream activity followed", connID)
+		debugf("quic conn request-stream diagnosis: conn_id=%s handshake completed but no HTTP/3 stream activity followed", connID)
 	default:
 		metrics.PreRequestClose.WithLabelValues("stream_activity_without_request").Inc()
-		log.Printf("[debug] quic conn request-stream diagnosis: conn_id=%s stream activity observed without client request stream (client_uni=%d server_bidi=%d server_uni=%d)", connID, clientUni, serverBidi, serverUni)
+		debugf("quic conn request-stream diagnosis: conn_id=%s stream activity observed without client request stream (client_uni=%d server_bidi=%d server_uni=%d)", connID, clientUni, serverBidi, serverUni)
 	}
 }
 
@@ -502,13 +1320,3 @@ func shouldSuppressQuicDebugRecord(record slog.Record) bool {
 	})
 	return strings.Contains(errText, "NO_ERROR (remote)")
 }
-
-func loadServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
-	tlsCfg := config.DefaultTLSConfig()
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return nil, err
-	}
-	tlsCfg.Certificates = []tls.Certificate{cert}
-	return tlsCfg, nil
-}
@@ -1,7 +1,9 @@
 package app
 
 import (
+	"context"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
@@ -127,3 +129,76 @@ func TestMetricsHandlerExposesGoRuntimeMetrics(t *testing.T) {
 		}
 	}
 }
+
+func TestCertExpiryLevel(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		remaining time.Duration
+		want      int
+	}{
+		{remaining: 90 * 24 * time.Hour, want: 0},
+		{remaining: 29 * 24 * time.Hour, want: 1},
+		{remaining: 10 * 24 * time.Hour, want: 2},
+		{remaining: 5 * 24 * time.Hour, want: 3},
+		{remaining: 2 * 24 * time.Hour, want: 4},
+		{remaining: time.Hour, want: 5},
+		{remaining: -time.Hour, want: 6},
+	}
+	for _, tc := range tests {
+		if got := certExpiryLevel(tc.remaining); got != tc.want {
+			t.Fatalf("certExpiryLevel(%s): got %d, want %d", tc.remaining, got, tc.want)
+		}
+	}
+}
+
+func TestRunReleasesListenersOnReturn(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "proxy")
+	freeAddr := func() string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		return ln.Addr().String()
+	}
+	metricsAddr, adminAddr := freeAddr(), freeAddr()
+	args := []string{
+		"-backend", "ws://127.0.0.1:1", "-cert", certFile, "-key", keyFile, "-listen", "127.0.0.1:0",
+		"-metrics", metricsAddr, "-expvar", "-admin", adminAddr, "-admin-token", "secret",
+		"-goaway-timeout", "100ms", "-drain-timeout", "100ms",
+	}
+	// A second Run in the same process must be able to bind the same ports.
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- Run(ctx, args) }()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			resp, err := http.Get("http://" + metricsAddr + "/healthz")
+			if err == nil {
+				resp.Body.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("run %d: metrics server not up: %v", i, err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("run %d: %v", i, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("run %d did not return", i)
+		}
+		for _, addr := range []string{metricsAddr, adminAddr} {
+			if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+				t.Fatalf("run %d: %s still listening after Run returned", i, addr)
+			}
+		}
+	}
+}
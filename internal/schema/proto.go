@@ -0,0 +1,92 @@
+package schema
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Proto checks binary messages against a protobuf message type.
+type Proto struct {
+	typ protoreflect.MessageType
+	// AllowUnknown accepts messages with fields the type does not declare.
+	// Arbitrary bytes often parse as nothing but unknown fields, so they
+	// are refused by default.
+	AllowUnknown bool
+}
+
+// CompileProto looks up message, a fully qualified name such as
+// "chat.v1.Event", in a serialized FileDescriptorSet as written by
+// protoc --descriptor_set_out --include_imports.
+func CompileProto(descriptorSet []byte, message string) (*Proto, error) {
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(descriptorSet, &set); err != nil {
+		return nil, fmt.Errorf("descriptor set: %w", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor set: %w", err)
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(message))
+	if err != nil {
+		return nil, fmt.Errorf("message %q: %w", message, err)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a message", message)
+	}
+	return &Proto{typ: dynamicpb.NewMessageType(md)}, nil
+}
+
+// Validate reports whether data is a valid encoding of the message type,
+// with all proto2 required fields set.
+func (p *Proto) Validate(data []byte) error {
+	m := p.typ.New()
+	if err := proto.Unmarshal(data, m.Interface()); err != nil {
+		return fmt.Errorf("invalid %s: %w", p.typ.Descriptor().FullName(), err)
+	}
+	if !p.AllowUnknown {
+		if at := unknownField(m, "$"); at != "" {
+			return fmt.Errorf("%s: unknown field", at)
+		}
+	}
+	return nil
+}
+
+// unknownField returns the path of the first message under m that holds
+// undeclared fields, or "".
+func unknownField(m protoreflect.Message, at string) string {
+	if len(m.GetUnknown()) > 0 {
+		return at
+	}
+	var found string
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		name := at + "." + string(fd.Name())
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() == nil {
+				return true
+			}
+			v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+				found = unknownField(mv.Message(), name+"["+k.String()+"]")
+				return found == ""
+			})
+		case fd.IsList():
+			if fd.Message() == nil {
+				return true
+			}
+			l := v.List()
+			for i := 0; i < l.Len() && found == ""; i++ {
+				found = unknownField(l.Get(i).Message(), fmt.Sprintf("%s[%d]", name, i))
+			}
+		case fd.Message() != nil:
+			found = unknownField(v.Message(), name)
+		}
+		return found == ""
+	})
+	return found
+}
@@ -0,0 +1,66 @@
+package schema
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestProtoValidate(t *testing.T) {
+	set, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("chat.proto"),
+		Package: proto.String("chat"),
+		Syntax:  proto.String("proto2"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Event"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{Name: proto.String("op"), Number: proto.Int32(1), Label: descriptorpb.FieldDescriptorProto_LABEL_REQUIRED.Enum(), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()},
+					{Name: proto.String("user"), Number: proto.Int32(2), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), Type: descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(), TypeName: proto.String(".chat.User")},
+				},
+			},
+			{
+				Name: proto.String("User"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{Name: proto.String("id"), Number: proto.Int32(1), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), Type: descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum()},
+				},
+			},
+		},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CompileProto(set, "chat.Missing"); err == nil {
+		t.Fatal("unknown message compiled")
+	}
+	if _, err := CompileProto([]byte("\xff"), "chat.Event"); err == nil {
+		t.Fatal("garbage descriptor set compiled")
+	}
+	p, err := CompileProto(set, "chat.Event")
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		msg  string
+		ok   bool
+	}{
+		{"valid", "\x0a\x03sub\x12\x02\x08\x07", true},
+		{"missing required", "\x12\x02\x08\x07", false},
+		{"truncated", "\x0a\x05sub", false},
+		{"unknown top-level field", "\x0a\x03sub\x18\x01", false},
+		{"unknown nested field", "\x0a\x03sub\x12\x02\x10\x01", false},
+	}
+	for _, c := range cases {
+		if err := p.Validate([]byte(c.msg)); (err == nil) != c.ok {
+			t.Errorf("%s: Validate = %v, want ok=%v", c.name, err, c.ok)
+		}
+	}
+
+	p.AllowUnknown = true
+	if err := p.Validate([]byte("\x0a\x03sub\x12\x02\x10\x01")); err != nil {
+		t.Errorf("unknown field with AllowUnknown: %v", err)
+	}
+}
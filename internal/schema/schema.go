@@ -0,0 +1,284 @@
+// Package schema validates JSON documents against a subset of JSON Schema
+// (type, enum, const, properties, required, additionalProperties, items,
+// length, size and numeric bounds, pattern). Keywords outside that subset
+// are rejected at compile time instead of being silently ignored. Proto
+// checks binary messages against a protobuf message type.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a compiled JSON Schema.
+type Schema struct {
+	types        []string
+	enum         []any
+	constVal     any
+	hasConst     bool
+	properties   map[string]*Schema
+	required     []string
+	additional   *Schema
+	noAdditional bool
+	items        *Schema
+	minLength    *int
+	maxLength    *int
+	minItems     *int
+	maxItems     *int
+	minimum      *float64
+	maximum      *float64
+	pattern      *regexp.Regexp
+}
+
+var jsonTypes = []string{"null", "boolean", "object", "array", "number", "integer", "string"}
+
+// ignoredKeywords are annotations with no effect on validation.
+var ignoredKeywords = []string{"$schema", "$id", "$comment", "title", "description", "default", "examples"}
+
+// Compile parses a JSON Schema document.
+func Compile(doc []byte) (*Schema, error) {
+	return compile(doc, "$")
+}
+
+func compile(doc []byte, at string) (*Schema, error) {
+	doc = bytes.TrimSpace(doc)
+	if string(doc) == "true" {
+		return &Schema{}, nil
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &raw); err != nil {
+		return nil, fmt.Errorf("%s: schema must be an object or true: %w", at, err)
+	}
+	s := &Schema{}
+	for key, val := range raw {
+		var err error
+		switch key {
+		case "type":
+			err = unmarshalStrings(val, &s.types)
+			for _, t := range s.types {
+				if !slices.Contains(jsonTypes, t) {
+					err = fmt.Errorf("unknown type %q", t)
+				}
+			}
+		case "enum":
+			err = unmarshalNumbers(val, &s.enum)
+		case "const":
+			s.hasConst = true
+			err = unmarshalNumbers(val, &s.constVal)
+		case "properties":
+			var props map[string]json.RawMessage
+			if err = json.Unmarshal(val, &props); err == nil {
+				s.properties = make(map[string]*Schema, len(props))
+				for name, sub := range props {
+					if s.properties[name], err = compile(sub, at+"."+name); err != nil {
+						return nil, err
+					}
+				}
+			}
+		case "required":
+			err = json.Unmarshal(val, &s.required)
+		case "additionalProperties":
+			if string(bytes.TrimSpace(val)) == "false" {
+				s.noAdditional = true
+			} else if s.additional, err = compile(val, at+".*"); err != nil {
+				return nil, err
+			}
+		case "items":
+			if s.items, err = compile(val, at+"[]"); err != nil {
+				return nil, err
+			}
+		case "minLength":
+			err = json.Unmarshal(val, &s.minLength)
+		case "maxLength":
+			err = json.Unmarshal(val, &s.maxLength)
+		case "minItems":
+			err = json.Unmarshal(val, &s.minItems)
+		case "maxItems":
+			err = json.Unmarshal(val, &s.maxItems)
+		case "minimum":
+			err = json.Unmarshal(val, &s.minimum)
+		case "maximum":
+			err = json.Unmarshal(val, &s.maximum)
+		case "pattern":
+			var p string
+			if err = json.Unmarshal(val, &p); err == nil {
+				s.pattern, err = regexp.Compile(p)
+			}
+		default:
+			if !slices.Contains(ignoredKeywords, key) {
+				err = errors.New("unsupported keyword")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", at, key, err)
+		}
+	}
+	return s, nil
+}
+
+func unmarshalStrings(val json.RawMessage, out *[]string) error {
+	var one string
+	if err := json.Unmarshal(val, &one); err == nil {
+		*out = []string{one}
+		return nil
+	}
+	return json.Unmarshal(val, out)
+}
+
+func unmarshalNumbers(val json.RawMessage, out any) error {
+	dec := json.NewDecoder(bytes.NewReader(val))
+	dec.UseNumber()
+	return dec.Decode(out)
+}
+
+// Validate decodes data as JSON and checks it against the schema.
+func (s *Schema) Validate(data []byte) error {
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	if dec.More() {
+		return errors.New("invalid JSON: trailing data")
+	}
+	return s.validate(v, "$")
+}
+
+func (s *Schema) validate(v any, at string) error {
+	if len(s.types) > 0 && !slices.ContainsFunc(s.types, func(t string) bool { return hasType(v, t) }) {
+		return fmt.Errorf("%s: expected %s", at, strings.Join(s.types, " or "))
+	}
+	if s.hasConst && !equal(v, s.constVal) {
+		return fmt.Errorf("%s: does not match const", at)
+	}
+	if s.enum != nil && !slices.ContainsFunc(s.enum, func(e any) bool { return equal(v, e) }) {
+		return fmt.Errorf("%s: not one of the enum values", at)
+	}
+	switch v := v.(type) {
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.minLength != nil && n < *s.minLength {
+			return fmt.Errorf("%s: shorter than %d", at, *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			return fmt.Errorf("%s: longer than %d", at, *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fmt.Errorf("%s: does not match pattern", at)
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if s.minimum != nil && f < *s.minimum {
+			return fmt.Errorf("%s: less than %v", at, *s.minimum)
+		}
+		if s.maximum != nil && f > *s.maximum {
+			return fmt.Errorf("%s: greater than %v", at, *s.maximum)
+		}
+	case []any:
+		if s.minItems != nil && len(v) < *s.minItems {
+			return fmt.Errorf("%s: fewer than %d items", at, *s.minItems)
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			return fmt.Errorf("%s: more than %d items", at, *s.maxItems)
+		}
+		if s.items != nil {
+			for i, item := range v {
+				if err := s.items.validate(item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]any:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", at, name)
+			}
+		}
+		for name, val := range v {
+			sub, ok := s.properties[name]
+			switch {
+			case ok:
+			case s.noAdditional:
+				return fmt.Errorf("%s: unexpected property %q", at, name)
+			case s.additional != nil:
+				sub = s.additional
+			default:
+				continue
+			}
+			if err := sub.validate(val, at+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hasType(v any, t string) bool {
+	switch v := v.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case string:
+		return t == "string"
+	case []any:
+		return t == "array"
+	case map[string]any:
+		return t == "object"
+	case json.Number:
+		if t == "number" {
+			return true
+		}
+		f, err := v.Float64()
+		return t == "integer" && err == nil && f == math.Trunc(f)
+	}
+	return false
+}
+
+// equal compares JSON values the way enum and const need: numbers by value
+// at any depth, so 1 and 1.0 match inside arrays and objects too.
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case json.Number:
+		bn, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		af, _ := a.Float64()
+		bf, _ := bn.Float64()
+		return af == bf
+	case []any:
+		bs, ok := b.([]any)
+		if !ok || len(a) != len(bs) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], bs[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		bm, ok := b.(map[string]any)
+		if !ok || len(a) != len(bm) {
+			return false
+		}
+		for k, av := range a {
+			bv, ok := bm[k]
+			if !ok || !equal(av, bv) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
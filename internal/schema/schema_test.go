@@ -0,0 +1,75 @@
+package schema
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	s, err := Compile([]byte(`{
+		"type": "object",
+		"required": ["op", "id"],
+		"additionalProperties": false,
+		"properties": {
+			"op": {"enum": ["sub", "unsub"]},
+			"id": {"type": "integer", "minimum": 1},
+			"tags": {"type": "array", "maxItems": 2, "items": {"type": "string", "pattern": "^[a-z]+$"}}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	cases := []struct {
+		doc string
+		ok  bool
+	}{
+		{`{"op":"sub","id":3}`, true},
+		{`{"op":"sub","id":3,"tags":["a","b"]}`, true},
+		{`{"op":"sub"}`, false},
+		{`{"op":"pub","id":3}`, false},
+		{`{"op":"sub","id":1.5}`, false},
+		{`{"op":"sub","id":0}`, false},
+		{`{"op":"sub","id":3,"extra":true}`, false},
+		{`{"op":"sub","id":3,"tags":["a","b","c"]}`, false},
+		{`{"op":"sub","id":3,"tags":["A"]}`, false},
+		{`{"op":"sub","id":3} {}`, false},
+		{`not json`, false},
+	}
+	for _, c := range cases {
+		if err := s.Validate([]byte(c.doc)); (err == nil) != c.ok {
+			t.Errorf("Validate(%s) = %v, want ok=%v", c.doc, err, c.ok)
+		}
+	}
+}
+
+func TestCompileRejectsUnsupportedKeywords(t *testing.T) {
+	for _, doc := range []string{
+		`{"$ref": "#/defs/x"}`,
+		`{"properties": {"a": {"oneOf": []}}}`,
+		`{"type": "text"}`,
+		`{"pattern": "("}`,
+	} {
+		if _, err := Compile([]byte(doc)); err == nil {
+			t.Errorf("Compile(%s) succeeded, want error", doc)
+		}
+	}
+}
+
+func TestEnumComparesNestedNumbers(t *testing.T) {
+	s, err := Compile([]byte(`{"enum": [[1, {"v": 2}], {"a": [3.0]}]}`))
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	cases := []struct {
+		doc string
+		ok  bool
+	}{
+		{`[1.0, {"v": 2e0}]`, true},
+		{`{"a": [3]}`, true},
+		{`[1, {"v": 3}]`, false},
+		{`{"a": [3], "b": 1}`, false},
+		{`[1]`, false},
+	}
+	for _, c := range cases {
+		if err := s.Validate([]byte(c.doc)); (err == nil) != c.ok {
+			t.Errorf("Validate(%s) = %v, want ok=%v", c.doc, err, c.ok)
+		}
+	}
+}
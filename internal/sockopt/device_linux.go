@@ -0,0 +1,20 @@
+package sockopt
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// BindToDevice restricts the socket to one network interface
+// (SO_BINDTODEVICE). It usually needs CAP_NET_RAW. An empty name returns nil.
+func BindToDevice(name string) Option {
+	if name == "" {
+		return nil
+	}
+	return func(fd uintptr) error {
+		if err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name); err != nil {
+			return fmt.Errorf("bind to device %s: %w", name, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package sockopt
+
+import (
+	"errors"
+)
+
+// BindToDevice is only supported on Linux; elsewhere a non-empty name fails
+// at socket creation.
+func BindToDevice(name string) Option {
+	if name == "" {
+		return nil
+	}
+	return func(uintptr) error {
+		return errors.New("binding to a network device is only supported on linux")
+	}
+}
@@ -0,0 +1,35 @@
+package sockopt
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestDSCPSetsTOS(t *testing.T) {
+	lc := net.ListenConfig{Control: Control(DSCP(46))}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	raw, err := conn.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tos int
+	var gerr error
+	if err := raw.Control(func(fd uintptr) {
+		tos, gerr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if gerr != nil {
+		t.Fatal(gerr)
+	}
+	if tos != 46<<2 {
+		t.Fatalf("IP_TOS = %#x, want %#x", tos, 46<<2)
+	}
+}
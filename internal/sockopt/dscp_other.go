@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || freebsd)
+
+package sockopt
+
+import (
+	"errors"
+)
+
+// DSCP is not supported on this platform; a non-zero value fails at socket
+// creation.
+func DSCP(value int) Option {
+	if value == 0 {
+		return nil
+	}
+	return func(uintptr) error {
+		return errors.New("dscp marking is not supported on this platform")
+	}
+}
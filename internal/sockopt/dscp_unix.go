@@ -0,0 +1,27 @@
+//go:build linux || darwin || freebsd
+
+package sockopt
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// DSCP marks outgoing packets with the given DSCP code point (0-63) by
+// setting the TOS byte for IPv4 and the traffic class for IPv6. Both are
+// attempted because dual-stack IPv6 sockets carry IPv4 traffic too; the
+// option only fails when neither applies. Zero returns nil.
+func DSCP(value int) Option {
+	if value == 0 {
+		return nil
+	}
+	tos := value << 2
+	return func(fd uintptr) error {
+		err4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		err6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+		if err4 != nil && err6 != nil {
+			return fmt.Errorf("set dscp %d: %w", value, err4)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,57 @@
+// Package sockopt builds net.ListenConfig / net.Dialer control functions
+// that apply socket options before bind or connect.
+package sockopt
+
+import (
+	"syscall"
+)
+
+// Option is applied to a raw socket file descriptor.
+type Option func(fd uintptr) error
+
+// ControlFunc is the signature of net.Dialer.Control and
+// net.ListenConfig.Control.
+type ControlFunc func(network, address string, c syscall.RawConn) error
+
+// Control returns a Control function applying opts in order, or nil when
+// there is nothing to apply.
+func Control(opts ...Option) ControlFunc {
+	var active []Option
+	for _, o := range opts {
+		if o != nil {
+			active = append(active, o)
+		}
+	}
+	if len(active) == 0 {
+		return nil
+	}
+	return func(_, _ string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			for _, o := range active {
+				if opErr = o(fd); opErr != nil {
+					return
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return opErr
+	}
+}
+
+// Chain runs the non-nil control functions in order.
+func Chain(fns ...ControlFunc) ControlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		for _, fn := range fns {
+			if fn == nil {
+				continue
+			}
+			if err := fn(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
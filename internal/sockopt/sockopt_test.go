@@ -0,0 +1,31 @@
+package sockopt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestControl(t *testing.T) {
+	if Control(nil, BindToDevice("")) != nil {
+		t.Fatal("Control without options should be nil")
+	}
+
+	var calls int
+	lc := net.ListenConfig{Control: Control(func(uintptr) error { calls++; return nil })}
+	conn, err := lc.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if calls != 1 {
+		t.Fatalf("option applied %d times, want 1", calls)
+	}
+
+	boom := errors.New("boom")
+	lc = net.ListenConfig{Control: Control(func(uintptr) error { return boom })}
+	if _, err := lc.ListenPacket(context.Background(), "udp", "127.0.0.1:0"); !errors.Is(err, boom) {
+		t.Fatalf("err = %v, want %v", err, boom)
+	}
+}
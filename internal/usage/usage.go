@@ -0,0 +1,283 @@
+// Package usage accumulates traffic per client identity and periodically
+// exports it as usage records for billing and abuse analysis.
+package usage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxUnsent caps records kept for retry while the sink is failing.
+const maxUnsent = 100000
+
+// Counters are a session's running totals as seen by its pumps.
+type Counters struct {
+	BytesFromClient    uint64 `json:"bytes_from_client"`
+	BytesToClient      uint64 `json:"bytes_to_client"`
+	MessagesFromClient uint64 `json:"messages_from_client"`
+	MessagesToClient   uint64 `json:"messages_to_client"`
+}
+
+func (c Counters) sub(o Counters) Counters {
+	return Counters{
+		BytesFromClient:    c.BytesFromClient - o.BytesFromClient,
+		BytesToClient:      c.BytesToClient - o.BytesToClient,
+		MessagesFromClient: c.MessagesFromClient - o.MessagesFromClient,
+		MessagesToClient:   c.MessagesToClient - o.MessagesToClient,
+	}
+}
+
+func (c *Counters) add(o Counters) {
+	c.BytesFromClient += o.BytesFromClient
+	c.BytesToClient += o.BytesToClient
+	c.MessagesFromClient += o.MessagesFromClient
+	c.MessagesToClient += o.MessagesToClient
+}
+
+// Record is one identity's usage over [Start, End).
+type Record struct {
+	Identity string    `json:"identity"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Sessions uint64    `json:"sessions"`
+	Counters
+}
+
+// Sink receives usage records.
+type Sink interface {
+	Export(ctx context.Context, records []Record) error
+}
+
+type tracked struct {
+	identity string
+	read     func() Counters
+	last     Counters
+}
+
+type pending struct {
+	sessions uint64
+	Counters
+}
+
+// Accumulator collects usage of running and finished sessions. Running
+// sessions are sampled at every flush, so long-lived sessions show up in
+// each window instead of only when they end. A nil Accumulator ignores
+// everything.
+type Accumulator struct {
+	mu      sync.Mutex
+	live    map[*tracked]struct{}
+	pending map[string]*pending
+	start   time.Time
+	unsent  []Record
+	now     func() time.Time
+}
+
+func NewAccumulator() *Accumulator {
+	a := &Accumulator{live: make(map[*tracked]struct{}), pending: make(map[string]*pending)}
+	a.start = a.clock()
+	return a
+}
+
+// Track starts accounting a session. read returns its running totals; the
+// returned func must be called once the session ends.
+func (a *Accumulator) Track(identity string, read func() Counters) (done func()) {
+	if a == nil {
+		return func() {}
+	}
+	t := &tracked{identity: identity, read: read}
+	a.mu.Lock()
+	a.live[t] = struct{}{}
+	a.entry(identity).sessions++
+	a.mu.Unlock()
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.live, t)
+		a.sample(t)
+	}
+}
+
+func (a *Accumulator) entry(identity string) *pending {
+	e := a.pending[identity]
+	if e == nil {
+		e = &pending{}
+		a.pending[identity] = e
+	}
+	return e
+}
+
+func (a *Accumulator) sample(t *tracked) {
+	cur := t.read()
+	a.entry(t.identity).add(cur.sub(t.last))
+	t.last = cur
+}
+
+// Flush closes the current window and returns its records, preceded by
+// any that a failed export handed back.
+func (a *Accumulator) Flush() []Record {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for t := range a.live {
+		a.sample(t)
+	}
+	end := a.clock()
+	records := a.unsent
+	a.unsent = nil
+	ids := make([]string, 0, len(a.pending))
+	for id := range a.pending {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		e := a.pending[id]
+		if e.sessions == 0 && e.Counters == (Counters{}) {
+			continue
+		}
+		records = append(records, Record{Identity: id, Start: a.start, End: end, Sessions: e.sessions, Counters: e.Counters})
+	}
+	a.pending = make(map[string]*pending)
+	a.start = end
+	return records
+}
+
+// requeue keeps records whose export failed for the next flush, dropping
+// the oldest beyond maxUnsent.
+func (a *Accumulator) requeue(records []Record) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.unsent = append(records, a.unsent...)
+	if n := len(a.unsent) - maxUnsent; n > 0 {
+		slog.Warn("usage export backlog full, dropping records", "records", n)
+		a.unsent = a.unsent[n:]
+	}
+}
+
+// Run exports usage every interval and once more when ctx is done.
+// onResult reports each export as "ok", "empty" or "error".
+func (a *Accumulator) Run(ctx context.Context, interval time.Duration, sink Sink, onResult func(result string)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		stopping := false
+		select {
+		case <-ctx.Done():
+			stopping = true
+		case <-ticker.C:
+		}
+		a.export(ctx, sink, onResult)
+		if stopping {
+			return
+		}
+	}
+}
+
+func (a *Accumulator) export(ctx context.Context, sink Sink, onResult func(string)) {
+	records := a.Flush()
+	if len(records) == 0 {
+		onResult("empty")
+		return
+	}
+	exportCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	if err := sink.Export(exportCtx, records); err != nil {
+		slog.Error("usage export failed, keeping records for retry", "records", len(records), "err", err)
+		a.requeue(records)
+		onResult("error")
+		return
+	}
+	onResult("ok")
+}
+
+func (a *Accumulator) clock() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+	return time.Now().UTC()
+}
+
+func encodeLines(records []Record) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// FileSink appends records as JSON lines. The file is reopened for every
+// export so it can be rotated by renaming.
+type FileSink struct {
+	Path string
+}
+
+func (s FileSink) Export(_ context.Context, records []Record) error {
+	data, err := encodeLines(records)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WebhookSink POSTs records as JSON lines (application/x-ndjson). A Kafka
+// REST proxy or HTTP source connector can take the same body.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s WebhookSink) Export(ctx context.Context, records []Record) error {
+	data, err := encodeLines(records)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("usage webhook %s: unexpected status %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+// Sinks exports to every sink, failing if any of them fails. Records are
+// retried on all sinks, so delivery is at least once.
+type Sinks []Sink
+
+func (s Sinks) Export(ctx context.Context, records []Record) error {
+	var firstErr error
+	for _, sink := range s {
+		if err := sink.Export(ctx, records); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
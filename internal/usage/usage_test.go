@@ -0,0 +1,96 @@
+package usage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccumulatorSamplesLiveSessions(t *testing.T) {
+	a := NewAccumulator()
+	var alice Counters
+	doneAlice := a.Track("alice", func() Counters { return alice })
+	doneBob := a.Track("bob", func() Counters { return Counters{BytesFromClient: 5, MessagesFromClient: 1} })
+	doneBob()
+
+	alice = Counters{BytesFromClient: 10, BytesToClient: 100, MessagesFromClient: 1, MessagesToClient: 2}
+	records := a.Flush()
+	if len(records) != 2 || records[0].Identity != "alice" || records[1].Identity != "bob" {
+		t.Fatalf("first window = %+v", records)
+	}
+	if records[0].Counters != alice || records[0].Sessions != 1 {
+		t.Fatalf("alice first window = %+v", records[0])
+	}
+
+	// Only the delta since the last flush is reported for a running session.
+	alice.BytesToClient = 150
+	doneAlice()
+	records = a.Flush()
+	if len(records) != 1 || records[0].BytesToClient != 50 || records[0].BytesFromClient != 0 || records[0].Sessions != 0 {
+		t.Fatalf("second window = %+v", records)
+	}
+	if records := a.Flush(); len(records) != 0 {
+		t.Fatalf("idle window = %+v", records)
+	}
+}
+
+type failingSink struct{ fail bool }
+
+func (s *failingSink) Export(context.Context, []Record) error {
+	if s.fail {
+		return errors.New("down")
+	}
+	return nil
+}
+
+func TestExportRetriesFailedRecords(t *testing.T) {
+	a := NewAccumulator()
+	a.Track("alice", func() Counters { return Counters{BytesFromClient: 1} })()
+	sink := &failingSink{fail: true}
+	var results []string
+	onResult := func(r string) { results = append(results, r) }
+	a.export(context.Background(), sink, onResult)
+	a.Track("bob", func() Counters { return Counters{BytesFromClient: 2} })()
+	if records := a.Flush(); len(records) != 2 || records[0].Identity != "alice" {
+		t.Fatalf("records after failed export = %+v", records)
+	}
+	sink.fail = false
+	a.export(context.Background(), sink, onResult)
+	if len(results) != 2 || results[0] != "error" || results[1] != "empty" {
+		t.Fatalf("results = %v", results)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	rec := Record{Identity: "alice", Start: start, End: start.Add(time.Minute), Sessions: 1, Counters: Counters{BytesFromClient: 3}}
+	for range 2 {
+		if err := (FileSink{Path: path}).Export(context.Background(), []Record{rec}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	for sc := bufio.NewScanner(f); sc.Scan(); lines++ {
+		var m map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		if m["identity"] != "alice" || m["bytes_from_client"] != float64(3) {
+			t.Fatalf("line = %s", sc.Text())
+		}
+	}
+	if lines != 2 {
+		t.Fatalf("got %d lines, want 2", lines)
+	}
+}
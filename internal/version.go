@@ -0,0 +1,55 @@
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Version is the release the binary was built from. Release builds set it
+// with -ldflags "-X h3ws2h1ws-proxy/internal.Version=v1.2.3"; otherwise the
+// module version from the build info is used.
+var Version string
+
+// buildInfo returns the version, the VCS commit (with a "-dirty" suffix for
+// modified trees) and the Go version of the running binary.
+func buildInfo() (version, commit, goVersion string) {
+	version, commit = Version, "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if version == "" {
+			version = info.Main.Version
+		}
+		dirty := false
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				commit = s.Value
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if dirty && commit != "unknown" {
+			commit += "-dirty"
+		}
+	}
+	if version == "" {
+		version = "(devel)"
+	}
+	return version, commit, runtime.Version()
+}
+
+// printVersion runs the version command.
+func printVersion(args []string) error {
+	fs := flag.NewFlagSet("ws-quic-proxy version", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	version, commit, goVersion := buildInfo()
+	fmt.Printf("ws-quic-proxy %s (commit %s, %s)\n", version, commit, goVersion)
+	return nil
+}
@@ -0,0 +1,19 @@
+package app
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestBuildInfo(t *testing.T) {
+	defer func(v string) { Version = v }(Version)
+	Version = "v1.2.3"
+	version, commit, goVersion := buildInfo()
+	if version != "v1.2.3" || commit == "" || goVersion != runtime.Version() {
+		t.Errorf("buildInfo() = %q, %q, %q", version, commit, goVersion)
+	}
+	Version = ""
+	if version, _, _ := buildInfo(); version == "" {
+		t.Error("no fallback version")
+	}
+}
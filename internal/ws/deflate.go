@@ -0,0 +1,160 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrMessageTooBig is returned when an inflated message exceeds the limit.
+var ErrMessageTooBig = errors.New("message too big")
+
+// deflateTail is the empty stored block stripped from every compressed
+// message (RFC 7692 7.2.1), followed by a final block so the reader ends
+// with io.EOF.
+const deflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+
+const deflateWindow = 32 << 10
+
+// DeflateParams is the permessage-deflate configuration agreed with a peer.
+type DeflateParams struct {
+	// ServerNoContextTakeover resets the server's compressor after every
+	// message.
+	ServerNoContextTakeover bool
+	// ClientNoContextTakeover means the client resets its compressor after
+	// every message, so the server need not keep a dictionary.
+	ClientNoContextTakeover bool
+	// ClientMaxWindowBits limits the client's LZ77 window (0 = 15).
+	ClientMaxWindowBits int
+}
+
+// NegotiateDeflate picks the first acceptable permessage-deflate offer from
+// a client's Sec-WebSocket-Extensions header. want holds the server's
+// preferences; the client's requests are honoured on top of them. Go's
+// encoder always uses a 15 bit window, so offers that ask for a smaller
+// server window are declined, and ClientMaxWindowBits only applies when the
+// client offered client_max_window_bits.
+func NegotiateDeflate(header string, want DeflateParams) (DeflateParams, string, bool) {
+	for _, ext := range strings.Split(header, ",") {
+		parts := strings.Split(ext, ";")
+		if strings.TrimSpace(parts[0]) != "permessage-deflate" {
+			continue
+		}
+		p := DeflateParams{ServerNoContextTakeover: want.ServerNoContextTakeover, ClientNoContextTakeover: want.ClientNoContextTakeover}
+		ok := true
+		clientBits := false
+		for _, param := range parts[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			value = strings.Trim(strings.TrimSpace(value), `"`)
+			switch strings.TrimSpace(name) {
+			case "server_no_context_takeover":
+				p.ServerNoContextTakeover = true
+			case "client_no_context_takeover":
+				p.ClientNoContextTakeover = true
+			case "client_max_window_bits":
+				clientBits = true
+			case "server_max_window_bits":
+				ok = value == "15"
+			default:
+				ok = false
+			}
+		}
+		if !ok {
+			continue
+		}
+		resp := "permessage-deflate"
+		if p.ServerNoContextTakeover {
+			resp += "; server_no_context_takeover"
+		}
+		if p.ClientNoContextTakeover {
+			resp += "; client_no_context_takeover"
+		}
+		if clientBits && want.ClientMaxWindowBits >= 8 && want.ClientMaxWindowBits < 15 {
+			p.ClientMaxWindowBits = want.ClientMaxWindowBits
+			resp += "; client_max_window_bits=" + strconv.Itoa(p.ClientMaxWindowBits)
+		}
+		return p, resp, true
+	}
+	return DeflateParams{}, "", false
+}
+
+// Compressor deflates outgoing messages. With context takeover the LZ77
+// window carries over between messages, trading memory for ratio.
+type Compressor struct {
+	level    int
+	takeover bool
+	buf      bytes.Buffer
+	fw       *flate.Writer
+}
+
+func NewCompressor(level int, contextTakeover bool) *Compressor {
+	return &Compressor{level: level, takeover: contextTakeover}
+}
+
+// Compress returns the deflated payload of msg with the trailing empty block
+// removed. The result is only valid until the next call.
+func (c *Compressor) Compress(msg []byte) ([]byte, error) {
+	c.buf.Reset()
+	if c.fw == nil {
+		fw, err := flate.NewWriter(&c.buf, c.level)
+		if err != nil {
+			return nil, err
+		}
+		c.fw = fw
+	} else if !c.takeover {
+		c.fw.Reset(&c.buf)
+	}
+	if _, err := c.fw.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := c.fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(c.buf.Bytes(), []byte(deflateTail[:4])), nil
+}
+
+// Decompressor inflates incoming messages. With context takeover it keeps
+// the last window of output as the dictionary for the next message.
+type Decompressor struct {
+	takeover   bool
+	windowSize int
+	window     []byte
+}
+
+func NewDecompressor(p DeflateParams) *Decompressor {
+	d := &Decompressor{takeover: !p.ClientNoContextTakeover, windowSize: deflateWindow}
+	if p.ClientMaxWindowBits > 0 {
+		d.windowSize = 1 << p.ClientMaxWindowBits
+	}
+	return d
+}
+
+// Decompress inflates one message, failing with ErrMessageTooBig once the
+// output passes limit bytes.
+func (d *Decompressor) Decompress(payload []byte, limit int64) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(payload), strings.NewReader(deflateTail))
+	var fr io.ReadCloser
+	if d.takeover {
+		fr = flate.NewReaderDict(src, d.window)
+	} else {
+		fr = flate.NewReader(src)
+	}
+	defer func() { _ = fr.Close() }()
+	out, err := io.ReadAll(io.LimitReader(fr, limit+1))
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, ErrMessageTooBig
+	}
+	if d.takeover {
+		d.window = append(d.window, out...)
+		if len(d.window) > d.windowSize {
+			d.window = append(d.window[:0], d.window[len(d.window)-d.windowSize:]...)
+		}
+	}
+	return out, nil
+}
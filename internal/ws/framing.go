@@ -20,76 +20,150 @@ const (
 	OpPong   = 0xA
 )
 
+// MaxControlPayload is the largest control frame payload (RFC 6455 5.5).
+const MaxControlPayload = 125
+
+var (
+	// ErrBadControlFrame fails a fragmented or oversized control frame; the
+	// connection must be closed with 1002.
+	ErrBadControlFrame = errors.New("protocol error: control frame fragmented or over 125 bytes")
+	// ErrControlTooLong refuses to write an oversized control frame.
+	ErrControlTooLong = errors.New("control frame payload over 125 bytes")
+)
+
 type Frame struct {
-	Fin     bool
-	Opcode  byte
-	Masked  bool
-	Payload []byte
+	Fin    bool
+	Opcode byte
+	Masked bool
+	// Rsv1 marks a compressed message when permessage-deflate is in use.
+	Rsv1 bool
+	// Rsv2 and Rsv3 belong to other extensions.
+	Rsv2, Rsv3 bool
+	Payload    []byte
 }
 
-func ReadFrame(r *bufio.Reader, maxFramePayload int64) (Frame, error) {
-	var f Frame
+// FrameHeader is a frame up to its payload.
+type FrameHeader struct {
+	Fin              bool
+	Opcode           byte
+	Rsv1, Rsv2, Rsv3 bool
+	Masked           bool
+	MaskKey          [4]byte
+	Length           int64
+}
+
+// ReadFrameHeader reads a frame up to its payload, which is left in r for
+// PayloadReader. Control frames are validated as in ReadFrame.
+func ReadFrameHeader(r *bufio.Reader) (FrameHeader, error) {
+	var h FrameHeader
 
 	b0, err := r.ReadByte()
 	if err != nil {
-		return f, err
+		return h, err
 	}
 	b1, err := r.ReadByte()
 	if err != nil {
-		return f, err
+		return h, err
 	}
 
-	f.Fin = (b0 & 0x80) != 0
-	f.Opcode = b0 & 0x0F
-	f.Masked = (b1 & 0x80) != 0
+	h.Fin = (b0 & 0x80) != 0
+	h.Opcode = b0 & 0x0F
+	h.Rsv1 = (b0 & 0x40) != 0
+	h.Rsv2 = (b0 & 0x20) != 0
+	h.Rsv3 = (b0 & 0x10) != 0
+	h.Masked = (b1 & 0x80) != 0
 
-	plen := int64(b1 & 0x7F)
-	switch plen {
+	h.Length = int64(b1 & 0x7F)
+	switch h.Length {
 	case 126:
 		var tmp [2]byte
 		if _, err := io.ReadFull(r, tmp[:]); err != nil {
-			return f, err
+			return h, err
 		}
-		plen = int64(binary.BigEndian.Uint16(tmp[:]))
+		h.Length = int64(binary.BigEndian.Uint16(tmp[:]))
 	case 127:
 		var tmp [8]byte
 		if _, err := io.ReadFull(r, tmp[:]); err != nil {
-			return f, err
+			return h, err
 		}
-		plen = int64(binary.BigEndian.Uint64(tmp[:]))
-		if plen < 0 {
-			return f, errors.New("invalid length")
+		h.Length = int64(binary.BigEndian.Uint64(tmp[:]))
+		if h.Length < 0 {
+			return h, errors.New("invalid length")
 		}
 	}
 
-	if maxFramePayload > 0 && plen > maxFramePayload {
-		metrics.OversizeDrops.WithLabelValues("frame").Inc()
-		return f, fmt.Errorf("frame too large: %d", plen)
+	if h.Opcode >= OpClose && (!h.Fin || h.Length > MaxControlPayload) {
+		return h, ErrBadControlFrame
 	}
-
-	var maskKey [4]byte
-	if f.Masked {
-		if _, err := io.ReadFull(r, maskKey[:]); err != nil {
-			return f, err
+	if h.Masked {
+		if _, err := io.ReadFull(r, h.MaskKey[:]); err != nil {
+			return h, err
 		}
 	}
+	return h, nil
+}
 
-	f.Payload = make([]byte, plen)
-	if _, err := io.ReadFull(r, f.Payload); err != nil {
+// PayloadReader returns a reader of the unmasked payload of the frame h
+// heads, which must be read from r before the next frame.
+func (h FrameHeader) PayloadReader(r io.Reader) io.Reader {
+	lr := io.LimitReader(r, h.Length)
+	if !h.Masked {
+		return lr
+	}
+	return &unmaskReader{r: lr, key: h.MaskKey}
+}
+
+func ReadFrame(r *bufio.Reader, maxFramePayload int64) (Frame, error) {
+	h, err := ReadFrameHeader(r)
+	f := Frame{Fin: h.Fin, Opcode: h.Opcode, Masked: h.Masked, Rsv1: h.Rsv1, Rsv2: h.Rsv2, Rsv3: h.Rsv3}
+	if err != nil {
 		return f, err
 	}
+	if maxFramePayload > 0 && h.Length > maxFramePayload {
+		metrics.OversizeDrops.WithLabelValues("frame").Inc()
+		return f, fmt.Errorf("frame too large: %d", h.Length)
+	}
 
+	f.Payload = make([]byte, h.Length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return f, err
+	}
 	if f.Masked {
-		for i := range f.Payload {
-			f.Payload[i] ^= maskKey[i%4]
-		}
+		maskBytes(h.MaskKey, f.Payload)
 	}
 	return f, nil
 }
 
+// ErrReservedBits fails a frame whose reserved bits no negotiated
+// extension defines; the connection must be closed with 1002.
+var ErrReservedBits = errors.New("protocol error: reserved bits set without a negotiated extension")
+
+// CheckReserved validates f's reserved bits when at most permessage-deflate
+// is negotiated: RSV1 only on the first frame of a data message and only
+// with deflate, RSV2 and RSV3 never.
+func CheckReserved(f Frame, deflate bool) error {
+	if f.Rsv2 || f.Rsv3 {
+		return ErrReservedBits
+	}
+	if f.Rsv1 && (!deflate || (f.Opcode != OpText && f.Opcode != OpBinary)) {
+		return ErrReservedBits
+	}
+	return nil
+}
+
 func WriteDataFrame(w io.Writer, opcode byte, payload []byte, masked bool, maxFramePayload int64) error {
+	return writeDataFrame(w, opcode, payload, masked, false, maxFramePayload)
+}
+
+// WriteCompressedDataFrame writes an already deflated message, setting RSV1
+// on its first frame.
+func WriteCompressedDataFrame(w io.Writer, opcode byte, payload []byte, maxFramePayload int64) error {
+	return writeDataFrame(w, opcode, payload, false, true, maxFramePayload)
+}
+
+func writeDataFrame(w io.Writer, opcode byte, payload []byte, masked, compressed bool, maxFramePayload int64) error {
 	if maxFramePayload <= 0 || int64(len(payload)) <= maxFramePayload {
-		return writeFrame(w, opcode, payload, masked, true)
+		return writeFrame(w, opcode, payload, masked, true, compressed)
 	}
 
 	remaining := payload
@@ -102,8 +176,9 @@ func WriteDataFrame(w io.Writer, opcode byte, payload []byte, masked bool, maxFr
 		if !first {
 			op = OpCont
 		}
+		rsv1 := compressed && first
 		first = false
-		if err := writeFrame(w, op, chunk, masked, false); err != nil {
+		if err := writeFrame(w, op, chunk, masked, false, rsv1); err != nil {
 			return err
 		}
 	}
@@ -111,57 +186,85 @@ func WriteDataFrame(w io.Writer, opcode byte, payload []byte, masked bool, maxFr
 	if !first {
 		op = OpCont
 	}
-	return writeFrame(w, op, remaining, masked, true)
+	return writeFrame(w, op, remaining, masked, true, compressed && first)
 }
 
 func WriteControlFrame(w io.Writer, opcode byte, payload []byte) error {
-	if len(payload) > 125 {
-		payload = payload[:125]
+	if len(payload) > MaxControlPayload {
+		return ErrControlTooLong
 	}
-	return writeFrame(w, opcode, payload, false, true)
+	return writeFrame(w, opcode, payload, false, true, false)
 }
 
+// WriteCloseFrame writes a close frame; 1005 (no status) is sent as a
+// close frame without a code, as the code itself may not be.
 func WriteCloseFrame(w io.Writer, code uint16, reason string) error {
+	if code == 1005 {
+		return writeFrame(w, OpClose, nil, false, true, false)
+	}
 	pl := make([]byte, 2+len(reason))
 	binary.BigEndian.PutUint16(pl[:2], code)
 	copy(pl[2:], []byte(reason))
-	if len(pl) > 125 {
-		pl = pl[:125]
+	if len(pl) > MaxControlPayload {
+		return ErrControlTooLong
 	}
-	return writeFrame(w, OpClose, pl, false, true)
+	return writeFrame(w, OpClose, pl, false, true, false)
 }
 
-func writeFrame(w io.Writer, opcode byte, payload []byte, masked bool, fin bool) error {
-	b0 := opcode & 0x0F
-	if fin {
+// WriteFrame writes f as it is, reserved bits included, masking its
+// payload when f.Masked is set.
+func WriteFrame(w io.Writer, f Frame) error {
+	b0 := f.Opcode & 0x0F
+	if f.Fin {
 		b0 |= 0x80
 	}
+	if f.Rsv1 {
+		b0 |= 0x40
+	}
+	if f.Rsv2 {
+		b0 |= 0x20
+	}
+	if f.Rsv3 {
+		b0 |= 0x10
+	}
+	return writeHeaderAndPayload(w, b0, f.Payload, f.Masked)
+}
 
-	var hdr []byte
+func writeFrame(w io.Writer, opcode byte, payload []byte, masked bool, fin bool, rsv1 bool) error {
+	return WriteFrame(w, Frame{Fin: fin, Opcode: opcode, Masked: masked, Rsv1: rsv1, Payload: payload})
+}
+
+func writeHeaderAndPayload(w io.Writer, b0 byte, payload []byte, masked bool) error {
 	var b1 byte
 	if masked {
 		b1 = 0x80
 	}
 
 	n := len(payload)
+	hdrLen := 2
 	switch {
 	case n <= 125:
 		b1 |= byte(n)
-		hdr = []byte{b0, b1}
 	case n <= 65535:
 		b1 |= 126
-		hdr = make([]byte, 4)
-		hdr[0], hdr[1] = b0, b1
-		binary.BigEndian.PutUint16(hdr[2:], uint16(n))
+		hdrLen += 2
 	default:
 		b1 |= 127
-		hdr = make([]byte, 10)
-		hdr[0], hdr[1] = b0, b1
-		binary.BigEndian.PutUint64(hdr[2:], uint64(n))
+		hdrLen += 8
+	}
+	if masked {
+		hdrLen += 4
 	}
 
-	if _, err := w.Write(hdr); err != nil {
-		return err
+	// Header, mask key and payload go out in a single Write so that a frame
+	// is never split across writers (see the resumable client writer).
+	buf := make([]byte, hdrLen+n)
+	buf[0], buf[1] = b0, b1
+	switch {
+	case n > 65535:
+		binary.BigEndian.PutUint64(buf[2:], uint64(n))
+	case n > 125:
+		binary.BigEndian.PutUint16(buf[2:], uint16(n))
 	}
 
 	if masked {
@@ -169,25 +272,26 @@ func writeFrame(w io.Writer, opcode byte, payload []byte, masked bool, fin bool)
 		if _, err := rand.Read(key[:]); err != nil {
 			return err
 		}
-		if _, err := w.Write(key[:]); err != nil {
-			return err
-		}
-		m := make([]byte, len(payload))
+		copy(buf[hdrLen-4:hdrLen], key[:])
+		m := buf[hdrLen:]
 		copy(m, payload)
-		for i := range m {
-			m[i] ^= key[i%4]
-		}
-		_, err := w.Write(m)
-		return err
+		maskBytes(key, m)
+	} else {
+		copy(buf[hdrLen:], payload)
 	}
 
-	_, err := w.Write(payload)
+	_, err := w.Write(buf)
 	return err
 }
 
+// ParseClosePayload returns the code and reason of a close frame: 1005
+// when it has no code, 0 (not a valid code) for a lone byte.
 func ParseClosePayload(p []byte) (int, string) {
-	if len(p) < 2 {
-		return 1000, ""
+	switch len(p) {
+	case 0:
+		return 1005, ""
+	case 1:
+		return 0, ""
 	}
 	code := int(binary.BigEndian.Uint16(p[:2]))
 	reason := ""
@@ -196,3 +300,15 @@ func ParseClosePayload(p []byte) (int, string) {
 	}
 	return code, reason
 }
+
+// ValidCloseCode reports whether an endpoint may send code in a close frame
+// (RFC 6455 7.4): 1000-1003, 1007-1014 and the 3000-4999 ranges for
+// libraries and applications.
+func ValidCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	default:
+		return code >= 3000 && code <= 4999
+	}
+}
@@ -0,0 +1,38 @@
+package ws
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// maskBytes XORs b in place with the masking key (RFC 6455 5.3), eight
+// bytes at a time.
+func maskBytes(key [4]byte, b []byte) {
+	k32 := binary.LittleEndian.Uint32(key[:])
+	k := uint64(k32)<<32 | uint64(k32)
+	for len(b) >= 8 {
+		binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)^k)
+		b = b[8:]
+	}
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
+
+// unmaskReader unmasks a frame payload as it is read.
+type unmaskReader struct {
+	r   io.Reader
+	key [4]byte
+	pos int
+}
+
+func (u *unmaskReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	var key [4]byte
+	for i := range key {
+		key[i] = u.key[(u.pos+i)&3]
+	}
+	maskBytes(key, p[:n])
+	u.pos += n
+	return n, err
+}
@@ -0,0 +1,60 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestMaskBytesMatchesBytewiseXOR(t *testing.T) {
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+	for n := range 40 {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(i * 7)
+		}
+		want := append([]byte(nil), b...)
+		for i := range want {
+			want[i] ^= key[i%4]
+		}
+		maskBytes(key, b)
+		if !bytes.Equal(b, want) {
+			t.Fatalf("len %d: got %x, want %x", n, b, want)
+		}
+	}
+}
+
+func BenchmarkMaskBytes(b *testing.B) {
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+	buf := make([]byte, 64<<10)
+	b.SetBytes(int64(len(buf)))
+	for b.Loop() {
+		maskBytes(key, buf)
+	}
+}
+
+func TestPayloadReaderUnmasksAcrossReads(t *testing.T) {
+	payload := []byte("a payload longer than one word, read a few bytes at a time")
+	var frame bytes.Buffer
+	if err := WriteFrame(&frame, Frame{Fin: true, Opcode: OpText, Masked: true, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	frame.WriteString("next")
+	br := bufio.NewReader(&frame)
+	h, err := ReadFrameHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(iotest.HalfReader(h.PayloadReader(br)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("got %q", got)
+	}
+	if rest, _ := io.ReadAll(br); string(rest) != "next" {
+		t.Fatalf("payload reader overran the frame: %q left", rest)
+	}
+}
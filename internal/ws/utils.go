@@ -16,14 +16,6 @@ func ComputeAccept(key string) string {
 	return base64.StdEncoding.EncodeToString(h[:])
 }
 
-func PickFirstToken(v string) string {
-	parts := strings.Split(v, ",")
-	if len(parts) == 0 {
-		return ""
-	}
-	return strings.TrimSpace(parts[0])
-}
-
 func IsNetClose(err error) bool {
 	if err == nil {
 		return false
@@ -0,0 +1,142 @@
+// Package proxy embeds the RFC 9220 to RFC 6455 WebSocket bridge in another
+// Go service. Mount Handler on an http3.Server, which advertises extended
+// CONNECT, and WebSocket sessions opened on the matching paths are relayed
+// to an HTTP/1.1 WebSocket backend:
+//
+//	p, err := proxy.New(proxy.Options{Backend: "ws://127.0.0.1:8080", Path: "^/ws$"})
+//	if err != nil {
+//		return err
+//	}
+//	mux.Handle("/ws", p.Handler())
+//	srv := &http3.Server{Addr: ":443", Handler: mux, TLSConfig: tlsConf}
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/config"
+	bridge "h3ws2h1ws-proxy/internal/proxy"
+)
+
+// Defaults for zero Options fields; they match the ws-quic-proxy flags.
+const (
+	DefaultPath           = "^/ws$"
+	DefaultMaxFrameSize   = 1 << 20
+	DefaultMaxMessageSize = 8 << 20
+	DefaultMaxConns       = 2000
+	DefaultReadTimeout    = 120 * time.Second
+	DefaultWriteTimeout   = 15 * time.Second
+)
+
+// Options configures a Proxy. Only Backend is required.
+type Options struct {
+	// Backend is the ws:// or wss:// URL sessions are relayed to, or
+	// ws+unix:///path/to.sock for a Unix domain socket.
+	Backend string
+	// Path is a regexp CONNECT paths must match (DefaultPath when empty);
+	// other requests are answered with 404.
+	Path string
+
+	MaxFrameSize   int64         // largest client frame payload
+	MaxMessageSize int64         // largest reassembled client message
+	MaxConns       int64         // concurrent sessions
+	ReadTimeout    time.Duration // without traffic from a side
+	WriteTimeout   time.Duration // per write to a side
+
+	// ForwardHeaders are copied from the client's CONNECT into the backend
+	// handshake, e.g. Cookie or Origin.
+	ForwardHeaders []string
+	// BackendTLSConfig is used for wss:// backends (nil = system roots).
+	BackendTLSConfig *tls.Config
+	// Debug logs every session in detail through slog.
+	Debug bool
+	// Hooks, when set, are told about every session and may refuse it.
+	Hooks Hooks
+}
+
+// Hooks observe and veto sessions; see the methods for when each is
+// called. Embed NopHooks to implement only some of them.
+type Hooks = bridge.Hooks
+
+// The types Hooks are called with.
+type (
+	NopHooks    = bridge.NopHooks
+	SessionInfo = bridge.SessionInfo
+	Message     = bridge.Message
+	CloseInfo   = bridge.CloseInfo
+)
+
+// Proxy relays RFC 9220 WebSocket sessions to a backend. It is safe for
+// concurrent use.
+type Proxy struct {
+	p *bridge.Proxy
+}
+
+// New validates opts and returns a Proxy for them.
+func New(opts Options) (*Proxy, error) {
+	if opts.Backend == "" {
+		return nil, errors.New("proxy: Backend is required")
+	}
+	backend, err := bridge.ParseBackendURL(opts.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: bad Backend: %w", err)
+	}
+	path, err := regexp.Compile(cmp.Or(opts.Path, DefaultPath))
+	if err != nil {
+		return nil, fmt.Errorf("proxy: bad Path: %w", err)
+	}
+	if opts.MaxFrameSize < 0 || opts.MaxMessageSize < 0 || opts.MaxConns < 0 || opts.ReadTimeout < 0 || opts.WriteTimeout < 0 {
+		return nil, errors.New("proxy: limits must not be negative")
+	}
+	limits := config.Limits{
+		MaxFrameSize:   cmp.Or(opts.MaxFrameSize, DefaultMaxFrameSize),
+		MaxMessageSize: cmp.Or(opts.MaxMessageSize, DefaultMaxMessageSize),
+		MaxConns:       cmp.Or(opts.MaxConns, DefaultMaxConns),
+		ReadTimeout:    cmp.Or(opts.ReadTimeout, DefaultReadTimeout),
+		WriteTimeout:   cmp.Or(opts.WriteTimeout, DefaultWriteTimeout),
+	}
+	if err := limits.Validate(); err != nil {
+		return nil, fmt.Errorf("proxy: %w", err)
+	}
+	forward, err := bridge.ForwardHeaders(strings.Join(opts.ForwardHeaders, ","))
+	if err != nil {
+		return nil, fmt.Errorf("proxy: bad ForwardHeaders: %w", err)
+	}
+	return &Proxy{p: &bridge.Proxy{
+		Backend:          backend,
+		PathRegexp:       path,
+		Debug:            opts.Debug,
+		Limits:           limits,
+		ForwardHeaders:   forward,
+		BackendTLSConfig: opts.BackendTLSConfig,
+		Hooks:            opts.Hooks,
+	}}, nil
+}
+
+// Handler returns the handler for RFC 9220 extended CONNECT requests.
+func (p *Proxy) Handler() http.Handler {
+	return http.HandlerFunc(p.p.HandleH3WebSocket)
+}
+
+// Shutdown refuses new sessions and closes the running ones with 1001
+// (going away), letting messages in flight finish. Sessions still open
+// when ctx is done are terminated and ctx's error is returned.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	if _, terminated := p.p.Drain(ctx, 1001, "going away"); terminated > 0 {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// Sessions returns the number of sessions being relayed.
+func (p *Proxy) Sessions() int {
+	return p.p.Stats().Sessions
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"h3ws2h1ws-proxy/internal/ws"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestNewValidatesOptions(t *testing.T) {
+	for name, opts := range map[string]Options{
+		"no backend":      {},
+		"bad scheme":      {Backend: "http://127.0.0.1:8080"},
+		"bad path":        {Backend: "ws://127.0.0.1:8080", Path: "("},
+		"negative limit":  {Backend: "ws://127.0.0.1:8080", MaxConns: -1},
+		"frame > message": {Backend: "ws://127.0.0.1:8080", MaxFrameSize: 2 << 20, MaxMessageSize: 1 << 20},
+		"owned header":    {Backend: "ws://127.0.0.1:8080", ForwardHeaders: []string{"Sec-WebSocket-Key"}},
+	} {
+		if _, err := New(opts); err == nil {
+			t.Errorf("%s: New accepted %+v", name, opts)
+		}
+	}
+	if _, err := New(Options{Backend: "ws://127.0.0.1:8080"}); err != nil {
+		t.Fatalf("defaults: %v", err)
+	}
+}
+
+// TestHandlerMountedOnHTTP3Server relays a session through a Proxy mounted
+// on a mux next to the embedding service's own handlers.
+func TestHandlerMountedOnHTTP3Server(t *testing.T) {
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			_ = c.WriteMessage(mt, append([]byte(r.Header.Get("Origin")+" "), msg...))
+		}
+	}))
+	defer backend.Close()
+
+	p, err := New(Options{
+		Backend:        "ws" + strings.TrimPrefix(backend.URL, "http"),
+		Path:           "^/ws$",
+		ForwardHeaders: []string{"Origin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/ws", p.Handler())
+	mux.HandleFunc("/status", func(w http.ResponseWriter, _ *http.Request) { _, _ = w.Write([]byte("ok")) })
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http3.Server{TLSConfig: &tls.Config{Certificates: []tls.Certificate{testCert(t)}, NextProtos: []string{http3.NextProtoH3}}, Handler: mux}
+	defer srv.Close()
+	go func() { _ = srv.Serve(pc) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, pc.LocalAddr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.CloseWithError(0, "") }()
+	rt := &http3.SingleDestinationRoundTripper{Connection: conn}
+	str, err := rt.OpenRequestStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodConnect, "https://"+pc.LocalAddr().String()+"/ws", nil)
+	req.Proto = "websocket"
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Origin", "https://app.example.com")
+	if err := str.SendRequestHeader(req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := str.ReadResponse()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+	if err := ws.WriteDataFrame(str, ws.OpText, []byte("hello"), true, 0); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(str)
+	f, err := ws.ReadFrame(br, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(f.Payload); got != "https://app.example.com hello" {
+		t.Fatalf("echo = %q", got)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- p.Shutdown(ctx) }()
+	// The client answers the close frame Shutdown sends.
+	for f.Opcode != ws.OpClose {
+		if f, err = ws.ReadFrame(br, 1<<20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if code, _ := ws.ParseClosePayload(f.Payload); code != 1001 {
+		t.Fatalf("close code = %d, want 1001", code)
+	}
+	_ = ws.WriteFrame(str, ws.Frame{Fin: true, Opcode: ws.OpClose, Masked: true, Payload: f.Payload[:2]})
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if n := p.Sessions(); n != 0 {
+		t.Fatalf("%d sessions after Shutdown", n)
+	}
+}
+
+func testCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}